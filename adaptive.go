@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Adaptive concurrency tuning, see adjustConcurrency
+const (
+	adaptInterval       = 10 * time.Second
+	adaptMinAttempts    = 20   // Fewer attempts in a window say too little to act on
+	adaptErrorThreshold = 0.25 // Failure rate above which concurrency is halved
+	adaptIncrease       = 10   // Workers added after a healthy window
+)
+
+// Crawl attempts and failed attempts since the controller last looked
+var (
+	adaptAttempts atomic.Int64
+	adaptFailures atomic.Int64
+)
+
+// observeAttempt feeds one crawl attempt's outcome to the adaptive controller. Dead
+// hosts and refused connections say nothing about our own link, so they don't count
+// as failures.
+func observeAttempt(err error) {
+	adaptAttempts.Add(1)
+	if err == nil {
+		return
+	}
+	switch classifyFailure(err) {
+	case "dns", "refused":
+	default:
+		adaptFailures.Add(1)
+	}
+}
+
+// adjustConcurrency is the AIMD step: after a window with a failure rate above the
+// threshold the target is halved, otherwise it grows by adaptIncrease, always within
+// [minimum, maximum]. Windows with too few attempts leave it unchanged.
+func adjustConcurrency(current, attempts, failures int64, minimum, maximum int) int64 {
+	if attempts < adaptMinAttempts {
+		return current
+	}
+	next := current + adaptIncrease
+	if float64(failures)/float64(attempts) > adaptErrorThreshold {
+		next = current / 2
+	}
+	return max(int64(minimum), min(int64(maximum), next))
+}
+
+// runAdaptiveConcurrency retunes the target concurrency every adaptInterval
+func runAdaptiveConcurrency() {
+	ticker := time.NewTicker(adaptInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		adaptConcurrency()
+	}
+}
+
+// adaptConcurrency closes the attempt window and retunes the target concurrency from it
+func adaptConcurrency() {
+	attempts, failures := adaptAttempts.Swap(0), adaptFailures.Swap(0)
+	current := targetConcurrency.Load()
+	next := adjustConcurrency(current, attempts, failures, cfg.MinConcurrency, cfg.MaxConcurrency)
+	if next != current {
+		setTargetConcurrency(next)
+		crawlLog.Info("adjusted concurrency", "from", current, "to", next,
+			"attempts", attempts, "failures", failures)
+	}
+}
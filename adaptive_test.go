@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAdjustConcurrency(t *testing.T) {
+	tests := []struct {
+		name                        string
+		current, attempts, failures int64
+		want                        int64
+	}{
+		{"healthy window grows", 100, 100, 0, 110},
+		{"failures at the threshold grow", 100, 100, 25, 110},
+		{"failures above the threshold halve", 100, 100, 26, 50},
+		{"every attempt failing halves", 100, 40, 40, 50},
+		{"too few attempts hold", 100, adaptMinAttempts - 1, adaptMinAttempts - 1, 100},
+		{"growth stops at the maximum", 195, 100, 0, 200},
+		{"halving stops at the minimum", 30, 100, 90, 20},
+		{"below the minimum is raised", 5, 100, 90, 20},
+	}
+	for _, test := range tests {
+		if got := adjustConcurrency(test.current, test.attempts, test.failures, 20, 200); got != test.want {
+			t.Errorf("%s: adjustConcurrency(%d, %d, %d) = %d, want %d", test.name, test.current, test.attempts,
+				test.failures, got, test.want)
+		}
+	}
+}
+
+// Errors from dead hosts say nothing about our link and don't count as failures
+func TestObserveAttempt(t *testing.T) {
+	adaptAttempts.Store(0)
+	adaptFailures.Store(0)
+	for _, err := range []error{
+		nil,
+		errors.New("dial error: dial tcp: lookup relay.example.com: no such host"),
+		errors.New("dial error: dial tcp 192.0.2.1:443: connect: connection refused"),
+		errors.New("dial error: dial tcp 192.0.2.1:443: i/o timeout"),
+		errors.New("receive error: read tcp: connection reset by peer"),
+	} {
+		observeAttempt(err)
+	}
+	if attempts, failures := adaptAttempts.Load(), adaptFailures.Load(); attempts != 5 || failures != 2 {
+		t.Errorf("counted %d attempts and %d failures, want 5 and 2", attempts, failures)
+	}
+}
+
+// Feed the controller windows from a link that starts failing past a capacity: the
+// target has to back off above it, climb back below it and stay within the bounds
+func TestAdaptiveConcurrencyConverges(t *testing.T) {
+	resetState(t)
+	captureJSONLogs(t)
+	cfg.MinConcurrency, cfg.MaxConcurrency = 10, 400
+	saved := targetConcurrency.Load()
+	t.Cleanup(func() { targetConcurrency.Store(saved) })
+	adaptAttempts.Store(0)
+	adaptFailures.Store(0)
+
+	const capacity = 150
+	timeout := errors.New("dial error: i/o timeout")
+	targetConcurrency.Store(50)
+	var history []int64
+	for window := 0; window < 60; window++ {
+		current := targetConcurrency.Load()
+		// Past the capacity every extra worker's attempt times out
+		for i := int64(0); i < current; i++ {
+			if i >= capacity {
+				observeAttempt(timeout)
+			} else {
+				observeAttempt(nil)
+			}
+		}
+		adaptConcurrency()
+		history = append(history, targetConcurrency.Load())
+	}
+
+	for window, target := range history {
+		if target < int64(cfg.MinConcurrency) || target > int64(cfg.MaxConcurrency) {
+			t.Fatalf("window %d: target %d outside [%d, %d]", window, target, cfg.MinConcurrency, cfg.MaxConcurrency)
+		}
+	}
+	// Once settled the sawtooth never runs far past the capacity: a window failing more
+	// than a quarter of its attempts halves the target
+	for window, target := range history[20:] {
+		if target > capacity*4/3+adaptIncrease {
+			t.Errorf("window %d: target %d ran far past the capacity of %d", window+20, target, capacity)
+		}
+		if target < capacity/2 {
+			t.Errorf("window %d: target %d backed off below half the capacity of %d", window+20, target, capacity)
+		}
+	}
+
+	// A window with too few attempts, such as an idle crawl, leaves the target alone
+	before := targetConcurrency.Load()
+	observeAttempt(timeout)
+	adaptConcurrency()
+	if after := targetConcurrency.Load(); after != before {
+		t.Errorf("a window of one failed attempt moved the target from %d to %d", before, after)
+	}
+}
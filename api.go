@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Query API limits
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+	apiMaxAge       = 5 // Seconds clients may reuse a response, results change every pass
+)
+
+// RelayPage is one page of the relays of a category
+type RelayPage struct {
+	Category RelayCategory `json:"category"`
+	Total    int           `json:"total"` // Relays matching the query across all pages
+	Offset   int           `json:"offset"`
+	Limit    int           `json:"limit"`
+	Relays   []RelayRecord `json:"relays"`
+}
+
+// registerAPI serves the crawl results for dashboards querying a long-running crawler:
+//
+//	GET /relays?category=clear_online&min_count=5&limit=100&offset=0
+//	GET /relays/{url}  with the relay URL path-escaped
+//	GET /categories
+func registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /relays", handleRelays)
+	mux.HandleFunc("GET /relays/{url}", handleRelay)
+	mux.HandleFunc("GET /categories", handleCategories)
+}
+
+// handleRelays serves a page of relays of one category, ordered by URL
+func handleRelays(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	category := ClearOnline
+	if value := query.Get("category"); value != "" {
+		category = RelayCategory(value)
+		if categoryMap(category) == nil {
+			http.Error(w, fmt.Sprintf("unknown category %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+	minCount, err := queryInt(query.Get("min_count"), 0)
+	if err != nil {
+		http.Error(w, "min_count "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := queryInt(query.Get("limit"), apiDefaultLimit)
+	if err != nil {
+		http.Error(w, "limit "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil {
+		http.Error(w, "offset "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page := RelayPage{Category: category, Offset: offset, Limit: min(limit, apiMaxLimit)}
+	page.Relays, page.Total = pageRelays(category, minCount, offset, page.Limit)
+	writeAPIResponse(w, page)
+}
+
+// pageRelays returns the records of a page of relays of a category together with the
+// number of relays matching. A category can hold millions of relays, so only the
+// matching ones are copied under mu and they are sorted without it, the crawl isn't
+// held up by a dashboard polling. Records are copied so they stay consistent after mu
+// is released.
+func pageRelays(category RelayCategory, minCount, offset, limit int) ([]RelayRecord, int) {
+	type match struct {
+		relay string
+		count int
+	}
+	var matching []match
+	locked(func() {
+		for relay, count := range categoryMap(category) {
+			if count >= minCount {
+				matching = append(matching, match{relay, count})
+			}
+		}
+	})
+	sort.Slice(matching, func(i, j int) bool { return matching[i].relay < matching[j].relay })
+
+	records := []RelayRecord{}
+	page := matching[min(offset, len(matching)):]
+	page = page[:min(limit, len(page))]
+	locked(func() {
+		for _, relay := range page {
+			records = append(records, copyRecord(relayRecordFor(relay.relay, category, relay.count)))
+		}
+	})
+	return records, len(matching)
+}
+
+// handleRelay serves the full record of a single relay
+func handleRelay(w http.ResponseWriter, r *http.Request) {
+	relayURL := r.PathValue("url")
+
+	var record RelayRecord
+	var found bool
+	locked(func() {
+		for _, category := range allCategories {
+			if count, ok := categoryMap(category)[relayURL]; ok {
+				record, found = copyRecord(relayRecordFor(relayURL, category, count)), true
+				return
+			}
+		}
+	})
+	if !found {
+		http.Error(w, "relay not found", http.StatusNotFound)
+		return
+	}
+	writeAPIResponse(w, record)
+}
+
+// handleCategories serves the number of relays in each category
+func handleCategories(w http.ResponseWriter, r *http.Request) {
+	writeAPIResponse(w, snapshotStatus().Categories)
+}
+
+// copyRecord copies the slices of a record so it can be encoded without holding mu
+func copyRecord(record RelayRecord) RelayRecord {
+	record.Attempts = append([]CrawlAttempt(nil), record.Attempts...)
+	record.SupportedNIPs = append([]int(nil), record.SupportedNIPs...)
+	record.Referrers = append([]string(nil), record.Referrers...)
+	return record
+}
+
+// queryInt parses a non-negative query parameter, an empty value gives the fallback
+func queryInt(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("must be a non-negative number")
+	}
+	return n, nil
+}
+
+// writeAPIResponse encodes a query result as JSON, cacheable for a few seconds
+func writeAPIResponse(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", apiMaxAge))
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Pages of /relays follow the URL order, counting every relay that matches
+func TestRelaysPage(t *testing.T) {
+	resetState(t)
+	locked(func() {
+		for i := 0; i < 250; i++ {
+			relay := fmt.Sprintf("wss://relay%03d.example.com", i)
+			clearOnline[relay] = i % 5
+			recordFor(relay).DiscoveredBy = "wss://seed.example.com"
+		}
+	})
+	mux := http.NewServeMux()
+	registerAPI(mux)
+
+	tests := []struct {
+		query        string
+		total, first int
+		rows         int
+	}{
+		{"", 250, 0, apiDefaultLimit},
+		{"?offset=240&limit=100", 250, 240, 10},
+		{"?min_count=4&offset=2&limit=3", 50, 14, 3},
+		{"?offset=500", 250, 0, 0},
+		{"?limit=5000", 250, 0, 250}, // Capped at apiMaxLimit, which is more than there are
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/relays"+test.query, nil))
+		var page RelayPage
+		if err := json.Unmarshal(recorder.Body.Bytes(), &page); err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		if page.Total != test.total || len(page.Relays) != test.rows {
+			t.Errorf("%s: %d of %d relays, want %d of %d", test.query, len(page.Relays), page.Total, test.rows, test.total)
+			continue
+		}
+		if test.rows == 0 {
+			continue
+		}
+		first := page.Relays[0]
+		if want := fmt.Sprintf("wss://relay%03d.example.com", test.first); first.URL != want ||
+			first.Count != test.first%5 || first.DiscoveredBy != "wss://seed.example.com" {
+			t.Errorf("%s: first relay %+v, want %s", test.query, first, want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// archivedFrame is one line of the event archive
+type archivedFrame struct {
+	Relay      string          `json:"relay"`
+	ReceivedAt time.Time       `json:"received_at"`
+	Frame      json.RawMessage `json:"frame"`
+}
+
+// eventArchive appends received EVENT frames to a gzipped JSONL file
+type eventArchive struct {
+	mu      sync.Mutex
+	file    *os.File
+	gz      *gzip.Writer
+	encoder *json.Encoder
+}
+
+// openArchive opens path for appending, each run adds a new gzip member to the file
+func openArchive(path string) (*eventArchive, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event archive: %v", err)
+	}
+	gz := gzip.NewWriter(file)
+	return &eventArchive{file: file, gz: gz, encoder: json.NewEncoder(gz)}, nil
+}
+
+// Append writes a frame received from relayURL to the archive
+func (a *eventArchive) Append(relayURL string, frame []byte) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.encoder == nil {
+		return // Already closed
+	}
+	entry := archivedFrame{Relay: relayURL, ReceivedAt: time.Now().UTC(), Frame: frame}
+	if err := a.encoder.Encode(entry); err != nil {
+		crawlLog.Error("failed to archive event", "relay", relayURL, "error", err)
+	}
+}
+
+// Close flushes the gzip stream and closes the file
+func (a *eventArchive) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.encoder == nil {
+		return nil
+	}
+	a.encoder = nil
+	if err := a.gz.Close(); err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
+
+// runReplay rebuilds all relay lists from an event archive and writes the normal
+// exports without touching the network. Run times and id are taken from the archive
+// so identical archives produce identical output.
+func runReplay(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %v", err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %v", err)
+	}
+	defer gz.Close()
+
+	reader := bufio.NewReader(gz)
+	sources := make(map[string]bool)
+	frames := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var entry archivedFrame
+			if jsonErr := json.Unmarshal(line, &entry); jsonErr != nil {
+				return fmt.Errorf("corrupt archive line %d: %v", frames+1, jsonErr)
+			}
+
+			if frames == 0 {
+				runStart = entry.ReceivedAt
+			}
+			runEnd = entry.ReceivedAt
+			sources[entry.Relay] = true
+			frames++
+
+			bytesTransferred.Add(int64(len(entry.Frame)))
+			if parseErr := handleMessage(entry.Frame, entry.Relay, nil); parseErr != nil {
+				crawlLog.Warn("failed to handle archived message", "relay", entry.Relay, "error", parseErr)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+	}
+
+	_, sum, err := hashFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to hash archive: %v", err)
+	}
+	runID = "replay-" + sum[:16]
+
+	if cfg.Reference != "" {
+		if err := loadReference(cfg.Reference); err != nil {
+			return fmt.Errorf("failed to load reference list: %v", err)
+		}
+	}
+
+	// The archive doesn't know the configured seeds, use the relays events came from
+	seedRelays = make([]string, 0, len(sources))
+	for relay := range sources {
+		seedRelays = append(seedRelays, relay)
+	}
+	sort.Strings(seedRelays)
+
+	if err := prepareOutputDir(); err != nil {
+		return err
+	}
+	finalize()
+
+	fmt.Printf("Replayed %d frames from %s\n", frames, path)
+	return nil
+}
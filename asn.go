@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/csv"
+	"sort"
+	"strconv"
+
+	"crawlr2/atomicfile"
+	"crawlr2/geoip"
+)
+
+// Loaded from -asn-db at startup, nil without it
+var asnDB *geoip.DB
+
+// Bucket of online relays without a known AS in asn_summary.csv
+const unknownASN = "unknown"
+
+// ASNShare is one autonomous system of the AS report
+type ASNShare struct {
+	ASN     int     `json:"asn"` // 0 for the unknown bucket
+	Org     string  `json:"org,omitempty"`
+	Relays  int     `json:"relays"`
+	Percent float64 `json:"percent"` // Of the online relays with a known AS
+}
+
+// ASNConcentration measures how centralized the hosting of online relays is. Shares
+// and the index only cover relays with a known AS, those without one are counted in
+// Unknown instead of being treated as one more network.
+type ASNConcentration struct {
+	Relays   int        `json:"online_relays"`
+	Unknown  int        `json:"unknown_asn"`
+	ASNs     int        `json:"asns"`
+	Top1     float64    `json:"top1_percent"`
+	Top5     float64    `json:"top5_percent"`
+	Top10    float64    `json:"top10_percent"`
+	HHI      float64    `json:"hhi"` // Herfindahl-Hirschman index, sum of squared percentages, 0 to 10000
+	Networks []ASNShare `json:"-"`   // Largest first, written to asn_summary.csv
+}
+
+// buildASNConcentration groups the online relays by AS, nil without -asn-db
+func (s relayState) buildASNConcentration() *ASNConcentration {
+	if asnDB == nil {
+		return nil
+	}
+
+	online := s.lists[ClearOnline]
+	report := &ASNConcentration{Relays: len(online)}
+	networks := make(map[int]*ASNShare)
+	for relay := range online {
+		record, ok := s.records[relay]
+		if !ok || record.ASN == 0 {
+			report.Unknown++
+			continue
+		}
+		if networks[record.ASN] == nil {
+			networks[record.ASN] = &ASNShare{ASN: record.ASN, Org: record.ASOrg}
+		}
+		networks[record.ASN].Relays++
+	}
+
+	known := report.Relays - report.Unknown
+	for _, network := range networks {
+		network.Percent = float64(network.Relays) * 100 / float64(known)
+		report.HHI += network.Percent * network.Percent
+		report.Networks = append(report.Networks, *network)
+	}
+	sort.Slice(report.Networks, func(i, j int) bool {
+		a, b := report.Networks[i], report.Networks[j]
+		if a.Relays != b.Relays {
+			return a.Relays > b.Relays
+		}
+		return a.ASN < b.ASN
+	})
+	report.ASNs = len(report.Networks)
+
+	var cumulative float64
+	for i, network := range report.Networks {
+		cumulative += network.Percent
+		switch i + 1 {
+		case 1:
+			report.Top1 = cumulative
+		case 5:
+			report.Top5 = cumulative
+		case 10:
+			report.Top10 = cumulative
+		}
+	}
+	// With fewer networks than a cutoff, the top ones are all of them
+	if report.ASNs < 5 {
+		report.Top5 = cumulative
+	}
+	if report.ASNs < 10 {
+		report.Top10 = cumulative
+	}
+	return report
+}
+
+// exportASNSummary writes the online relays per AS to asn_summary.csv, largest first
+// and the unknown bucket last
+func exportASNSummary(report *ASNConcentration) error {
+	if report == nil {
+		return nil
+	}
+
+	path := runFilePath("asn_summary.csv")
+	file, err := atomicfile.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"asn", "org", "relays", "percent", "cumulative_percent"})
+	var cumulative float64
+	for _, network := range report.Networks {
+		cumulative += network.Percent
+		writer.Write([]string{
+			strconv.Itoa(network.ASN),
+			network.Org,
+			strconv.Itoa(network.Relays),
+			strconv.FormatFloat(network.Percent, 'f', 2, 64),
+			strconv.FormatFloat(cumulative, 'f', 2, 64),
+		})
+	}
+	writer.Write([]string{unknownASN, "", strconv.Itoa(report.Unknown), "", ""})
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Abort()
+		return err
+	}
+	if err := file.Commit(); err != nil {
+		return err
+	}
+	recordOutput(path, len(report.Networks)+1)
+	return nil
+}
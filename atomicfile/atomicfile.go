@@ -0,0 +1,58 @@
+// Package atomicfile writes files through a temporary file that is renamed over the
+// target once complete, so readers never see a half-written output.
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// File writes to a temporary file that only replaces the target on Commit
+type File struct {
+	*os.File
+	path string
+}
+
+// Create opens a temporary file next to path for writing
+func Create(path string) (*File, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+
+	// CreateTemp uses 0600, match the permissions os.Create would have given
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &File{File: file, path: path}, nil
+}
+
+// Commit closes the temporary file and renames it over the target
+func (f *File) Commit() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), f.path)
+}
+
+// Abort discards the temporary file
+func (f *File) Abort() {
+	f.File.Close()
+	os.Remove(f.Name())
+}
+
+// WriteFile writes data to path atomically
+func WriteFile(path string, data []byte) error {
+	file, err := Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Commit()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"crawlr2/atomicfile"
+)
+
+// With -availability, a state file keeps every relay's record across runs: how many
+// runs crawled it, how many found it online and how many runs in a row it has been
+// offline. Relays offline for -max-offline-streak runs in a row aren't dialed again
+// unless -recheck-dead is given, they go straight to the offline list.
+
+// Version of the availability file layout
+const availabilitySchemaVersion = 1
+
+// errOfflineStreak is the failure recorded on relays skipped for their offline streak
+var errOfflineStreak = errors.New("skipped: offline in every recent run")
+
+// relayHistory is what the availability file keeps about one relay. Relays listed but
+// never crawled only have FirstSeen.
+type relayHistory struct {
+	Runs          int        `json:"runs"`
+	Online        int        `json:"online"`
+	OfflineStreak int        `json:"offline_streak"`
+	FirstSeen     time.Time  `json:"first_seen"`
+	LastOnline    *time.Time `json:"last_online,omitempty"`
+}
+
+// availabilityFile is the layout of the -availability file
+type availabilityFile struct {
+	Version   int                      `json:"version"`
+	UpdatedAt time.Time                `json:"updated_at"`
+	Relays    map[string]*relayHistory `json:"relays"`
+}
+
+// AvailabilitySummary reports how this run's relays relate to earlier runs
+type AvailabilitySummary struct {
+	New           int `json:"new"`       // Not seen by any earlier run
+	Returning     int `json:"returning"` // Seen by an earlier run
+	SkippedStreak int `json:"skipped_offline_streak"`
+}
+
+// Loaded by loadAvailability, nil without -availability. Guarded by mu once the crawl runs.
+var availability map[string]*relayHistory
+
+// loadAvailability reads the history of earlier runs. A missing file starts an empty
+// history, an unreadable one is reported and replaced at the end of the run.
+func loadAvailability() error {
+	availability = make(map[string]*relayHistory)
+	data, err := os.ReadFile(cfg.Availability)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var file availabilityFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("corrupt availability file %s: %v", cfg.Availability, err)
+	}
+	if file.Version != availabilitySchemaVersion {
+		return fmt.Errorf("availability file %s has unsupported version %d", cfg.Availability, file.Version)
+	}
+	if file.Relays != nil {
+		availability = file.Relays
+	}
+	return nil
+}
+
+// observedThisRun reports whether this run crawled a relay to a result and if it was
+// online. Relays skipped for their streak weren't observed.
+func (s relayState) observedThisRun(relayURL string) (observed, online bool) {
+	record, ok := s.records[relayURL]
+	if !ok || !record.crawled || record.skippedStreak {
+		return false, false
+	}
+	if _, offline := s.lists[ClearOffline][relayURL]; offline {
+		return true, false
+	}
+	_, online = s.lists[ClearOnline][relayURL]
+	return online, online
+}
+
+// applyAvailability sets a record's availability columns from the earlier runs plus
+// this one
+func (s relayState) applyAvailability(record *RelayRecord) {
+	if availability == nil {
+		return
+	}
+	history := relayHistory{}
+	if earlier, ok := availability[record.URL]; ok {
+		history = *earlier
+	}
+	if observed, online := s.observedThisRun(record.URL); observed {
+		history.Runs++
+		if online {
+			history.Online++
+			history.OfflineStreak = 0
+		} else {
+			history.OfflineStreak++
+		}
+	}
+
+	record.FirstSeen = earliest(record.FirstSeen, history.FirstSeen)
+	if history.LastOnline != nil {
+		record.LastSeen = latest(record.LastSeen, *history.LastOnline)
+	}
+
+	record.RunsObserved = history.Runs
+	record.RunsOnline = history.Online
+	record.OfflineStreak = history.OfflineStreak
+	if history.Runs > 0 {
+		uptime := float64(history.Online) * 100 / float64(history.Runs)
+		record.Uptime = &uptime
+	}
+}
+
+// skipForStreak moves a relay offline in enough earlier runs in a row straight to the
+// offline list, reporting whether it did. Caller must hold mu.
+func skipForStreak(relayURL string) (RelayRecord, bool) {
+	if availability == nil || cfg.RecheckDead || cfg.MaxOfflineStreak <= 0 {
+		return RelayRecord{}, false
+	}
+	history, ok := availability[relayURL]
+	if !ok || history.OfflineStreak < cfg.MaxOfflineStreak {
+		return RelayRecord{}, false
+	}
+	record := markOffline(relayURL, errOfflineStreak)
+	recordFor(relayURL).skippedStreak = true
+	return record, true
+}
+
+// earliest returns the earlier of two sightings, a zero time being none
+func earliest(seen *time.Time, other time.Time) *time.Time {
+	if other.IsZero() || seen != nil && !other.Before(*seen) {
+		return seen
+	}
+	other = other.UTC()
+	return &other
+}
+
+// latest returns the later of two sightings
+func latest(seen *time.Time, other time.Time) *time.Time {
+	if seen != nil && !other.After(*seen) {
+		return seen
+	}
+	other = other.UTC()
+	return &other
+}
+
+// summarizeAvailability counts new and returning relays, nil without -availability.
+// Caller must hold mu.
+func summarizeAvailability() *AvailabilitySummary {
+	if availability == nil {
+		return nil
+	}
+	summary := new(AvailabilitySummary)
+	for _, relayList := range []map[string]int{clearOnline, clearOffline} {
+		for relay := range relayList {
+			if _, seen := availability[relay]; seen {
+				summary.Returning++
+			} else {
+				summary.New++
+			}
+			if record, ok := relayRecords[relay]; ok && record.skippedStreak {
+				summary.SkippedStreak++
+			}
+		}
+	}
+	return summary
+}
+
+// saveAvailability adds this run's results to the history and writes it back. Relays
+// not crawled this run keep their history unchanged. Caller must hold mu.
+func saveAvailability() {
+	if availability == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	state := liveState()
+	for _, relayList := range []map[string]int{clearOnline, clearOffline} {
+		for relay := range relayList {
+			history, ok := availability[relay]
+			if !ok {
+				history = new(relayHistory)
+				availability[relay] = history
+			}
+			if record, ok := relayRecords[relay]; ok {
+				if first := earliest(record.FirstSeen, history.FirstSeen); first != nil {
+					history.FirstSeen = *first
+				}
+				if record.LastSeen != nil {
+					history.LastOnline = latest(history.LastOnline, *record.LastSeen)
+				}
+			}
+
+			observed, online := state.observedThisRun(relay)
+			if !observed {
+				continue // Listed but not crawled, only its first sighting is kept
+			}
+			history.Runs++
+			if online {
+				history.Online++
+				history.OfflineStreak = 0
+			} else {
+				history.OfflineStreak++
+			}
+		}
+	}
+
+	data, err := json.Marshal(availabilityFile{Version: availabilitySchemaVersion, UpdatedAt: now, Relays: availability})
+	if err == nil {
+		err = atomicfile.WriteFile(cfg.Availability, data)
+	}
+	if err != nil {
+		exportLog.Error("failed to save availability history", "path", cfg.Availability, "error", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Provenance recorded for relays loaded from a previous run
+const bootstrapSource = "bootstrap"
+
+// Provenance recorded for relays seeded from the nostr.watch API with -seed-nostrwatch
+const nostrWatchSource = "nostr.watch"
+
+// Where -seed-nostrwatch fetches the relays nostr.watch currently sees online, a JSON
+// array of URLs, and how long it waits for them
+const (
+	nostrWatchAPI     = "https://api.nostr.watch/v1/online"
+	nostrWatchTimeout = 15 * time.Second
+)
+
+// previousOnlineExport finds the clear_online CSV of the most recent earlier run, if any.
+// Templates containing {timestamp} are matched against every run and the newest wins.
+func previousOnlineExport() string {
+	current := outputPath(ClearOnline, "csv")
+	if !strings.Contains(cfg.OutputDir+cfg.FilenameTemplate, "{timestamp}") {
+		if _, err := os.Stat(current); err == nil {
+			return current
+		}
+		return ""
+	}
+
+	pattern := filepath.Join(
+		strings.ReplaceAll(cfg.OutputDir, "{timestamp}", "*"),
+		strings.NewReplacer("{category}", string(ClearOnline), "{timestamp}", "*", "{format}", "csv").Replace(cfg.FilenameTemplate),
+	)
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return ""
+	}
+
+	// Run timestamps sort lexically, skip this run's own file
+	sort.Strings(matches)
+	for i := len(matches) - 1; i >= 0; i-- {
+		if matches[i] != current {
+			return matches[i]
+		}
+	}
+	return ""
+}
+
+// Columns of the sightings in an online CSV row, see csvRow
+const (
+	onlineFirstSeenColumn = 9
+	onlineLastSeenColumn  = 10
+)
+
+// carrySeen keeps the first and last sighting a previous run exported for a relay, when
+// they are earlier and later than this run's. Exports from before these columns have
+// none to carry.
+func carrySeen(record *RelayRecord, row []string) {
+	if len(row) <= onlineLastSeenColumn {
+		return
+	}
+	if first, err := time.Parse(time.RFC3339, row[onlineFirstSeenColumn]); err == nil {
+		record.FirstSeen = earliest(record.FirstSeen, first)
+	}
+	if last, err := time.Parse(time.RFC3339, row[onlineLastSeenColumn]); err == nil {
+		record.LastSeen = latest(record.LastSeen, last)
+	}
+}
+
+// bootstrapFrontier loads the online relays of the previous run into the frontier so
+// the crawl fans out immediately. Only URLs are imported, never counts.
+func bootstrapFrontier() (int, error) {
+	path := previousOnlineExport()
+	if path == "" {
+		return 0, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	loaded := 0
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return loaded, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		if len(row) == 0 {
+			continue
+		}
+
+		relay := normalizeURL(row[0])
+		if categorize(relay) != ClearOnline {
+			continue // Classification rules may have changed since the previous run
+		}
+		if _, known := clearOnline[relay]; known {
+			continue
+		}
+
+		clearOnline[relay] = 0
+		countRelay(ClearOnline, relay)
+		record := recordFor(relay)
+		record.DiscoveredBy = bootstrapSource
+		carrySeen(record, row)
+		loaded++
+	}
+	return loaded, nil
+}
+
+// seedFromNostrWatch classifies every relay the nostr.watch API lists as if a relay had
+// listed it, before the crawl starts. Relays already known keep their provenance.
+func seedFromNostrWatch() (int, error) {
+	client := &http.Client{Timeout: nostrWatchTimeout}
+	resp, err := client.Get(nostrWatchAPI)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch %s: %v", nostrWatchAPI, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to fetch %s: %s", nostrWatchAPI, resp.Status)
+	}
+
+	var urls []string
+	if err := json.NewDecoder(resp.Body).Decode(&urls); err != nil {
+		return 0, fmt.Errorf("failed to decode %s: %v", nostrWatchAPI, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, relay := range urls {
+		normalizedURL := normalizeURL(relay)
+		classifyRelay(listedRelay{url: normalizedURL, category: categorize(normalizedURL)}, nostrWatchSource)
+	}
+	return len(urls), nil
+}
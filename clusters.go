@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/websocket"
+)
+
+// Relays are clustered at export when they share evidence of a single operator: the
+// IP they were reached at, the public key of their TLS certificate, the exact set of
+// names it covers, or their autonomous system together with the pattern of their
+// host's reverse name, which needs -asn-db and -dns. Clusters only span online relays
+// and need at least two members.
+
+// Evidence shared by more relays than this is taken for shared hosting, like a CDN
+// address, rather than one operator
+const clusterMaxShared = 100
+
+// Kinds of cluster evidence
+const (
+	evidenceIP   = "ip"
+	evidenceSPKI = "tls_spki"
+	evidenceSANs = "tls_sans"
+	evidenceRDNS = "asn_rdns"
+)
+
+// A reverse name with this many numbers spells out the address, the hosting
+// provider's default naming rather than the operator's
+const rdnsAddressNumbers = 4
+
+// ClusterEvidence is one value shared by some members of a cluster
+type ClusterEvidence struct {
+	Kind    string   `json:"kind"`
+	Value   string   `json:"value"`
+	Members []string `json:"members"`
+}
+
+// RelayCluster is a group of relays that look run by the same operator
+type RelayCluster struct {
+	ID       string            `json:"id"`
+	Members  []string          `json:"members"`
+	Evidence []ClusterEvidence `json:"evidence"`
+}
+
+// peerCertificate is what clustering keeps of a relay's TLS leaf certificate
+type peerCertificate struct {
+	spki string   // SHA-256 of the SubjectPublicKeyInfo, hex
+	sans []string // DNS names, sorted
+}
+
+// watchCertificate makes a wss dial remember the leaf certificate the relay presented,
+// after the usual verification accepted it
+func watchCertificate(config *websocket.Config) *atomic.Pointer[peerCertificate] {
+	cert := new(atomic.Pointer[peerCertificate])
+	if config.Location.Scheme != "wss" {
+		return cert
+	}
+	config.TlsConfig = &tls.Config{
+		ServerName: config.Location.Hostname(),
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) > 0 {
+				leaf := state.PeerCertificates[0]
+				sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+				sans := slices.Clone(leaf.DNSNames)
+				sort.Strings(sans)
+				cert.Store(&peerCertificate{spki: hex.EncodeToString(sum[:]), sans: sans})
+			}
+			return nil
+		},
+	}
+	return cert
+}
+
+// recordCertificate stores the certificate a relay was reached with
+func recordCertificate(relayURL string, cert *atomic.Pointer[peerCertificate]) {
+	leaf := cert.Load()
+	if leaf == nil {
+		return
+	}
+	locked(func() {
+		record := recordFor(relayURL)
+		record.CertSPKI = leaf.spki
+		record.CertSANs = leaf.sans
+	})
+}
+
+// buildClusters groups the online relays by shared evidence, largest cluster first,
+// and sets the cluster id of every member
+func (s relayState) buildClusters() []RelayCluster {
+	relays := sortedRelays(s.lists[ClearOnline])
+
+	// Relays sharing each piece of evidence
+	type evidenceKey struct{ kind, value string }
+	shared := make(map[evidenceKey][]string)
+	for _, relay := range relays {
+		record, ok := s.records[relay]
+		if !ok {
+			continue
+		}
+		record.ClusterID = ""
+		if record.IP != "" {
+			key := evidenceKey{evidenceIP, record.IP}
+			shared[key] = append(shared[key], relay)
+		}
+		if record.CertSPKI != "" {
+			key := evidenceKey{evidenceSPKI, record.CertSPKI}
+			shared[key] = append(shared[key], relay)
+		}
+		if len(record.CertSANs) > 0 {
+			key := evidenceKey{evidenceSANs, strings.Join(record.CertSANs, ",")}
+			shared[key] = append(shared[key], relay)
+		}
+		if record.ASN != 0 && record.DNS != nil {
+			if pattern, ok := rdnsPattern(record.DNS.PTR); ok {
+				key := evidenceKey{evidenceRDNS, fmt.Sprintf("AS%d %s", record.ASN, pattern)}
+				shared[key] = append(shared[key], relay)
+			}
+		}
+	}
+
+	// Union the relays of every usable piece of evidence
+	parent := make(map[string]string)
+	var find func(string) string
+	find = func(relay string) string {
+		if parent[relay] == relay {
+			return relay
+		}
+		parent[relay] = find(parent[relay])
+		return parent[relay]
+	}
+	var evidence []ClusterEvidence
+	for key, members := range shared {
+		if len(members) < 2 || len(members) > clusterMaxShared {
+			continue
+		}
+		evidence = append(evidence, ClusterEvidence{Kind: key.kind, Value: key.value, Members: members})
+		for _, member := range members {
+			if _, seen := parent[member]; !seen {
+				parent[member] = member
+			}
+		}
+		root := find(members[0])
+		for _, member := range members[1:] {
+			if other := find(member); other != root {
+				parent[other] = root
+			}
+		}
+	}
+
+	groups := make(map[string]*RelayCluster)
+	for _, relay := range relays {
+		if _, clustered := parent[relay]; !clustered {
+			continue
+		}
+		root := find(relay)
+		if groups[root] == nil {
+			groups[root] = new(RelayCluster)
+		}
+		groups[root].Members = append(groups[root].Members, relay)
+	}
+	for _, item := range evidence {
+		cluster := groups[find(item.Members[0])]
+		cluster.Evidence = append(cluster.Evidence, item)
+	}
+
+	clusters := make([]RelayCluster, 0, len(groups))
+	for _, cluster := range groups {
+		sort.Slice(cluster.Evidence, func(i, j int) bool {
+			a, b := cluster.Evidence[i], cluster.Evidence[j]
+			if a.Kind != b.Kind {
+				return a.Kind < b.Kind
+			}
+			return a.Value < b.Value
+		})
+		clusters = append(clusters, *cluster)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i].Members) != len(clusters[j].Members) {
+			return len(clusters[i].Members) > len(clusters[j].Members)
+		}
+		return clusters[i].Members[0] < clusters[j].Members[0]
+	})
+	for i := range clusters {
+		clusters[i].ID = fmt.Sprintf("c%d", i+1)
+		for _, member := range clusters[i].Members {
+			s.records[member].ClusterID = clusters[i].ID
+		}
+	}
+	return clusters
+}
+
+// rdnsPattern returns a reverse name with every run of digits replaced by #, so hosts
+// an operator numbered alike, relay1.example.net and relay2.example.net, share it. A
+// name that spells out its address has none.
+func rdnsPattern(ptr string) (string, bool) {
+	if ptr == "" {
+		return "", false
+	}
+	var pattern strings.Builder
+	numbers, inNumber := 0, false
+	for _, r := range strings.ToLower(ptr) {
+		if r >= '0' && r <= '9' {
+			if !inNumber {
+				pattern.WriteByte('#')
+				numbers++
+			}
+			inNumber = true
+			continue
+		}
+		inNumber = false
+		pattern.WriteRune(r)
+	}
+	if numbers >= rdnsAddressNumbers {
+		return "", false
+	}
+	return pattern.String(), true
+}
+
+// exportClusters writes the clusters to clusters.json
+func exportClusters(clusters []RelayCluster) error {
+	return writeJSONFile(runFilePath("clusters.json"), clusters, len(clusters))
+}
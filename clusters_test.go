@@ -0,0 +1,59 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRDNSPattern(t *testing.T) {
+	tests := []struct {
+		ptr, want string
+		ok        bool
+	}{
+		{"relay1.example.net", "relay#.example.net", true},
+		{"Relay12.Example.NET", "relay#.example.net", true},
+		{"nostr.example.org", "nostr.example.org", true},
+		{"static.12.34.56.78.clients.your-server.de", "", false}, // The provider's default
+		{"ip-10-0-0-1.ec2.internal", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		if got, ok := rdnsPattern(test.ptr); got != test.want || ok != test.ok {
+			t.Errorf("rdnsPattern(%q) = %q, %v, want %q, %v", test.ptr, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+// Relays in one autonomous system whose reverse names follow one pattern are a cluster,
+// the same pattern in another system or a provider's default name isn't evidence
+func TestBuildClustersASNReverseDNS(t *testing.T) {
+	records := map[string]*RelayRecord{
+		"wss://a.example.com": {ASN: 64500, DNS: &DNSRecords{PTR: "relay1.operator.net"}},
+		"wss://b.example.com": {ASN: 64500, DNS: &DNSRecords{PTR: "relay2.operator.net"}},
+		"wss://c.example.com": {ASN: 64501, DNS: &DNSRecords{PTR: "relay3.operator.net"}},
+		"wss://d.example.com": {ASN: 64500, DNS: &DNSRecords{PTR: "static.1.2.3.4.provider.net"}},
+		"wss://e.example.com": {ASN: 64500, DNS: &DNSRecords{PTR: "static.1.2.3.5.provider.net"}},
+		"wss://f.example.com": {DNS: &DNSRecords{PTR: "relay4.operator.net"}}, // No -asn-db
+	}
+	state := relayState{lists: map[RelayCategory]map[string]int{ClearOnline: {}}, records: records}
+	for relay := range records {
+		state.lists[ClearOnline][relay] = 1
+	}
+
+	clusters := state.buildClusters()
+	if len(clusters) != 1 {
+		t.Fatalf("clusters = %+v, want one", clusters)
+	}
+	members := []string{"wss://a.example.com", "wss://b.example.com"}
+	if !slices.Equal(clusters[0].Members, members) {
+		t.Errorf("members = %v, want %v", clusters[0].Members, members)
+	}
+	want := ClusterEvidence{Kind: evidenceRDNS, Value: "AS64500 relay#.operator.net", Members: members}
+	if evidence := clusters[0].Evidence; len(evidence) != 1 || evidence[0].Kind != want.Kind ||
+		evidence[0].Value != want.Value || !slices.Equal(evidence[0].Members, want.Members) {
+		t.Errorf("evidence = %+v, want %+v", evidence, want)
+	}
+	if records["wss://a.example.com"].ClusterID != clusters[0].ID || records["wss://c.example.com"].ClusterID != "" {
+		t.Error("cluster ids not set on the members alone")
+	}
+}
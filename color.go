@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Log attribute marking what a crawl log line means, the terminal colors by it
+const outcomeKey = "outcome"
+
+// Outcomes of crawl log lines
+const (
+	outcomeSuccess   = "success"
+	outcomeRetry     = "retry"
+	outcomeFailure   = "failure"
+	outcomeDiscovery = "discovery"
+)
+
+// ANSI colors used on the terminal
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorCyan   = "\033[36m"
+)
+
+// colorEnabled reports whether terminal log lines may be colored
+func colorEnabled() bool {
+	_, noColor := os.LookupEnv("NO_COLOR")
+	return !cfg.NoColor && !noColor && stdoutIsTerminal()
+}
+
+// colorFor picks the color of a log line from its outcome, falling back to its level
+func colorFor(record slog.Record) string {
+	color := ""
+	record.Attrs(func(attr slog.Attr) bool {
+		if attr.Key != outcomeKey {
+			return true
+		}
+		switch attr.Value.String() {
+		case outcomeSuccess:
+			color = colorGreen
+		case outcomeRetry:
+			color = colorYellow
+		case outcomeFailure:
+			color = colorRed
+		case outcomeDiscovery:
+			color = colorCyan
+		}
+		return false
+	})
+
+	switch {
+	case color != "":
+		return color
+	case record.Level >= slog.LevelError:
+		return colorRed
+	case record.Level >= slog.LevelWarn:
+		return colorYellow
+	}
+	return ""
+}
+
+// colorWriter wraps every line written while color is set in that color
+type colorWriter struct {
+	mu    sync.Mutex // Held from choosing the color until the line is written
+	color string
+	w     io.Writer
+}
+
+func (c *colorWriter) Write(p []byte) (int, error) {
+	if c.color == "" {
+		return c.w.Write(p)
+	}
+	line := make([]byte, 0, len(p)+len(c.color)+len(colorReset))
+	line = append(line, c.color...)
+	line = append(line, bytes.TrimRight(p, "\n")...)
+	line = append(line, colorReset+"\n"...)
+	if _, err := c.w.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// colorHandler is the terminal handler with colored lines. Coloring happens only
+// here, so the log file and JSON output never contain escape sequences.
+type colorHandler struct {
+	slog.Handler
+	writer *colorWriter
+}
+
+// newColorHandler returns a terminal handler that colors lines by outcome and level
+func newColorHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	writer := &colorWriter{w: w}
+	return colorHandler{Handler: newTerminalHandler(writer, level), writer: writer}
+}
+
+func (h colorHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.writer.mu.Lock()
+	defer h.writer.mu.Unlock()
+	h.writer.color = colorFor(record)
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h colorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return colorHandler{Handler: h.Handler.WithAttrs(attrs), writer: h.writer}
+}
+
+func (h colorHandler) WithGroup(name string) slog.Handler {
+	return colorHandler{Handler: h.Handler.WithGroup(name), writer: h.writer}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the options the crawler was started with. Each option's flag is named
+// like its JSON field with dashes, or by its flag tag where the two differ.
+type Config struct {
+	ConfigFile        string                `json:"config_file,omitempty" flag:"-"` // A config file can't name another
+	OutputDir         string                `json:"output_dir"`
+	FilenameTemplate  string                `json:"filename_template"`
+	Concurrency       int                   `json:"concurrency"`
+	CrawlTimeout      time.Duration         `json:"crawl_timeout"`
+	MaxTries          int                   `json:"max_tries"`
+	Backoff           time.Duration         `json:"backoff"`
+	SeedRelay         string                `json:"seed_relay" flag:"seed"`
+	SeedTimeout       time.Duration         `json:"seed_timeout"`
+	ProbeList         string                `json:"probe_list,omitempty" flag:"probe"`
+	Stdin             bool                  `json:"stdin,omitempty"`
+	Once              bool                  `json:"once,omitempty"`
+	SampleRate        float64               `json:"sample_rate,omitempty" flag:"sample"`
+	SampleSize        int                   `json:"sample_size,omitempty" flag:"-"` // Set by -sample too, see sampleOption
+	SampleSeed        uint64                `json:"sample_seed,omitempty"`
+	MaxRuntime        time.Duration         `json:"max_runtime,omitempty"`
+	Adaptive          bool                  `json:"adaptive_concurrency"`
+	MinConcurrency    int                   `json:"min_concurrency"`
+	MaxConcurrency    int                   `json:"max_concurrency"`
+	Quiet             bool                  `json:"quiet"`
+	NoProgress        bool                  `json:"no_progress"`
+	NoColor           bool                  `json:"no_color"`
+	OTLPEndpoint      string                `json:"otlp_endpoint"`
+	OTLPSampleRate    float64               `json:"otlp_sample_rate"`
+	PostgresDSN       string                `json:"-"` // May contain credentials, never exported
+	ArchivePath       string                `json:"archive_path,omitempty" flag:"archive"`
+	OutputFormats     []string              `json:"output_formats" flag:"output-format"`
+	ExportCategories  []RelayCategory       `json:"export_categories,omitempty"`
+	MinCount          map[RelayCategory]int `json:"min_count,omitempty"`
+	Columns           []string              `json:"columns,omitempty"`
+	NoBootstrap       bool                  `json:"no_bootstrap"`
+	SeedNostrWatch    bool                  `json:"seed_nostrwatch,omitempty"`
+	SecretKey         string                `json:"-"` // Signing key, never exported
+	MaxAttemptHistory int                   `json:"max_attempt_history"`
+	MaxPubkeys        int                   `json:"max_pubkeys"`
+	MaxReferrers      int                   `json:"max_referrers"`
+	DeadRelayTTL      time.Duration         `json:"dead_relay_ttl"`
+	MaxPerIP          int                   `json:"max_per_ip"`
+	MemoryLimitMB     int                   `json:"memory_limit_mb,omitempty" flag:"memory-limit"`
+	NIP11             bool                  `json:"nip11"`
+	NIP11Concurrency  int                   `json:"nip11_concurrency"`
+	NIP11Timeout      time.Duration         `json:"nip11_timeout"`
+	NIP11Cache        string                `json:"nip11_cache,omitempty"`
+	NIP11ExcludePaid  bool                  `json:"nip11_exclude_paid,omitempty"`
+	GeoIP             string                `json:"geoip,omitempty"`
+	ASNDB             string                `json:"asn_db,omitempty"`
+	ProbeNIPs         bool                  `json:"probe_nips"`
+	DNS               bool                  `json:"dns"`
+	PlaintextProbe    bool                  `json:"plaintext_probe,omitempty"`
+	Availability      string                `json:"availability,omitempty"`
+	History           string                `json:"history,omitempty"`
+	Reference         string                `json:"reference,omitempty"`
+	MaxOfflineStreak  int                   `json:"max_offline_streak"`
+	RecheckDead       bool                  `json:"recheck_dead,omitempty"`
+	ProbeNIPsRate     int                   `json:"probe_nips_rate"`
+	NIP66Relays       []string              `json:"nip66_relays,omitempty"`
+	NIP66Rate         float64               `json:"nip66_rate"`
+	NIP66Interval     time.Duration         `json:"nip66_interval"`
+	NIP66DryRun       string                `json:"nip66_dry_run,omitempty"`
+	Webhooks          []string              `json:"-"` // URLs often embed a token, never exported
+	WebhookEvents     []string              `json:"webhook_events"`
+	WebhookSecret     string                `json:"-"` // HMAC key, never exported
+	WebhookTimeout    time.Duration         `json:"webhook_timeout"`
+	NoDomainPenalty   bool                  `json:"no_domain_penalty"`
+	DeadDomainRatio   float64               `json:"dead_domain_ratio"`
+	DeadDomainMin     int                   `json:"dead_domain_min"`
+	LogLevel          string                `json:"log_level"`
+	LogFormat         string                `json:"log_format"`
+	LogFile           string                `json:"log_file,omitempty"`
+	LogMaxSizeMB      int                   `json:"log_max_size_mb" flag:"log-max-size"`
+	LogMaxFiles       int                   `json:"log_max_files"`
+	TraceRelays       []string              `json:"trace_relays,omitempty" flag:"trace-relay,repeatable"`
+	HTTPAddr          string                `json:"http_addr,omitempty"`
+	ControlToken      string                `json:"-"` // Grants control over the crawl, never exported
+	Pprof             bool                  `json:"pprof"`
+}
+
+// Supported values for -output-format
+var knownOutputFormats = map[string]bool{
+	"csv":        true, // One CSV file per category
+	"json":       true, // Combined relays.json with per-relay metadata
+	"nostrwatch": true, // Online relays in the nostr.watch relay list format
+	"nip51":      true, // Online relays as NIP-51 kind 30002 relay set events
+}
+
+// Active configuration, populated by parseFlags
+var cfg = Config{
+	OutputDir:         defaultOutputDir,
+	FilenameTemplate:  defaultFilenameTemplate,
+	OutputFormats:     []string{"csv", "json"},
+	Concurrency:       defaultConcurrency,
+	CrawlTimeout:      defaultCrawlTimeout,
+	MaxTries:          defaultMaxTries,
+	Backoff:           defaultBackoff,
+	SeedRelay:         defaultSeedRelay,
+	SeedTimeout:       defaultSeedTimeout,
+	MinConcurrency:    10,
+	MaxConcurrency:    1000,
+	OTLPSampleRate:    0.01,
+	MaxAttemptHistory: 10,
+	MaxPubkeys:        10000,
+	MaxReferrers:      5,
+	DeadRelayTTL:      defaultDeadRelayTTL,
+	MaxPerIP:          4,
+	NIP11Concurrency:  20,
+	NIP11Timeout:      10 * time.Second,
+	NIP66Rate:         5,
+	ProbeNIPsRate:     5,
+	MaxOfflineStreak:  10,
+	NIP66Interval:     time.Hour,
+	WebhookEvents:     []string{WebhookDiscovered, WebhookOffline, WebhookPass},
+	WebhookTimeout:    10 * time.Second,
+	DeadDomainRatio:   0.9,
+	DeadDomainMin:     20,
+	LogLevel:          "info",
+	LogFormat:         "text",
+	LogMaxSizeMB:      10,
+	LogMaxFiles:       5,
+}
+
+// parseFlags populates cfg from command line arguments
+func parseFlags(args []string) {
+	flag.StringVar(&cfg.ConfigFile, "config", cfg.ConfigFile,
+		"read options from this TOML file, flags override it; SIGHUP re-reads concurrency and log-level")
+	dump := flag.Bool("dump-config", false, "print the effective configuration and exit")
+	flag.StringVar(&cfg.OutputDir, "output-dir", cfg.OutputDir,
+		"directory for exported files, may contain {timestamp}")
+	flag.StringVar(&cfg.FilenameTemplate, "filename-template", cfg.FilenameTemplate,
+		"name of per-category exports, supports {category}, {timestamp} and {format}")
+	flag.Func("concurrency", fmt.Sprintf("maximum number of relays crawled at once (default %d)", defaultConcurrency),
+		func(value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fmt.Errorf("must be a positive number")
+			}
+			cfg.Concurrency = n
+			return nil
+		})
+	flag.DurationVar(&cfg.CrawlTimeout, "crawl-timeout", cfg.CrawlTimeout,
+		"time a relay gets to connect and answer in the fast lane, slower relays are retried in the slow lane")
+	flag.IntVar(&cfg.MaxTries, "max-tries", cfg.MaxTries, "attempts per relay before it is marked offline")
+	flag.DurationVar(&cfg.Backoff, "backoff", cfg.Backoff, "wait between two attempts at the same relay")
+	flag.StringVar(&cfg.SeedRelay, "seed", cfg.SeedRelay, "relay every crawl pass starts from")
+	flag.DurationVar(&cfg.SeedTimeout, "seed-timeout", cfg.SeedTimeout,
+		"time the seed gets to answer its relay list request once connected")
+	flag.StringVar(&cfg.ProbeList, "probe", cfg.ProbeList,
+		"only check the relays listed in this file, one URL per line or - for stdin, and exit once all are crawled")
+	flag.BoolVar(&cfg.Stdin, "stdin", cfg.Stdin,
+		"add the relay URLs piped to standard input, one per line, to the frontier as they arrive")
+	flag.BoolVar(&cfg.Once, "once", cfg.Once,
+		"exit after the first crawl pass, and with -stdin once standard input is closed, instead of crawling again")
+	flag.Func("sample", "only dial a random sample of the crawlable relays: a fraction like 0.1 or 10% of them as they "+
+		"are found, or a number of them drawn once the first seed query is through", parseSample)
+	flag.Uint64Var(&cfg.SampleSeed, "sample-seed", cfg.SampleSeed,
+		"seed of the -sample draw, the same seed samples the same relays (default random, logged at startup)")
+	flag.DurationVar(&cfg.MaxRuntime, "max-runtime", cfg.MaxRuntime,
+		"stop crawling this long after launch and write what was found, e.g. 45m (off by default)")
+	flag.BoolVar(&cfg.Adaptive, "adaptive-concurrency", cfg.Adaptive,
+		"start at -concurrency and raise it while crawls succeed, halving it when timeouts and errors spike")
+	flag.IntVar(&cfg.MinConcurrency, "min-concurrency", cfg.MinConcurrency, "lowest concurrency -adaptive-concurrency goes down to")
+	flag.IntVar(&cfg.MaxConcurrency, "max-concurrency", cfg.MaxConcurrency, "highest concurrency -adaptive-concurrency goes up to")
+	flag.BoolVar(&cfg.Quiet, "quiet", cfg.Quiet,
+		"only print errors and a one-line summary at exit, for cron and CI")
+	flag.BoolVar(&cfg.NoProgress, "no-progress", cfg.NoProgress,
+		"print plain log lines instead of the full-screen view")
+	flag.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", cfg.OTLPEndpoint,
+		"export crawl spans as OTLP/HTTP to this collector, e.g. http://localhost:4318 (disabled by default)")
+	flag.Float64Var(&cfg.OTLPSampleRate, "otlp-sample-rate", cfg.OTLPSampleRate,
+		"fraction of relay crawls exported as traces")
+	flag.BoolVar(&cfg.NoColor, "no-color", cfg.NoColor,
+		"don't color terminal output (also off with NO_COLOR or without a terminal)")
+	flag.StringVar(&cfg.PostgresDSN, "postgres-dsn", os.Getenv("CRAWLR_POSTGRES_DSN"),
+		"PostgreSQL connection string to also store results in (default $CRAWLR_POSTGRES_DSN)")
+	flag.StringVar(&cfg.ArchivePath, "archive", cfg.ArchivePath,
+		"append every received relay list event to this gzipped JSONL file")
+	flag.BoolVar(&cfg.NoBootstrap, "no-bootstrap", cfg.NoBootstrap,
+		"start from the seed only instead of the previous run's online relays")
+	flag.BoolVar(&cfg.SeedNostrWatch, "seed-nostrwatch", cfg.SeedNostrWatch,
+		"also seed the crawl with the relays the nostr.watch API lists as online, recorded as discovered by \""+nostrWatchSource+"\"")
+	flag.StringVar(&cfg.SecretKey, "secret-key", os.Getenv("CRAWLR_SECRET_KEY"),
+		"hex or nsec key used to sign published events (default $CRAWLR_SECRET_KEY)")
+	flag.Func("output-format", "comma separated export formats: csv, json, nostrwatch, nip51 (default \"csv,json\")",
+		func(value string) error {
+			formats := strings.Split(value, ",")
+			for i, format := range formats {
+				formats[i] = strings.TrimSpace(format)
+				if !knownOutputFormats[formats[i]] {
+					return fmt.Errorf("unknown format %q", formats[i])
+				}
+			}
+			cfg.OutputFormats = formats
+			return nil
+		})
+	flag.Func("export-categories", "comma separated categories to write in the CSV and JSON exports (default all), "+
+		"relays of categories left out that aren't crawled are only counted",
+		func(value string) error {
+			cfg.ExportCategories = nil
+			for _, name := range strings.Split(value, ",") {
+				category, err := parseCategory(name)
+				if err != nil {
+					return err
+				}
+				cfg.ExportCategories = append(cfg.ExportCategories, category)
+			}
+			return nil
+		})
+	flag.Func("min-count", "leave relays mentioned fewer times out of the CSV and JSON exports: a number for every "+
+		"category or category=number pairs, e.g. clear_online=3 (default 0)",
+		func(value string) error {
+			minCount, err := parseMinCount(value)
+			cfg.MinCount = minCount
+			return err
+		})
+	flag.Func("columns", "comma separated CSV columns and relays.json fields to export, url always included (default all)",
+		func(value string) error {
+			known := knownColumns()
+			cfg.Columns = nil
+			for _, column := range strings.Split(value, ",") {
+				if column = strings.TrimSpace(column); !known[column] {
+					return fmt.Errorf("unknown column %q", column)
+				}
+				cfg.Columns = append(cfg.Columns, column)
+			}
+			return nil
+		})
+	flag.Func("log-level", "minimum log level: debug, info, warn or error (default \"info\")",
+		func(value string) error {
+			level, err := parseLogLevel(value)
+			if err != nil {
+				return err
+			}
+			cfg.LogLevel = strings.ToLower(value)
+			logLevel.Set(level)
+			return nil
+		})
+	flag.Func("log-format", "log output format: text or json (default \"text\")", func(value string) error {
+		if value != "text" && value != "json" {
+			return fmt.Errorf("unknown log format %q", value)
+		}
+		cfg.LogFormat = value
+		return nil
+	})
+	flag.IntVar(&cfg.MaxAttemptHistory, "max-attempt-history", cfg.MaxAttemptHistory,
+		"crawl attempts kept per relay, older ones are dropped and the record marked truncated")
+	flag.IntVar(&cfg.MaxPubkeys, "max-pubkeys", cfg.MaxPubkeys,
+		"distinct pubkeys tracked exactly per relay, beyond this the count is estimated")
+	flag.IntVar(&cfg.MaxReferrers, "max-referrers", cfg.MaxReferrers,
+		"relays listed per relay as referrers in the exports, the distinct referrer count covers all of them")
+	flag.DurationVar(&cfg.DeadRelayTTL, "dead-relay-ttl", cfg.DeadRelayTTL,
+		"redial an offline relay mentioned again only once it has been offline this long, 0 never redials")
+	flag.IntVar(&cfg.MaxPerIP, "max-per-ip", cfg.MaxPerIP,
+		"connections open at once to a single IP address, 0 for no limit")
+	flag.BoolVar(&cfg.NIP11, "nip11", cfg.NIP11,
+		"fetch the NIP-11 document of every online relay and add its software, version, NIPs and limits to the exports")
+	flag.IntVar(&cfg.NIP11Concurrency, "nip11-concurrency", cfg.NIP11Concurrency,
+		"NIP-11 requests in flight at once, independent of -concurrency")
+	flag.DurationVar(&cfg.NIP11Timeout, "nip11-timeout", cfg.NIP11Timeout, "timeout of a single NIP-11 request")
+	flag.StringVar(&cfg.NIP11Cache, "nip11-cache", cfg.NIP11Cache,
+		"file NIP-11 documents are cached in between runs (no cache by default)")
+	flag.BoolVar(&cfg.NIP11ExcludePaid, "nip11-exclude-paid", cfg.NIP11ExcludePaid,
+		"leave relays that require payment or list fees out of the NIP-11 software and open relay statistics")
+	flag.Func("nip66-relays", "comma separated relays to publish NIP-66 monitor events to after crawl passes, needs -secret-key",
+		func(value string) error {
+			cfg.NIP66Relays = parseRelayURLs(value)
+			return nil
+		})
+	flag.Float64Var(&cfg.NIP66Rate, "nip66-rate", cfg.NIP66Rate, "NIP-66 events sent per second to each publish relay")
+	flag.DurationVar(&cfg.NIP66Interval, "nip66-interval", cfg.NIP66Interval,
+		"minimum time between two rounds of NIP-66 events, a round is due after the pass that follows")
+	flag.StringVar(&cfg.NIP66DryRun, "nip66-dry-run", cfg.NIP66DryRun,
+		"write the NIP-66 events to this JSONL file instead of publishing them")
+	flag.Func("webhook", "POST a JSON payload to this URL when a selected crawl event happens (repeatable)",
+		func(value string) error {
+			cfg.Webhooks = append(cfg.Webhooks, value)
+			return nil
+		})
+	flag.Func("webhook-events", "comma separated webhook event types: relay_discovered, relay_offline, pass_completed (default all)",
+		func(value string) error {
+			events := strings.Split(value, ",")
+			for i, event := range events {
+				events[i] = strings.TrimSpace(event)
+				if !knownWebhookEvents[events[i]] {
+					return fmt.Errorf("unknown event type %q", events[i])
+				}
+			}
+			cfg.WebhookEvents = events
+			return nil
+		})
+	flag.StringVar(&cfg.WebhookSecret, "webhook-secret", os.Getenv("CRAWLR_WEBHOOK_SECRET"),
+		"sign webhook payloads with HMAC-SHA256 in the "+webhookSignatureHeader+" header (default $CRAWLR_WEBHOOK_SECRET)")
+	flag.DurationVar(&cfg.WebhookTimeout, "webhook-timeout", cfg.WebhookTimeout, "timeout of a single webhook delivery attempt")
+	flag.StringVar(&cfg.GeoIP, "geoip", cfg.GeoIP,
+		"locate online relays with this \"start,end,country\" IP range CSV (DB-IP or IP2Location lite) for the country report")
+	flag.StringVar(&cfg.ASNDB, "asn-db", cfg.ASNDB,
+		"look up the autonomous system of online relays in this ip2asn TSV (iptoasn.com) for the AS concentration report")
+	flag.BoolVar(&cfg.ProbeNIPs, "probe-nips", cfg.ProbeNIPs,
+		"after EOSE, test NIP-42, NIP-45 and NIP-50 on the crawl connection and compare with the advertised supported_nips")
+	flag.IntVar(&cfg.ProbeNIPsRate, "probe-nips-rate", cfg.ProbeNIPsRate,
+		"relays probed per second with -probe-nips, relays over the limit are skipped")
+	flag.BoolVar(&cfg.PlaintextProbe, "plaintext-probe", cfg.PlaintextProbe,
+		"retry wss:// relays that fail in the TLS layer once over ws:// on the same port, marking them plaintext_only")
+	flag.BoolVar(&cfg.DNS, "dns", cfg.DNS,
+		"resolve the host of every online relay once more and export its CNAME target, A and AAAA records and reverse name")
+	flag.StringVar(&cfg.Availability, "availability", cfg.Availability,
+		"keep every relay's availability across runs in this file and export runs, uptime and offline streak (off by default)")
+	flag.StringVar(&cfg.Reference, "reference", cfg.Reference,
+		"compare the crawl with this relay list, one URL per line or a nostr.watch JSON list, and write coverage.json")
+	flag.StringVar(&cfg.History, "history", cfg.History,
+		"append this run's totals, new and disappeared relays and median latency to this JSONL file for \"crawlr trend\"")
+	flag.IntVar(&cfg.MaxOfflineStreak, "max-offline-streak", cfg.MaxOfflineStreak,
+		"with -availability, don't dial relays offline in this many runs in a row, 0 dials them all")
+	flag.BoolVar(&cfg.RecheckDead, "recheck-dead", cfg.RecheckDead,
+		"dial relays past -max-offline-streak anyway, still counting their runs")
+	flag.IntVar(&cfg.MemoryLimitMB, "memory-limit", cfg.MemoryLimitMB,
+		"hold back discovery and write a checkpoint while the crawler uses more than this many megabytes (off by default)")
+	flag.BoolVar(&cfg.NoDomainPenalty, "no-domain-penalty", cfg.NoDomainPenalty,
+		"crawl relays under domains that mostly produce dead relays like any other")
+	flag.Float64Var(&cfg.DeadDomainRatio, "dead-domain-ratio", cfg.DeadDomainRatio,
+		"share of a domain's crawled relays that must be dead before its further relays go to the penalty lane")
+	flag.IntVar(&cfg.DeadDomainMin, "dead-domain-min", cfg.DeadDomainMin,
+		"relays of a domain that must have been crawled before -dead-domain-ratio applies")
+	flag.StringVar(&cfg.LogFile, "log-file", cfg.LogFile, "also write logs to this file in the output directory")
+	flag.IntVar(&cfg.LogMaxSizeMB, "log-max-size", cfg.LogMaxSizeMB, "rotate the log file after this many megabytes")
+	flag.IntVar(&cfg.LogMaxFiles, "log-max-files", cfg.LogMaxFiles, "number of log files to keep, including the current one")
+	flag.StringVar(&cfg.HTTPAddr, "http-addr", cfg.HTTPAddr, "serve the dashboard, /metrics, /status and the /relays query API on this address, e.g. localhost:9090 (disabled by default)")
+	flag.StringVar(&cfg.ControlToken, "control-token", os.Getenv("CRAWLR_CONTROL_TOKEN"),
+		"bearer token required by the /control endpoints of the HTTP listener (default $CRAWLR_CONTROL_TOKEN)")
+	flag.BoolVar(&cfg.Pprof, "pprof", cfg.Pprof, "also serve /debug/pprof/ profiles on the HTTP listener")
+	flag.Func("trace-relay", "write every frame exchanged with this relay to a trace file (repeatable)",
+		func(value string) error {
+			cfg.TraceRelays = append(cfg.TraceRelays, value)
+			return nil
+		})
+	flag.CommandLine.Parse(args)
+
+	if cfg.ConfigFile != "" {
+		if err := applyConfigFile(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot load config file: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	if *dump {
+		dumpConfig()
+		os.Exit(0)
+	}
+}
+
+// validateConfig rejects option values the crawl can't run with
+func validateConfig() error {
+	switch {
+	case cfg.CrawlTimeout <= 0:
+		return fmt.Errorf("-crawl-timeout must be positive, got %s", cfg.CrawlTimeout)
+	case cfg.MaxTries < 1:
+		return fmt.Errorf("-max-tries must be at least 1, got %d", cfg.MaxTries)
+	case cfg.Backoff < 0:
+		return fmt.Errorf("-backoff must not be negative, got %s", cfg.Backoff)
+	case cfg.MaxRuntime < 0:
+		return fmt.Errorf("-max-runtime must not be negative, got %s", cfg.MaxRuntime)
+	case categorize(normalizeURL(cfg.SeedRelay)) != ClearOnline:
+		return fmt.Errorf("-seed must be a ws:// or wss:// clearnet relay URL, got %q", cfg.SeedRelay)
+	case cfg.SeedTimeout <= 0:
+		return fmt.Errorf("-seed-timeout must be positive, got %s", cfg.SeedTimeout)
+	case cfg.Adaptive && (cfg.MinConcurrency < 1 || cfg.MaxConcurrency < cfg.MinConcurrency):
+		return fmt.Errorf("-min-concurrency must be positive and not above -max-concurrency")
+	case cfg.NIP66Rate <= 0:
+		return fmt.Errorf("-nip66-rate must be positive")
+	case cfg.NIP11Timeout <= 0:
+		return fmt.Errorf("-nip11-timeout must be positive, got %s", cfg.NIP11Timeout)
+	case cfg.NIP66Interval < 0:
+		return fmt.Errorf("-nip66-interval must not be negative, got %s", cfg.NIP66Interval)
+	case cfg.WebhookTimeout <= 0:
+		return fmt.Errorf("-webhook-timeout must be positive, got %s", cfg.WebhookTimeout)
+	case cfg.NIP11Concurrency < 1:
+		return fmt.Errorf("-nip11-concurrency must be at least 1, got %d", cfg.NIP11Concurrency)
+	case cfg.MaxPerIP < 0:
+		return fmt.Errorf("-max-per-ip must not be negative, 0 for no limit, got %d", cfg.MaxPerIP)
+	case cfg.ProbeNIPsRate < 1:
+		return fmt.Errorf("-probe-nips-rate must be at least 1, got %d", cfg.ProbeNIPsRate)
+	case cfg.DeadDomainRatio < 0 || cfg.DeadDomainRatio > 1:
+		return fmt.Errorf("-dead-domain-ratio must be between 0 and 1, got %g", cfg.DeadDomainRatio)
+	case cfg.OTLPSampleRate < 0 || cfg.OTLPSampleRate > 1:
+		return fmt.Errorf("-otlp-sample-rate must be between 0 and 1, got %g", cfg.OTLPSampleRate)
+	case cfg.LogMaxSizeMB < 1:
+		return fmt.Errorf("-log-max-size must be at least 1 megabyte, got %d", cfg.LogMaxSizeMB)
+	case cfg.LogMaxFiles < 1:
+		return fmt.Errorf("-log-max-files must be at least 1, got %d", cfg.LogMaxFiles)
+	case cfg.Stdin && cfg.ProbeList == "-":
+		return fmt.Errorf("-stdin and -probe - can't both read standard input")
+	}
+	return nil
+}
+
+// logConfig logs the effective value of every option at startup so a run's log
+// describes it
+func logConfig() {
+	mainLog.Info("effective configuration", configOptions()...)
+}
+
+// configOptions lists every option's name and effective value, durations formatted.
+// Secrets are left out like in the manifest.
+func configOptions() []any {
+	value := reflect.ValueOf(cfg)
+	args := make([]any, 0, 2*value.NumField())
+	for i := 0; i < value.NumField(); i++ {
+		name, _, _ := strings.Cut(value.Type().Field(i).Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		option := value.Field(i).Interface()
+		if duration, ok := option.(time.Duration); ok {
+			option = duration.String()
+		}
+		args = append(args, name, option)
+	}
+	return args
+}
+
+// outputEnabled reports whether an export format was selected
+func outputEnabled(format string) bool {
+	for _, enabled := range cfg.OutputFormats {
+		if enabled == format {
+			return true
+		}
+	}
+	return false
+}
+
+// runTimestamp formats the run start time for use in file and directory names
+func runTimestamp() string {
+	return runStart.UTC().Format("20060102T150405Z")
+}
+
+// newRunID returns an identifier unique to this run, even across machines
+func newRunID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%s-%d", runTimestamp(), host, os.Getpid())
+}
+
+// runDir returns the directory this run writes its output to
+func runDir() string {
+	return strings.ReplaceAll(cfg.OutputDir, "{timestamp}", runTimestamp())
+}
+
+// outputPath returns the path of the export for a category in the given format
+func outputPath(category RelayCategory, format string) string {
+	name := strings.NewReplacer(
+		"{category}", string(category),
+		"{timestamp}", runTimestamp(),
+		"{format}", format,
+	).Replace(cfg.FilenameTemplate)
+	return filepath.Join(runDir(), name)
+}
+
+// runFilePath returns the path of a run-level document such as relays.json
+func runFilePath(name string) string {
+	return filepath.Join(runDir(), name)
+}
+
+// prepareOutputDir creates the run directory and checks that it is writable
+func prepareOutputDir() error {
+	dir := runDir()
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("cannot create output directory %s: %v", dir, err)
+	}
+
+	probe, err := os.CreateTemp(dir, ".crawlr-write-check-*")
+	if err != nil {
+		return fmt.Errorf("output directory %s is not writable: %v", dir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return nil
+}
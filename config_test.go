@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Every option validateConfig checks is rejected with a message naming its flag, and
+// the defaults pass
+func TestValidateConfig(t *testing.T) {
+	resetState(t)
+	defaults := cfg
+	if err := validateConfig(); err != nil {
+		t.Fatalf("defaults rejected: %v", err)
+	}
+
+	tests := []struct {
+		flag   string
+		change func(c *Config)
+	}{
+		{"-crawl-timeout", func(c *Config) { c.CrawlTimeout = 0 }},
+		{"-max-tries", func(c *Config) { c.MaxTries = 0 }},
+		{"-backoff", func(c *Config) { c.Backoff = -1 }},
+		{"-max-runtime", func(c *Config) { c.MaxRuntime = -1 }},
+		{"-seed", func(c *Config) { c.SeedRelay = "ws://relay.onion" }},
+		{"-seed-timeout", func(c *Config) { c.SeedTimeout = 0 }},
+		{"-min-concurrency", func(c *Config) { c.Adaptive, c.MinConcurrency = true, 0 }},
+		{"-nip66-rate", func(c *Config) { c.NIP66Rate = 0 }},
+		{"-stdin", func(c *Config) { c.Stdin, c.ProbeList = true, "-" }},
+		{"-nip11-timeout", func(c *Config) { c.NIP11Timeout = 0 }},
+		{"-nip11-timeout", func(c *Config) { c.NIP11Timeout = -time.Second }},
+		{"-nip66-interval", func(c *Config) { c.NIP66Interval = -time.Minute }},
+		{"-webhook-timeout", func(c *Config) { c.WebhookTimeout = 0 }},
+		{"-webhook-timeout", func(c *Config) { c.WebhookTimeout = -time.Second }},
+		{"-nip11-concurrency", func(c *Config) { c.NIP11Concurrency = 0 }},
+		{"-nip11-concurrency", func(c *Config) { c.NIP11Concurrency = -4 }},
+		{"-max-per-ip", func(c *Config) { c.MaxPerIP = -1 }},
+		{"-probe-nips-rate", func(c *Config) { c.ProbeNIPsRate = 0 }},
+		{"-probe-nips-rate", func(c *Config) { c.ProbeNIPsRate = -5 }},
+		{"-dead-domain-ratio", func(c *Config) { c.DeadDomainRatio = -0.1 }},
+		{"-dead-domain-ratio", func(c *Config) { c.DeadDomainRatio = 1.5 }},
+		{"-otlp-sample-rate", func(c *Config) { c.OTLPSampleRate = -0.01 }},
+		{"-otlp-sample-rate", func(c *Config) { c.OTLPSampleRate = 2 }},
+		{"-log-max-size", func(c *Config) { c.LogMaxSizeMB = 0 }},
+		{"-log-max-files", func(c *Config) { c.LogMaxFiles = 0 }},
+	}
+	for _, test := range tests {
+		cfg = defaults
+		test.change(&cfg)
+		err := validateConfig()
+		if err == nil || !strings.HasPrefix(err.Error(), test.flag+" ") {
+			t.Errorf("%s: err = %v, want one about %s", test.flag, err, test.flag)
+		}
+	}
+
+	// Limits that are valid at their edges
+	for _, change := range []func(c *Config){
+		func(c *Config) { c.MaxPerIP = 0 },      // No limit
+		func(c *Config) { c.NIP66Interval = 0 }, // A round after every pass
+		func(c *Config) { c.DeadDomainRatio, c.OTLPSampleRate = 0, 0 },
+		func(c *Config) { c.DeadDomainRatio, c.OTLPSampleRate = 1, 1 },
+		func(c *Config) { c.NIP11Concurrency, c.ProbeNIPsRate, c.LogMaxSizeMB, c.LogMaxFiles = 1, 1, 1, 1 },
+	} {
+		cfg = defaults
+		change(&cfg)
+		if err := validateConfig(); err != nil {
+			t.Errorf("valid config rejected: %v", err)
+		}
+	}
+}
+
+// A dumped configuration read back with -config sets every option to what was dumped,
+// under names that are all flags
+func TestDumpConfigRoundTrip(t *testing.T) {
+	resetState(t)
+	defaults := cfg
+	savedFlags, savedLevel := flag.CommandLine, logLevel.Level()
+	t.Cleanup(func() {
+		flag.CommandLine = savedFlags
+		logLevel.Set(savedLevel)
+	})
+
+	cfg.OutputDir = "out/{timestamp}"
+	cfg.Concurrency = 64
+	cfg.CrawlTimeout = 7500 * time.Millisecond
+	cfg.SeedRelay = "wss://relay.example.com"
+	cfg.ProbeList = `relays "to check".txt`
+	cfg.SampleRate = 0.07
+	cfg.SampleSeed = 1 << 63
+	cfg.MaxRuntime = 45 * time.Minute
+	cfg.OTLPSampleRate = 1e-05
+	cfg.ArchivePath = "archive.jsonl.gz"
+	cfg.OutputFormats = []string{"csv", "nostrwatch"}
+	cfg.ExportCategories = []RelayCategory{ClearOnline, Onion}
+	cfg.MinCount = map[RelayCategory]int{ClearOnline: 3, Malformed: 1}
+	cfg.Columns = []string{"url", "count"}
+	cfg.MemoryLimitMB = 2048
+	cfg.NIP11 = true
+	cfg.NIP66Relays = []string{"wss://a.example.com", "wss://b.example.com"}
+	cfg.DeadDomainRatio = 0.75
+	cfg.LogLevel = "warn"
+	cfg.LogFormat = "json"
+	cfg.LogMaxSizeMB = 50
+	cfg.TraceRelays = []string{"wss://a.example.com", "wss://c.example.com"}
+	want := cfg
+
+	var dump bytes.Buffer
+	writeConfig(&dump)
+	path := filepath.Join(t.TempDir(), "crawlr.toml")
+	if err := os.WriteFile(path, dump.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg = defaults
+	flag.CommandLine = flag.NewFlagSet("crawlr", flag.ContinueOnError)
+	parseFlags([]string{"-config", path})
+	for _, line := range strings.Split(strings.TrimSpace(dump.String()), "\n") {
+		name, _, _ := strings.Cut(line, " = ")
+		if flag.Lookup(name) == nil {
+			t.Errorf("dumped %q, which is no flag", line)
+		}
+	}
+
+	// Secrets aren't dumped, and the file read is recorded
+	want.ConfigFile, want.PostgresDSN, want.SecretKey = path, cfg.PostgresDSN, cfg.SecretKey
+	want.WebhookSecret, want.ControlToken = cfg.WebhookSecret, cfg.ControlToken
+	if !reflect.DeepEqual(cfg, want) {
+		got, wanted := reflect.ValueOf(cfg), reflect.ValueOf(want)
+		for i := 0; i < got.NumField(); i++ {
+			if !reflect.DeepEqual(got.Field(i).Interface(), wanted.Field(i).Interface()) {
+				t.Errorf("%s = %v after the round trip, want %v", got.Type().Field(i).Name, got.Field(i), wanted.Field(i))
+			}
+		}
+		t.Logf("dump:\n%s", dump.String())
+	}
+
+	// -sample as a size, and a rate of 1, which as a bare 1 would read back as a size
+	for _, sample := range []struct {
+		rate float64
+		size int
+	}{{0, 500}, {1, 0}} {
+		cfg = defaults
+		cfg.SampleRate, cfg.SampleSize = sample.rate, sample.size
+		dump.Reset()
+		writeConfig(&dump)
+		if err := os.WriteFile(path, dump.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cfg = defaults
+		flag.CommandLine = flag.NewFlagSet("crawlr", flag.ContinueOnError)
+		parseFlags([]string{"-config", path})
+		if cfg.SampleRate != sample.rate || cfg.SampleSize != sample.size {
+			t.Errorf("sample rate %g and size %d read back as %g and %d", sample.rate, sample.size,
+				cfg.SampleRate, cfg.SampleSize)
+		}
+	}
+}
+
+// Config files are read as TOML, tables and all, into the values their flags take
+func TestReadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crawlr.toml")
+	document := `# Every shape of TOML value an option can take
+concurrency = 1_000
+crawl_timeout = "8s" # underscores work like dashes
+nip11 = true
+dead-domain-ratio = 0.75
+output-dir = 'C:\crawls'
+webhook = [
+  "https://a.example/hook", # a comment between elements
+  'https://b.example/hook',
+]
+trace-relay = []
+
+[log]
+level = "debug"
+max-files = 0x10
+
+[nip66]
+interval = "2h"
+`
+	if err := os.WriteFile(path, []byte(document), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	values, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := configValues{
+		"concurrency":       {"1000"},
+		"crawl-timeout":     {"8s"},
+		"nip11":             {"true"},
+		"dead-domain-ratio": {"0.75"},
+		"output-dir":        {`C:\crawls`},
+		"webhook":           {"https://a.example/hook", "https://b.example/hook"},
+		"trace-relay":       {},
+		"log-level":         {"debug"},
+		"log-max-files":     {"16"},
+		"nip66-interval":    {"2h"},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("values = %v, want %v", values, want)
+	}
+
+	for _, invalid := range []string{
+		"concurrency = ",                   // Not TOML
+		"concurrency = 1\nconcurrency = 2", // Set twice
+		"started = 2024-05-01T10:00:00Z",   // No flag takes a date
+		"webhook = [{url = \"https://a.example/hook\"}]",
+	} {
+		if err := os.WriteFile(path, []byte(invalid), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readConfigFile(path); err == nil || !strings.HasPrefix(err.Error(), path+": ") {
+			t.Errorf("%q: err = %v, want one naming the file", invalid, err)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// A -config file is TOML setting options by their flag name:
+//
+//	# comments and blank lines are skipped
+//	concurrency = 300
+//	crawl-timeout = "8s"
+//	nip11 = true
+//	webhook = [
+//	  "https://a.example/hook",
+//	  "https://b.example/hook",
+//	]
+//
+//	[log]
+//	level = "debug" # log-level
+//
+// Underscores in names work like dashes, and a table's keys are named after it like
+// log.level is log-level. Values are strings, numbers, booleans or arrays for
+// repeatable flags. Flags given on the command line win over the file, which wins over
+// the defaults.
+
+// Options a SIGHUP re-reads from the -config file while the crawl runs
+var reloadableOptions = []string{"concurrency", "log-level"}
+
+// Flags given on the command line, set by applyConfigFile
+var commandLineFlags map[string]bool
+
+// configValues is what a config file assigns, values as flag.Set takes them
+type configValues map[string][]string
+
+// readConfigFile parses a config file, see the format above
+func readConfigFile(path string) (configValues, error) {
+	var document map[string]any
+	if _, err := toml.DecodeFile(path, &document); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	values := make(configValues)
+	if err := addConfigTable(values, "", document); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return values, nil
+}
+
+// addConfigTable adds the options of a table, named after it with a prefix
+func addConfigTable(values configValues, prefix string, table map[string]any) error {
+	for key, value := range table {
+		name := prefix + strings.ReplaceAll(key, "_", "-")
+		if inner, ok := value.(map[string]any); ok {
+			if err := addConfigTable(values, name+"-", inner); err != nil {
+				return err
+			}
+			continue
+		}
+		parsed, err := configFlagValues(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		values[name] = parsed
+	}
+	return nil
+}
+
+// configFlagValues turns a TOML value into flag values, one per array element
+func configFlagValues(value any) ([]string, error) {
+	elements, ok := value.([]any)
+	if !ok {
+		elements = []any{value}
+	}
+	values := make([]string, 0, len(elements))
+	for _, element := range elements {
+		switch element := element.(type) {
+		case string:
+			values = append(values, element)
+		case int64:
+			values = append(values, strconv.FormatInt(element, 10))
+		case float64:
+			values = append(values, strconv.FormatFloat(element, 'g', -1, 64))
+		case bool:
+			values = append(values, strconv.FormatBool(element))
+		default:
+			return nil, fmt.Errorf("unsupported value %v, want a string, number, boolean or array of them", element)
+		}
+	}
+	return values, nil
+}
+
+// applyConfigFile sets every option of the -config file that the command line didn't,
+// warning about names no flag has. Called by parseFlags once the command line is parsed.
+func applyConfigFile() error {
+	commandLineFlags = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { commandLineFlags[f.Name] = true })
+
+	values, err := readConfigFile(cfg.ConfigFile)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedConfigNames(values) {
+		switch {
+		case name == "config" || name == "dump-config" || flag.Lookup(name) == nil:
+			fmt.Fprintf(os.Stderr, "Warning: ignoring unknown option %q in %s\n", name, cfg.ConfigFile)
+		case commandLineFlags[name]:
+			// The command line wins
+		default:
+			for _, value := range values[name] {
+				if err := flag.Set(name, value); err != nil {
+					return fmt.Errorf("%s: invalid value %q for %s: %v", cfg.ConfigFile, value, name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sortedConfigNames lists a config file's options in a stable order
+func sortedConfigNames(values configValues) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// reloadConfigFile re-reads the -config file on SIGHUP and applies the options that can
+// change while the crawl runs, unless the command line set them
+func reloadConfigFile() {
+	values, err := readConfigFile(cfg.ConfigFile)
+	if err != nil {
+		mainLog.Error("failed to reload config file", "path", cfg.ConfigFile, "error", err)
+		return
+	}
+	for _, name := range reloadableOptions {
+		value, ok := values[name]
+		if !ok || len(value) == 0 || commandLineFlags[name] {
+			continue
+		}
+		switch name {
+		case "concurrency":
+			concurrency, err := strconv.Atoi(value[0])
+			if err != nil || concurrency < 1 {
+				mainLog.Warn("ignoring invalid concurrency in config file", "value", value[0])
+				continue
+			}
+			mainLog.Info("concurrency reloaded", "concurrency", setConcurrency(concurrency))
+		case "log-level":
+			var err error
+			locked(func() { err = flag.Set(name, value[0]) })
+			if err != nil {
+				mainLog.Warn("ignoring invalid log level in config file", "value", value[0], "error", err)
+				continue
+			}
+			mainLog.Info("log level reloaded", "log_level", value[0])
+		}
+	}
+}
+
+// dumpConfig prints the effective configuration, merged from defaults, -config and
+// flags, as a config file that sets it again
+func dumpConfig() {
+	writeConfig(os.Stdout)
+}
+
+// writeConfig writes every option a config file can set under its flag name, see
+// Config. Secrets are left out like in the manifest, and so are empty lists and an unset
+// -sample, which no flag value stands for.
+func writeConfig(w io.Writer) {
+	value := reflect.ValueOf(cfg)
+	for i := 0; i < value.NumField(); i++ {
+		name, repeatable := configFlagName(value.Type().Field(i))
+		if name == "" {
+			continue
+		}
+		var option string
+		var ok bool
+		if name == "sample" {
+			option, ok = sampleOption()
+		} else {
+			option, ok = configValue(value.Field(i), repeatable)
+		}
+		if ok {
+			fmt.Fprintf(w, "%s = %s\n", name, option)
+		}
+	}
+}
+
+// configFlagName returns the flag that sets a Config field and whether it's repeatable,
+// no name for fields that are secret or have no flag of their own
+func configFlagName(field reflect.StructField) (string, bool) {
+	jsonName, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if jsonName == "-" {
+		return "", false
+	}
+	tag, ok := field.Tag.Lookup("flag")
+	if !ok {
+		return strings.ReplaceAll(jsonName, "_", "-"), false
+	}
+	name, options, _ := strings.Cut(tag, ",")
+	if name == "-" {
+		return "", false
+	}
+	return name, options == "repeatable"
+}
+
+// configValue formats an option as a TOML value: lists comma separated like
+// their flags take them, or as an array for repeatable flags, and maps as key=value pairs
+func configValue(option reflect.Value, repeatable bool) (string, bool) {
+	if duration, ok := option.Interface().(time.Duration); ok {
+		return strconv.Quote(duration.String()), true
+	}
+	switch option.Kind() {
+	case reflect.String:
+		return strconv.Quote(option.String()), true
+	case reflect.Bool:
+		return strconv.FormatBool(option.Bool()), true
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(option.Int(), 10), true
+	case reflect.Uint64:
+		// TOML integers are 64-bit signed, larger ones are written as strings
+		if option.Uint() > math.MaxInt64 {
+			return strconv.Quote(strconv.FormatUint(option.Uint(), 10)), true
+		}
+		return strconv.FormatUint(option.Uint(), 10), true
+	case reflect.Float64:
+		return strconv.FormatFloat(option.Float(), 'g', -1, 64), true
+	case reflect.Slice:
+		elements := make([]string, option.Len())
+		for i := range elements {
+			elements[i] = option.Index(i).String()
+		}
+		if len(elements) == 0 {
+			return "", false
+		}
+		if repeatable {
+			array, _ := json.Marshal(elements)
+			return string(array), true
+		}
+		return strconv.Quote(strings.Join(elements, ",")), true
+	case reflect.Map:
+		pairs := make([]string, 0, option.Len())
+		for iter := option.MapRange(); iter.Next(); {
+			pairs = append(pairs, fmt.Sprintf("%v=%v", iter.Key(), iter.Value()))
+		}
+		if len(pairs) == 0 {
+			return "", false
+		}
+		slices.Sort(pairs)
+		return strconv.Quote(strings.Join(pairs, ",")), true
+	}
+	return "", false
+}
+
+// sampleOption formats -sample, which sets either SampleSize or SampleRate. A rate of 1
+// is written as a percentage, which can't be mistaken for a size of one relay.
+func sampleOption() (string, bool) {
+	switch {
+	case cfg.SampleSize > 0:
+		return strconv.Itoa(cfg.SampleSize), true
+	case cfg.SampleRate == 1:
+		return `"100%"`, true
+	case cfg.SampleRate > 0:
+		return strconv.FormatFloat(cfg.SampleRate, 'g', -1, 64), true
+	}
+	return "", false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// The console goroutine is the only writer to the terminal once logging has started.
+// Log lines arrive on logChannel and other output through consolePrint. While the TUI
+// is up it also redraws the screen and handles key presses.
+var (
+	consoleWrites  = make(chan consoleWrite)
+	consoleLeave   = make(chan chan struct{}) // Asks the console to leave the TUI
+	consoleRunning atomic.Bool
+)
+
+// consoleWrite is text to print, written is closed once it's out
+type consoleWrite struct {
+	text    string
+	written chan struct{}
+}
+
+// consolePrint writes text to stdout through the console goroutine and waits until it
+// is written. Without a console, e.g. in replay, it prints directly.
+func consolePrint(text string) {
+	if !consoleRunning.Load() {
+		fmt.Print(text)
+		return
+	}
+	write := consoleWrite{text: text, written: make(chan struct{})}
+	consoleWrites <- write
+	<-write.written
+}
+
+// startConsole starts the console goroutine, showing the TUI when ui is set
+func startConsole(ui *tui) {
+	consoleRunning.Store(true)
+	go func() {
+		defer recoverFatal("console")
+		defer consoleRunning.Store(false) // Runs first, later output is printed directly
+		runConsole(ui)
+	}()
+}
+
+// runConsole serializes everything written to the terminal
+func runConsole(ui *tui) {
+	var events <-chan tcell.Event
+	if ui != nil {
+		ui.enter()
+		events = ui.events
+	}
+
+	redraw := time.NewTicker(tuiRedrawInterval)
+	defer redraw.Stop()
+	sample := time.NewTicker(time.Second)
+	defer sample.Stop()
+
+	for {
+		select {
+		case line := <-logChannel:
+			if ui != nil {
+				ui.addLog(line)
+			} else {
+				os.Stdout.WriteString(line + "\n")
+			}
+		case write := <-consoleWrites:
+			if ui != nil {
+				ui.addLog(write.text)
+			} else {
+				os.Stdout.WriteString(write.text)
+			}
+			close(write.written)
+		case left := <-consoleLeave:
+			if ui != nil {
+				ui.leave()
+				ui, events = nil, nil
+			}
+			close(left)
+		case event, ok := <-events:
+			if ok {
+				ui.handleEvent(event)
+				ui.draw()
+			}
+		case <-sample.C:
+			if ui != nil {
+				ui.sample()
+			}
+		case <-redraw.C:
+			if ui != nil {
+				ui.draw()
+			}
+		}
+	}
+}
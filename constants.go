@@ -11,11 +11,87 @@ const (
 	Malformed    RelayCategory = "malformed"
 )
 
-// Max retries for relays before giving up
-const maxTries = 1
+// Attempts per relay before giving up unless -max-tries says otherwise
+const defaultMaxTries = 1
 
-// Increased timeout for slow relays
-const crawlTimeout = 5 * time.Second
+// Crawl timeout of the fast lane unless -crawl-timeout says otherwise
+const defaultCrawlTimeout = 5 * time.Second
 
-// Backoff duration after a failed attempt
-const backoffDuration = 2 * time.Second
+// Time the seed gets to answer its relay list request unless -seed-timeout says otherwise
+const defaultSeedTimeout = 3 * time.Second
+
+// Wait between attempts unless -backoff says otherwise
+const defaultBackoff = 2 * time.Second
+
+// Relays crawled at once unless -concurrency says otherwise
+const defaultConcurrency = 200
+
+// Crawl timeout of the slow lane, for relays that hit -crawl-timeout in the fast lane
+const slowLaneTimeout = 20 * time.Second
+
+// The slow lane gets one worker per this many of the target concurrency
+const slowLaneShare = 10
+
+// Crawl timeout of the penalty lane, for relays under domains that mostly produce dead relays
+const penaltyLaneTimeout = 2 * time.Second
+
+// How long a relay whose addresses were all at -max-per-ip waits before it is queued again
+const ipBusyRetry = 500 * time.Millisecond
+
+// How long an offline relay isn't redialed when it is mentioned again, see -dead-relay-ttl
+const defaultDeadRelayTTL = time.Hour
+
+// Exports are written through a buffer of this size and checked for write errors
+// every exportChunkRows rows
+const (
+	exportBufferSize = 1 << 20
+	exportChunkRows  = 10000
+)
+
+// Frames waiting for a parser before the relay read loops block, and how often
+// drainParsers checks whether the queue has emptied
+const (
+	parseQueueSize = 1024
+	parseDrainPoll = 10 * time.Millisecond
+)
+
+// Events a list session counts before merging its mentions, see listSession
+const mentionFlushEvents = 50
+
+// While the memory guard is active the parse queue is held to 1/parseQueueThrottledShare
+// of its size
+const parseQueueThrottledShare = 8
+
+// How often the memory guard samples memory use, and the share of -memory-limit usage
+// has to fall below before it lets go
+const (
+	memoryGuardInterval = 5 * time.Second
+	memoryResumeShare   = 0.9
+)
+
+// How long a cached NIP-11 document is used without asking the relay, see -nip11-cache
+const nip11CacheTTL = 24 * time.Hour
+
+// Pause between crawl passes
+const passInterval = 2 * time.Second
+
+// Interval between heartbeat lines while there is nothing to crawl
+const heartbeatInterval = 30 * time.Second
+
+// Progress bar width used when the terminal width is unknown
+const defaultBarWidth = 40
+
+// Interval between plain progress lines when stdout is not a terminal
+const progressLogInterval = 30 * time.Second
+
+// Relay the crawl starts from unless -seed says otherwise
+const defaultSeedRelay = "wss://nos.lol"
+
+// Version of the relays.json layout, bumped on incompatible changes
+const relaysSchemaVersion = 1
+
+// Default location and naming of exported files
+const (
+	defaultOutputDir        = "logs"
+	defaultFilenameTemplate = "{category}_relays.{format}"
+)
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Source recorded on relays added through POST /control/seeds
+const controlSeedSource = "control"
+
+// Most seeds accepted in one request
+const controlMaxSeeds = 1000
+
+// SeedResult reports what happened to the relays of a seed request
+type SeedResult struct {
+	Added   []string `json:"added"`
+	Known   []string `json:"known"`   // Already discovered, left as they are
+	Invalid []string `json:"invalid"` // Not a clearnet relay URL
+}
+
+// registerControl serves the runtime controls, all of them POST only:
+//
+//	/control/pause        hold back new crawls, those in flight finish
+//	/control/resume
+//	/control/concurrency  ?value=N
+//	/control/seeds        {"relays": ["wss://...", ...]}
+//
+// With -control-token every request needs an "Authorization: Bearer <token>" header.
+func registerControl(mux *http.ServeMux) {
+	mux.HandleFunc("POST /control/pause", requireControlToken(func(w http.ResponseWriter, r *http.Request) {
+		setPaused(true)
+		handleStatus(w, r)
+	}))
+	mux.HandleFunc("POST /control/resume", requireControlToken(func(w http.ResponseWriter, r *http.Request) {
+		setPaused(false)
+		handleStatus(w, r)
+	}))
+	mux.HandleFunc("POST /control/concurrency", requireControlToken(handleSetConcurrency))
+	mux.HandleFunc("POST /control/seeds", requireControlToken(handleSeeds))
+}
+
+// requireControlToken rejects requests without the -control-token, if one is set
+func requireControlToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.ControlToken != "" {
+			given := []byte(r.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare(given, []byte("Bearer "+cfg.ControlToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// setPaused pauses or resumes discovery, shared by the TUI and the control API
+func setPaused(paused bool) {
+	if discoveryPaused.Swap(paused) != paused {
+		mainLog.Info("discovery paused", "paused", paused)
+	}
+}
+
+// handleSetConcurrency changes the target concurrency and answers with the new status
+func handleSetConcurrency(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.URL.Query().Get("value"))
+	if err != nil || n < 1 {
+		http.Error(w, "value must be a positive number", http.StatusBadRequest)
+		return
+	}
+	if workerSlots.Load() == 0 {
+		http.Error(w, "crawl pool not started", http.StatusServiceUnavailable)
+		return
+	}
+	applied := setConcurrency(n)
+	crawlLog.Info("concurrency changed over the control API", "requested", n, "concurrency", applied)
+	handleStatus(w, r)
+}
+
+// handleSeeds adds relays to the frontier as if a relay list had named them
+func handleSeeds(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Relays []string `json:"relays"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(request.Relays) == 0 || len(request.Relays) > controlMaxSeeds {
+		http.Error(w, fmt.Sprintf("relays must list 1 to %d URLs", controlMaxSeeds), http.StatusBadRequest)
+		return
+	}
+
+	var result SeedResult
+	locked(func() { result = addSeeds(request.Relays) })
+	crawlLog.Info("seeds added over the control API", "added", len(result.Added), "known", len(result.Known),
+		"invalid", len(result.Invalid))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(result)
+}
+
+// addSeeds queues clearnet relays not discovered yet and lists them as seeds of the run,
+// caller must hold mu
+func addSeeds(relays []string) SeedResult {
+	result := SeedResult{Added: []string{}, Known: []string{}, Invalid: []string{}}
+	for _, relay := range relays {
+		normalized := normalizeURL(relay)
+		if categorize(normalized) != ClearOnline {
+			result.Invalid = append(result.Invalid, relay)
+			continue
+		}
+		_, online := clearOnline[normalized]
+		_, offline := clearOffline[normalized]
+		if online || offline {
+			result.Known = append(result.Known, normalized)
+			continue
+		}
+
+		classifyRelay(listedRelay{url: normalized, category: ClearOnline}, controlSeedSource)
+		enqueueRelay(normalized) // Queues a relay only once, whether classifyRelay did already or not
+		seedRelays = append(seedRelays, normalized)
+		result.Added = append(result.Added, normalized)
+	}
+	return result
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// Seeds added over the control API are discovered like listed relays, with control as
+// their source, and crawled once. Relays known already and anything but clearnet relay
+// URLs are left alone.
+func TestAddSeeds(t *testing.T) {
+	resetState(t)
+	resolveToLoopback(t)
+	cfg.MaxPerIP = 0
+	saved := seedRelays
+	t.Cleanup(func() { seedRelays = saved })
+	seedRelays = nil
+
+	relay := newMockRelay(t, 5*time.Millisecond)
+	known, seeds := relay.hostURL(0), []string{relay.hostURL(1), relay.hostURL(2)}
+	startTestPool(t, 4, 4)
+	locked(func() { classifyRelay(listedRelay{url: known, category: ClearOnline}, "wss://seed.example.com") })
+	waitForCrawl(t, 10*time.Second)
+
+	var result SeedResult
+	locked(func() {
+		result = addSeeds(append([]string{known, "ws://relay.onion", "not a relay"}, seeds...))
+	})
+	waitForCrawl(t, 10*time.Second)
+
+	if !slices.Equal(result.Added, seeds) || !slices.Equal(result.Known, []string{known}) ||
+		!slices.Equal(result.Invalid, []string{"ws://relay.onion", "not a relay"}) {
+		t.Errorf("result = %+v", result)
+	}
+	relay.checkCrawledOnce(t, append([]string{known}, seeds...))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(seedRelays, seeds) {
+		t.Errorf("run seeds = %v, want %v", seedRelays, seeds)
+	}
+	for _, seed := range seeds {
+		if by := relayRecords[seed].DiscoveredBy; by != controlSeedSource {
+			t.Errorf("%s discovered by %q, want %q", seed, by, controlSeedSource)
+		}
+		if mentions, ok := clearOnline[seed]; !ok || mentions != 0 {
+			t.Errorf("%s listed %v with %d mentions, want listed without any", seed, ok, mentions)
+		}
+	}
+	if by := relayRecords[known].DiscoveredBy; by != "wss://seed.example.com" {
+		t.Errorf("%s rediscovered by %q", known, by)
+	}
+	if _, credited := relayRecords[controlSeedSource]; credited {
+		t.Error("the control API was credited as a relay")
+	}
+	if accounting := crawlAccounting(); accounting.Discovered != 3 || accounting.Succeeded != 3 {
+		t.Errorf("accounting = %+v, want 3 relays discovered and succeeded", accounting)
+	}
+}
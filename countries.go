@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/csv"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+
+	"crawlr2/atomicfile"
+	"crawlr2/geoip"
+)
+
+// Countries listed in the summary
+const summaryTopCountries = 10
+
+// Loaded from -geoip at startup, nil without it
+var geoDB *geoip.DB
+
+// Note written to countries.json on how declarations are counted
+const countriesNote = "declared counts a relay listing n countries as 1/n in each of them, " +
+	"\"*\" is a relay declaring itself global; mismatched counts relays GeoIP places in a " +
+	"country their relay_countries don't list, under the GeoIP country"
+
+// CountryStats is one country of the country report
+type CountryStats struct {
+	Country    string  `json:"country"`
+	GeoIP      int     `json:"geoip"`      // Online relays whose IP is located here
+	Declared   float64 `json:"declared"`   // Online relays listing it in relay_countries, weighted
+	Mismatched int     `json:"mismatched"` // Located here but declaring other countries only
+}
+
+// CountryReport joins where online relays are located according to GeoIP with where
+// their NIP-11 documents say they are. A relay missing either side only counts on the
+// side it has.
+type CountryReport struct {
+	Note            string         `json:"note"`
+	Relays          int            `json:"online_relays"`
+	WithGeoIP       int            `json:"with_geoip"`
+	WithDeclaration int            `json:"with_declaration"`
+	WithBoth        int            `json:"with_both"`
+	Mismatched      int            `json:"mismatched"`
+	Countries       []CountryStats `json:"countries"` // Most relays by GeoIP first
+}
+
+// watchPeer makes dialer remember the address it last connected to, after any Control
+// hook it already has accepted it. Racing IPv4 and IPv6 dials may both get this far,
+// either address serves for locating the relay.
+func watchPeer(dialer *net.Dialer) *atomic.Pointer[string] {
+	peer := new(atomic.Pointer[string])
+	next := dialer.Control
+	dialer.Control = func(network, address string, conn syscall.RawConn) error {
+		if next != nil {
+			if err := next(network, address, conn); err != nil {
+				return err
+			}
+		}
+		if ip, _, err := net.SplitHostPort(address); err == nil {
+			peer.Store(&ip)
+		}
+		return nil
+	}
+	return peer
+}
+
+// recordPeer stores the IP a relay was reached at and, with -geoip and -asn-db, its
+// country and AS
+func recordPeer(relayURL string, peer *atomic.Pointer[string]) {
+	ip := peer.Load()
+	if ip == nil {
+		return
+	}
+	var country string
+	if geoDB != nil {
+		country = geoDB.Country(*ip)
+	}
+	var network geoip.Range
+	if asnDB != nil {
+		if found := asnDB.Lookup(*ip); found != nil {
+			network = *found
+		}
+	}
+	locked(func() {
+		record := recordFor(relayURL)
+		record.IP = *ip
+		record.Country = country
+		record.ASN, record.ASOrg = network.ASN, network.Org
+	})
+}
+
+// buildCountryReport aggregates the online relays by country, nil without -geoip and
+// -nip11
+func (s relayState) buildCountryReport() *CountryReport {
+	if geoDB == nil && !cfg.NIP11 {
+		return nil
+	}
+
+	online := s.lists[ClearOnline]
+	report := &CountryReport{Note: countriesNote, Relays: len(online)}
+	stats := make(map[string]*CountryStats)
+	statsFor := func(country string) *CountryStats {
+		if stats[country] == nil {
+			stats[country] = &CountryStats{Country: country}
+		}
+		return stats[country]
+	}
+
+	for relay := range online {
+		record, ok := s.records[relay]
+		if !ok {
+			continue
+		}
+		declared := record.RelayCountries
+
+		if record.Country != "" {
+			report.WithGeoIP++
+			statsFor(record.Country).GeoIP++
+		}
+		if len(declared) > 0 {
+			report.WithDeclaration++
+			for _, country := range declared {
+				statsFor(country).Declared += 1 / float64(len(declared))
+			}
+		}
+		if record.Country != "" && len(declared) > 0 {
+			report.WithBoth++
+			if !slices.Contains(declared, record.Country) && !slices.Contains(declared, "*") {
+				report.Mismatched++
+				statsFor(record.Country).Mismatched++
+			}
+		}
+	}
+
+	for _, country := range stats {
+		report.Countries = append(report.Countries, *country)
+	}
+	sort.Slice(report.Countries, func(i, j int) bool {
+		a, b := report.Countries[i], report.Countries[j]
+		if a.GeoIP != b.GeoIP {
+			return a.GeoIP > b.GeoIP
+		}
+		if a.Declared != b.Declared {
+			return a.Declared > b.Declared
+		}
+		return a.Country < b.Country
+	})
+	return report
+}
+
+// exportCountries writes the country report to countries.csv and countries.json
+func exportCountries(state relayState) error {
+	report := state.buildCountryReport()
+	if report == nil {
+		return nil
+	}
+
+	path := runFilePath("countries.csv")
+	file, err := atomicfile.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"country", "geoip_relays", "declared_relays_weighted", "mismatched_relays"})
+	for _, country := range report.Countries {
+		writer.Write([]string{
+			country.Country,
+			strconv.Itoa(country.GeoIP),
+			strconv.FormatFloat(country.Declared, 'f', 2, 64),
+			strconv.Itoa(country.Mismatched),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Abort()
+		return err
+	}
+	if err := file.Commit(); err != nil {
+		return err
+	}
+	recordOutput(path, len(report.Countries))
+
+	return writeJSONFile(runFilePath("countries.json"), report, len(report.Countries))
+}
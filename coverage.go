@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// With -reference the run is compared with a curated relay list: every reference relay
+// is reported as found online, found offline or not discovered, and every clearnet
+// relay the crawl found outside the list is reported as unlisted. URLs on both sides
+// are canonicalized first, see canonicalURL.
+
+// Coverage status of a reference relay the crawl never listed
+const notDiscovered = "not_discovered"
+
+// referenceRelays is the -reference list by canonical URL, nil without -reference.
+// Loaded before the crawl starts.
+var referenceRelays map[string]string
+
+// canonicalURL extends normalizeURL for matching URLs from different sources: the
+// default port of the scheme is dropped, so wss://relay.example:443/ matches
+// wss://relay.example
+func canonicalURL(relay string) string {
+	normalized := normalizeURL(relay)
+	parsed, err := url.Parse(normalized)
+	if err != nil {
+		return normalized
+	}
+	if (parsed.Scheme == "wss" && parsed.Port() == "443") || (parsed.Scheme == "ws" && parsed.Port() == "80") {
+		parsed.Host = strings.TrimSuffix(parsed.Host, ":"+parsed.Port())
+	}
+	return strings.TrimRight(parsed.String(), "/")
+}
+
+// loadReference reads a -reference file: a JSON array of URLs or of objects with a
+// "url" field, like the nostr.watch lists, or else one URL per line with # comments
+func loadReference(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var urls []string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var entries []json.RawMessage
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		for _, entry := range entries {
+			var relay nostrWatchRelay
+			if json.Unmarshal(entry, &relay.URL) != nil && json.Unmarshal(entry, &relay) != nil {
+				return fmt.Errorf("failed to parse %s: unexpected entry %s", path, entry)
+			}
+			urls = append(urls, relay.URL)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				urls = append(urls, line)
+			}
+		}
+	}
+
+	referenceRelays = make(map[string]string, len(urls))
+	for _, relay := range urls {
+		if relay != "" {
+			referenceRelays[canonicalURL(relay)] = relay
+		}
+	}
+	return nil
+}
+
+// CoverageSummary is the headline of the comparison with -reference
+type CoverageSummary struct {
+	Reference     int     `json:"reference_relays"`
+	Online        int     `json:"found_online"`
+	Offline       int     `json:"found_offline"`
+	Other         int     `json:"found_other"` // Listed in a category that isn't crawled, like onion
+	NotDiscovered int     `json:"not_discovered"`
+	Unlisted      int     `json:"unlisted"` // Clearnet relays found that the reference lacks
+	OnlinePct     float64 `json:"found_online_percent"`
+	DiscoveredPct float64 `json:"discovered_percent"`
+}
+
+// ReferenceRelay is a reference relay and what the crawl made of it
+type ReferenceRelay struct {
+	URL    string `json:"url"`             // As the reference lists it
+	Status string `json:"status"`          // Category it was found in, or not_discovered
+	Found  string `json:"found,omitempty"` // URL the crawl found it under, when it differs
+}
+
+// CoverageReport is the coverage.json written with -reference
+type CoverageReport struct {
+	Reference string           `json:"reference"`
+	Summary   CoverageSummary  `json:"summary"`
+	Relays    []ReferenceRelay `json:"relays"`
+	Unlisted  []string         `json:"unlisted"`
+}
+
+// buildCoverageReport compares the crawl with the reference, nil without -reference
+func (s relayState) buildCoverageReport() *CoverageReport {
+	if referenceRelays == nil {
+		return nil
+	}
+
+	// Every listed relay by canonical URL, clearnet categories win over the rest
+	found := make(map[string]listedRelay)
+	for i := len(allCategories) - 1; i >= 0; i-- {
+		for relay := range s.lists[allCategories[i]] {
+			found[canonicalURL(relay)] = listedRelay{url: relay, category: allCategories[i]}
+		}
+	}
+
+	canonicals := make([]string, 0, len(referenceRelays))
+	for canonical := range referenceRelays {
+		canonicals = append(canonicals, canonical)
+	}
+	sort.Strings(canonicals)
+
+	report := &CoverageReport{Reference: cfg.Reference, Relays: []ReferenceRelay{}, Unlisted: []string{}}
+	for _, canonical := range canonicals {
+		entry := ReferenceRelay{URL: referenceRelays[canonical], Status: notDiscovered}
+		if relay, ok := found[canonical]; ok {
+			entry.Status = string(relay.category)
+			if relay.url != entry.URL {
+				entry.Found = relay.url
+			}
+		}
+		switch RelayCategory(entry.Status) {
+		case ClearOnline:
+			report.Summary.Online++
+		case ClearOffline:
+			report.Summary.Offline++
+		case notDiscovered:
+			report.Summary.NotDiscovered++
+		default:
+			report.Summary.Other++
+		}
+		report.Relays = append(report.Relays, entry)
+	}
+
+	for _, relayList := range []map[string]int{s.lists[ClearOnline], s.lists[ClearOffline]} {
+		for relay := range relayList {
+			if _, listed := referenceRelays[canonicalURL(relay)]; !listed {
+				report.Unlisted = append(report.Unlisted, relay)
+			}
+		}
+	}
+	sort.Strings(report.Unlisted)
+
+	summary := &report.Summary
+	summary.Reference = len(report.Relays)
+	summary.Unlisted = len(report.Unlisted)
+	if summary.Reference > 0 {
+		summary.OnlinePct = float64(summary.Online) * 100 / float64(summary.Reference)
+		summary.DiscoveredPct = float64(summary.Reference-summary.NotDiscovered) * 100 / float64(summary.Reference)
+	}
+	return report
+}
+
+// exportCoverage writes the comparison with -reference to coverage.json
+func exportCoverage(state relayState) error {
+	report := state.buildCoverageReport()
+	if report == nil {
+		return nil
+	}
+	return writeJSONFile(runFilePath("coverage.json"), report, len(report.Relays))
+}
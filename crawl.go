@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"sync"
+	"net"
+	"slices"
+	"strings"
 	"time"
 
 	"golang.org/x/net/websocket"
@@ -13,41 +15,112 @@ import (
 
 // ReqKind10002 initiates a request to a relay URL with kind 10002 and processes responses.
 func ReqKind10002(relayURL string) error {
-	// Create context with a timeout for the entire operation.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	defer claimRelay(relayURL)()
 
 	// Establish a WebSocket connection.
-	ws, err := establishWebSocketConnection(relayURL)
+	ws, err := establishWebSocketConnection(relayURL, cfg.CrawlTimeout, nil)
 	if err != nil {
 		return err
 	}
-	defer ws.Close()
+	defer closeConnection(ws)
+
+	// Give the seed -seed-timeout to answer, counted from the connection so a slow dial
+	// doesn't eat into it
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.SeedTimeout)
+	defer cancel()
+
+	// Bound the reads by the same deadline, the claim is held until they end
+	deadline, _ := ctx.Deadline()
+	ws.SetReadDeadline(deadline)
 
 	// Send the "REQ" message.
 	if err := sendREQMessage(ws); err != nil {
 		return fmt.Errorf("failed to send REQ message: %v", err)
 	}
 
-	// Continuously receive and process messages until "EOSE" or connection closed.
-	return receiveMessages(ctx, ws)
+	// Receive and process messages until "EOSE" or connection closed, then
+	// merge the session's mentions once the parsers are through with its frames
+	session := openListSession(relayURL)
+	defer func() {
+		drainParsers()
+		session.close()
+	}()
+	return receiveMessages(ctx, ws, session)
 }
 
-// establishWebSocketConnection sets up and establishes the WebSocket connection.
-func establishWebSocketConnection(relayURL string) (*websocket.Conn, error) {
-	config, err := websocket.NewConfig(relayURL, "http://localhost/")
+// establishWebSocketConnection sets up and establishes the WebSocket connection, giving
+// the TCP/TLS dial up to timeout. The dial phases are recorded below crawlSpan when the
+// crawl is sampled.
+func establishWebSocketConnection(relayURL string, timeout time.Duration, crawlSpan *span) (*websocket.Conn, error) {
+	return dialRelay(relayURL, relayURL, timeout, crawlSpan)
+}
+
+// dialRelay connects to a relay at dialURL, which differs from relayURL only for the
+// plaintext probe, see plaintextURL. Failures in the TLS layer are returned as tlsError.
+func dialRelay(relayURL, dialURL string, timeout time.Duration, crawlSpan *span) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig(dialURL, "http://localhost/")
 	if err != nil {
 		return nil, fmt.Errorf("config error: %v", err)
 	}
-
-	ws, err := websocket.DialConfig(config)
+	config.Dialer = &net.Dialer{Timeout: timeout}
+	lease := limitDialer(config.Dialer)
+	peer := watchPeer(config.Dialer)
+	cert := watchCertificate(config)
+
+	var ws *websocket.Conn
+	if tracer := tracerFor(relayURL); tracer != nil {
+		ws, err = dialTraced(config, tracer)
+	} else if crawlSpan != nil {
+		ws, err = dialWithSpans(config, crawlSpan)
+	} else {
+		ws, err = websocket.DialConfig(config)
+	}
 	if err != nil {
+		if lease != nil {
+			lease.release() // The handshake may fail after the TCP dial took a slot
+			if lease.busy {
+				return nil, errIPBusy // Left for later rather than counted as a failure
+			}
+		}
+		metricDialErrors.Inc(classifyFailure(err))
+		if isTLSFailure(err) {
+			return nil, tlsError{fmt.Errorf("dial error: %v", err)}
+		}
 		return nil, fmt.Errorf("dial error: %v", err)
 	}
 
+	holdLease(ws, lease)
+	recordPeer(relayURL, peer)
+	recordCertificate(relayURL, cert)
+	metricActiveConnections.Inc()
 	return ws, nil
 }
 
+// closeConnection closes a connection opened by establishWebSocketConnection
+func closeConnection(ws *websocket.Conn) {
+	ws.Close()
+	releaseConnection(ws)
+	metricActiveConnections.Dec()
+}
+
+// sendFrame sends a text frame, counting and tracing it
+func sendFrame(ws *websocket.Conn, data []byte) error {
+	bytesTransferred.Add(int64(len(data)))
+	traceFrame(ws, ">", data)
+	return websocket.Message.Send(ws, string(data))
+}
+
+// receiveFrame receives the next frame, counting and tracing it
+func receiveFrame(ws *websocket.Conn) ([]byte, error) {
+	var msg []byte
+	if err := websocket.Message.Receive(ws, &msg); err != nil {
+		return nil, err
+	}
+	bytesTransferred.Add(int64(len(msg)))
+	traceFrame(ws, "<", msg)
+	return msg, nil
+}
+
 // sendREQMessage creates and sends a REQ message to the WebSocket connection.
 func sendREQMessage(ws *websocket.Conn) error {
 	subscriptionID := "crawlr"
@@ -58,228 +131,502 @@ func sendREQMessage(ws *websocket.Conn) error {
 		},
 	}
 
-	return websocket.JSON.Send(ws, req)
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return sendFrame(ws, data)
 }
 
-// receiveMessages continuously receives and processes messages from the WebSocket connection.
-func receiveMessages(ctx context.Context, ws *websocket.Conn) error {
+// receiveMessages receives messages from the WebSocket connection until EOSE and queues them for the parsers.
+func receiveMessages(ctx context.Context, ws *websocket.Conn, session *listSession) error {
 	for {
 		select {
 		case <-ctx.Done():
 			return fmt.Errorf("timeout: no response from relay")
 		default:
-			var msg []byte
-			if err := websocket.Message.Receive(ws, &msg); err != nil {
+			msg, err := receiveFrame(ws)
+			if err != nil {
 				if err == io.EOF {
 					return nil // Connection closed normally.
 				}
 				return fmt.Errorf("receive error: %v", err)
 			}
-
-			if err := handleMessage(msg); err != nil {
-				logError(fmt.Sprintf("Error handling message: %v", err))
+			if label, _ := peekLabel(msg); label == labelEOSE {
+				return nil // Every stored list was sent, don't wait for new ones
 			}
+
+			queueFrame(msg, session)
 		}
 	}
 }
 
-// handleMessage unmarshals a message and checks for "EOSE" or parses relay list data.
-func handleMessage(msg []byte) error {
-	var response []interface{}
-	if err := json.Unmarshal(msg, &response); err != nil {
+// handleMessage peeks at a message's label and decodes it when it carries a relay list.
+// Mentions are counted in session when given, or merged one event at a time.
+func handleMessage(msg []byte, relayURL string, session *listSession) error {
+	label, err := peekLabel(msg)
+	if err != nil {
 		return fmt.Errorf("unmarshal error: %v", err)
 	}
-
-	// Check if the message indicates "EOSE" (End of Stream).
-	if len(response) > 0 && response[0] == "EOSE" {
-		return nil // EOSE received, successfully end.
+	if label != labelEvent {
+		return nil // EOSE or a notice, nothing to parse
 	}
 
-	// Otherwise, parse relay list.
-	return parseRelayList(msg)
-}
-
-// logError logs error messages (could be sent to a logging channel or external system).
-func logError(message string) {
-	// In this example, we'll just print to the console.
-	// You can replace this with sending to a logging channel or external system.
-	fmt.Println(message)
+	message, err := decodeEventMessage(msg)
+	if err != nil {
+		return fmt.Errorf("invalid event data format: %v", err)
+	}
+	if message == nil {
+		return nil // Insufficient data
+	}
+	return parseRelayList(msg, &message.Event, relayURL, session)
 }
 
-// parseRelayList parses relay URLs from kind 10002 messages
-func parseRelayList(message []byte) error {
-	var response []interface{}
-	if err := json.Unmarshal(message, &response); err != nil {
-		return fmt.Errorf("failed to parse message: %v", err)
+// parseRelayList parses relay URLs from an event received from sourceRelay, message is
+// the raw EVENT frame it came in for the archive
+func parseRelayList(message []byte, event *Event, sourceRelay string, session *listSession) error {
+	eventsProcessed.Add(1)
+	archive.Append(sourceRelay, message)
+
+	// Collect all valid relay URLs, normalized and categorized before taking the lock
+	relays := make([]listedRelay, 0, len(event.Tags))
+	for _, tag := range event.Tags {
+		// The second element must be the relay URL
+		if len(tag) >= 2 && tag[0] == "r" {
+			normalizedURL := normalizeURL(tag[1])
+			relays = append(relays, listedRelay{url: normalizedURL, category: categorize(normalizedURL)})
+		}
 	}
 
-	// Expect the message to have at least 3 elements and be an "EVENT"
-	if len(response) < 3 || response[0] != "EVENT" {
-		return nil // Not an event message or insufficient data
+	if session != nil {
+		session.add(relays, event.Pubkey)
+		return nil
 	}
 
-	// Extract event data, must be a map
-	eventData, ok := response[2].(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("invalid event data format")
+	// Lock the global mutex only when modifying shared state, every worker parses
+	// events concurrently so nothing that can be computed up front belongs in here
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Track the distinct authors each relay served lists for
+	if event.Pubkey != "" {
+		recordFor(sourceRelay).addPubkey(event.Pubkey)
 	}
 
-	// Extract "tags" from event data
-	tags, ok := eventData["tags"].([]interface{})
-	if !ok {
-		return fmt.Errorf("invalid tags format")
+	for _, relay := range relays {
+		classifyRelay(relay, sourceRelay) // Classify each relay URL
 	}
 
-	// Collect all valid relay URLs
-	var relayURLs []string
-	for _, tag := range tags {
-		if tagArr, ok := tag.([]interface{}); ok && len(tagArr) >= 2 && tagArr[0] == "r" {
-			// The second element must be the relay URL
-			if relayURL, ok := tagArr[1].(string); ok {
-				relayURLs = append(relayURLs, relayURL)
+	return nil
+}
+
+// listedRelay is a relay URL from a relay list, normalized and categorized
+type listedRelay struct {
+	url      string
+	category RelayCategory
+}
+
+// classifyRelay adds the relay to its category's list, caller must hold mu. A source
+// that isn't a relay, like nostrWatchSource, is recorded as the discoverer but neither
+// credited nor counted as a mention.
+func classifyRelay(relay listedRelay, sourceRelay string) {
+	normalizedURL, category := relay.url, relay.category
+	external := !strings.Contains(sourceRelay, "://")
+
+	// Junk is only counted, see junkRelays
+	if isJunk(category) {
+		if junkRelays.add(normalizedURL, category) {
+			if !external {
+				recordFor(sourceRelay).Discovered++
 			}
+			countRelay(category, normalizedURL)
+			metricDiscovered.Inc(string(category))
 		}
+		return
 	}
 
-	// Lock the global mutex only when modifying shared state
-	mu.Lock()
-	defer mu.Unlock()
+	if category == Malformed {
+		// Listed with its mentions and origin but without a record, see malformedOrigins
+		if _, known := malformed[normalizedURL]; !known {
+			malformedOrigins[normalizedURL] = origin{discoveredBy: sourceRelay, firstSeen: observedAt()}
+			if !external {
+				recordFor(sourceRelay).Discovered++
+			}
+		}
+	} else {
+		// Remember which relay first told us about this one and credit it for the find
+		record, seen := relayRecords[normalizedURL]
+		if !seen {
+			record = newRelayRecord(normalizedURL)
+			record.DiscoveredBy = sourceRelay
+			relayRecords[normalizedURL] = record
+			if !external {
+				recordFor(sourceRelay).Discovered++
+			}
+		}
+		// Every relay that lists it counts, a list session calls this once per relay it lists
+		if !external {
+			record.addReferrer(sourceRelay)
+		}
+	}
 
-	for _, relayURL := range relayURLs {
-		classifyRelay(relayURL) // Classify each relay URL
+	// A relay already found dead only has its mention counted, see recheckRelay
+	if _, offline := clearOffline[normalizedURL]; offline && category == ClearOnline {
+		if !external {
+			clearOffline[normalizedURL]++
+			recheckRelay(normalizedURL, 1)
+		}
+		return
 	}
 
-	return nil
+	relays := categoryMap(category)
+	if _, known := relays[normalizedURL]; !known {
+		relays[normalizedURL] = 0 // Its mention, if any, is counted below
+		countRelay(category, normalizedURL)
+		metricDiscovered.Inc(string(category))
+		rememberDiscovery(normalizedURL, category)
+		notifyWebhooks(WebhookEvent{Type: WebhookDiscovered, Relay: normalizedURL, Category: category})
+		crawlLog.Debug("discovered relay", "relay", normalizedURL, "category", category,
+			"source", sourceRelay, outcomeKey, outcomeDiscovery)
+		if category == ClearOnline {
+			enqueueRelay(normalizedURL) // Only clear online relays are ever crawled
+		}
+	}
+	if !external {
+		relays[normalizedURL]++
+	}
 }
 
-// classifyRelay categorizes the relay URL into the appropriate list
-func classifyRelay(relayURL string) {
-	normalizedURL := normalizeURL(relayURL)
+// countMentions adds further mentions of a relay classifyRelay has already taken in,
+// caller must hold mu
+func countMentions(relay listedRelay, mentions int) {
+	if isJunk(relay.category) {
+		return // Only counted once, see junkRelays
+	}
+	if _, offline := clearOffline[relay.url]; offline && relay.category == ClearOnline {
+		clearOffline[relay.url] += mentions
+		recheckRelay(relay.url, mentions)
+		return
+	}
+	categoryMap(relay.category)[relay.url] += mentions
+}
 
+// categorize decides which list a normalized relay URL belongs to
+func categorize(normalizedURL string) RelayCategory {
 	if isMalformedRelay(normalizedURL) {
-		malformed[normalizedURL]++
+		return Malformed
 	} else if isLocalRelay(normalizedURL) {
-		local[normalizedURL]++
+		return Local
 	} else if isOnionRelay(normalizedURL) {
-		onion[normalizedURL]++
+		return Onion
 	} else if isAPIRelay(normalizedURL) {
-		clearAPI[normalizedURL]++
-	} else {
-		clearOnline[normalizedURL]++
+		return ClearAPI
 	}
+	return ClearOnline
 }
 
-// crawlClearOnlineRelays crawls the relays from the clearOnline list concurrently
-func crawlClearOnlineRelays(concurrency int) {
-	sem := make(chan struct{}, concurrency)
-	var wg sync.WaitGroup
+// crawlRelay crawls one relay from a lane with retries and records the outcome. A relay
+// that hits the fast lane's deadline is moved to the slow lane instead.
+func crawlRelay(relayURL string, lane *crawlLane) {
+	defer recoverRelay(relayURL)
+	if crawlHook != nil {
+		crawlHook(relayURL)
+	}
 
-	mu.Lock()
-	relays := make([]string, 0, len(clearOnline))
-	for relay := range clearOnline {
-		if !crawledRelays[relay] {
-			relays = append(relays, relay)
+	var skipped bool
+	var record RelayRecord
+	locked(func() { record, skipped = skipForStreak(relayURL) })
+	if skipped {
+		crawlLog.Debug("skipping relay offline in recent runs", "relay", relayURL, "max_offline_streak", cfg.MaxOfflineStreak)
+		saveToStore(record)
+		return
+	}
+
+	var err error
+	var timing crawlTiming
+	for i := 0; i < cfg.MaxTries; i++ {
+		if i > 0 {
+			time.Sleep(cfg.Backoff) // Apply backoff between retries
+		}
+
+		started := time.Now()
+		timing, err = attemptCrawl(relayURL, lane.timeout, false)
+		elapsed := time.Since(started)
+
+		if err == errIPBusy {
+			crawlLog.Debug("relay addresses at their connection limit, requeueing", "relay", relayURL)
+			lane.requeueLater(relayURL)
+			return
+		}
+
+		locked(func() { recordAttempt(relayURL, started, err) })
+		observeAttempt(err)
+
+		if err == nil {
+			break
+		}
+		outcome := outcomeRetry
+		if i+1 == cfg.MaxTries {
+			outcome = outcomeFailure
 		}
+		crawlLog.Warn("crawl attempt failed", "relay", relayURL, "attempt", i+1, "max_attempts", cfg.MaxTries,
+			"error", err, "error_class", classifyFailure(err), "duration", elapsed, outcomeKey, outcome)
 	}
-	mu.Unlock()
 
-	for _, relay := range relays {
-		wg.Add(1)
-		sem <- struct{}{} // Block when reaching concurrency limit
+	plaintext := false
+	if err != nil && cfg.PlaintextProbe {
+		if probeTiming, ok := probePlaintext(relayURL, lane.timeout, err); ok {
+			timing, err, plaintext = probeTiming, nil, true
+		}
+	}
 
-		go func(r string) {
-			defer wg.Done()
-			defer func() { <-sem }() // Release semaphore after task
+	if lane == fastLane && (timing.timedOut || err != nil && classifyFailure(err) == "timeout") {
+		crawlLog.Debug("moving relay to the slow lane", "relay", relayURL, "timeout", lane.timeout)
+		locked(func() {
+			recordFor(relayURL).Lane = slowLane.name
+			slowLane.push(relayURL)
+		})
+		return
+	}
 
-			for i := 0; i < maxTries; i++ {
-				err := attemptCrawl(r)
-				if err != nil {
-					logChannel <- fmt.Sprintf("Failed to crawl relay %s: %v", r, err)
+	locked(func() {
+		recordFor(relayURL).Lane = lane.name
+		recordDomainOutcome(relayURL, err != nil)
+		if err != nil {
+			record = markOffline(relayURL, err) // Mark as offline after the last failed attempt
+		} else {
+			metricCrawled.Inc("online")
+			recordTiming(relayURL, timing)
+			observeLatency(ClearOnline, timing)
+			if _, offline := clearOffline[relayURL]; offline {
+				markRecovered(relayURL) // Came back since it was marked offline
+			} else {
+				countSuccess()
+			}
+			recordFor(relayURL).crawled = true // Mark it as crawled after success
+			recordFor(relayURL).PlaintextOnly = plaintext
+			now := observedAt()
+			recordFor(relayURL).LastSeen = &now
+			enrichRelay(relayURL)
+			resolveRelay(relayURL)
+			record = relayRecordFor(relayURL, ClearOnline, clearOnline[relayURL])
+		}
+	})
 
-					mu.Lock()
-					clearOffline[r] = clearOnline[r] // Mark as offline after failure
-					delete(clearOnline, r)           // Remove from online list
-					crawledRelays[r] = true          // Mark it as crawled
-					mu.Unlock()
+	if err == nil {
+		crawlLog.Debug("crawled relay", "relay", relayURL, "attempts", record.AttemptCount, outcomeKey, outcomeSuccess)
+	}
+	saveToStore(record)
+}
 
-					time.Sleep(backoffDuration) // Apply backoff between retries
+// markOffline moves a relay that couldn't be crawled to the offline list, caller must hold mu
+func markOffline(relayURL string, err error) RelayRecord {
+	metricCrawled.Inc("offline")
+	if _, offline := clearOffline[relayURL]; offline {
+		offlineReasons[relayRecords[relayURL].FailureClass]-- // Failed a recheck, counted again below
+	}
+	if _, online := clearOnline[relayURL]; online && isCrawled(relayURL) {
+		notifyWebhooks(WebhookEvent{Type: WebhookOffline, Relay: relayURL, Category: ClearOffline})
+	}
+	recordFailure(relayURL, err)
+	offlineReasons[relayRecords[relayURL].FailureClass]++
+	countOffline(relayURL)
+	if count, online := clearOnline[relayURL]; online {
+		clearOffline[relayURL] = count
+		delete(clearOnline, relayURL) // Remove from online list
+	}
+	record := recordFor(relayURL)
+	record.crawled = true // Mark it as crawled
+	record.offlineAt = time.Now()
+	return relayRecordFor(relayURL, ClearOffline, clearOffline[relayURL])
+}
 
-				} else {
-					logChannel <- fmt.Sprintf("Successfully crawled relay: %s", r)
+// markRecovered moves a relay that answered its recheck back to the online list, caller
+// must hold mu
+func markRecovered(relayURL string) {
+	record := recordFor(relayURL)
+	offlineReasons[record.FailureClass]--
+	record.FailureReason, record.FailureClass = "", ""
+	countRecovered()
+	clearOnline[relayURL] = clearOffline[relayURL]
+	delete(clearOffline, relayURL)
+}
 
-					mu.Lock()
-					crawledRelays[r] = true // Mark it as crawled after success
-					mu.Unlock()
-					break
-				}
+// claimRelay waits until no other goroutine has a connection to the relay, then lists it
+// as being crawled until the returned func is called. Claims are keyed by the normalized
+// URL and taken before dialing, so a relay never has two connections open at once: the
+// seed query and a pool crawl of the same relay take turns.
+func claimRelay(relayURL string) func() {
+	key := normalizeURL(relayURL)
+	for {
+		inFlightMu.Lock()
+		current, busy := inFlight[key]
+		if !busy {
+			flight := &crawlFlight{started: time.Now(), done: make(chan struct{})}
+			inFlight[key] = flight
+			inFlightMu.Unlock()
+
+			return func() {
+				inFlightMu.Lock()
+				delete(inFlight, key)
+				inFlightMu.Unlock()
+				close(flight.done)
 			}
-		}(relay)
+		}
+		inFlightMu.Unlock()
+		<-current.done
 	}
+}
 
-	wg.Wait() // Wait for all goroutines to finish
+// waitWhilePaused blocks while discovery is paused from the TUI or by the memory guard,
+// and for good once the run is past -max-runtime
+func waitWhilePaused() {
+	for discoveryPaused.Load() || memoryThrottled.Load() || runExpired.Load() {
+		time.Sleep(200 * time.Millisecond)
+	}
 }
 
-// attemptCrawl handles the crawl attempt and returns an error if unsuccessful
-func attemptCrawl(relayURL string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), crawlTimeout)
-	defer cancel()
+// recordFor returns the stored record for a relay, creating it if needed. Caller must hold mu.
+func recordFor(relayURL string) *RelayRecord {
+	record, ok := relayRecords[relayURL]
+	if !ok {
+		record = newRelayRecord(relayURL)
+		relayRecords[relayURL] = record
+	}
+	return record
+}
 
-	wsConfig, err := websocket.NewConfig(relayURL, "http://localhost/")
-	if err != nil {
-		return fmt.Errorf("config error: %v", err)
+// newRelayRecord creates the record of a relay seen for the first time this run
+func newRelayRecord(relayURL string) *RelayRecord {
+	now := observedAt()
+	return &RelayRecord{URL: relayURL, FirstSeen: &now}
+}
+
+// observedAt returns the time of an observation in UTC, during a replay the time the
+// frame being replayed was received
+func observedAt() time.Time {
+	if !runEnd.IsZero() {
+		return runEnd
 	}
+	return time.Now().UTC()
+}
 
-	ws, err := websocket.DialConfig(wsConfig)
+// recordAttempt adds a crawl attempt to the relay's history, caller must hold mu
+func recordAttempt(relayURL string, started time.Time, err error) {
+	attempt := CrawlAttempt{
+		StartedAt: started.UTC(),
+		Duration:  time.Since(started).Round(time.Millisecond).String(),
+	}
 	if err != nil {
-		return fmt.Errorf("dial error: %v", err)
+		attempt.Error = err.Error()
 	}
-	defer ws.Close()
 
-	// Send REQ message
-	subscriptionID := "crawlr"
-	req := []interface{}{
-		"REQ", subscriptionID, map[string]interface{}{
-			"kinds": []int{10002},
-			"limit": 100,
-		},
+	record := recordFor(relayURL)
+	record.Attempts = append(record.Attempts, attempt)
+	record.AttemptCount++
+	record.LastAttempt = &attempt.StartedAt
+
+	// Keep only the latest attempts
+	if keep := max(cfg.MaxAttemptHistory, 0); len(record.Attempts) > keep {
+		record.Attempts = slices.Delete(record.Attempts, 0, len(record.Attempts)-keep)
+		record.Truncated = true
 	}
+}
 
-	err = websocket.JSON.Send(ws, req)
+// recordFailure stores the reason a relay could not be crawled, caller must hold mu
+func recordFailure(relayURL string, err error) {
+	record := recordFor(relayURL)
+	record.FailureReason = err.Error()
+	record.FailureClass = classifyFailure(err)
+}
+
+// recordTiming stores the phase timings of a relay's successful crawl, caller must hold mu
+func recordTiming(relayURL string, timing crawlTiming) {
+	record := recordFor(relayURL)
+	record.DialMs = durationMillis(timing.dial)
+	record.FirstEventMs = durationMillis(timing.firstEvent)
+	record.EOSEMs = durationMillis(timing.eose)
+}
+
+// durationMillis converts a duration to milliseconds with microsecond precision
+func durationMillis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// attemptCrawl handles the crawl attempt and returns an error if unsuccessful. The relay
+// counts as online once it answers at all, the exchange is read up to EOSE for timing.
+// plaintext dials the relay over ws:// instead, see probePlaintext.
+func attemptCrawl(relayURL string, timeout time.Duration, plaintext bool) (timing crawlTiming, err error) {
+	defer claimRelay(relayURL)()
+
+	crawlSpan := startCrawlSpan(relayURL)
+	var received, events int
+	defer func() {
+		crawlSpan.set("bytes.received", received)
+		crawlSpan.set("events", events)
+		crawlSpan.finish(err)
+	}()
+
+	started := time.Now()
+	dialURL := relayURL
+	if plaintext {
+		dialURL = plaintextURL(relayURL)
+	}
+	ws, err := dialRelay(relayURL, dialURL, timeout, crawlSpan)
 	if err != nil {
-		return fmt.Errorf("failed to send REQ message: %v", err)
+		return timing, err
 	}
+	defer closeConnection(ws)
+	timing.dial = time.Since(started)
+
+	// Bound the whole exchange so a silent relay can't hold up its worker
+	ws.SetDeadline(started.Add(timeout))
 
-	// Wait for response or timeout
-	select {
-	case <-ctx.Done():
-		return fmt.Errorf("timeout: no response from relay")
-	default:
-		var msg []byte
-		err := websocket.Message.Receive(ws, &msg)
+	// Send REQ message
+	reqSent := time.Now()
+	exchange := crawlSpan.child("req_eose")
+	defer func() { exchange.finish(err) }()
+	if err := sendREQMessage(ws); err != nil {
+		return timing, fmt.Errorf("failed to send REQ message: %v", err)
+	}
+
+	answered, challenged := false, false
+	for {
+		msg, err := receiveFrame(ws)
 		if err != nil {
-			return fmt.Errorf("receive error: %v", err)
+			if answered {
+				timing.timedOut = classifyFailure(err) == "timeout"
+				return timing, nil // Online, but it never finished with EOSE
+			}
+			return timing, fmt.Errorf("receive error: %v", err)
 		}
+		received += len(msg)
 
 		// Parse response
-		var response []interface{}
-		if err := json.Unmarshal(msg, &response); err != nil {
-			return fmt.Errorf("failed to parse message: %v", err)
+		parse := crawlSpan.child("parse")
+		label, err := peekLabel(msg)
+		parse.finish(err)
+		if err != nil {
+			if answered {
+				continue
+			}
+			return timing, fmt.Errorf("failed to parse message: %v", err)
 		}
-
-		if len(response) > 0 && response[0] == "EOSE" {
-			return nil // Successfully reached end of stream
+		answered = true
+
+		switch label {
+		case labelEvent:
+			events++
+			eventsProcessed.Add(1)
+			if timing.firstEvent == 0 {
+				timing.firstEvent = time.Since(reqSent)
+			}
+		case labelAuth:
+			challenged = true
+		case labelEOSE:
+			timing.eose = time.Since(reqSent)
+			probeNIPs(ws, relayURL, challenged)
+			return timing, nil // Successfully reached end of stream
 		}
-
-		// Handle any other messages or continue to parse...
-	}
-
-	return nil
-}
-
-// Logger that prints messages without affecting the status bar
-func logRelayEvents() {
-	for msg := range logChannel {
-		// Move the cursor up to print above the status bar
-		fmt.Printf("\033[F%s\n", msg)
 	}
 }
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// testRelays returns n distinct clearnet relay URLs
+func testRelays(n int) []string {
+	relays := make([]string, n)
+	for i := range relays {
+		relays[i] = fmt.Sprintf("wss://relay%d.example.com", i)
+	}
+	return relays
+}
+
+// relayListEvent returns a kind 10002 event by pubkey listing relays as r tags
+func relayListEvent(pubkey string, relays []string) *Event {
+	event := &Event{Pubkey: pubkey, Kind: 10002, Tags: make([][]string, 0, len(relays))}
+	for _, relay := range relays {
+		event.Tags = append(event.Tags, []string{"r", relay})
+	}
+	return event
+}
+
+// relayListFrames returns n EVENT frames of kind 10002 events with 8 relay tags each,
+// shaped like those seed relays send
+func relayListFrames(tb testing.TB, n int) [][]byte {
+	tb.Helper()
+	relays := testRelays(n + 8)
+	frames := make([][]byte, n)
+	for i := range frames {
+		event := relayListEvent(fmt.Sprintf("%064x", i), relays[i:i+8])
+		event.ID, event.Sig, event.CreatedAt = fmt.Sprintf("%064x", i), fmt.Sprintf("%0128x", i), 1700000000
+		for j := range event.Tags {
+			if j%2 == 0 {
+				event.Tags[j] = append(event.Tags[j], "write")
+			}
+		}
+		frame, err := json.Marshal([]any{"EVENT", "crawlr", event})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		frames[i] = frame
+	}
+	return frames
+}
+
+// Many sources parsing the same relay lists at once, while the relays they list are
+// claimed and released, must come out with every mention counted. Run with -race.
+func TestParseRelayListConcurrent(t *testing.T) {
+	resetState(t)
+	const sources = 16
+	relays := testRelays(200)
+
+	var wg sync.WaitGroup
+	for i := 0; i < sources; i++ {
+		wg.Add(2)
+		source := fmt.Sprintf("wss://source%d.example.com", i)
+		go func() {
+			defer wg.Done()
+			for start := 0; start < len(relays); start += 20 {
+				event := relayListEvent(fmt.Sprintf("%064x", start), relays[start:start+20])
+				if err := parseRelayList(nil, event, source, nil); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for _, relay := range relays {
+				claimRelay(relay)()
+			}
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(clearOnline) != len(relays) {
+		t.Fatalf("%d relays classified, want %d", len(clearOnline), len(relays))
+	}
+	credited := 0
+	for i := 0; i < sources; i++ {
+		credited += relayRecords[fmt.Sprintf("wss://source%d.example.com", i)].Discovered
+	}
+	if credited != len(relays) {
+		t.Errorf("sources credited with %d discoveries, want %d", credited, len(relays))
+	}
+	for _, relay := range relays {
+		if mentions := clearOnline[relay]; mentions != sources {
+			t.Errorf("%s has %d mentions, want %d", relay, mentions, sources)
+		}
+	}
+	inFlightMu.Lock()
+	defer inFlightMu.Unlock()
+	if len(inFlight) != 0 {
+		t.Errorf("%d claims left after every one was released", len(inFlight))
+	}
+}
+
+// A seed query holds its relay's claim only until EOSE, though the relay keeps the
+// connection open, so a pool crawl of the same relay started meanwhile waits its turn
+// rather than opening a second connection. Run with -race.
+func TestSeedQueryClaim(t *testing.T) {
+	resetState(t)
+	resolveToLoopback(t)
+	cfg.MaxPerIP = 0
+	relay := newMockRelay(t, 200*time.Millisecond)
+	seed, listed := relay.url(0), relay.hostURL(1)
+	frame, err := json.Marshal([]any{"EVENT", "crawlr", relayListEvent(fmt.Sprintf("%064x", 1), []string{listed})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.events = []string{string(frame)}
+	connections := func(relayURL string) int {
+		u, err := url.Parse(relayURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+		return relay.connections[relayKey(u)]
+	}
+	startTestPool(t, 4, 4)
+
+	done := make(chan error, 1)
+	go func() { done <- ReqKind10002(seed) }()
+	for connections(seed) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The seed is discovered while its query waits for the relay to answer
+	locked(func() { classifyRelay(listedRelay{url: seed, category: ClearOnline}, "wss://other.example.com") })
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("seed query still reading after EOSE")
+	}
+	waitForCrawl(t, 10*time.Second)
+
+	if count := connections(seed); count != 2 {
+		t.Errorf("seed was fetched %d times, want once by the query and once by the pool", count)
+	}
+	if count := connections(listed); count != 1 {
+		t.Errorf("listed relay was fetched %d times, want once", count)
+	}
+	if len(relay.overlapped) > 0 {
+		t.Errorf("relays served two connections at once: %v", relay.overlapped)
+	}
+}
+
+// The seed gets -seed-timeout to answer from when it is connected, however long the
+// dial took, and no longer
+func TestSeedTimeout(t *testing.T) {
+	resetState(t)
+	startTestPool(t, 4, 4)
+	cfg.CrawlTimeout = 5 * time.Second
+	cfg.SeedTimeout = 300 * time.Millisecond
+
+	for _, test := range []struct {
+		name        string
+		dial, reply time.Duration
+		timeout     bool
+	}{
+		{"slow dial", 500 * time.Millisecond, 0, false},
+		{"slow reply", 0, time.Second, true},
+	} {
+		relay := newMockRelay(t, test.reply)
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(test.dial)
+			websocket.Handler(relay.serve).ServeHTTP(w, r)
+		}))
+		t.Cleanup(slow.Close)
+
+		err := ReqKind10002("ws" + strings.TrimPrefix(slow.URL, "http") + "/seed")
+		if timedOut := err != nil && strings.Contains(err.Error(), "timeout"); timedOut != test.timeout {
+			t.Errorf("%s: err = %v, want a timeout %v", test.name, err, test.timeout)
+		}
+	}
+}
+
+// BenchmarkParseRelayList parses relay lists from many goroutines at once, as the
+// parsers do, so only the merge into the shared maps contends for mu
+func BenchmarkParseRelayList(b *testing.B) {
+	resetState(b)
+	relays := testRelays(1000)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			start := i % (len(relays) - 20)
+			event := relayListEvent("", relays[start:start+20])
+			parseRelayList(nil, event, "wss://seed.example.com", nil)
+			i++
+		}
+	})
+}
+
+// BenchmarkClaimRelay claims and releases relays from many goroutines at once, which
+// takes only inFlightMu
+func BenchmarkClaimRelay(b *testing.B) {
+	resetState(b)
+	relays := testRelays(1000)
+	var next sync.Mutex
+	worker := 0
+	b.RunParallel(func(pb *testing.PB) {
+		next.Lock()
+		offset := worker * 100
+		worker++
+		next.Unlock()
+
+		i := offset
+		for pb.Next() {
+			claimRelay(relays[i%len(relays)])()
+			i++
+		}
+	})
+}
+
+// BenchmarkHandleRelayListFrames processes a batch of 100 kind 10002 frames the way a
+// seed query does, merged one event at a time and through a list session
+func BenchmarkHandleRelayListFrames(b *testing.B) {
+	frames := relayListFrames(b, 100)
+	for _, bench := range []struct {
+		name    string
+		session bool
+	}{{"merged", false}, {"session", true}} {
+		b.Run(bench.name, func(b *testing.B) {
+			resetState(b)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var session *listSession
+				if bench.session {
+					session = openListSession("wss://seed.example.com")
+				}
+				for _, frame := range frames {
+					if err := handleMessage(frame, "wss://seed.example.com", session); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if session != nil {
+					session.close()
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRelayListLocks counts how often mu is taken for a batch of 100 kind 10002
+// frames with 8 r tags each naming 80 relays between them, merged one event at a time
+// and through a list session
+func BenchmarkRelayListLocks(b *testing.B) {
+	relays := testRelays(80)
+	frames := make([][]byte, 100)
+	for i := range frames {
+		start := i * 8 % len(relays)
+		frame, err := json.Marshal([]any{"EVENT", "crawlr", relayListEvent(fmt.Sprintf("%064x", i), relays[start:start+8])})
+		if err != nil {
+			b.Fatal(err)
+		}
+		frames[i] = frame
+	}
+	for _, bench := range []struct {
+		name    string
+		session bool
+	}{{"merged", false}, {"session", true}} {
+		b.Run(bench.name, func(b *testing.B) {
+			resetState(b)
+			before := mu.acquired.Load()
+			for i := 0; i < b.N; i++ {
+				var session *listSession
+				if bench.session {
+					session = openListSession("wss://seed.example.com")
+				}
+				for _, frame := range frames {
+					if err := handleMessage(frame, "wss://seed.example.com", session); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if session != nil {
+					session.close()
+				}
+			}
+			b.ReportMetric(float64(mu.acquired.Load()-before)/float64(b.N), "locks/batch")
+		})
+	}
+}
+
+// BenchmarkPeekLabel reads the label of the frames the crawl loop sees most
+func BenchmarkPeekLabel(b *testing.B) {
+	frames := append(relayListFrames(b, 1), []byte(`["EOSE","crawlr"]`), []byte(`["NOTICE","rate limited"]`))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := peekLabel(frames[i%len(frames)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// Dashboard tuning
+const (
+	dashboardInterval     = time.Second
+	dashboardRecentRelays = 20
+)
+
+// Discovery is a relay seen for the first time during this run
+type Discovery struct {
+	URL      string        `json:"url"`
+	Category RelayCategory `json:"category"`
+	At       time.Time     `json:"at"`
+}
+
+// dashboardUpdate is one message of the dashboard event stream
+type dashboardUpdate struct {
+	CrawlStatus
+	RecentDiscoveries []Discovery    `json:"recent_discoveries"`
+	OfflineReasons    map[string]int `json:"offline_reasons"`
+}
+
+// rememberDiscovery adds a relay to the ring of recent discoveries, caller must hold mu
+func rememberDiscovery(relayURL string, category RelayCategory) {
+	discovery := Discovery{URL: relayURL, Category: category, At: time.Now().UTC()}
+	if len(recentDiscoveries) < dashboardRecentRelays {
+		recentDiscoveries = append(recentDiscoveries, discovery)
+		return
+	}
+	copy(recentDiscoveries, recentDiscoveries[1:])
+	recentDiscoveries[len(recentDiscoveries)-1] = discovery
+}
+
+// snapshotDashboard builds a dashboard update, newest discoveries first
+func snapshotDashboard() dashboardUpdate {
+	update := dashboardUpdate{CrawlStatus: snapshotStatus(), OfflineReasons: make(map[string]int)}
+
+	mu.Lock()
+	update.RecentDiscoveries = make([]Discovery, len(recentDiscoveries))
+	for i, discovery := range recentDiscoveries {
+		update.RecentDiscoveries[len(recentDiscoveries)-1-i] = discovery
+	}
+	for reason, count := range offlineReasons {
+		update.OfflineReasons[reason] = count
+	}
+	mu.Unlock()
+
+	return update
+}
+
+// registerDashboard serves the dashboard page at / and its event stream at /events.
+// Streams end when the client goes away or the server shuts down.
+func registerDashboard(mux *http.ServeMux, shutdown <-chan struct{}) {
+	static, _ := fs.Sub(dashboardFiles, "dashboard")
+	mux.Handle("/", http.FileServer(http.FS(static)))
+
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		ticker := time.NewTicker(dashboardInterval)
+		defer ticker.Stop()
+
+		for {
+			data, err := json.Marshal(snapshotDashboard())
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return // Client went away
+			}
+			flusher.Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-shutdown:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// With -dns every online relay's host is resolved once more after the crawl, in the
+// background, to record the raw DNS picture: the canonical name a CNAME chain leads to,
+// every A and AAAA record and the reverse name of the first address, which clustering
+// reads, see rdnsPattern. Relays sharing a host share one lookup. A failed lookup
+// is kept on the record and never changes whether the relay counts as online.
+
+// DNSRecords is what -dns found for a relay's host
+type DNSRecords struct {
+	CNAME string   `json:"cname,omitempty"` // Canonical name, when the host is an alias
+	A     []string `json:"a,omitempty"`
+	AAAA  []string `json:"aaaa,omitempty"`
+	PTR   string   `json:"ptr,omitempty"` // Reverse name of the first address
+	Error string   `json:"error,omitempty"`
+}
+
+// Lookups run at once with -dns
+const dnsConcurrency = 16
+
+var (
+	dnsCache   = make(map[string]*DNSRecords) // By host, guarded by mu
+	dnsWaiting = make(map[string][]string)    // Relays waiting for a host being looked up, guarded by mu
+	dnsSlots   = make(chan struct{}, dnsConcurrency)
+)
+
+// resolveRelay attaches the DNS records of an online relay's host, looking the host up
+// unless another relay already did. Caller must hold mu.
+func resolveRelay(relayURL string) {
+	host := extractHost(relayURL)
+	if !cfg.DNS || host == "" || net.ParseIP(host) != nil || recordFor(relayURL).DNS != nil {
+		return
+	}
+	if records, ok := dnsCache[host]; ok {
+		recordFor(relayURL).DNS = records
+		return
+	}
+	waiting, inFlight := dnsWaiting[host]
+	dnsWaiting[host] = append(waiting, relayURL)
+	if inFlight {
+		return
+	}
+
+	go func() {
+		defer recoverAndLog("dns lookup")
+		records := lookupDNS(host)
+		locked(func() {
+			dnsCache[host] = records
+			for _, relay := range dnsWaiting[host] {
+				recordFor(relay).DNS = records
+			}
+			delete(dnsWaiting, host)
+		})
+	}()
+}
+
+// lookupDNS resolves a host's canonical name and addresses
+func lookupDNS(host string) *DNSRecords {
+	dnsSlots <- struct{}{}
+	defer func() { <-dnsSlots }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.CrawlTimeout)
+	defer cancel()
+
+	records := new(DNSRecords)
+	// Without a CNAME the resolver returns the host itself
+	if cname, err := net.DefaultResolver.LookupCNAME(ctx, host); err == nil {
+		if cname = strings.TrimSuffix(cname, "."); !strings.EqualFold(cname, host) {
+			records.CNAME = cname
+		}
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		records.Error = err.Error()
+		return records
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			records.A = append(records.A, addr.IP.String())
+		} else {
+			records.AAAA = append(records.AAAA, addr.IP.String())
+		}
+	}
+	slices.Sort(records.A)
+	slices.Sort(records.AAAA)
+	if addresses := slices.Concat(records.A, records.AAAA); len(addresses) > 0 {
+		if names, err := net.DefaultResolver.LookupAddr(ctx, addresses[0]); err == nil && len(names) > 0 {
+			records.PTR = strings.TrimSuffix(names[0], ".")
+		}
+	}
+	return records
+}
+
+// dnsColumns formats the first address and whether the host is an alias for csvRow,
+// none without -dns
+func dnsColumns(record RelayRecord) []string {
+	if !cfg.DNS {
+		return nil
+	}
+	address, hasCNAME := "", false
+	if records := record.DNS; records != nil {
+		if len(records.A) > 0 {
+			address = records.A[0]
+		} else if len(records.AAAA) > 0 {
+			address = records.AAAA[0]
+		}
+		hasCNAME = records.CNAME != ""
+	}
+	return []string{address, strconv.FormatBool(hasCNAME)}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sort"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// DomainStats counts the crawl outcomes of the relays under one registrable domain.
+// Domains whose relays are mostly dead, such as expired vanity relay services handing
+// out a subdomain per user, are penalized: their further relays go to the penalty
+// lane, which has few workers and a short timeout, so they stop holding up the crawl.
+type DomainStats struct {
+	Domain    string `json:"domain"`
+	Crawled   int    `json:"crawled"`
+	Dead      int    `json:"dead"`
+	Penalized int    `json:"penalized_relays"` // Relays sent to the penalty lane
+}
+
+// registrableDomain returns the domain a relay's host was registered under, e.g.
+// example.co.uk for wss://a.b.example.co.uk, or the host itself when there is none
+func registrableDomain(relayURL string) string {
+	host := extractHost(relayURL)
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+// recordDomainOutcome counts a finished crawl towards its domain, caller must hold mu
+func recordDomainOutcome(relayURL string, dead bool) {
+	domain := registrableDomain(relayURL)
+	stats, ok := domainStats[domain]
+	if !ok {
+		stats = &DomainStats{Domain: domain}
+		domainStats[domain] = stats
+	}
+	stats.Crawled++
+	if dead {
+		stats.Dead++
+	}
+}
+
+// penalized reports whether the domain's dead ratio is past -dead-domain-ratio over
+// at least -dead-domain-min crawled relays
+func (d *DomainStats) penalized() bool {
+	return !cfg.NoDomainPenalty && d.Crawled >= cfg.DeadDomainMin &&
+		float64(d.Dead) >= cfg.DeadDomainRatio*float64(d.Crawled)
+}
+
+// laneFor picks the lane a newly queued relay is crawled in, caller must hold mu
+func laneFor(relayURL string) *crawlLane {
+	stats, ok := domainStats[registrableDomain(relayURL)]
+	if !ok || !stats.penalized() {
+		return fastLane
+	}
+	stats.Penalized++
+	return penaltyLane
+}
+
+// penalizedDomains lists the domains that had relays sent to the penalty lane, most
+// penalized first. Caller must hold mu.
+func penalizedDomains() []DomainStats {
+	var domains []DomainStats
+	for _, stats := range domainStats {
+		if stats.Penalized > 0 {
+			domains = append(domains, *stats)
+		}
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		if domains[i].Penalized != domains[j].Penalized {
+			return domains[i].Penalized > domains[j].Penalized
+		}
+		return domains[i].Domain < domains[j].Domain
+	})
+	return domains
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+
+	"crawlr2/nip11"
+)
+
+// The enrichment stage fetches the NIP-11 document of every relay that comes online and
+// attaches what it advertises to the relay's record. It runs on its own pool with its
+// own limit, fed from a queue the crawl adds to as relays come online, so slow HTTP
+// servers never hold up a crawl worker and a fast crawl never floods them.
+
+var (
+	enrichPool  *nip11.Pool  // Nil unless -nip11
+	enrichCache *nip11.Cache // Nil without -nip11-cache
+	enrichQueue []string     // Online relays waiting for the pool, guarded by mu
+
+	enrichFailures = make(map[string]int) // Failed fetches by nip11.Outcome, guarded by mu
+	enrichReady    = make(chan struct{}, 1)
+)
+
+// startEnrichment starts the NIP-11 pool and the feeder that hands it queued relays
+func startEnrichment() {
+	fetcher := &nip11.Fetcher{Client: &http.Client{Timeout: cfg.NIP11Timeout}}
+	if cfg.NIP11Cache != "" {
+		cache, err := nip11.LoadCache(cfg.NIP11Cache, nip11CacheTTL)
+		if err != nil {
+			crawlLog.Warn("starting with an empty NIP-11 cache", "error", err)
+		}
+		fetcher.Cache = cache
+		enrichCache = cache
+	}
+
+	enrichPool = nip11.NewPool(cfg.NIP11Concurrency, fetcher, attachDocument)
+	go func() {
+		defer recoverFatal("nip11 feeder")
+		feedEnrichment()
+	}()
+}
+
+// enrichRelay queues an online relay for its NIP-11 document, caller must hold mu
+func enrichRelay(relayURL string) {
+	if enrichPool == nil {
+		return
+	}
+	enrichQueue = append(enrichQueue, relayURL)
+	select {
+	case enrichReady <- struct{}{}:
+	default:
+	}
+}
+
+// feedEnrichment hands queued relays to the pool in the order they came online,
+// waiting whenever the pool's own queue is full
+func feedEnrichment() {
+	for {
+		mu.Lock()
+		if len(enrichQueue) == 0 {
+			mu.Unlock()
+			<-enrichReady
+			continue
+		}
+		relay := enrichQueue[0]
+		enrichQueue = enrichQueue[1:]
+		if len(enrichQueue) == 0 {
+			enrichQueue = nil // Let the drained backing array be collected
+		}
+		mu.Unlock()
+
+		enrichPool.Submit(relay)
+	}
+}
+
+// attachDocument stores what a relay's NIP-11 document advertises on its record
+func attachDocument(relayURL string, doc *nip11.Document, err error) {
+	if err != nil {
+		outcome := nip11.Outcome(err)
+		crawlLog.Debug("failed to fetch NIP-11 document", "relay", relayURL, "outcome", outcome, "error", err)
+		locked(func() { enrichFailures[outcome]++ })
+		return
+	}
+	locked(func() {
+		record := recordFor(relayURL)
+		record.documented = true
+		record.Software = doc.Software
+		record.Version = doc.Version
+		record.SupportedNIPs = doc.SupportedNIPs
+		record.Limitation = doc.Limitation
+		record.NIP11URL = doc.URL
+		record.Paid = doc.Paid()
+		record.PaymentsURL = doc.PaymentsURL
+		record.RelayCountries = doc.RelayCountries
+	})
+}
+
+// NIP11Summary reports the enrichment stage's throughput and backlog, the software the
+// online relays run and how many of them restrict access. With -nip11-exclude-paid,
+// paid relays are only counted under Paid.
+type NIP11Summary struct {
+	nip11.PoolStats
+	Pending  int            `json:"pending"` // Online relays still waiting for the pool
+	Software map[string]int `json:"software"`
+	Failures map[string]int `json:"failures,omitempty"` // By nip11.Outcome
+
+	Open             int `json:"open"` // Neither paid, auth-required nor write-restricted
+	AuthRequired     int `json:"auth_required"`
+	Paid             int `json:"paid"`
+	RestrictedWrites int `json:"restricted_writes"`
+
+	// How fetches were served with -nip11-cache: from the cache while fresh, from the
+	// cache after a 304 Not Modified, or downloaded in full
+	CacheHits        int `json:"cache_hits,omitempty"`
+	CacheRevalidated int `json:"cache_revalidated,omitempty"`
+	CacheMisses      int `json:"cache_misses,omitempty"`
+}
+
+// summarizeEnrichment reports the enrichment stage, nil when it is off. Caller must hold mu.
+func summarizeEnrichment() *NIP11Summary {
+	if enrichPool == nil {
+		return nil
+	}
+	summary := &NIP11Summary{
+		PoolStats: enrichPool.Stats(),
+		Pending:   len(enrichQueue),
+		Software:  make(map[string]int),
+		Failures:  maps.Clone(enrichFailures),
+	}
+	if enrichCache != nil {
+		summary.CacheHits, summary.CacheRevalidated, summary.CacheMisses = enrichCache.Stats()
+	}
+	for relay := range clearOnline {
+		record, ok := relayRecords[relay]
+		if !ok {
+			continue
+		}
+		if record.Paid {
+			summary.Paid++
+			if cfg.NIP11ExcludePaid {
+				continue
+			}
+		}
+		if record.Software != "" {
+			summary.Software[record.Software]++
+		}
+		authRequired := record.Limitation != nil && record.Limitation.AuthRequired
+		restrictedWrites := record.Limitation != nil && record.Limitation.RestrictedWrites
+		if authRequired {
+			summary.AuthRequired++
+		}
+		if restrictedWrites {
+			summary.RestrictedWrites++
+		}
+		if record.documented && !record.Paid && !authRequired && !restrictedWrites {
+			summary.Open++
+		}
+	}
+	return summary
+}
+
+// saveEnrichmentCache writes the NIP-11 cache for the next run, if there is one
+func saveEnrichmentCache() {
+	if enrichCache == nil {
+		return
+	}
+	if err := enrichCache.Save(); err != nil {
+		exportLog.Error("failed to save NIP-11 cache", "error", err)
+	}
+}
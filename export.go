@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"time"
+
+	"crawlr2/atomicfile"
+)
+
+// relaysDocumentHeader is the part of relays.json written before the relays array
+type relaysDocumentHeader struct {
+	Version int         `json:"version"`
+	Run     RunMetadata `json:"run"`
+}
+
+// relayState is what the exports are built from: the relay lists, the records, the
+// origins of malformed URLs and the timeline. Finalize uses the crawl's own under mu, a checkpoint copies them under mu
+// and builds its exports from the copy so the crawl isn't held up while files are written.
+type relayState struct {
+	lists    map[RelayCategory]map[string]int
+	records  map[string]*RelayRecord
+	origins  map[string]origin // Of malformed URLs, which have no record
+	timeline []timelineSample
+}
+
+// liveState is the crawl's own relay state, only usable while holding mu
+func liveState() relayState {
+	state := relayState{lists: make(map[RelayCategory]map[string]int, len(allCategories)), records: relayRecords,
+		origins: malformedOrigins, timeline: timeline}
+	for _, category := range allCategories {
+		state.lists[category] = categoryMap(category)
+	}
+	return state
+}
+
+// snapshotState copies the relay state for building exports without mu, caller must
+// hold mu. Records are copied with the parts the exports read, the pubkey and referrer
+// sets stay behind.
+func snapshotState() relayState {
+	state := relayState{lists: make(map[RelayCategory]map[string]int, len(allCategories)),
+		records: make(map[string]*RelayRecord, len(relayRecords)), origins: maps.Clone(malformedOrigins),
+		timeline: slices.Clone(timeline)}
+	for _, category := range allCategories {
+		state.lists[category] = maps.Clone(categoryMap(category))
+	}
+	for relay, record := range relayRecords {
+		copied := *record
+		copied.Referrers = slices.Clone(record.Referrers)
+		copied.Attempts = slices.Clone(record.Attempts)
+		copied.probes = maps.Clone(record.probes)
+		copied.pubkeys, copied.sketch, copied.referrers, copied.referrerSketch = nil, nil, nil, nil
+		state.records[relay] = &copied
+	}
+	return state
+}
+
+// categoryMap returns the relay list backing a category
+func categoryMap(category RelayCategory) map[string]int {
+	switch category {
+	case ClearOnline:
+		return clearOnline
+	case ClearOffline:
+		return clearOffline
+	case ClearAPI:
+		return clearAPI
+	case Onion:
+		return onion
+	case Local:
+		return local
+	case Malformed:
+		return malformed
+	}
+	return nil
+}
+
+// sortedRelays returns the URLs of a relay list in a stable order for exports
+func sortedRelays(relayList map[string]int) []string {
+	relays := make([]string, 0, len(relayList))
+	for relay := range relayList {
+		relays = append(relays, relay)
+	}
+	sort.Strings(relays)
+	return relays
+}
+
+// relayRecordFor builds the exported record for a relay, caller must hold mu
+func relayRecordFor(relayURL string, category RelayCategory, count int) RelayRecord {
+	return liveState().recordFor(relayURL, category, count)
+}
+
+// recordFor builds the exported record for a relay of the state
+func (s relayState) recordFor(relayURL string, category RelayCategory, count int) RelayRecord {
+	record := RelayRecord{URL: relayURL}
+	if stored, ok := s.records[relayURL]; ok {
+		record = *stored
+	} else if origin, ok := s.origins[relayURL]; ok {
+		record.DiscoveredBy = origin.discoveredBy
+		record.FirstSeen = &origin.firstSeen
+	}
+	record.Category = category
+	record.Count = count
+	record.NIPProbes = nipProbes(&record)
+	s.applyAvailability(&record)
+	return record
+}
+
+// exportToJSON writes every relay with its metadata to a single relays.json document.
+// Records are encoded one at a time so memory use doesn't grow with the output size.
+func exportToJSON(state relayState, path string, run RunMetadata) error {
+	file, err := atomicfile.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", path, err)
+	}
+
+	writer := bufio.NewWriterSize(file, exportBufferSize)
+
+	// Write the header object, leaving it open for the relays array
+	header, err := json.Marshal(relaysDocumentHeader{Version: relaysSchemaVersion, Run: run})
+	if err != nil {
+		file.Abort()
+		return fmt.Errorf("failed to encode run metadata: %v", err)
+	}
+	writer.Write(header[:len(header)-1])
+	writer.WriteString(`,"relays":[` + "\n")
+
+	encoder := json.NewEncoder(writer)
+	rows := 0
+	first := true
+	for _, category := range allCategories {
+		relays := state.lists[category]
+		for _, relay := range state.exportedRelays(category) {
+			count := relays[relay]
+			if !first {
+				writer.WriteString(",")
+			}
+			first = false
+
+			record, err := selectFields(state.recordFor(relay, category, count))
+			if err == nil {
+				err = encoder.Encode(record)
+			}
+			if err != nil {
+				file.Abort()
+				return fmt.Errorf("failed to encode relay %s: %v", relay, err)
+			}
+			rows++
+
+			// Write errors stick to the buffer, surface them a chunk at a time
+			if rows%exportChunkRows == 0 {
+				if err := writer.Flush(); err != nil {
+					file.Abort()
+					return fmt.Errorf("failed to write %s after %d rows: %v", path, rows, err)
+				}
+			}
+		}
+	}
+
+	writer.WriteString("]}\n")
+	if err := writer.Flush(); err != nil {
+		file.Abort()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := file.Commit(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+
+	recordOutput(path, rows)
+	return nil
+}
+
+// runMetadata describes the current run as of now
+func runMetadata() RunMetadata {
+	finishedAt := runEnd
+	if finishedAt.IsZero() {
+		finishedAt = time.Now()
+	}
+
+	return RunMetadata{
+		RunID:          runID,
+		Seed:           seedRelays,
+		StartedAt:      runStart.UTC(),
+		FinishedAt:     finishedAt.UTC(),
+		CrawlerVersion: crawlerVersion,
+		CrawlerCommit:  crawlerCommit(),
+	}
+}
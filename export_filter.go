@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The relay exports, the per-category CSVs and relays.json, can be narrowed down with
+// -export-categories, -min-count and -columns. The defaults write everything. Relays
+// left out are counted for the summary so a filtered export isn't mistaken for a
+// smaller crawl.
+
+// ExportFilterSummary reports the relays the export filters left out
+type ExportFilterSummary struct {
+	Suppressed map[RelayCategory]int `json:"suppressed"`
+}
+
+// exportFiltered reports whether any export filter is set
+func exportFiltered() bool {
+	return len(cfg.ExportCategories) > 0 || len(cfg.MinCount) > 0 || len(cfg.Columns) > 0
+}
+
+// exportCategory reports whether a category's relays are exported
+func exportCategory(category RelayCategory) bool {
+	if len(cfg.ExportCategories) == 0 {
+		return true
+	}
+	for _, selected := range cfg.ExportCategories {
+		if selected == category {
+			return true
+		}
+	}
+	return false
+}
+
+// exportedRelays returns the relays of a category that pass the export filters, in
+// export order
+func (s relayState) exportedRelays(category RelayCategory) []string {
+	if !exportCategory(category) {
+		return nil
+	}
+	relayList := s.lists[category]
+	relays := sortedRelays(relayList)
+	minCount := cfg.MinCount[category]
+	if minCount <= 0 {
+		return relays
+	}
+	kept := relays[:0]
+	for _, relay := range relays {
+		if relayList[relay] >= minCount {
+			kept = append(kept, relay)
+		}
+	}
+	return kept
+}
+
+// summarizeExportFilters counts the relays the filters leave out of the exports, nil
+// without filters. Caller must hold mu.
+func summarizeExportFilters() *ExportFilterSummary {
+	if !exportFiltered() {
+		return nil
+	}
+	summary := &ExportFilterSummary{Suppressed: make(map[RelayCategory]int)}
+	for _, category := range allCategories {
+		relayList := categoryMap(category)
+		suppressed := junkRelays.counts[category]
+		for _, count := range relayList {
+			if !exportCategory(category) || count < cfg.MinCount[category] {
+				suppressed++
+			}
+		}
+		if suppressed > 0 {
+			summary.Suppressed[category] = suppressed
+		}
+	}
+	return summary
+}
+
+// csvColumns names the columns csvRow writes for a category
+func csvColumns(category RelayCategory) []string {
+	columns := []string{"url", "count"}
+	switch category {
+	case ClearOnline:
+		columns = append(columns, "dial_ms", "first_event_ms", "eose_ms", "discovered_count", "software", "version",
+			"referrer_count", "first_seen", "last_seen", "cluster_id")
+		if cfg.DNS {
+			columns = append(columns, "first_address", "has_cname")
+		}
+		if samplingEnabled() {
+			columns = append(columns, "not_probed")
+		}
+	case ClearOffline:
+		columns = append(columns, "failure_reason", "attempt_count", "last_attempt", "discovered_by", "referrer_count",
+			"first_seen", "last_seen")
+	default:
+		return columns
+	}
+	if availability != nil {
+		columns = append(columns, "runs_observed", "runs_online", "offline_streak", "uptime_percent")
+	}
+	return columns
+}
+
+// selectColumns keeps the -columns of a CSV row, in the row's order. The URL always stays
+// first so the export still identifies its relays.
+func selectColumns(category RelayCategory, row []string) []string {
+	if len(cfg.Columns) == 0 {
+		return row
+	}
+	selected := []string{row[0]}
+	for i, column := range csvColumns(category)[1:] {
+		if columnSelected(column) {
+			selected = append(selected, row[i+1])
+		}
+	}
+	return selected
+}
+
+// columnSelected reports whether -columns includes a column
+func columnSelected(column string) bool {
+	for _, selected := range cfg.Columns {
+		if selected == column {
+			return true
+		}
+	}
+	return false
+}
+
+// selectFields keeps the -columns of a relays.json record, along with its url and
+// category
+func selectFields(record RelayRecord) (any, error) {
+	if len(cfg.Columns) == 0 {
+		return record, nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name := range fields {
+		if name != "url" && name != "category" && !columnSelected(name) {
+			delete(fields, name)
+		}
+	}
+	return fields, nil
+}
+
+// knownColumns lists every name -columns accepts: the CSV columns and the fields of a
+// relays.json record
+func knownColumns() map[string]bool {
+	known := make(map[string]bool)
+	for _, category := range allCategories {
+		for _, column := range csvColumns(category) {
+			known[column] = true
+		}
+	}
+	for _, column := range []string{"first_address", "has_cname", "runs_observed", "runs_online", "offline_streak",
+		"uptime_percent"} {
+		known[column] = true // Only written with -dns and -availability
+	}
+	fields := reflect.TypeOf(RelayRecord{})
+	for i := 0; i < fields.NumField(); i++ {
+		if name, _, _ := strings.Cut(fields.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			known[name] = true
+		}
+	}
+	return known
+}
+
+// parseMinCount reads -min-count: a bare number for every category or category=number
+// pairs, comma separated
+func parseMinCount(value string) (map[RelayCategory]int, error) {
+	minCount := make(map[RelayCategory]int)
+	for _, part := range strings.Split(value, ",") {
+		name, number, paired := strings.Cut(strings.TrimSpace(part), "=")
+		if !paired {
+			number = name
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(number))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid count %q", number)
+		}
+		if !paired {
+			for _, category := range allCategories {
+				minCount[category] = n
+			}
+			continue
+		}
+		category, err := parseCategory(name)
+		if err != nil {
+			return nil, err
+		}
+		minCount[category] = n
+	}
+	return minCount, nil
+}
+
+// parseCategory checks a category name given on the command line
+func parseCategory(name string) (RelayCategory, error) {
+	name = strings.TrimSpace(name)
+	for _, category := range allCategories {
+		if string(category) == name {
+			return category, nil
+		}
+	}
+	return "", fmt.Errorf("unknown category %q", name)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// NIP-51 relay set layout
+const (
+	relaySetKind      = 30002
+	relaySetDTag      = "crawlr-online"
+	relaySetMaxRelays = 500 // Larger sets are split into several events
+)
+
+// buildRelaySets builds kind 30002 relay set events for the online relays, split into
+// indexed d tags when there are more than relaySetMaxRelays. Without a secret key they
+// are templates, the signer fills in the pubkey and id.
+func buildRelaySets(state relayState, secretKey []byte, createdAt time.Time) ([]Event, error) {
+	relays := sortedRelays(state.lists[ClearOnline])
+	parts := (len(relays) + relaySetMaxRelays - 1) / relaySetMaxRelays
+	if parts == 0 {
+		parts = 1
+	}
+
+	events := make([]Event, 0, parts)
+	for part := 0; part < parts; part++ {
+		start := part * relaySetMaxRelays
+		end := min(start+relaySetMaxRelays, len(relays))
+
+		dTag, title := relaySetDTag, "Online relays found by crawlr"
+		if parts > 1 {
+			dTag = fmt.Sprintf("%s-%d", relaySetDTag, part+1)
+			title = fmt.Sprintf("%s (%d/%d)", title, part+1, parts)
+		}
+
+		event := Event{
+			CreatedAt: createdAt.Unix(),
+			Kind:      relaySetKind,
+			Tags:      [][]string{{"d", dTag}, {"title", title}},
+		}
+		for _, relay := range relays[start:end] {
+			event.Tags = append(event.Tags, []string{"relay", relay})
+		}
+
+		if secretKey != nil {
+			if err := event.sign(secretKey); err != nil {
+				return nil, fmt.Errorf("failed to sign relay set: %v", err)
+			}
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// exportRelaySet writes the online relays as NIP-51 relay set events, signed when a
+// secret key is configured
+func exportRelaySet(state relayState, run RunMetadata) error {
+	var secretKey []byte
+	if cfg.SecretKey != "" {
+		key, err := parseSecretKey(cfg.SecretKey)
+		if err != nil {
+			return err
+		}
+		secretKey = key
+	}
+
+	events, err := buildRelaySets(state, secretKey, run.FinishedAt)
+	if err != nil {
+		return err
+	}
+	return writeJSONFile(runFilePath("nip51_relay_set.json"), events, len(events))
+}
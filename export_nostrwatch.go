@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"crawlr2/atomicfile"
+)
+
+// nostrWatchRelay is an entry of the extended nostr.watch list, the plain list only
+// carries the URL
+type nostrWatchRelay struct {
+	URL       string     `json:"url"`
+	Count     int        `json:"count"`
+	FirstSeen *time.Time `json:"first_seen,omitempty"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+}
+
+// exportNostrWatch writes the online relays in the nostr.watch list formats: a plain
+// array of relay URLs and an extended array of objects
+func exportNostrWatch(state relayState) error {
+	online := state.lists[ClearOnline]
+	relays := sortedRelays(online)
+
+	extended := make([]nostrWatchRelay, 0, len(relays))
+	for _, relay := range relays {
+		record := state.recordFor(relay, ClearOnline, online[relay])
+		extended = append(extended, nostrWatchRelay{URL: relay, Count: record.Count, FirstSeen: record.FirstSeen,
+			LastSeen: record.LastSeen})
+	}
+
+	if err := writeJSONFile(runFilePath("nostrwatch_online.json"), relays, len(relays)); err != nil {
+		return err
+	}
+	return writeJSONFile(runFilePath("nostrwatch_online_extended.json"), extended, len(extended))
+}
+
+// writeJSONFile atomically writes value as indented JSON and records it for the manifest
+func writeJSONFile(path string, value interface{}, rows int) error {
+	file, err := atomicfile.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", path, err)
+	}
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		file.Abort()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := file.Commit(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+
+	recordOutput(path, rows)
+	return nil
+}
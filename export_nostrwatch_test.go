@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"testing"
+)
+
+// The relays of testdata/nostrwatch_online.json, a list in the shape the nostr.watch
+// v1 online endpoint serves, must come back out of both exports unchanged
+func TestNostrWatchRoundTrip(t *testing.T) {
+	resetState(t)
+
+	data, err := os.ReadFile("testdata/nostrwatch_online.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sample []string
+	if err := json.Unmarshal(data, &sample); err != nil {
+		t.Fatal(err)
+	}
+
+	// Take the sample in the way -seed-nostrwatch does
+	mu.Lock()
+	for _, relay := range sample {
+		normalizedURL := normalizeURL(relay)
+		classifyRelay(listedRelay{url: normalizedURL, category: categorize(normalizedURL)}, nostrWatchSource)
+	}
+	err = exportNostrWatch(liveState())
+	mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make([]string, 0, len(sample))
+	for _, relay := range sample {
+		want = append(want, normalizeURL(relay))
+	}
+	slices.Sort(want)
+
+	// The plain list is an array of URL strings and nothing else
+	var plain []string
+	readJSON(t, runFilePath("nostrwatch_online.json"), &plain)
+	if !slices.Equal(plain, want) {
+		t.Errorf("plain list = %v, want %v", plain, want)
+	}
+
+	// The extended list is an array of objects keyed by url, in the same order
+	var extended []map[string]any
+	readJSON(t, runFilePath("nostrwatch_online_extended.json"), &extended)
+	if len(extended) != len(want) {
+		t.Fatalf("extended list has %d entries, want %d", len(extended), len(want))
+	}
+	for i, entry := range extended {
+		if url, _ := entry["url"].(string); url != want[i] {
+			t.Errorf("extended entry %d has url %v, want %s", i, entry["url"], want[i])
+		}
+	}
+
+	// Tools reading nostr.watch lists, -reference among them, read both back the same
+	for _, name := range []string{"nostrwatch_online.json", "nostrwatch_online_extended.json"} {
+		if err := loadReference(runFilePath(name)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(referenceRelays) != len(want) {
+			t.Errorf("%s: read back %d relays, want %d", name, len(referenceRelays), len(want))
+		}
+		for _, relay := range want {
+			if _, ok := referenceRelays[canonicalURL(relay)]; !ok {
+				t.Errorf("%s: %s missing when read back", name, relay)
+			}
+		}
+	}
+	referenceRelays = nil
+}
+
+// readJSON decodes a JSON file, failing the test on unknown shapes
+func readJSON(t *testing.T, path string, value any) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+}
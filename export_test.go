@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// BenchmarkExportToJSON writes relays.json for two million synthetic relays, reporting
+// rows written per second
+func BenchmarkExportToJSON(b *testing.B) {
+	resetState(b)
+	state := syntheticExportState(exportBenchRows)
+	if err := prepareOutputDir(); err != nil {
+		b.Fatal(err)
+	}
+	exportMu.Lock()
+	defer exportMu.Unlock()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := exportToJSON(state, runFilePath("relays.json"), runMetadata()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(2*exportBenchRows*b.N)/b.Elapsed().Seconds(), "rows/s")
+}
+
+// Relay sets are signed with a secret key and otherwise left as templates without a
+// pubkey, id or signature, since an id over an empty pubkey matches no signer
+func TestBuildRelaySets(t *testing.T) {
+	state := relayState{lists: map[RelayCategory]map[string]int{
+		ClearOnline: {"wss://a.example.com": 1, "wss://b.example.com": 2},
+	}}
+	createdAt := time.Unix(1700000000, 0)
+
+	templates, err := buildRelaySets(state, nil, createdAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(templates[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"id"`, `"pubkey"`, `"sig"`} {
+		if bytes.Contains(encoded, []byte(field)) {
+			t.Errorf("template has %s: %s", field, encoded)
+		}
+	}
+
+	secretKey := bytes.Repeat([]byte{1}, 32)
+	events, err := buildRelaySets(state, secretKey, createdAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := events[0]
+	serialized, err := event.serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := sha256.Sum256(serialized)
+	if event.ID != hex.EncodeToString(id[:]) {
+		t.Errorf("id %s isn't the hash of the signed event", event.ID)
+	}
+	pubkey, _ := hex.DecodeString(event.Pubkey)
+	sig, _ := hex.DecodeString(event.Sig)
+	publicKey, err := schnorr.ParsePubKey(pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := schnorr.ParseSignature(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !signature.Verify(id[:], publicKey) {
+		t.Error("signature doesn't verify")
+	}
+}
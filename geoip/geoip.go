@@ -0,0 +1,203 @@
+// Package geoip maps IP addresses to countries using a range database in CSV form, one
+// "start,end,country" row per range as in the DB-IP country lite and IP2Location LITE
+// DB1 downloads, and to autonomous systems using the iptoasn.com ip2asn TSV. Addresses
+// are given either as IPs or, like IP2Location, as decimal numbers.
+package geoip
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Range is a block of addresses located in one country or announced by one AS
+type Range struct {
+	Start, End netip.Addr
+	Country    string // ISO 3166-1 alpha-2, upper case
+	ASN        int    // Only in AS databases
+	Org        string // Description of the AS
+}
+
+// DB answers lookups from ranges sorted by start address
+type DB struct {
+	ranges []Range
+}
+
+// Load reads a range database from a CSV file
+func Load(path string) (*DB, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	db, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return db, nil
+}
+
+// LoadASN reads an AS database in the ip2asn TSV layout:
+// start, end, AS number, country, AS description
+func LoadASN(path string) (*DB, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	db, err := ParseASN(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return db, nil
+}
+
+// ParseASN reads an AS database. Ranges announced by no AS, AS number 0, are skipped.
+func ParseASN(r io.Reader) (*DB, error) {
+	reader := csv.NewReader(r)
+	reader.Comma = '\t'
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	db := new(DB)
+	for line := 1; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(row) < 3 {
+			return nil, fmt.Errorf("line %d: expected start, end and AS number", line)
+		}
+
+		asn, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(row[2]), "AS"))
+		if err != nil || asn <= 0 {
+			continue
+		}
+		start, startErr := parseAddr(row[0])
+		end, endErr := parseAddr(row[1])
+		if startErr != nil || endErr != nil || end.Less(start) {
+			return nil, fmt.Errorf("line %d: invalid address range %q-%q", line, row[0], row[1])
+		}
+		if start.Is4() != end.Is4() {
+			continue
+		}
+
+		r := Range{Start: start, End: end, ASN: asn}
+		if len(row) > 3 {
+			r.Country = strings.ToUpper(strings.TrimSpace(row[3]))
+		}
+		if len(row) > 4 {
+			r.Org = strings.TrimSpace(row[4])
+		}
+		db.ranges = append(db.ranges, r)
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool { return db.ranges[i].Start.Less(db.ranges[j].Start) })
+	return db, nil
+}
+
+// Parse reads a range database. Rows without a country code, such as IP2Location's "-"
+// for unallocated space, are skipped.
+func Parse(r io.Reader) (*DB, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	db := new(DB)
+	for line := 1; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(row) < 3 {
+			return nil, fmt.Errorf("line %d: expected start, end and country", line)
+		}
+
+		country := strings.ToUpper(strings.TrimSpace(row[2]))
+		if len(country) != 2 {
+			continue
+		}
+		start, startErr := parseAddr(row[0])
+		end, endErr := parseAddr(row[1])
+		if startErr != nil || endErr != nil {
+			if line == 1 {
+				continue // Header row
+			}
+			return nil, fmt.Errorf("line %d: invalid address range %q-%q", line, row[0], row[1])
+		}
+		if start.Is4() != end.Is4() {
+			continue // Spans the IPv4-mapped block of an IPv6 database, never looked up
+		}
+		if end.Less(start) {
+			return nil, fmt.Errorf("line %d: invalid address range %q-%q", line, row[0], row[1])
+		}
+		db.ranges = append(db.ranges, Range{Start: start, End: end, Country: country})
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool { return db.ranges[i].Start.Less(db.ranges[j].Start) })
+	return db, nil
+}
+
+// parseAddr parses an address written as an IP or as a decimal number. Numbers up to
+// 2^32-1 are IPv4, larger ones IPv6, with IPv4-mapped addresses turned back into IPv4.
+func parseAddr(value string) (netip.Addr, error) {
+	value = strings.TrimSpace(value)
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return addr.Unmap(), nil
+	}
+
+	n, ok := new(big.Int).SetString(value, 10)
+	if !ok || n.Sign() < 0 || n.BitLen() > 128 {
+		return netip.Addr{}, fmt.Errorf("invalid address %q", value)
+	}
+	if n.BitLen() <= 32 {
+		var b [4]byte
+		return netip.AddrFrom4([4]byte(n.FillBytes(b[:]))), nil
+	}
+	var b [16]byte
+	return netip.AddrFrom16([16]byte(n.FillBytes(b[:]))).Unmap(), nil
+}
+
+// Lookup returns the range holding an IP, nil when it is invalid or not in any range
+func (db *DB) Lookup(ip string) *Range {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap().WithZone("")
+
+	// The last range starting at or before the address is the only one that can hold it
+	i := sort.Search(len(db.ranges), func(i int) bool { return addr.Less(db.ranges[i].Start) })
+	if i == 0 || db.ranges[i-1].End.Less(addr) {
+		return nil
+	}
+	return &db.ranges[i-1]
+}
+
+// Country returns the country an IP is located in, or "" when unknown
+func (db *DB) Country(ip string) string {
+	if r := db.Lookup(ip); r != nil {
+		return r.Country
+	}
+	return ""
+}
+
+// Len returns the number of ranges loaded
+func (db *DB) Len() int {
+	return len(db.ranges)
+}
@@ -3,8 +3,22 @@ module crawlr2
 go 1.22.2
 
 require (
-	github.com/olekukonko/ts v0.0.0-20171002115256-78ecb04241c0
+	github.com/BurntSushi/toml v1.6.0
+	github.com/btcsuite/btcd/btcec/v2 v2.3.4
+	github.com/gdamore/tcell/v2 v2.7.4
+	github.com/lib/pq v1.12.3
+	github.com/mattn/go-runewidth v0.0.15
 	golang.org/x/net v0.29.0
 )
 
-require golang.org/x/sys v0.25.0 // indirect
+require (
+	github.com/btcsuite/btcd/chaincfg/chainhash v1.0.1 // indirect
+	github.com/decred/dcrd/crypto/blake256 v1.0.0 // indirect
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1 // indirect
+	github.com/gdamore/encoding v1.0.0 // indirect
+	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
+	github.com/rivo/uniseg v0.4.3 // indirect
+	golang.org/x/sys v0.25.0 // indirect
+	golang.org/x/term v0.24.0 // indirect
+	golang.org/x/text v0.18.0 // indirect
+)
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"crawlr2/atomicfile"
+)
+
+// With -history every run appends its headline numbers to a JSONL file, one line per run
+// keyed by run id, and "crawlr trend" turns the file into a time series. New and
+// disappeared relays compare the online list with the previous run's online export.
+
+// HistoryEntry is one run's line in the -history file
+type HistoryEntry struct {
+	RunID        string                `json:"run_id"`
+	StartedAt    time.Time             `json:"started_at"`
+	FinishedAt   time.Time             `json:"finished_at"`
+	Totals       map[RelayCategory]int `json:"totals"`
+	New          *int                  `json:"new,omitempty"` // Nil without a previous run to compare with
+	Disappeared  *int                  `json:"disappeared,omitempty"`
+	MedianDialMs float64               `json:"median_dial_ms"` // Of online relays
+	MedianEOSEMs float64               `json:"median_eose_ms"`
+}
+
+// Online relays of the previous run, loaded by loadTrendBaseline. Nil when there was none.
+var trendBaseline map[string]struct{}
+
+// loadTrendBaseline reads the previous run's online relays before this run's export
+// can replace them
+func loadTrendBaseline() error {
+	path := previousOnlineExport()
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	baseline := make(map[string]struct{})
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		if len(row) > 0 {
+			baseline[normalizeURL(row[0])] = struct{}{}
+		}
+	}
+	trendBaseline = baseline
+	return nil
+}
+
+// historyEntry collects this run's headline numbers, caller must hold mu
+func historyEntry(run RunMetadata) HistoryEntry {
+	entry := HistoryEntry{
+		RunID:      run.RunID,
+		StartedAt:  run.StartedAt,
+		FinishedAt: run.FinishedAt,
+		Totals:     make(map[RelayCategory]int),
+	}
+	for _, category := range allCategories {
+		entry.Totals[category] = categoryTotal(category)
+	}
+	if histograms, ok := latencies[ClearOnline]; ok {
+		entry.MedianDialMs = histograms.dial.summarize().P50
+		entry.MedianEOSEMs = histograms.eose.summarize().P50
+	}
+
+	if trendBaseline != nil {
+		var added, gone int
+		for relay := range clearOnline {
+			if _, known := trendBaseline[relay]; !known {
+				added++
+			}
+		}
+		for relay := range trendBaseline {
+			if _, online := clearOnline[relay]; !online {
+				gone++
+			}
+		}
+		entry.New, entry.Disappeared = &added, &gone
+	}
+	return entry
+}
+
+// saveHistory adds this run to the -history file, replacing its line if finalize already
+// wrote one. Caller must hold mu.
+func saveHistory(run RunMetadata) {
+	if cfg.History == "" {
+		return
+	}
+	entries, err := readHistory(cfg.History)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		exportLog.Error("failed to read run history, not adding this run", "path", cfg.History, "error", err)
+		return
+	}
+
+	current := historyEntry(run)
+	replaced := false
+	for i := range entries {
+		if entries[i].RunID == current.RunID {
+			entries[i], replaced = current, true
+		}
+	}
+	if !replaced {
+		entries = append(entries, current)
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			exportLog.Error("failed to encode run history", "error", err)
+			return
+		}
+	}
+	if err := atomicfile.WriteFile(cfg.History, buf.Bytes()); err != nil {
+		exportLog.Error("failed to save run history", "path", cfg.History, "error", err)
+	}
+}
+
+// readHistory reads every run of a -history file, oldest first
+func readHistory(path string) ([]HistoryEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("corrupt history line %d: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// TrendDelta compares the last run with the first of a window of recent runs
+type TrendDelta struct {
+	Runs         int     `json:"runs"` // In the window, fewer than asked when the history is shorter
+	From         string  `json:"from_run_id"`
+	To           string  `json:"to_run_id"`
+	Online       int     `json:"online_delta"`
+	Offline      int     `json:"offline_delta"`
+	New          int     `json:"new"` // Summed over the window's runs
+	Disappeared  int     `json:"disappeared"`
+	MedianDialMs float64 `json:"median_dial_ms_delta"`
+	MedianEOSEMs float64 `json:"median_eose_ms_delta"`
+}
+
+// trendDelta compares the last runs of the history, nil when it is empty
+func trendDelta(entries []HistoryEntry, window int) *TrendDelta {
+	if len(entries) == 0 || window < 1 {
+		return nil
+	}
+	recent := entries[max(0, len(entries)-window):]
+	first, last := recent[0], recent[len(recent)-1]
+	delta := &TrendDelta{
+		Runs:         len(recent),
+		From:         first.RunID,
+		To:           last.RunID,
+		Online:       last.Totals[ClearOnline] - first.Totals[ClearOnline],
+		Offline:      last.Totals[ClearOffline] - first.Totals[ClearOffline],
+		MedianDialMs: last.MedianDialMs - first.MedianDialMs,
+		MedianEOSEMs: last.MedianEOSEMs - first.MedianEOSEMs,
+	}
+	// The first run's changes happened before the window
+	for _, entry := range recent[1:] {
+		if entry.New != nil {
+			delta.New += *entry.New
+		}
+		if entry.Disappeared != nil {
+			delta.Disappeared += *entry.Disappeared
+		}
+	}
+	return delta
+}
+
+// runTrend implements "crawlr trend [flags] <history>": the time series of the last runs
+// and the deltas over each window, as text, CSV or JSON
+func runTrend(args []string) error {
+	flags := flag.NewFlagSet("trend", flag.ExitOnError)
+	last := flags.Int("last", 30, "runs listed in the time series, 0 lists all")
+	windowList := flags.String("windows", "7,30,90", "comma separated run counts to compute deltas over")
+	format := flags.String("format", "text", "output format: text, csv or json")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: crawlr trend [flags] <history>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var windows []int
+	for _, value := range strings.Split(*windowList, ",") {
+		window, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || window < 1 {
+			return fmt.Errorf("invalid window %q", value)
+		}
+		windows = append(windows, window)
+	}
+
+	entries, err := readHistory(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to read history: %v", err)
+	}
+	series := entries
+	if *last > 0 {
+		series = entries[max(0, len(entries)-*last):]
+	}
+	var deltas []TrendDelta
+	for _, window := range windows {
+		if delta := trendDelta(entries, window); delta != nil {
+			deltas = append(deltas, *delta)
+		}
+	}
+
+	switch *format {
+	case "text":
+		writeTrendText(os.Stdout, series, deltas)
+	case "csv":
+		return writeTrendCSV(os.Stdout, series)
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			Series []HistoryEntry `json:"series"`
+			Deltas []TrendDelta   `json:"deltas"`
+		}{series, deltas})
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	return nil
+}
+
+// optionalCount formats a count that earlier runs may not have, "-" when missing
+func optionalCount(count *int) string {
+	if count == nil {
+		return "-"
+	}
+	return strconv.Itoa(*count)
+}
+
+// writeTrendText prints the series as a table followed by the deltas
+func writeTrendText(w io.Writer, series []HistoryEntry, deltas []TrendDelta) {
+	fmt.Fprintf(w, "%-20s %-26s %8s %8s %6s %11s %9s %9s\n",
+		"finished", "run", "online", "offline", "new", "disappeared", "dial p50", "eose p50")
+	for _, entry := range series {
+		fmt.Fprintf(w, "%-20s %-26s %8d %8d %6s %11s %8.1fms %8.1fms\n",
+			entry.FinishedAt.Format(time.DateTime), entry.RunID, entry.Totals[ClearOnline], entry.Totals[ClearOffline],
+			optionalCount(entry.New), optionalCount(entry.Disappeared), entry.MedianDialMs, entry.MedianEOSEMs)
+	}
+	if len(deltas) > 0 {
+		fmt.Fprintln(w)
+	}
+	for _, delta := range deltas {
+		fmt.Fprintf(w, "Last %d runs: online %+d, offline %+d, %d new, %d disappeared, dial p50 %+.1fms, eose p50 %+.1fms\n",
+			delta.Runs, delta.Online, delta.Offline, delta.New, delta.Disappeared, delta.MedianDialMs, delta.MedianEOSEMs)
+	}
+}
+
+// writeTrendCSV writes the series with one column per category total
+func writeTrendCSV(w io.Writer, series []HistoryEntry) error {
+	writer := csv.NewWriter(w)
+	header := []string{"run_id", "started_at", "finished_at"}
+	for _, category := range allCategories {
+		header = append(header, string(category))
+	}
+	writer.Write(append(header, "new", "disappeared", "median_dial_ms", "median_eose_ms"))
+	for _, entry := range series {
+		row := []string{entry.RunID, entry.StartedAt.Format(time.RFC3339), entry.FinishedAt.Format(time.RFC3339)}
+		for _, category := range allCategories {
+			row = append(row, strconv.Itoa(entry.Totals[category]))
+		}
+		newCount, gone := "", ""
+		if entry.New != nil {
+			newCount, gone = strconv.Itoa(*entry.New), strconv.Itoa(*entry.Disappeared)
+		}
+		writer.Write(append(row, newCount, gone,
+			strconv.FormatFloat(entry.MedianDialMs, 'f', 1, 64), strconv.FormatFloat(entry.MedianEOSEMs, 'f', 1, 64)))
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// How long in-flight HTTP requests get to finish when the crawler exits
+const httpShutdownTimeout = 5 * time.Second
+
+// startHTTPServer starts the optional listener serving metrics, status, the query and
+// control APIs, the dashboard and profiles, returns nil when disabled
+func startHTTPServer(addr string) (*http.Server, error) {
+	if addr == "" {
+		return nil, nil
+	}
+
+	// Closed on shutdown so long-lived streams let the server stop
+	shutdown := make(chan struct{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/status", handleStatus)
+	registerAPI(mux)
+	registerControl(mux)
+	registerDashboard(mux, shutdown)
+
+	// Profiling exposes internals, so it is only served when asked for. Handlers are
+	// registered on our own mux, the pprof import side effect only touches the default one.
+	if cfg.Pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	// Listen before returning so a bad address is reported at startup
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on %s: %v", addr, err)
+	}
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	server.RegisterOnShutdown(func() { close(shutdown) })
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			mainLog.Error("HTTP server stopped", "error", err)
+		}
+	}()
+	mainLog.Info("HTTP server listening", "addr", listener.Addr().String())
+	if tcp, ok := listener.Addr().(*net.TCPAddr); ok && !tcp.IP.IsLoopback() && cfg.ControlToken == "" {
+		mainLog.Warn("control endpoints are reachable from other hosts without -control-token", "addr", listener.Addr().String())
+	}
+	return server, nil
+}
+
+// stopHTTPServer shuts the listener down, waiting briefly for in-flight requests
+func stopHTTPServer(server *http.Server) {
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		mainLog.Warn("HTTP server shutdown failed", "error", err)
+	}
+}
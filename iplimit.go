@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/websocket"
+)
+
+// Wildcard DNS and operators running many relay hostnames on one server would otherwise
+// have dozens of connections open to the same machine at once. Every dial takes a slot
+// for the address it is about to connect to, after DNS resolution, and a relay whose
+// addresses are all full goes back to the frontier instead of dialing.
+
+// errIPBusy is returned for a dial whose every address already has -max-per-ip connections
+var errIPBusy = errors.New("every address of the relay is at its connection limit")
+
+// Open connections per remote IP and the IP each connection holds a slot for. Like
+// inFlight it is touched on every dial, so it has its own lock.
+var (
+	ipSlotsMu sync.Mutex
+	ipSlots   = make(map[string]int)
+	ipLeases  = make(map[*websocket.Conn]string)
+)
+
+// ipLease is the slot one dial holds. A dialer tries a host's addresses one after the
+// other, so each new address it tries replaces the slot of the one that failed.
+type ipLease struct {
+	ip   string // Empty while no slot is held
+	busy bool   // An address was skipped for being full
+}
+
+// control is a net.Dialer Control hook, called with the resolved address right before
+// each connect
+func (l *ipLease) control(network, address string, _ syscall.RawConn) error {
+	ip, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ipSlotsMu.Lock()
+	defer ipSlotsMu.Unlock()
+	l.releaseLocked()
+	if ipSlots[ip] >= cfg.MaxPerIP {
+		l.busy = true
+		return errIPBusy
+	}
+	ipSlots[ip]++
+	l.ip = ip
+	return nil
+}
+
+// release frees the slot if one is held
+func (l *ipLease) release() {
+	ipSlotsMu.Lock()
+	l.releaseLocked()
+	ipSlotsMu.Unlock()
+}
+
+// releaseLocked frees the slot, caller must hold ipSlotsMu
+func (l *ipLease) releaseLocked() {
+	if l.ip == "" {
+		return
+	}
+	if ipSlots[l.ip]--; ipSlots[l.ip] <= 0 {
+		delete(ipSlots, l.ip)
+	}
+	l.ip = ""
+}
+
+// limitDialer makes dialer take an IP slot for each address it connects to, returning
+// the lease, or nil when -max-per-ip is off
+func limitDialer(dialer *net.Dialer) *ipLease {
+	if cfg.MaxPerIP <= 0 {
+		return nil
+	}
+	lease := new(ipLease)
+	dialer.Control = lease.control
+	dialer.FallbackDelay = -1 // Try addresses one at a time, so one slot is held at once
+	return lease
+}
+
+// holdLease keeps the lease's slot until the connection is closed
+func holdLease(ws *websocket.Conn, lease *ipLease) {
+	if lease == nil {
+		return
+	}
+	ipSlotsMu.Lock()
+	ipLeases[ws] = lease.ip
+	lease.ip = "" // Owned by the connection now
+	ipSlotsMu.Unlock()
+}
+
+// releaseConnection frees the slot held by a connection from holdLease
+func releaseConnection(ws *websocket.Conn) {
+	ipSlotsMu.Lock()
+	defer ipSlotsMu.Unlock()
+	ip, ok := ipLeases[ws]
+	if !ok {
+		return
+	}
+	delete(ipLeases, ws)
+	(&ipLease{ip: ip}).releaseLocked()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// Most URLs found in relay lists on a long run are junk nobody reads again. A category
+// that is neither crawled nor exported, left out with -export-categories, keeps none of
+// its URLs: classifyRelay only remembers their hashes so each is counted once, and no
+// record is made for them. Malformed URLs that are exported keep their list entry and
+// where they came from, an origin instead of a record: nothing is ever crawled or
+// enriched for them.
+
+// seenSet remembers URLs by a 64-bit FNV-1a hash of the normalized URL, 8 bytes of map
+// key a URL however long it is. Two URLs sharing a hash are counted as one, which over
+// a few million URLs is less than a one in a million chance for the whole run and only
+// ever touches a count.
+type seenSet struct {
+	hashes map[uint64]struct{}
+	counts map[RelayCategory]int // URLs of each category added
+}
+
+// Junk relays seen this run and the origins of exported malformed URLs, guarded by mu
+var (
+	junkRelays       = newSeenSet()
+	malformedOrigins = make(map[string]origin)
+)
+
+// origin is the provenance of a malformed URL, what its exported entry carries of a
+// record
+type origin struct {
+	discoveredBy string
+	firstSeen    time.Time
+}
+
+func newSeenSet() *seenSet {
+	return &seenSet{hashes: make(map[uint64]struct{}), counts: make(map[RelayCategory]int)}
+}
+
+// add remembers a URL of a category, reporting whether it is new
+func (s *seenSet) add(normalizedURL string, category RelayCategory) bool {
+	hash := fnv.New64a()
+	hash.Write([]byte(normalizedURL))
+	key := hash.Sum64()
+	if _, seen := s.hashes[key]; seen {
+		return false
+	}
+	s.hashes[key] = struct{}{}
+	s.counts[category]++
+	return true
+}
+
+// isJunk reports whether a category's relays are neither crawled nor exported, so only
+// their number is kept
+func isJunk(category RelayCategory) bool {
+	return category != ClearOnline && category != ClearOffline && !exportCategory(category)
+}
+
+// categoryTotal returns the number of relays found in a category, junk ones included,
+// caller must hold mu
+func categoryTotal(category RelayCategory) int {
+	return len(categoryMap(category)) + junkRelays.counts[category]
+}
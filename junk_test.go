@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// Malformed URLs keep their list entry, mentions and origin for the export but get no
+// record
+func TestMalformedWithoutRecord(t *testing.T) {
+	resetState(t)
+	junk := "wss://junk-relay"
+
+	locked(func() {
+		classifyRelay(listedRelay{url: junk, category: Malformed}, "wss://source1.example.com")
+		classifyRelay(listedRelay{url: junk, category: Malformed}, "wss://source2.example.com")
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if mentions := malformed[junk]; mentions != 2 {
+		t.Errorf("%d mentions, want 2", mentions)
+	}
+	if _, ok := relayRecords[junk]; ok {
+		t.Error("record made for a malformed URL")
+	}
+	if credited := relayRecords["wss://source1.example.com"].Discovered; credited != 1 {
+		t.Errorf("first source credited with %d discoveries, want 1", credited)
+	}
+	if _, ok := relayRecords["wss://source2.example.com"]; ok {
+		t.Error("second source credited for a URL it didn't find first")
+	}
+	row := liveState().recordFor(junk, Malformed, malformed[junk])
+	if row.URL != junk || row.Count != 2 || row.DiscoveredBy != "wss://source1.example.com" || row.FirstSeen == nil {
+		t.Errorf("exported row %+v, want its mentions and first source", row)
+	}
+	if row := snapshotState().recordFor(junk, Malformed, 2); row.DiscoveredBy != "wss://source1.example.com" {
+		t.Errorf("row from a snapshot discovered by %q", row.DiscoveredBy)
+	}
+}
+
+// A category left out of the exports is only counted, once per URL
+func TestJunkOnlyCounted(t *testing.T) {
+	resetState(t)
+	cfg.ExportCategories = []RelayCategory{ClearOnline, ClearOffline}
+
+	locked(func() {
+		for _, source := range []string{"wss://source1.example.com", "wss://source2.example.com"} {
+			classifyRelay(listedRelay{url: "wss://junk-relay", category: Malformed}, source)
+			classifyRelay(listedRelay{url: "ws://192.168.1.1", category: Local}, source)
+			classifyRelay(listedRelay{url: "wss://relay.example.com", category: ClearOnline}, source)
+		}
+		countMentions(listedRelay{url: "wss://junk-relay", category: Malformed}, 3)
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(malformed) != 0 || len(local) != 0 || len(malformedOrigins) != 0 {
+		t.Errorf("junk listed: malformed %v, local %v, origins %v", malformed, local, malformedOrigins)
+	}
+	if len(relayRecords) != 2 { // The relay and its first source
+		t.Errorf("%d records, want 2", len(relayRecords))
+	}
+	for _, category := range []RelayCategory{Malformed, Local, ClearOnline} {
+		if total := categoryTotal(category); total != 1 {
+			t.Errorf("%s total %d, want 1", category, total)
+		}
+		if count := relayCounts[category].Load(); count != 1 {
+			t.Errorf("%s counter %d, want 1", category, count)
+		}
+	}
+	if credited := relayRecords["wss://source1.example.com"].Discovered; credited != 3 {
+		t.Errorf("first source credited with %d discoveries, want 3", credited)
+	}
+	if suppressed := summarizeExportFilters().Suppressed; suppressed[Malformed] != 1 || suppressed[Local] != 1 {
+		t.Errorf("suppressed %v, want the junk counted", suppressed)
+	}
+}
+
+// syntheticURL returns the n-th URL of a run that mostly finds junk: nine in ten have
+// no TLD and are malformed, the rest are clearnet relays
+func syntheticURL(n int) string {
+	if n%10 == 0 {
+		return fmt.Sprintf("wss://relay%d.example.com", n)
+	}
+	return fmt.Sprintf("wss://junk-relay-%d", n)
+}
+
+// BenchmarkClassifyMillions classifies a few million synthetic URLs and reports the
+// heap they leave behind per URL, with every category exported and with the junk left
+// out of the exports so it is only counted
+func BenchmarkClassifyMillions(b *testing.B) {
+	const urls = 2_000_000
+	for _, bench := range []struct {
+		name   string
+		export []RelayCategory
+	}{
+		{"all-exported", nil},
+		{"junk-counted", []RelayCategory{ClearOnline, ClearOffline}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				resetState(b)
+				cfg.ExportCategories = bench.export
+
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				locked(func() {
+					for n := 0; n < urls; n++ {
+						url := syntheticURL(n)
+						classifyRelay(listedRelay{url: url, category: categorize(url)}, "wss://seed.example.com")
+					}
+				})
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/urls, "B/url")
+				b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/(1<<20), "MB")
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import "math"
+
+// Latency histogram layout: bucket i holds samples up to latencyGrowth^i milliseconds,
+// so estimates are within about 10% and the last bucket reaches several minutes
+const (
+	latencyGrowth  = 1.1
+	latencyBuckets = 140
+)
+
+// latencyHistogram estimates quantiles of millisecond samples without keeping them
+type latencyHistogram struct {
+	counts [latencyBuckets]int64
+	total  int64
+	max    float64
+}
+
+// observe adds a sample in milliseconds
+func (h *latencyHistogram) observe(ms float64) {
+	bucket := 0
+	if ms > 1 {
+		bucket = int(math.Ceil(math.Log(ms) / math.Log(latencyGrowth)))
+	}
+	h.counts[min(bucket, latencyBuckets-1)]++
+	h.total++
+	h.max = math.Max(h.max, ms)
+}
+
+// quantile returns the upper bound of the bucket holding the q-th sample, capped at
+// the largest sample seen
+func (h *latencyHistogram) quantile(q float64) float64 {
+	if h.total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.total)))
+	var seen int64
+	for i, count := range h.counts {
+		seen += count
+		if seen >= rank {
+			return math.Min(math.Pow(latencyGrowth, float64(i)), h.max)
+		}
+	}
+	return h.max
+}
+
+// LatencyQuantiles is the distribution of one crawl phase in milliseconds
+type LatencyQuantiles struct {
+	Count int64   `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+}
+
+// summarize reports the p50/p90/p99 of the histogram, rounded to 0.1ms
+func (h *latencyHistogram) summarize() LatencyQuantiles {
+	round := func(ms float64) float64 { return math.Round(ms*10) / 10 }
+	return LatencyQuantiles{
+		Count: h.total,
+		P50:   round(h.quantile(0.50)),
+		P90:   round(h.quantile(0.90)),
+		P99:   round(h.quantile(0.99)),
+	}
+}
+
+// phaseLatencies holds the histograms of one relay category
+type phaseLatencies struct {
+	dial latencyHistogram
+	eose latencyHistogram
+}
+
+// LatencySummary is the dial and time-to-EOSE distribution of one category
+type LatencySummary struct {
+	Dial LatencyQuantiles `json:"dial"`
+	EOSE LatencyQuantiles `json:"eose"`
+}
+
+// observeLatency feeds a successful crawl's timings into its category's histograms,
+// phases that never happened are skipped. Caller must hold mu.
+func observeLatency(category RelayCategory, timing crawlTiming) {
+	histograms, ok := latencies[category]
+	if !ok {
+		histograms = &phaseLatencies{}
+		latencies[category] = histograms
+	}
+	if timing.dial > 0 {
+		histograms.dial.observe(durationMillis(timing.dial))
+	}
+	if timing.eose > 0 {
+		histograms.eose.observe(durationMillis(timing.eose))
+	}
+}
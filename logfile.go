@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Lines waiting for the log file writer
+const logFileBuffer = 4096
+
+// rotatingLog writes log lines to a file from a single goroutine, rotating it once it
+// reaches maxBytes. Because only that goroutine touches the file, lines written while a
+// rotation is in progress simply wait in the channel.
+type rotatingLog struct {
+	path     string
+	maxBytes int64
+	keep     int
+
+	file *os.File
+	size int64
+
+	mu     sync.Mutex // Guards closed against concurrent Write and Close
+	closed bool
+	lines  chan []byte
+	done   chan struct{}
+}
+
+// openRotatingLog opens path for appending and starts the writer goroutine
+func openRotatingLog(path string, maxBytes int64, keep int) (*rotatingLog, error) {
+	if maxBytes <= 0 || keep < 1 {
+		return nil, fmt.Errorf("log rotation needs a positive size and at least one file")
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open log file: %v", err)
+	}
+
+	l := &rotatingLog{
+		path:     path,
+		maxBytes: maxBytes,
+		keep:     keep,
+		file:     file,
+		size:     info.Size(),
+		lines:    make(chan []byte, logFileBuffer),
+		done:     make(chan struct{}),
+	}
+	go l.writer()
+	return l, nil
+}
+
+// Write queues a copy of p for the writer goroutine
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, os.ErrClosed
+	}
+
+	// Never stall the crawl on a slow disk, count the line as dropped instead
+	select {
+	case l.lines <- line:
+	default:
+		droppedLogLines.Add(1)
+	}
+	return len(p), nil
+}
+
+// writer appends queued lines and rotates the file when it grows too large
+func (l *rotatingLog) writer() {
+	defer close(l.done)
+
+	for line := range l.lines {
+		if l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+			if err := l.rotate(); err != nil {
+				fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+			}
+		}
+		n, _ := l.file.Write(line)
+		l.size += int64(n)
+	}
+	l.file.Close()
+}
+
+// rotate shifts crawlr.log.N-1 to crawlr.log.N, drops the oldest file and starts a new one
+func (l *rotatingLog) rotate() error {
+	l.file.Close()
+
+	// With a single file the current one is just truncated
+	if l.keep > 1 {
+		os.Remove(fmt.Sprintf("%s.%d", l.path, l.keep-1))
+		for i := l.keep - 2; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		os.Rename(l.path, l.path+".1")
+	}
+
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.size = 0
+	return nil
+}
+
+// Close writes out queued lines and closes the file
+func (l *rotatingLog) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.lines)
+	l.mu.Unlock()
+
+	<-l.done
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stalledLog returns a rotatingLog whose writer blocks for good on its first write, as
+// on a hung disk, and the pipe end to unblock it with
+func stalledLog(t *testing.T) (*rotatingLog, *os.File) {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fill the pipe so the writer goroutine's first write blocks
+	writer.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	filler := make([]byte, 1<<16)
+	for {
+		if _, err := writer.Write(filler); err != nil {
+			break
+		}
+	}
+	writer.SetWriteDeadline(time.Time{})
+
+	l := &rotatingLog{
+		path:     os.DevNull,
+		maxBytes: 1 << 30,
+		keep:     1,
+		file:     writer,
+		lines:    make(chan []byte, logFileBuffer),
+		done:     make(chan struct{}),
+	}
+	go l.writer()
+	return l, reader
+}
+
+// runLoggingWorkers logs lines from as many goroutines as a crawl has workers and fails
+// the test if they don't get through in time
+func runLoggingWorkers(t *testing.T, workers, lines int) {
+	t.Helper()
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				crawlLog.Info("crawled relay", "relay", "wss://relay.example.com", "worker", i, "line", j)
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("crawl workers blocked on a stalled log consumer")
+	}
+}
+
+// A log file stuck on a hung disk drops lines instead of stalling the crawl workers
+func TestStalledLogFileDropsLines(t *testing.T) {
+	saved := logger.Handler()
+	t.Cleanup(func() { setupLogging(saved) })
+	droppedLogLines.Store(0)
+
+	l, reader := stalledLog(t)
+	setupLogging(newFileHandler(l))
+
+	const workers, lines = 50, 200
+	runLoggingWorkers(t, workers, lines)
+	if dropped := droppedLogLines.Load(); dropped < workers*lines-logFileBuffer-1 {
+		t.Errorf("dropped %d lines, want at least %d", dropped, workers*lines-logFileBuffer-1)
+	}
+
+	// Once the disk comes back the queued lines are written and Close returns
+	go func() {
+		buf := make([]byte, 1<<16)
+		for {
+			if _, err := reader.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	l.Close()
+	reader.Close()
+
+	if _, err := l.Write([]byte("late line\n")); err != os.ErrClosed {
+		t.Errorf("write after close returned %v, want %v", err, os.ErrClosed)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// How often lines dropped by a full log queue are reported
+const droppedLogReportInterval = 30 * time.Second
+
+// Loggers, replaced by setupLogging once the configuration is known. Each module
+// logger tags its entries with the module it came from.
+var (
+	logLevel   = new(slog.LevelVar)
+	logger     = slog.New(newTerminalHandler(os.Stderr, logLevel))
+	crawlLog   = logger.With("module", "crawl")
+	exportLog  = logger.With("module", "export")
+	storeLog   = logger.With("module", "store")
+	publishLog = logger.With("module", "publish")
+	mainLog    = logger.With("module", "main")
+)
+
+// parseLogLevel converts a level name from the command line
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+	return level, nil
+}
+
+// setupLogging installs the handlers used for the rest of the run
+func setupLogging(handlers ...slog.Handler) {
+	logger = slog.New(fanoutHandler(handlers))
+	crawlLog = logger.With("module", "crawl")
+	exportLog = logger.With("module", "export")
+	storeLog = logger.With("module", "store")
+	publishLog = logger.With("module", "publish")
+	mainLog = logger.With("module", "main")
+}
+
+// newFileHandler formats entries for the log file with full timestamps
+func newFileHandler(w io.Writer) slog.Handler {
+	if cfg.LogFormat == "json" {
+		return newJSONHandler(w, logLevel)
+	}
+	return slog.NewTextHandler(w, &slog.HandlerOptions{Level: logLevel})
+}
+
+// newJSONHandler writes one JSON object per entry for log shippers like Loki or ELK
+func newJSONHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) == 0 {
+				switch attr.Key {
+				case slog.TimeKey:
+					attr.Key = "timestamp"
+				case slog.MessageKey:
+					attr.Key = "message"
+				}
+			}
+			return attr
+		},
+	})
+}
+
+// interactiveTerminal reports whether the TUI may take over stdout, it would corrupt
+// a JSON log stream or a redirected stdout and is off in quiet and no-progress modes.
+// With -stdin standard input carries relay URLs, not keys.
+func interactiveTerminal() bool {
+	return cfg.LogFormat != "json" && !cfg.Quiet && !cfg.NoProgress && !cfg.Stdin && stdoutIsTerminal()
+}
+
+// consoleLevel is the level for stdout, quiet mode only lets errors through there.
+// The log file keeps the configured level.
+func consoleLevel() slog.Leveler {
+	if cfg.Quiet {
+		return quietLevel{}
+	}
+	return logLevel
+}
+
+// quietLevel is the configured level raised to at least error
+type quietLevel struct{}
+
+func (quietLevel) Level() slog.Level {
+	return max(logLevel.Level(), slog.LevelError)
+}
+
+// stdoutIsTerminal reports whether stdout is a character device rather than a file or pipe
+func stdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// startLogging sets up the terminal and optional file handlers for a crawl
+func startLogging() error {
+	var handlers []slog.Handler
+	if cfg.LogFormat == "json" {
+		handlers = append(handlers, newJSONHandler(os.Stdout, consoleLevel()))
+	} else {
+		// Log lines go through the console goroutine from here on
+		if colorEnabled() {
+			handlers = append(handlers, newColorHandler(channelWriter{}, consoleLevel()))
+		} else {
+			handlers = append(handlers, newTerminalHandler(channelWriter{}, consoleLevel()))
+		}
+	}
+
+	if cfg.LogFile != "" {
+		var err error
+		logFile, err = openRotatingLog(runFilePath(cfg.LogFile), int64(cfg.LogMaxSizeMB)<<20, cfg.LogMaxFiles)
+		if err != nil {
+			return err
+		}
+		handlers = append(handlers, newFileHandler(logFile))
+	}
+
+	setupLogging(handlers...)
+	if cfg.LogFormat != "json" {
+		startConsole(screen)
+	}
+	go func() {
+		defer recoverFatal("log reporter")
+		reportDroppedLogs()
+	}()
+	return nil
+}
+
+// channelWriter hands every written log line to logChannel for the console goroutine.
+// A full channel drops the line rather than stalling the caller.
+type channelWriter struct{}
+
+func (channelWriter) Write(p []byte) (int, error) {
+	select {
+	case logChannel <- strings.TrimRight(string(p), "\n"):
+	default:
+		droppedLogLines.Add(1)
+	}
+	return len(p), nil
+}
+
+// reportDroppedLogs warns about log lines lost to a slow consumer since the last report
+func reportDroppedLogs() {
+	var reported int64
+	for range time.Tick(droppedLogReportInterval) {
+		if dropped := droppedLogLines.Load(); dropped > reported {
+			mainLog.Warn("log lines dropped, consumer falling behind", "dropped", dropped-reported, "total_dropped", dropped)
+			reported = dropped
+		}
+	}
+}
+
+// newTerminalHandler formats entries as short key=value lines for humans
+func newTerminalHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	return slog.NewTextHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) == 0 && attr.Key == slog.TimeKey {
+				return slog.String(slog.TimeKey, attr.Value.Time().Format("15:04:05"))
+			}
+			return attr
+		},
+	})
+}
+
+// fanoutHandler passes every entry to several handlers
+type fanoutHandler []slog.Handler
+
+func (f fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range f {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanoutHandler) Handle(ctx context.Context, record slog.Record) error {
+	var errs []error
+	for _, handler := range f {
+		if handler.Enabled(ctx, record.Level) {
+			if err := handler.Handle(ctx, record.Clone()); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(fanoutHandler, len(f))
+	for i, handler := range f {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (f fanoutHandler) WithGroup(name string) slog.Handler {
+	handlers := make(fanoutHandler, len(f))
+	for i, handler := range f {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return handlers
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// captureJSONLogs sends every logger to a JSON handler writing into the returned buffer
+// until the test ends
+func captureJSONLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	saved := logger.Handler()
+	t.Cleanup(func() { setupLogging(saved) })
+
+	var buf bytes.Buffer
+	setupLogging(newJSONHandler(&buf, logLevel))
+	return &buf
+}
+
+// Every line in JSON mode must parse back into an object with the fields log shippers index
+func TestJSONLogLinesParse(t *testing.T) {
+	buf := captureJSONLogs(t)
+
+	crawlLog.Warn("crawl attempt failed", "relay", "wss://relay.example.com", "attempt", 2, "max_attempts", 3,
+		"error", errors.New(`dial tcp: "quoted"`+"\nsecond line"), "error_class", "timeout",
+		"duration", 1500*time.Millisecond, outcomeKey, outcomeRetry)
+	exportLog.Info("wrote export", "path", "out/clear_online_relays.csv", "rows", 12)
+	mainLog.Error("failed to write output", "error", "disk full")
+
+	var entries []map[string]any
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var entry map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("line %q is not a JSON object: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d log lines, want 3", len(entries))
+	}
+
+	for _, entry := range entries {
+		timestamp, _ := entry["timestamp"].(string)
+		if _, err := time.Parse(time.RFC3339Nano, timestamp); err != nil {
+			t.Errorf("timestamp %v: %v", entry["timestamp"], err)
+		}
+		for _, key := range []string{"level", "message", "module"} {
+			if _, ok := entry[key].(string); !ok {
+				t.Errorf("entry %v lacks %s", entry, key)
+			}
+		}
+	}
+
+	failed := entries[0]
+	want := map[string]any{
+		"level":       "WARN",
+		"message":     "crawl attempt failed",
+		"module":      "crawl",
+		"relay":       "wss://relay.example.com",
+		"attempt":     float64(2),
+		"error":       `dial tcp: "quoted"` + "\nsecond line",
+		"error_class": "timeout",
+		"duration":    float64(1500 * time.Millisecond),
+	}
+	for key, value := range want {
+		if failed[key] != value {
+			t.Errorf("%s = %#v, want %#v", key, failed[key], value)
+		}
+	}
+}
+
+// Levels below the configured one stay out of the JSON stream too
+func TestJSONLogLevel(t *testing.T) {
+	buf := captureJSONLogs(t)
+	saved := logLevel.Level()
+	t.Cleanup(func() { logLevel.Set(saved) })
+
+	logLevel.Set(slog.LevelWarn)
+	crawlLog.Debug("discovered relay", "relay", "wss://relay.example.com")
+	crawlLog.Info("crawled relay", "relay", "wss://relay.example.com")
+	if buf.Len() != 0 {
+		t.Errorf("got %q below the warn level", buf.String())
+	}
+}
+
+// The TUI would corrupt a JSON stream on stdout, so JSON mode never starts it
+func TestJSONLogSuppressesProgress(t *testing.T) {
+	resetState(t)
+	cfg.LogFormat = "json"
+	if interactiveTerminal() {
+		t.Error("TUI enabled in JSON log mode")
+	}
+}
+
+// With the console goroutine stalled, e.g. behind a terminal that stopped reading,
+// workers logging through channelWriter carry on and the lost lines are counted
+func TestStalledConsoleDropsLines(t *testing.T) {
+	saved := logger.Handler()
+	t.Cleanup(func() {
+		setupLogging(saved)
+		for len(logChannel) > 0 {
+			<-logChannel
+		}
+	})
+	droppedLogLines.Store(0)
+
+	setupLogging(newTerminalHandler(channelWriter{}, logLevel)) // Nothing reads logChannel
+
+	const workers, lines = 50, 200
+	runLoggingWorkers(t, workers, lines)
+	if len(logChannel) != cap(logChannel) {
+		t.Errorf("log channel holds %d lines, want it full at %d", len(logChannel), cap(logChannel))
+	}
+	if dropped := droppedLogLines.Load(); dropped != int64(workers*lines-cap(logChannel)) {
+		t.Errorf("dropped %d lines, want %d", dropped, workers*lines-cap(logChannel))
+	}
+}
@@ -1,92 +1,447 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/olekukonko/ts"
+	"crawlr2/geoip"
 )
 
-// Update progress and display in the terminal
-func updateProgress() {
-	for {
-		mu.Lock()
-		totalRelays := len(clearOnline) + len(clearOffline) // Include both online and offline relays
-		crawled := len(crawledRelays)
-		mu.Unlock()
+// progressWindow is how many one-second samples the rolling rates cover
+const progressWindow = 60
 
-		remaining := totalRelays - crawled
-		if remaining < 0 {
-			remaining = 0
-		}
+// progressSample is one reading of the crawl counters taken by updateProgress
+type progressSample struct {
+	at         time.Time
+	discovered int
+	crawled    int
+	events     int64
+}
 
-		// Progress calculation
-		var progress float64
-		if totalRelays > 0 {
-			progress = (float64(crawled) / float64(totalRelays)) * 100
-		}
+// sampleProgress reads the counters the progress display is built from
+func sampleProgress(status CrawlStatus) progressSample {
+	return progressSample{at: time.Now(), discovered: status.Discovered, crawled: status.Crawled, events: status.EventsProcessed}
+}
+
+// progressRates keeps a ring of recent samples to derive rolling rates from
+type progressRates struct {
+	samples [progressWindow]progressSample
+	next    int
+	filled  int
+}
 
-		// Print the status at the bottom
-		screen, _ := ts.GetSize()     // Get terminal size to dynamically adjust progress bar width
-		barWidth := screen.Col() - 30 // Adjust width for bar
-		progressBar := generateProgressBar(int(progress), barWidth)
+// add records a sample, overwriting the oldest once the ring is full
+func (p *progressRates) add(sample progressSample) {
+	p.samples[p.next] = sample
+	p.next = (p.next + 1) % progressWindow
+	if p.filled < progressWindow {
+		p.filled++
+	}
+}
 
-		// Clear last line and print status
-		fmt.Printf("\rDiscovered Relays: %d | Crawled Relays: %d | Remaining: %d | [%s] %.2f%%",
-			totalRelays, crawled, remaining, progressBar, progress)
+// perMinute returns the crawl and discovery rates in relays per minute over the window
+func (p *progressRates) perMinute() (crawled, discovered float64) {
+	if p.filled < 2 {
+		return 0, 0
+	}
+	newest := p.samples[(p.next+progressWindow-1)%progressWindow]
+	oldest := p.samples[(p.next+progressWindow-p.filled)%progressWindow]
+	minutes := newest.at.Sub(oldest.at).Minutes()
+	if minutes <= 0 {
+		return 0, 0
+	}
+	return float64(newest.crawled-oldest.crawled) / minutes, float64(newest.discovered-oldest.discovered) / minutes
+}
+
+// eventsPerSecond returns the event rate between the last two samples, so a stall
+// shows up within a second
+func (p *progressRates) eventsPerSecond() float64 {
+	if p.filled < 2 {
+		return 0
+	}
+	newest := p.samples[(p.next+progressWindow-1)%progressWindow]
+	previous := p.samples[(p.next+progressWindow-2)%progressWindow]
+	seconds := newest.at.Sub(previous.at).Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(newest.events-previous.events) / seconds
+}
+
+// estimateRemaining guesses how long the frontier takes to drain at the current rates.
+// The frontier shrinks only by what crawling outpaces discovery.
+func estimateRemaining(remaining int, crawlRate, discoveryRate float64) string {
+	switch {
+	case remaining == 0:
+		return "done"
+	case crawlRate <= 0:
+		return "∞"
+	case discoveryRate >= crawlRate:
+		return "growing"
+	}
+	eta := time.Duration(float64(remaining) / (crawlRate - discoveryRate) * float64(time.Minute))
+	return "~" + eta.Round(time.Second).String()
+}
+
+// updateProgress logs a plain progress line every progressLogInterval, used when
+// there is no terminal for the TUI
+func updateProgress() {
+	var rates progressRates
+	lastLogged := time.Now()
+	for {
+		status := snapshotStatus()
+		rates.add(sampleProgress(status))
+		observeUtilization()
+
+		if time.Since(lastLogged) >= progressLogInterval {
+			lastLogged = time.Now()
+			crawlRate, discoveryRate := rates.perMinute()
+			mainLog.Info("progress", "discovered", status.Discovered, "crawled", status.Crawled,
+				"remaining", status.Remaining, "progress_percent", fmt.Sprintf("%.2f", status.Progress),
+				"crawled_per_minute", fmt.Sprintf("%.0f", crawlRate),
+				"discovered_per_minute", fmt.Sprintf("%.0f", discoveryRate),
+				"eta_estimate", estimateRemaining(status.Remaining, crawlRate, discoveryRate),
+				"events", status.EventsProcessed, "events_per_second", fmt.Sprintf("%.1f", rates.eventsPerSecond()),
+				"workers_busy", status.BusyWorkers, "target_concurrency", status.TargetConcurrency,
+				"worker_utilization_percent", fmt.Sprintf("%.0f", status.workerUtilization()))
+		}
 
 		time.Sleep(1 * time.Second)
 	}
 }
 
-// Generate a progress bar
+// Generate a progress bar, empty when the width is not positive
 func generateProgressBar(progress int, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	progress = max(0, min(progress, 100))
 	filled := (progress * width) / 100
-	bar := ""
-	for i := 0; i < filled; i++ {
-		bar += "="
+	return strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+}
+
+// crawlPass asks the seed for relay lists and waits until the pool has crawled every
+// relay found since, a panic ends only this pass
+func crawlPass(seedRelay string) {
+	defer recoverAndLog("crawl pass")
+
+	passNumber.Add(1)
+	passStart := time.Now()
+	crawledBefore := snapshotStatus().Crawled
+
+	err := ReqKind10002(seedRelay)
+	if err != nil {
+		mainLog.Warn("seed crawl failed", "relay", seedRelay, "error", err, "error_class", classifyFailure(err))
 	}
-	for i := filled; i < width; i++ {
-		bar += " "
+	locked(drawSample)
+
+	waitForIdleFrontier()
+	crawled := snapshotStatus().Crawled - crawledBefore
+	metricPassDuration.Observe(time.Since(passStart).Seconds())
+
+	// A pass with nothing to crawl starts or continues an idle stretch
+	if crawled == 0 {
+		idleSince.CompareAndSwap(0, time.Now().UnixNano())
+	} else {
+		idleSince.Store(0)
+		notifyWebhooks(WebhookEvent{Type: WebhookPass, Pass: passNumber.Load()})
+	}
+
+	mu.Lock()
+	discovered := len(clearOnline)
+	mu.Unlock()
+	mainLog.Info("crawl pass finished", "online_relays", discovered)
+}
+
+// finishWhenDrained ends the run through exitSignal once standard input is closed and
+// every relay queued so far, the -sample drawn by then, has been crawled
+func finishWhenDrained(exitSignal chan os.Signal, reason string) {
+	<-stdinClosed
+	locked(drawSample)
+	waitForIdleFrontier()
+	mainLog.Info(reason)
+	select {
+	case exitSignal <- syscall.SIGTERM:
+	default: // A signal is already waiting, shutdown is underway
 	}
-	return bar
 }
 
 func main() {
+	// "crawlr verify <dir>" checks an archived run against its manifest
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		dir := defaultOutputDir
+		if len(os.Args) > 2 {
+			dir = os.Args[2]
+		}
+		if err := verifyRun(dir); err != nil {
+			fmt.Fprintf(os.Stderr, "Verification failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("All files match the manifest")
+		return
+	}
+
+	// "crawlr replay [flags] <archive>" rebuilds the exports from an event archive
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		parseFlags(os.Args[2:])
+		if flag.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "Usage: crawlr replay [flags] <archive>")
+			os.Exit(2)
+		}
+		if err := runReplay(flag.Arg(0)); err != nil {
+			fmt.Fprintf(os.Stderr, "Replay failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// "crawlr trend [flags] <history>" prints the time series of a -history file
+	if len(os.Args) > 1 && os.Args[1] == "trend" {
+		if err := runTrend(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Trend failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	parseFlags(os.Args[1:])
+	if err := validateConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	defer recoverFatal("main")
+
+	seedSampling()
+	runStart = time.Now()
+	runID = newRunID()
+	seedRelays = []string{cfg.SeedRelay}
+
+	if err := prepareOutputDir(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if cfg.Availability != "" {
+		if err := loadAvailability(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: starting with an empty availability history: %v\n", err)
+		}
+	}
+
+	if cfg.Reference != "" {
+		if err := loadReference(cfg.Reference); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot load reference list: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.History != "" {
+		if err := loadTrendBaseline(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: new and disappeared relays won't be counted: %v\n", err)
+		}
+	}
+
+	if cfg.ProbeList != "" {
+		seedRelays = nil // Nothing is discovered, the list is the whole frontier
+		listed, err := loadProbeList(cfg.ProbeList)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot read relay list: %v\n", err)
+			os.Exit(1)
+		}
+		mainLog.Info("probing listed relays", "relays", listed)
+	} else if !cfg.NoBootstrap {
+		loaded, err := bootstrapFrontier()
+		if err != nil {
+			mainLog.Warn("bootstrap skipped", "error", err)
+		} else if loaded > 0 {
+			mainLog.Info("loaded relays from the previous run", "relays", loaded)
+		}
+	}
+	if cfg.SeedNostrWatch && cfg.ProbeList == "" {
+		seeded, err := seedFromNostrWatch()
+		if err != nil {
+			mainLog.Warn("nostr.watch seeding skipped, crawling from the configured seeds", "error", err)
+		} else {
+			mainLog.Info("seeded relays from nostr.watch", "relays", seeded)
+		}
+	}
+
+	var err error
+	if store, err = openStore(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if store != nil {
+		if err := store.BeginRun(runMetadata()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := openTracers(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	openSpanExporter()
+
+	if cfg.ArchivePath != "" {
+		if archive, err = openArchive(cfg.ArchivePath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	exitSignal := make(chan os.Signal, 1)
 	signal.Notify(exitSignal, os.Interrupt, syscall.SIGTERM)
+	startRunTimer(exitSignal)
 
-	go logRelayEvents() // Start the logger goroutine
+	if cfg.ConfigFile != "" {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			defer recoverFatal("config reload")
+			for range reload {
+				reloadConfigFile()
+			}
+		}()
+	}
 
-	go func() {
-		initialRelay := "wss://nos.lol"
-		concurrency := 200 // Adjust this value based on your needs and system capabilities
+	if interactiveTerminal() {
+		if screen, err = startTUI(exitSignal); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: falling back to plain output: %v\n", err)
+		}
+	}
 
-		for {
-			err := ReqKind10002(initialRelay)
-			if err != nil {
-				logChannel <- fmt.Sprintf("Initial crawl failed: %v", err)
-			}
+	if err := startLogging(); err != nil {
+		if screen != nil {
+			screen.leave()
+		}
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	logConfig()
 
-			crawlClearOnlineRelays(concurrency)
+	if cfg.Pprof && cfg.HTTPAddr == "" {
+		fmt.Fprintln(os.Stderr, "Error: -pprof needs -http-addr")
+		os.Exit(1)
+	}
+	if cfg.NIP66DryRun == "" && len(cfg.NIP66Relays) > 0 {
+		if cfg.SecretKey == "" {
+			fmt.Fprintln(os.Stderr, "Error: -nip66-relays needs -secret-key")
+			os.Exit(1)
+		}
+		if _, err := parseSecretKey(cfg.SecretKey); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-			mu.Lock()
-			logChannel <- fmt.Sprintf("Discovered relays: %d", len(clearOnline))
-			mu.Unlock()
+	httpServer, err := startHTTPServer(cfg.HTTPAddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
-			time.Sleep(2 * time.Second)
+	if cfg.GeoIP != "" {
+		if geoDB, err = geoip.Load(cfg.GeoIP); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot load GeoIP database: %v\n", err)
+			os.Exit(1)
+		}
+		mainLog.Info("loaded GeoIP database", "ranges", geoDB.Len())
+	}
+	if cfg.ASNDB != "" {
+		if asnDB, err = geoip.LoadASN(cfg.ASNDB); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot load AS database: %v\n", err)
+			os.Exit(1)
 		}
+		mainLog.Info("loaded AS database", "ranges", asnDB.Len())
+	}
+	if cfg.NIP11 {
+		startEnrichment()
+	}
+	if cfg.ProbeNIPs {
+		startNIPProbes()
+	}
+	if len(cfg.Webhooks) > 0 {
+		go func() {
+			defer recoverFatal("webhooks")
+			runWebhookSender()
+		}()
+	}
+
+	if cfg.Adaptive {
+		start := max(cfg.MinConcurrency, min(cfg.MaxConcurrency, cfg.Concurrency))
+		startCrawlPool(cfg.MaxConcurrency, start)
+		go func() {
+			defer recoverFatal("adaptive concurrency")
+			runAdaptiveConcurrency()
+		}()
+	} else {
+		startCrawlPool(cfg.Concurrency, cfg.Concurrency)
+	}
+	startParsers(runtime.NumCPU(), parseQueueSize)
+	startStdinSeeds()
+
+	if cfg.ProbeList != "" {
+		go func() {
+			defer recoverFatal("probe")
+			finishWhenDrained(exitSignal, "every listed relay probed")
+		}()
+	} else {
+		go func() {
+			initialRelay := cfg.SeedRelay
+
+			for {
+				waitWhilePaused()
+				passDone := limitPass()
+				crawlPass(initialRelay)
+				passDone()
+				maybePublishMonitorEvents()
+				if cfg.Once {
+					finishWhenDrained(exitSignal, "single crawl pass finished")
+					return
+				}
+				nextPassAt.Store(time.Now().Add(passInterval).UnixNano())
+				time.Sleep(passInterval)
+			}
+		}()
+	}
+
+	if cfg.MemoryLimitMB > 0 {
+		go func() {
+			defer recoverFatal("memory guard")
+			runMemoryGuard()
+		}()
+	}
+	go func() {
+		defer recoverFatal("timeline")
+		recordTimeline()
+	}()
+	go func() {
+		defer recoverFatal("heartbeat")
+		logHeartbeat()
 	}()
 
-	// Start the progress updater in a separate goroutine
-	go updateProgress()
+	// Without the TUI, report progress as plain log lines
+	if screen == nil {
+		go func() {
+			defer recoverFatal("progress")
+			updateProgress()
+		}()
+	}
 
 	// Wait for an exit signal (Ctrl+C or kill)
 	<-exitSignal
 
-	fmt.Println("\nReceived exit signal, writing logs and exiting...")
+	screen.Stop()
+	mainLog.Info("received exit signal, writing output and exiting")
+	stopHTTPServer(httpServer)
+	drainParsers()
+	flushOpenSessions()
 	finalize()
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// resetState gives a test an empty crawl and its own output directory, restoring the
+// configuration when it ends. The crawl state is global, so tests using it don't run
+// in parallel.
+func resetState(t testing.TB) {
+	t.Helper()
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+
+	mu.Lock()
+	clearOnline = make(map[string]int)
+	clearOffline = make(map[string]int)
+	clearAPI = make(map[string]int)
+	onion = make(map[string]int)
+	local = make(map[string]int)
+	malformed = make(map[string]int)
+	relayRecords = make(map[string]*RelayRecord)
+	junkRelays = newSeenSet()
+	malformedOrigins = make(map[string]origin)
+	offlineReasons = make(map[string]int)
+	domainStats = make(map[string]*DomainStats)
+	recentDiscoveries = nil
+	latencies = make(map[RelayCategory]*phaseLatencies)
+	frontierPending = 0
+	timeline = nil
+	outputRows = make(map[string]int)
+	mu.Unlock()
+
+	for _, count := range relayCounts {
+		count.Store(0)
+	}
+	succeededRelays.Store(0)
+	remainingRelays.Store(0)
+	notProbedRelays.Store(0)
+
+	cfg.OutputDir = t.TempDir()
+	runStart = time.Now()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+
+	"crawlr2/atomicfile"
+)
+
+// Manifest lists every file a run produced so archived runs can be verified
+type Manifest struct {
+	Version int                   `json:"version"`
+	Run     RunMetadata           `json:"run"`
+	Totals  map[RelayCategory]int `json:"totals"`
+	Config  Config                `json:"config"`
+	Files   []ManifestFile        `json:"files"`
+}
+
+// ManifestFile describes one output file of a run
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Rows   int    `json:"rows"`
+}
+
+// recordOutput registers a finished output file and its row count for the manifest,
+// caller must hold exportMu
+func recordOutput(path string, rows int) {
+	outputRows[path] = rows
+	exportLog.Debug("wrote export", "path", path, "rows", rows)
+}
+
+// crawlerCommit returns the VCS revision the binary was built from, if known
+func crawlerCommit() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return ""
+}
+
+// hashFile returns the size and hex SHA-256 of a file
+func hashFile(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeManifest writes manifest.json for every recorded output, must run after all
+// other files are committed. Caller must hold mu.
+func writeManifest(run RunMetadata) error {
+	manifest := Manifest{
+		Version: relaysSchemaVersion,
+		Run:     run,
+		Totals:  make(map[RelayCategory]int),
+		Config:  cfg,
+	}
+	for _, category := range allCategories {
+		manifest.Totals[category] = categoryTotal(category)
+	}
+
+	paths := make([]string, 0, len(outputRows))
+	for path := range outputRows {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		size, sum, err := hashFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s: %v", path, err)
+		}
+		name, err := filepath.Rel(runDir(), path)
+		if err != nil {
+			name = path
+		}
+		manifest.Files = append(manifest.Files, ManifestFile{
+			Name:   filepath.ToSlash(name),
+			Size:   size,
+			SHA256: sum,
+			Rows:   outputRows[path],
+		})
+	}
+
+	file, err := atomicfile.Create(runFilePath("manifest.json"))
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Commit()
+}
+
+// verifyRun checks the files in a run directory against its manifest and reports
+// every mismatch. It returns an error if anything doesn't match.
+func verifyRun(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("failed to parse manifest: %v", err)
+	}
+
+	failures := 0
+	for _, entry := range manifest.Files {
+		size, sum, err := hashFile(filepath.Join(dir, filepath.FromSlash(entry.Name)))
+		switch {
+		case err != nil:
+			fmt.Printf("MISSING  %s: %v\n", entry.Name, err)
+			failures++
+		case size != entry.Size || sum != entry.SHA256:
+			fmt.Printf("MISMATCH %s\n", entry.Name)
+			failures++
+		default:
+			fmt.Printf("OK       %s\n", entry.Name)
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d of %d files failed verification", failures, len(manifest.Files))
+	}
+	return nil
+}
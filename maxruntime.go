@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// With -max-runtime the run ends on its own once it has crawled that long: no further
+// relays are handed to workers and no new pass starts, open connections get
+// maxRuntimeGrace to finish and the run then shuts down like on SIGTERM. A signal
+// arriving first, also during the grace period, ends the run right away as usual.
+// Crawling continuously, the limit is per pass: the clock restarts as each pass starts
+// and stops once it's through, so only a pass running over ends the run.
+
+// How long crawls still in flight may take once -max-runtime has passed
+const maxRuntimeGrace = 10 * time.Second
+
+// Set once the run is past -max-runtime, holds back new crawls like a pause
+var runExpired atomic.Bool
+
+// Fires at -max-runtime, nil without it
+var runTimer *time.Timer
+
+// TimeLimitSummary reports a run ended by -max-runtime
+type TimeLimitSummary struct {
+	MaxRuntime string `json:"max_runtime"`
+	Unvisited  int    `json:"unvisited_frontier"` // Relays queued or still being crawled at the end
+}
+
+// startRunTimer ends the run at -max-runtime after launch, or after a pass started with
+// limitPass, by sending exitSignal, the channel signals arrive on
+func startRunTimer(exitSignal chan os.Signal) {
+	if cfg.MaxRuntime <= 0 {
+		return
+	}
+	runTimer = time.AfterFunc(time.Until(runStart.Add(cfg.MaxRuntime)), func() {
+		defer recoverFatal("max runtime")
+		runExpired.Store(true)
+		mainLog.Info("max runtime reached, letting open crawls finish", "max_runtime", cfg.MaxRuntime,
+			"grace", maxRuntimeGrace)
+
+		deadline := time.Now().Add(maxRuntimeGrace)
+		for time.Now().Before(deadline) && crawlsInFlight() > 0 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		select {
+		case exitSignal <- syscall.SIGTERM:
+		default: // A signal is already waiting, shutdown is underway
+		}
+	})
+}
+
+// limitPass restarts the -max-runtime clock as a continuous crawl's pass starts and
+// returns a func stopping it once the pass is through. With -once the run is a single
+// pass, its limit counts from launch.
+func limitPass() func() {
+	if runTimer == nil || cfg.Once || runExpired.Load() {
+		return func() {}
+	}
+	runTimer.Reset(cfg.MaxRuntime)
+	return func() { runTimer.Stop() }
+}
+
+// crawlsInFlight counts the relays a connection is open to
+func crawlsInFlight() int {
+	inFlightMu.Lock()
+	defer inFlightMu.Unlock()
+	return len(inFlight)
+}
+
+// summarizeTimeLimit reports the frontier left by -max-runtime, nil when the run ended
+// otherwise. Caller must hold mu.
+func summarizeTimeLimit() *TimeLimitSummary {
+	if !runExpired.Load() {
+		return nil
+	}
+	return &TimeLimitSummary{MaxRuntime: cfg.MaxRuntime.String(), Unvisited: frontierPending}
+}
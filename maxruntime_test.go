@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// startTestRunTimer arms the -max-runtime timer from now, returning the channel it
+// signals on, and disarms it when the test ends
+func startTestRunTimer(t *testing.T, limit time.Duration) chan os.Signal {
+	t.Helper()
+	resetState(t)
+	cfg.MaxRuntime = limit
+	exitSignal := make(chan os.Signal, 1)
+	startRunTimer(exitSignal)
+	t.Cleanup(func() {
+		runTimer.Stop()
+		runTimer = nil
+		runExpired.Store(false)
+	})
+	return exitSignal
+}
+
+// Crawling continuously, passes within the limit never end the run however long the
+// run gets, however long the waits between them, and a pass running over does
+func TestRunTimerPerPass(t *testing.T) {
+	const limit = 100 * time.Millisecond
+	exitSignal := startTestRunTimer(t, limit)
+
+	for pass := 0; pass < 4; pass++ {
+		passDone := limitPass()
+		time.Sleep(limit / 2)
+		passDone()
+		time.Sleep(2 * limit) // Between passes
+	}
+	select {
+	case <-exitSignal:
+		t.Fatal("run ended though no pass ran over -max-runtime")
+	default:
+	}
+	if runExpired.Load() {
+		t.Fatal("run expired though no pass ran over -max-runtime")
+	}
+
+	started := time.Now()
+	limitPass()
+	select {
+	case <-exitSignal:
+		if elapsed := time.Since(started); elapsed < limit {
+			t.Errorf("run ended %v into the pass, before -max-runtime", elapsed)
+		}
+	case <-time.After(10 * limit):
+		t.Fatal("pass ran over -max-runtime without ending the run")
+	}
+	if !runExpired.Load() {
+		t.Error("run not marked expired")
+	}
+	if summary := summarizeTimeLimit(); summary == nil || summary.MaxRuntime != limit.String() {
+		t.Errorf("time limit summary = %+v", summary)
+	}
+}
+
+// With -once the limit counts from launch, a pass doesn't restart it
+func TestRunTimerOnce(t *testing.T) {
+	const limit = 100 * time.Millisecond
+	exitSignal := startTestRunTimer(t, limit)
+	cfg.Once = true
+
+	time.Sleep(limit / 2)
+	passDone := limitPass()
+	select {
+	case <-exitSignal:
+	case <-time.After(limit):
+		t.Fatal("pass restarted the -once limit")
+	}
+	passDone()
+	if !runExpired.Load() {
+		t.Error("run not marked expired")
+	}
+}
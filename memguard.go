@@ -0,0 +1,78 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// The memory guard keeps the crawler under -memory-limit on small machines. While the
+// memory the Go runtime holds from the OS is above the limit, no new crawls or seed
+// queries start, the parse queue is held to a fraction of its size and a checkpoint is
+// written in case the process is killed anyway. It lets go once usage falls below
+// memoryResumeShare of the limit.
+
+// Memory guard state, read from the crawl loops without taking mu
+var (
+	memoryThrottled   atomic.Bool
+	memoryActivations atomic.Int64
+	memoryThrottledNs atomic.Int64 // Time spent throttled, up to the last release
+	memoryPeakBytes   atomic.Uint64
+)
+
+// MemoryGuardSummary reports how often the memory guard held the crawl back
+type MemoryGuardSummary struct {
+	LimitMB          int     `json:"limit_mb"`
+	PeakMB           int     `json:"peak_mb"`
+	Activations      int64   `json:"activations"`
+	ThrottledSeconds float64 `json:"throttled_seconds"`
+}
+
+// runMemoryGuard samples memory use every memoryGuardInterval for the rest of the run
+func runMemoryGuard() {
+	limit := uint64(cfg.MemoryLimitMB) << 20
+	resume := uint64(float64(limit) * memoryResumeShare)
+
+	var throttledAt time.Time
+	var stats runtime.MemStats
+	for range time.Tick(memoryGuardInterval) {
+		runtime.ReadMemStats(&stats)
+		used := stats.Sys - stats.HeapReleased
+		if used > memoryPeakBytes.Load() {
+			memoryPeakBytes.Store(used)
+		}
+
+		switch {
+		case !memoryThrottled.Load() && used > limit:
+			throttledAt = time.Now()
+			memoryThrottled.Store(true)
+			memoryActivations.Add(1)
+			mainLog.Warn("memory limit reached, holding back discovery", "used_mb", used>>20,
+				"limit_mb", cfg.MemoryLimitMB)
+			debug.FreeOSMemory()
+			go func() {
+				defer recoverAndLog("memory guard checkpoint")
+				checkpoint()
+			}()
+		case memoryThrottled.Load() && used < resume:
+			memoryThrottled.Store(false)
+			memoryThrottledNs.Add(int64(time.Since(throttledAt)))
+			mainLog.Info("memory use back under the limit, resuming discovery", "used_mb", used>>20,
+				"throttled_for", time.Since(throttledAt).Round(time.Second))
+		}
+	}
+}
+
+// summarizeMemoryGuard reports the guard's activity, nil when it is off
+func summarizeMemoryGuard() *MemoryGuardSummary {
+	if cfg.MemoryLimitMB <= 0 {
+		return nil
+	}
+	return &MemoryGuardSummary{
+		LimitMB:          cfg.MemoryLimitMB,
+		PeakMB:           int(memoryPeakBytes.Load() >> 20),
+		Activations:      memoryActivations.Load(),
+		ThrottledSeconds: time.Duration(memoryThrottledNs.Load()).Seconds(),
+	}
+}
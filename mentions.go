@@ -0,0 +1,116 @@
+package main
+
+import "sync"
+
+// A list session is everything one relay sends back for a relay list query. Most of
+// its mentions are of relays the session already listed, so those are only counted in
+// the session and merged into the shared lists in one go: when the session ends and
+// every mentionFlushEvents events in between. The first mention of each relay is still
+// merged right away, so new relays reach the frontier as promptly as before.
+type listSession struct {
+	relay string
+
+	// Taken before mu and never while holding it, so merges can nest mu inside it
+	mu      sync.Mutex
+	seen    map[string]bool     // Relays whose first mention was merged
+	pending map[listedRelay]int // Later mentions not yet counted in the shared lists
+	pubkeys []string            // Authors not yet added to the relay's record
+	events  int
+}
+
+// Sessions that haven't ended yet, flushed on shutdown
+var (
+	sessionsMu   sync.Mutex
+	openSessions = make(map[*listSession]struct{})
+)
+
+// openListSession starts a session for the lists read from relayURL
+func openListSession(relayURL string) *listSession {
+	session := &listSession{
+		relay:   relayURL,
+		seen:    make(map[string]bool),
+		pending: make(map[listedRelay]int),
+	}
+	sessionsMu.Lock()
+	openSessions[session] = struct{}{}
+	sessionsMu.Unlock()
+	return session
+}
+
+// add records the relays and author of one event. Caller must not hold mu.
+func (s *listSession) add(relays []listedRelay, pubkey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var fresh []listedRelay
+	for _, relay := range relays {
+		if s.seen[relay.url] {
+			s.pending[relay]++
+			continue
+		}
+		s.seen[relay.url] = true
+		fresh = append(fresh, relay)
+	}
+	if pubkey != "" {
+		s.pubkeys = append(s.pubkeys, pubkey)
+	}
+	s.events++
+
+	flush := s.events%mentionFlushEvents == 0
+	if len(fresh) == 0 && !flush {
+		return
+	}
+	locked(func() {
+		for _, relay := range fresh {
+			classifyRelay(relay, s.relay)
+		}
+		if flush {
+			s.mergeLocked()
+		}
+	})
+}
+
+// close merges what the session still holds, once every frame it read was parsed
+func (s *listSession) close() {
+	sessionsMu.Lock()
+	delete(openSessions, s)
+	sessionsMu.Unlock()
+	s.flush()
+}
+
+// flush merges the pending mentions and authors into the shared state
+func (s *listSession) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	locked(s.mergeLocked)
+}
+
+// mergeLocked counts the pending mentions and authors, caller must hold s.mu and mu
+func (s *listSession) mergeLocked() {
+	if len(s.pubkeys) > 0 {
+		record := recordFor(s.relay)
+		for _, pubkey := range s.pubkeys {
+			record.addPubkey(pubkey)
+		}
+		s.pubkeys = s.pubkeys[:0]
+	}
+	for relay, mentions := range s.pending {
+		countMentions(relay, mentions)
+	}
+	clear(s.pending)
+}
+
+// flushOpenSessions merges every session still reading, so a shutdown mid-session
+// exports the same counts as if the mentions had been merged one by one
+func flushOpenSessions() {
+	sessionsMu.Lock()
+	sessions := make([]*listSession, 0, len(openSessions))
+	for session := range openSessions {
+		sessions = append(sessions, session)
+	}
+	sessionsMu.Unlock()
+
+	for _, session := range sessions {
+		session.flush()
+	}
+}
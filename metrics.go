@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is anything that can render itself in the Prometheus text format
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+// gauge is a value that can go up and down
+type gauge struct {
+	name, help string
+	value      atomic.Int64
+}
+
+func (g *gauge) Inc()        { g.value.Add(1) }
+func (g *gauge) Dec()        { g.value.Add(-1) }
+func (g *gauge) Load() int64 { return g.value.Load() }
+func (g *gauge) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value.Load())
+}
+
+// counterVec is a counter partitioned by a single label
+type counterVec struct {
+	name, help, label string
+	mu                sync.Mutex
+	values            map[string]int64
+}
+
+func (c *counterVec) Inc(labelValue string) {
+	c.mu.Lock()
+	c.values[labelValue]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	values := make(map[string]int, len(c.values))
+	for key, value := range c.values {
+		values[key] = int(value)
+	}
+	c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, key, values[key])
+	}
+}
+
+// funcMetric is a metric whose values are computed when scraped, kind is the
+// Prometheus type and an empty label means a single unlabeled value
+type funcMetric struct {
+	name, help, kind, label string
+	collect                 func() map[string]int
+}
+
+func (g *funcMetric) writeTo(w io.Writer) {
+	values := g.collect()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", g.name, g.help, g.name, g.kind)
+	if g.label == "" {
+		fmt.Fprintf(w, "%s %d\n", g.name, values[""])
+		return
+	}
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", g.name, g.label, key, values[key])
+	}
+}
+
+// histogram counts observations into cumulative buckets
+type histogram struct {
+	name, help string
+	buckets    []float64
+	mu         sync.Mutex
+	counts     []uint64
+	sum        float64
+	count      uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, strconv.FormatFloat(h.sum, 'g', -1, 64), h.name, h.count)
+}
+
+// All crawler metrics, registered in metricsRegistry below
+var (
+	metricDiscovered = &counterVec{name: "crawlr_relays_discovered_total", label: "category",
+		help: "Distinct relays discovered per category.", values: make(map[string]int64)}
+	metricCrawled = &counterVec{name: "crawlr_relays_crawled_total", label: "result",
+		help: "Relays crawled, by result.", values: make(map[string]int64)}
+	metricDialErrors = &counterVec{name: "crawlr_dial_errors_total", label: "reason",
+		help: "Failed websocket dials by failure class.", values: make(map[string]int64)}
+	metricActiveConnections = &gauge{name: "crawlr_active_connections",
+		help: "Open websocket connections."}
+	metricPassDuration = newHistogram("crawlr_crawl_pass_duration_seconds",
+		"Duration of crawl passes.", []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800})
+)
+
+var metricsRegistry = []metric{
+	metricDiscovered,
+	metricCrawled,
+	metricDialErrors,
+	metricActiveConnections,
+	metricPassDuration,
+	&funcMetric{name: "crawlr_relays", kind: "gauge", label: "category",
+		help: "Relays currently in each category.", collect: categorySizes},
+	&funcMetric{name: "crawlr_frontier_size", kind: "gauge",
+		help: "Online relays waiting to be crawled.", collect: func() map[string]int {
+			return map[string]int{"": frontierSize()}
+		}},
+	&funcMetric{name: "crawlr_dead_relay_skips_total", kind: "counter",
+		help: "Mentions of offline relays not redialed because they failed within -dead-relay-ttl.",
+		collect: func() map[string]int {
+			return map[string]int{"": int(deadRelayHits.Load())}
+		}},
+	&funcMetric{name: "crawlr_events_processed_total", kind: "counter",
+		help: "Relay list events processed.", collect: func() map[string]int {
+			return map[string]int{"": int(eventsProcessed.Load())}
+		}},
+	&funcMetric{name: "crawlr_bytes_transferred_total", kind: "counter",
+		help: "Websocket payload bytes sent and received.", collect: func() map[string]int {
+			return map[string]int{"": int(bytesTransferred.Load())}
+		}},
+}
+
+// categorySizes returns the number of relays per category
+func categorySizes() map[string]int {
+	sizes := make(map[string]int, len(allCategories))
+	for _, category := range allCategories {
+		sizes[string(category)] = int(relayCounts[category].Load())
+	}
+	return sizes
+}
+
+// frontierSize counts online relays that haven't been crawled yet
+func frontierSize() int {
+	return int(remainingRelays.Load())
+}
+
+// handleMetrics serves all registered metrics in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metricsRegistry {
+		m.writeTo(w)
+	}
+}
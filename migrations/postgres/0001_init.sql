@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS runs (
+    id              TEXT PRIMARY KEY,
+    started_at      TIMESTAMPTZ NOT NULL,
+    finished_at     TIMESTAMPTZ,
+    crawler_version TEXT NOT NULL,
+    crawler_commit  TEXT,
+    seed            TEXT[] NOT NULL DEFAULT '{}'
+);
+
+CREATE TABLE IF NOT EXISTS relays (
+    url           TEXT PRIMARY KEY,
+    category      TEXT NOT NULL,
+    discovered_by TEXT,
+    first_seen    TIMESTAMPTZ NOT NULL,
+    last_seen     TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS relay_observations (
+    run_id         TEXT NOT NULL REFERENCES runs (id) ON DELETE CASCADE,
+    url            TEXT NOT NULL REFERENCES relays (url) ON DELETE CASCADE,
+    observed_at    TIMESTAMPTZ NOT NULL,
+    category       TEXT NOT NULL,
+    count          INTEGER NOT NULL,
+    failure_reason TEXT,
+    failure_class  TEXT,
+    unique_pubkeys INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (run_id, url)
+);
+
+CREATE INDEX IF NOT EXISTS relay_observations_url_idx ON relay_observations (url);
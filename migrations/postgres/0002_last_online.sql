@@ -0,0 +1 @@
+ALTER TABLE relays ADD COLUMN IF NOT EXISTS last_online TIMESTAMPTZ;
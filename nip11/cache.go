@@ -0,0 +1,108 @@
+package nip11
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"crawlr2/atomicfile"
+)
+
+// cacheEntry is the NIP-11 document of one relay host and how to revalidate it
+type cacheEntry struct {
+	FetchedAt    time.Time       `json:"fetched_at"`
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"last_modified,omitempty"`
+	Document     json.RawMessage `json:"document"`
+	FinalURL     string          `json:"final_url,omitempty"` // Where redirects ended, if anywhere
+}
+
+// Cache keeps NIP-11 documents on disk between runs, keyed by relay host
+type Cache struct {
+	path string
+	ttl  time.Duration
+
+	mu          sync.Mutex
+	entries     map[string]cacheEntry
+	hits        int // Served from the cache without a request
+	revalidated int // Stale, but the server answered 304 Not Modified
+	misses      int // Fetched in full
+}
+
+// LoadCache reads the cache file, a missing file is an empty cache. A file that cannot
+// be read or parsed also gives an empty, usable cache along with the error, so a
+// corrupt cache costs one full fetch of every document rather than the run.
+func LoadCache(path string, ttl time.Duration) (*Cache, error) {
+	cache := &Cache{path: path, ttl: ttl, entries: make(map[string]cacheEntry)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return cache, fmt.Errorf("failed to read cache: %v", err)
+	}
+	if err := json.Unmarshal(data, &cache.entries); err != nil {
+		cache.entries = make(map[string]cacheEntry) // Unmarshal may have filled in part of it
+		return cache, fmt.Errorf("failed to parse cache %s: %v", path, err)
+	}
+	return cache, nil
+}
+
+// lookup returns the cached entry of a host and whether it is still fresh
+func (c *Cache) lookup(host string) (cacheEntry, bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[host]
+	return entry, ok, ok && time.Since(entry.FetchedAt) < c.ttl
+}
+
+// store records a fetched document along with its validators and the URL it was
+// served from. A 304 response may leave out validators, those of the previous entry
+// are kept then.
+func (c *Cache) store(host string, resp *http.Response, document []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous := c.entries[host]
+	entry := cacheEntry{
+		FetchedAt:    time.Now().UTC(),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Document:     document,
+		FinalURL:     resp.Request.URL.String(),
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		entry.ETag = cmp.Or(entry.ETag, previous.ETag)
+		entry.LastModified = cmp.Or(entry.LastModified, previous.LastModified)
+	}
+	c.entries[host] = entry
+}
+
+// count tallies how a lookup was served
+func (c *Cache) count(counter *int) {
+	c.mu.Lock()
+	*counter++
+	c.mu.Unlock()
+}
+
+// Stats returns how many lookups were served from the cache, revalidated with the
+// relay and fetched in full
+func (c *Cache) Stats() (hits, revalidated, misses int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.revalidated, c.misses
+}
+
+// Save writes the cache file
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	data, err := json.Marshal(c.entries)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(c.path, data)
+}
@@ -0,0 +1,434 @@
+// Package nip11 fetches and parses NIP-11 relay information documents, the JSON a
+// relay serves over HTTP at its websocket URL when asked for application/nostr+json.
+package nip11
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Document is the part of a relay information document the crawler records
+type Document struct {
+	Name          string      `json:"name,omitempty"`
+	Description   string      `json:"description,omitempty"`
+	Pubkey        string      `json:"pubkey,omitempty"`
+	Contact       string      `json:"contact,omitempty"`
+	SupportedNIPs []int       `json:"supported_nips,omitempty"`
+	Software      string      `json:"software,omitempty"`
+	Version       string      `json:"version,omitempty"`
+	Limitation    *Limitation `json:"limitation,omitempty"`
+	Fees          *Fees       `json:"fees,omitempty"`
+	PaymentsURL   string      `json:"payments_url,omitempty"`
+
+	Icon           string   `json:"icon,omitempty"`
+	Banner         string   `json:"banner,omitempty"`
+	RelayCountries []string `json:"relay_countries,omitempty"` // ISO 3166-1 alpha-2, upper case, "*" for global
+	LanguageTags   []string `json:"language_tags,omitempty"`   // IETF tags as in en-US, "*" for any
+	Tags           []string `json:"tags,omitempty"`
+	PostingPolicy  string   `json:"posting_policy,omitempty"`
+
+	// Where the document was served from when redirects led away from the relay's own
+	// URL, possibly on another host. The document still describes the relay it was
+	// requested for.
+	URL string `json:"url,omitempty"`
+
+	Timing *Timing `json:"timing,omitempty"` // Nil when served from the cache
+}
+
+// Limitation holds the limits a relay advertises, zero when not given
+type Limitation struct {
+	MaxMessageLength    int   `json:"max_message_length,omitempty"`
+	MaxSubscriptions    int   `json:"max_subscriptions,omitempty"`
+	MaxFilters          int   `json:"max_filters,omitempty"`
+	MaxLimit            int   `json:"max_limit,omitempty"`
+	MaxSubidLength      int   `json:"max_subid_length,omitempty"`
+	MaxEventTags        int   `json:"max_event_tags,omitempty"`
+	MaxContentLength    int   `json:"max_content_length,omitempty"`
+	MinPowDifficulty    int   `json:"min_pow_difficulty,omitempty"`
+	AuthRequired        bool  `json:"auth_required,omitempty"`
+	PaymentRequired     bool  `json:"payment_required,omitempty"`
+	RestrictedWrites    bool  `json:"restricted_writes,omitempty"`
+	CreatedAtLowerLimit int64 `json:"created_at_lower_limit,omitempty"`
+	CreatedAtUpperLimit int64 `json:"created_at_upper_limit,omitempty"`
+}
+
+// Fees lists what a relay charges, by what the fee pays for
+type Fees struct {
+	Admission    []Fee `json:"admission,omitempty"`
+	Subscription []Fee `json:"subscription,omitempty"`
+	Publication  []Fee `json:"publication,omitempty"`
+}
+
+// Fee is one price a relay charges
+type Fee struct {
+	Amount int64  `json:"amount"`
+	Unit   string `json:"unit,omitempty"`
+	Period int64  `json:"period,omitempty"` // Seconds a subscription lasts
+	Kinds  []int  `json:"kinds,omitempty"`  // Event kinds a publication fee applies to
+}
+
+// AuthRequired reports whether the relay asks clients to authenticate (NIP-42)
+func (d *Document) AuthRequired() bool {
+	return d.Limitation != nil && d.Limitation.AuthRequired
+}
+
+// RestrictedWrites reports whether the relay only accepts some events or authors
+func (d *Document) RestrictedWrites() bool {
+	return d.Limitation != nil && d.Limitation.RestrictedWrites
+}
+
+// Paid reports whether the relay charges for use: it says payment is required or
+// lists a fee
+func (d *Document) Paid() bool {
+	if d.Limitation != nil && d.Limitation.PaymentRequired {
+		return true
+	}
+	return d.Fees != nil && len(d.Fees.Admission)+len(d.Fees.Subscription)+len(d.Fees.Publication) > 0
+}
+
+// Parse decodes a relay information document. Relays fill in the fields loosely, so
+// a field of the wrong type is left empty instead of failing the whole document.
+func Parse(data []byte) (*Document, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, &ParseError{Err: err}
+	}
+
+	var doc Document
+	decode := func(name string, value interface{}) {
+		if raw, ok := fields[name]; ok {
+			json.Unmarshal(raw, value)
+		}
+	}
+	decode("name", &doc.Name)
+	decode("description", &doc.Description)
+	decode("pubkey", &doc.Pubkey)
+	decode("contact", &doc.Contact)
+	doc.SupportedNIPs = parseNIPs(fields["supported_nips"])
+	decode("software", &doc.Software)
+	decode("version", &doc.Version)
+	decode("limitation", &doc.Limitation)
+	decode("fees", &doc.Fees)
+	decode("payments_url", &doc.PaymentsURL)
+	decode("icon", &doc.Icon)
+	decode("banner", &doc.Banner)
+	decode("posting_policy", &doc.PostingPolicy)
+	doc.RelayCountries = parseStrings(fields["relay_countries"], strings.ToUpper)
+	doc.LanguageTags = parseStrings(fields["language_tags"], canonicalLanguage)
+	doc.Tags = parseStrings(fields["tags"], strings.ToLower)
+	doc.Software = strings.TrimSpace(doc.Software)
+	doc.Version = strings.TrimSpace(doc.Version)
+	return &doc, nil
+}
+
+// parseNIPs decodes supported_nips, which some relays list as strings ("11") rather
+// than numbers. Entries that are neither are skipped.
+func parseNIPs(raw json.RawMessage) []int {
+	var entries []json.RawMessage
+	if json.Unmarshal(raw, &entries) != nil {
+		return nil
+	}
+	var nips []int
+	for _, entry := range entries {
+		var number *float64
+		if json.Unmarshal(entry, &number) == nil {
+			if number != nil && *number == float64(int(*number)) {
+				nips = append(nips, int(*number))
+			}
+			continue
+		}
+		var text string
+		if json.Unmarshal(entry, &text) == nil {
+			if nip, err := strconv.Atoi(strings.TrimSpace(text)); err == nil {
+				nips = append(nips, nip)
+			}
+		}
+	}
+	return nips
+}
+
+// parseStrings decodes a list of strings, trimmed and passed through canonical. A
+// single string is taken as a list of one, entries that are not strings are skipped
+// and repeats are dropped, relays get these lists wrong often enough.
+func parseStrings(raw json.RawMessage, canonical func(string) string) []string {
+	var entries []json.RawMessage
+	if json.Unmarshal(raw, &entries) != nil {
+		entries = []json.RawMessage{raw}
+	}
+	var values []string
+	for _, entry := range entries {
+		var value string
+		if json.Unmarshal(entry, &value) != nil {
+			continue
+		}
+		if value = canonical(strings.TrimSpace(value)); value != "" && !slices.Contains(values, value) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// canonicalLanguage writes a language tag the way BCP 47 recommends: the language in
+// lower case and a two-letter region in upper case, as in en-US
+func canonicalLanguage(tag string) string {
+	subtags := strings.Split(strings.ReplaceAll(tag, "_", "-"), "-")
+	for i, subtag := range subtags {
+		if i > 0 && len(subtag) == 2 {
+			subtags[i] = strings.ToUpper(subtag)
+		} else {
+			subtags[i] = strings.ToLower(subtag)
+		}
+	}
+	return strings.Join(subtags, "-")
+}
+
+// Fetcher requests relay information documents, through the cache when one is set
+type Fetcher struct {
+	Client *http.Client
+	Onion  *http.Client // Requests to .onion hosts, see SOCKSClient. Without it they fail with ErrNoProbeRoute.
+	Cache  *Cache       // Optional
+}
+
+// Fetch returns the parsed relay information document of a relay
+func (f *Fetcher) Fetch(relayURL string) (*Document, error) {
+	resp, err := f.FetchRaw(relayURL)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := Parse(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if httpURL, _ := HTTPURL(relayURL); resp.URL != httpURL {
+		doc.URL = resp.URL
+	}
+	doc.Timing = resp.Timing
+	return doc, nil
+}
+
+// Response is a relay information document as served
+type Response struct {
+	Body   []byte
+	URL    string  // Where it was served from after redirects
+	Timing *Timing // How long the request took, nil when served from the cache
+}
+
+// Timing breaks down how long a document request took, in milliseconds from the start
+// of the request. Only successful requests are timed, a request that timed out has no
+// latency to report.
+type Timing struct {
+	ConnectMs   float64 `json:"connect_ms"`    // DNS, TCP and TLS until the connection was ready
+	FirstByteMs float64 `json:"first_byte_ms"` // Until the first byte of the response
+	TotalMs     float64 `json:"total_ms"`      // Until the whole document was read
+}
+
+// trace returns a request that fills in timing, counted from start, as it goes
+func trace(req *http.Request, timing *Timing, start time.Time) *http.Request {
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			if timing.ConnectMs == 0 { // Keep the first connection of a redirect chain
+				timing.ConnectMs = millisSince(start)
+			}
+		},
+		GotFirstResponseByte: func() {
+			timing.FirstByteMs = millisSince(start)
+		},
+	}))
+}
+
+// millisSince returns the milliseconds passed since start
+func millisSince(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
+
+// Redirects followed before a request is given up on
+const maxRedirects = 5
+
+// followRedirect limits redirect chains and asks for the document again on every hop.
+// The target may be on another host, relays commonly move to a www. name.
+func followRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	req.Header.Set("Accept", "application/nostr+json")
+	return nil
+}
+
+// Pause before the single retry of a request that timed out or was cut off
+const retryBackoff = 500 * time.Millisecond
+
+// FetchRaw returns the relay information document of a relay as served, from the
+// cache while it is fresh and revalidated with the server's ETag or Last-Modified
+// once it is stale. A request that fails on a timeout or a transient network error is
+// retried once after a short pause, only the final attempt is timed.
+func (f *Fetcher) FetchRaw(relayURL string) (*Response, error) {
+	resp, err := f.fetchRaw(relayURL)
+	if err != nil && transient(err) {
+		time.Sleep(retryBackoff)
+		resp, err = f.fetchRaw(relayURL)
+	}
+	return resp, err
+}
+
+func (f *Fetcher) fetchRaw(relayURL string) (*Response, error) {
+	httpURL, err := HTTPURL(relayURL)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := url.Parse(httpURL)
+	if err != nil {
+		return nil, err
+	}
+	host := parsed.Host // Entries stay keyed by the relay's host wherever it redirects
+
+	var entry cacheEntry
+	var cached bool
+	if f.Cache != nil {
+		var fresh bool
+		entry, cached, fresh = f.Cache.lookup(host)
+		if fresh {
+			f.Cache.count(&f.Cache.hits)
+			return &Response{Body: entry.Document, URL: cmp.Or(entry.FinalURL, httpURL)}, nil
+		}
+	}
+
+	req, err := http.NewRequest("GET", httpURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/nostr+json")
+	if cached {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	client, err := f.clientFor(host)
+	if err != nil {
+		return nil, err
+	}
+	timing, start := &Timing{}, time.Now()
+	resp, err := client.Do(trace(req, timing, start))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	finalURL := resp.Request.URL.String()
+
+	if cached && resp.StatusCode == http.StatusNotModified {
+		f.Cache.count(&f.Cache.revalidated)
+		f.Cache.store(host, resp, entry.Document)
+		timing.TotalMs = timing.FirstByteMs
+		return &Response{Body: entry.Document, URL: finalURL, Timing: timing}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDocumentSize))
+	if err != nil {
+		return nil, err
+	}
+	timing.TotalMs = millisSince(start)
+	if f.Cache != nil {
+		f.Cache.count(&f.Cache.misses)
+		if json.Valid(body) {
+			f.Cache.store(host, resp, body)
+		}
+	}
+	return &Response{Body: body, URL: finalURL, Timing: timing}, nil
+}
+
+// transient reports whether a failed request is worth trying again: it timed out, or
+// the connection was dropped before the relay answered
+func transient(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// StatusError is returned when a relay answers with anything but 200 OK
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return "unexpected status " + e.Status
+}
+
+// ParseError is returned when a relay's document is not a JSON object
+type ParseError struct {
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("invalid relay information document: %v", e.Err)
+}
+
+// Outcomes a failed fetch is bucketed under, see Outcome
+const (
+	OutcomeOffline      = "offline"        // No answer: DNS, TLS, refused
+	OutcomeTimeout      = "timeout"        // No answer in time, even after a retry
+	OutcomeNoNIP11      = "no_nip11"       // Answered, but does not serve a document
+	OutcomeInvalidJSON  = "invalid_json"   // Served something that is not a document
+	OutcomeNoProbeRoute = "no_probe_route" // Onion relay, but no SOCKS proxy to reach it through
+)
+
+// Outcome buckets a fetch error by how far the request got. Statuses that say the
+// relay has no document are OutcomeNoNIP11, any other status is http_<code>.
+func Outcome(err error) string {
+	var statusErr *StatusError
+	var parseErr *ParseError
+	switch {
+	case errors.As(err, &statusErr):
+		switch statusErr.Code {
+		case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotAcceptable,
+			http.StatusUnsupportedMediaType, http.StatusNotImplemented:
+			return OutcomeNoNIP11
+		}
+		return "http_" + strconv.Itoa(statusErr.Code)
+	case errors.As(err, &parseErr):
+		return OutcomeInvalidJSON
+	case errors.Is(err, ErrNoProbeRoute):
+		return OutcomeNoProbeRoute
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return OutcomeTimeout
+	}
+	return OutcomeOffline
+}
+
+// Relay information documents are small, anything past this is cut off
+const maxDocumentSize = 1 << 20
+
+// HTTPURL returns the URL a relay serves its information document at: the websocket
+// URL with wss replaced by https and ws by http
+func HTTPURL(relayURL string) (string, error) {
+	switch {
+	case strings.HasPrefix(relayURL, "wss://"):
+		return "https://" + strings.TrimPrefix(relayURL, "wss://"), nil
+	case strings.HasPrefix(relayURL, "ws://"):
+		return "http://" + strings.TrimPrefix(relayURL, "ws://"), nil
+	}
+	return "", fmt.Errorf("not a websocket URL: %s", relayURL)
+}
@@ -0,0 +1,200 @@
+package nip11
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// relayServer serves a relay information document at /doc and redirects along the
+// given routes, failing the test on a request without the NIP-11 Accept header
+type relayServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests int
+}
+
+func newRelayServer(t *testing.T, routes map[string]func(w http.ResponseWriter, r *http.Request)) *relayServer {
+	t.Helper()
+	server := &relayServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mu.Lock()
+		server.requests++
+		server.mu.Unlock()
+		if accept := r.Header.Get("Accept"); accept != "application/nostr+json" {
+			t.Errorf("%s requested with Accept %q", r.URL, accept)
+		}
+		if route, ok := routes[r.URL.Path]; ok {
+			route(w, r)
+			return
+		}
+		if r.URL.Path == "/doc" {
+			fmt.Fprint(w, `{"name":"relay","software":"strfry","supported_nips":[1,11]}`)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// count returns the requests the server answered
+func (s *relayServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// redirect answers with a redirect to target
+func redirect(code int, target string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target, code)
+	}
+}
+
+// wsURL returns the relay URL a server's HTTP URL is the NIP-11 address of
+func wsURL(httpURL string) string {
+	return "ws" + strings.TrimPrefix(httpURL, "http")
+}
+
+func newFetcher() *Fetcher {
+	return &Fetcher{Client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// A 301 then 302 chain on the relay's host lands on the document, which records where
+func TestFetchRedirectChain(t *testing.T) {
+	server := newRelayServer(t, map[string]func(http.ResponseWriter, *http.Request){
+		"/":      redirect(http.StatusMovedPermanently, "/nip11"),
+		"/nip11": redirect(http.StatusFound, "/doc"),
+	})
+
+	doc, err := newFetcher().Fetch(wsURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Name != "relay" {
+		t.Errorf("name = %q, want relay", doc.Name)
+	}
+	if want := server.URL + "/doc"; doc.URL != want {
+		t.Errorf("URL = %q, want %q", doc.URL, want)
+	}
+	if requests := server.count(); requests != 3 {
+		t.Errorf("%d requests, want 3", requests)
+	}
+}
+
+// A document served without a redirect has no URL of its own
+func TestFetchWithoutRedirect(t *testing.T) {
+	server := newRelayServer(t, map[string]func(http.ResponseWriter, *http.Request){
+		"/": func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, `{"name":"relay"}`) },
+	})
+
+	doc, err := newFetcher().Fetch(wsURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.URL != "" {
+		t.Errorf("URL = %q, want none", doc.URL)
+	}
+}
+
+// A redirect to a different host is followed and recorded, but the document stays the
+// relay's: it is cached under the relay's host and served from there afterwards
+func TestFetchRedirectOtherHost(t *testing.T) {
+	target := newRelayServer(t, nil)
+	targetURL, err := url.Parse(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetURL.Host = "localhost:" + targetURL.Port() // Another host name, not just another port
+	targetURL.Path = "/doc"
+	relay := newRelayServer(t, map[string]func(http.ResponseWriter, *http.Request){
+		"/": redirect(http.StatusMovedPermanently, targetURL.String()),
+	})
+	relayHost := strings.TrimPrefix(relay.URL, "http://")
+
+	cache, err := LoadCache(filepath.Join(t.TempDir(), "cache.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher := newFetcher()
+	fetcher.Cache = cache
+
+	for i := 0; i < 2; i++ {
+		doc, err := fetcher.Fetch(wsURL(relay.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.Name != "relay" || doc.URL != targetURL.String() {
+			t.Errorf("fetch %d: name %q from %q, want relay from %q", i, doc.Name, doc.URL, targetURL)
+		}
+	}
+	if relay.count() != 1 || target.count() != 1 {
+		t.Errorf("relay asked %d times and target %d, want once each", relay.count(), target.count())
+	}
+
+	entry, ok, _ := cache.lookup(relayHost)
+	if !ok || entry.FinalURL != targetURL.String() {
+		t.Errorf("cache entry of %s = %+v, want one ending at %s", relayHost, entry, targetURL)
+	}
+	if _, ok, _ := cache.lookup(targetURL.Host); ok {
+		t.Errorf("document cached under the redirect target %s", targetURL.Host)
+	}
+	if hits, _, misses := cache.Stats(); hits != 1 || misses != 1 {
+		t.Errorf("cache hits = %d, misses = %d, want 1 each", hits, misses)
+	}
+}
+
+// A redirect loop is given up on after maxRedirects
+func TestFetchRedirectLoop(t *testing.T) {
+	server := newRelayServer(t, map[string]func(http.ResponseWriter, *http.Request){
+		"/":      redirect(http.StatusFound, "/again"),
+		"/again": redirect(http.StatusFound, "/"),
+	})
+
+	_, err := newFetcher().Fetch(wsURL(server.URL))
+	if err == nil || !strings.Contains(err.Error(), "redirects") {
+		t.Fatalf("err = %v, want the redirect limit", err)
+	}
+	if requests := server.count(); requests != maxRedirects+1 {
+		t.Errorf("%d requests, want %d", requests, maxRedirects+1)
+	}
+}
+
+// A chain that ends anywhere but on a document fails with the final status
+func TestFetchRedirectToMissing(t *testing.T) {
+	server := newRelayServer(t, map[string]func(http.ResponseWriter, *http.Request){
+		"/": redirect(http.StatusMovedPermanently, "/gone"),
+	})
+
+	_, err := newFetcher().Fetch(wsURL(server.URL))
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusNotFound {
+		t.Fatalf("err = %v, want a 404 StatusError", err)
+	}
+	if outcome := Outcome(err); outcome != OutcomeNoNIP11 {
+		t.Errorf("outcome = %s, want %s", outcome, OutcomeNoNIP11)
+	}
+}
+
+// A clearnet relay redirecting to an onion host isn't followed there without a proxy
+func TestFetchRedirectToOnion(t *testing.T) {
+	server := newRelayServer(t, map[string]func(http.ResponseWriter, *http.Request){
+		"/": redirect(http.StatusFound, "http://relayabcdefghijklmnop.onion/"),
+	})
+
+	_, err := newFetcher().Fetch(wsURL(server.URL))
+	if !errors.Is(err, ErrNoProbeRoute) {
+		t.Fatalf("err = %v, want ErrNoProbeRoute", err)
+	}
+	if outcome := Outcome(err); outcome != OutcomeNoProbeRoute {
+		t.Errorf("outcome = %s, want %s", outcome, OutcomeNoProbeRoute)
+	}
+}
@@ -0,0 +1,60 @@
+package nip11
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ErrNoProbeRoute is returned for .onion relays when the fetcher has no onion client
+var ErrNoProbeRoute = errors.New("no route to onion relays without a SOCKS proxy")
+
+// SOCKSClient returns a client that sends every request through a SOCKS5 proxy such
+// as Tor's. Host names are handed to the proxy unresolved, so .onion names never reach
+// the system resolver.
+func SOCKSClient(proxyAddr string, timeout time.Duration) (*http.Client, error) {
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr, nil, proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOCKS proxy %s: %v", proxyAddr, err)
+	}
+	transport := &http.Transport{DialContext: dialer.(proxy.ContextDialer).DialContext}
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
+
+// IsOnion reports whether a host, with or without a port, is a Tor onion service
+func IsOnion(host string) bool {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return strings.HasSuffix(strings.ToLower(host), ".onion")
+}
+
+// clientFor picks the client a host is requested through: the onion client for
+// .onion hosts, which are never requested without one
+func (f *Fetcher) clientFor(host string) (http.Client, error) {
+	if !IsOnion(host) {
+		client := *f.Client
+		client.CheckRedirect = followClearnetRedirect
+		return client, nil
+	}
+	if f.Onion == nil {
+		return http.Client{}, ErrNoProbeRoute
+	}
+	client := *f.Onion
+	client.CheckRedirect = followRedirect
+	return client, nil
+}
+
+// followClearnetRedirect follows redirects like followRedirect but refuses to be sent
+// to an onion host, which would otherwise be looked up through the system resolver
+func followClearnetRedirect(req *http.Request, via []*http.Request) error {
+	if IsOnion(req.URL.Host) {
+		return ErrNoProbeRoute
+	}
+	return followRedirect(req, via)
+}
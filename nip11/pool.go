@@ -0,0 +1,111 @@
+package nip11
+
+import (
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pool fetches relay information documents on a fixed number of workers fed from a
+// bounded queue. Its limit is independent of anything else, so the HTTP requests never
+// open more than workers connections however fast relays are fed in.
+type Pool struct {
+	queue   chan string
+	fetcher *Fetcher
+	handle  func(relayURL string, doc *Document, err error) // Called from the workers with each result
+	wg      sync.WaitGroup
+	started time.Time
+
+	submitted   atomic.Int64
+	fetched     atomic.Int64 // Fetches finished, successful or not
+	failed      atomic.Int64
+	peakBacklog atomic.Int64 // Most relays seen waiting for a worker
+
+	outcomesMu sync.Mutex
+	outcomes   map[string]int64 // Failed fetches by Outcome
+}
+
+// Relays queued per worker before Submit blocks
+const queuePerWorker = 4
+
+// NewPool starts workers fetching through fetcher, handing every result to handle
+func NewPool(workers int, fetcher *Fetcher, handle func(relayURL string, doc *Document, err error)) *Pool {
+	workers = max(workers, 1)
+	p := &Pool{
+		queue:    make(chan string, workers*queuePerWorker),
+		fetcher:  fetcher,
+		handle:   handle,
+		started:  time.Now(),
+		outcomes: make(map[string]int64),
+	}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues a relay, blocking while the queue is full
+func (p *Pool) Submit(relayURL string) {
+	p.submitted.Add(1)
+	p.queue <- relayURL
+	backlog := int64(len(p.queue))
+	for {
+		peak := p.peakBacklog.Load()
+		if backlog <= peak || p.peakBacklog.CompareAndSwap(peak, backlog) {
+			return
+		}
+	}
+}
+
+// work fetches queued relays until the pool is closed
+func (p *Pool) work() {
+	defer p.wg.Done()
+	for relayURL := range p.queue {
+		doc, err := p.fetcher.Fetch(relayURL)
+		if err != nil {
+			p.failed.Add(1)
+			p.outcomesMu.Lock()
+			p.outcomes[Outcome(err)]++
+			p.outcomesMu.Unlock()
+		}
+		p.handle(relayURL, doc, err)
+		p.fetched.Add(1)
+	}
+}
+
+// Close waits for every queued fetch to finish
+func (p *Pool) Close() {
+	close(p.queue)
+	p.wg.Wait()
+}
+
+// PoolStats reports the pool's throughput and how far its queue backed up. A peak
+// backlog at the queue's capacity means the pool's limit, not the input, set the pace.
+type PoolStats struct {
+	Submitted     int64            `json:"submitted"`
+	Fetched       int64            `json:"fetched"`
+	Failed        int64            `json:"failed"`
+	Outcomes      map[string]int64 `json:"outcomes,omitempty"` // Failed fetches by Outcome
+	PerSecond     float64          `json:"per_second"`
+	PeakBacklog   int64            `json:"peak_backlog"`
+	QueueCapacity int              `json:"queue_capacity"`
+}
+
+// Stats returns the pool's activity so far
+func (p *Pool) Stats() PoolStats {
+	fetched := p.fetched.Load()
+	p.outcomesMu.Lock()
+	outcomes := maps.Clone(p.outcomes)
+	p.outcomesMu.Unlock()
+	return PoolStats{
+		Submitted:     p.submitted.Load(),
+		Fetched:       fetched,
+		Outcomes:      outcomes,
+		Failed:        p.failed.Load(),
+		PerSecond:     float64(fetched) / time.Since(p.started).Seconds(),
+		PeakBacklog:   p.peakBacklog.Load(),
+		QueueCapacity: cap(p.queue),
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"crawlr2/atomicfile"
+)
+
+// NIP-66 event kinds
+const (
+	relayDiscoveryKind      = 30166 // One per online relay, d tag set to its URL
+	monitorAnnouncementKind = 10166 // Describes the monitor publishing them
+)
+
+// Publishing limits
+const (
+	nip66DialTimeout = 10 * time.Second
+	nip66AckWait     = 5 * time.Second // How long trailing OK messages are waited for
+)
+
+var (
+	nip66Publishing atomic.Bool  // A publish round is running
+	nip66LastRound  atomic.Int64 // Unix nanoseconds the last round started
+)
+
+// maybePublishMonitorEvents starts a publish round in the background once
+// -nip66-interval has passed since the last one. A round never blocks or fails the
+// crawl, and one still running when the next is due makes it wait.
+func maybePublishMonitorEvents() {
+	if len(cfg.NIP66Relays) == 0 && cfg.NIP66DryRun == "" {
+		return
+	}
+	if last := nip66LastRound.Load(); last != 0 && time.Since(time.Unix(0, last)) < cfg.NIP66Interval {
+		return
+	}
+	if !nip66Publishing.CompareAndSwap(false, true) {
+		return
+	}
+	nip66LastRound.Store(time.Now().UnixNano())
+
+	go func() {
+		defer nip66Publishing.Store(false)
+		defer recoverAndLog("nip66 publish")
+		publishMonitorEvents()
+	}()
+}
+
+// publishMonitorEvents signs the current results and sends them to every publish relay,
+// or writes them to the -nip66-dry-run file
+func publishMonitorEvents() {
+	var secretKey []byte
+	if cfg.SecretKey != "" {
+		key, err := parseSecretKey(cfg.SecretKey)
+		if err != nil {
+			publishLog.Error("cannot sign NIP-66 events", "error", err)
+			return
+		}
+		secretKey = key
+	}
+
+	var events []Event
+	var err error
+	locked(func() { events, err = buildMonitorEvents(secretKey, time.Now()) })
+	if err != nil {
+		publishLog.Error("failed to build NIP-66 events", "error", err)
+		return
+	}
+
+	if cfg.NIP66DryRun != "" {
+		if err := writeEventLines(cfg.NIP66DryRun, events); err != nil {
+			publishLog.Error("failed to write NIP-66 events", "path", cfg.NIP66DryRun, "error", err)
+			return
+		}
+		publishLog.Info("wrote NIP-66 events instead of publishing", "path", cfg.NIP66DryRun, "events", len(events))
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, relay := range cfg.NIP66Relays {
+		wg.Add(1)
+		go func(relay string) {
+			defer wg.Done()
+			defer recoverAndLog("nip66 publish to " + relay)
+			accepted, rejected, err := publishEvents(relay, events)
+			if err != nil {
+				publishLog.Warn("failed to publish NIP-66 events", "relay", relay, "sent", accepted+rejected, "error", err)
+				return
+			}
+			publishLog.Info("published NIP-66 events", "relay", relay, "accepted", accepted, "rejected", rejected)
+		}(relay)
+	}
+	wg.Wait()
+}
+
+// buildMonitorEvents builds the monitor announcement followed by a relay discovery
+// event for every online relay, signed when a secret key is given. Caller must hold mu.
+func buildMonitorEvents(secretKey []byte, createdAt time.Time) ([]Event, error) {
+	announcement := Event{
+		CreatedAt: createdAt.Unix(),
+		Kind:      monitorAnnouncementKind,
+		Tags: [][]string{
+			{"frequency", strconv.Itoa(int(cfg.NIP66Interval.Seconds()))},
+			{"c", "open"},
+			{"c", "read"},
+			{"timeout", "open", strconv.FormatInt(cfg.CrawlTimeout.Milliseconds(), 10)},
+		},
+	}
+	events := []Event{announcement}
+
+	for _, relay := range sortedRelays(clearOnline) {
+		event := Event{
+			CreatedAt: createdAt.Unix(),
+			Kind:      relayDiscoveryKind,
+			Tags:      [][]string{{"d", relay}, {"n", "clearnet"}},
+		}
+		if record, ok := relayRecords[relay]; ok {
+			event.Tags = append(event.Tags, discoveryTags(record)...)
+		}
+		events = append(events, event)
+	}
+
+	if secretKey == nil {
+		return events, nil // Templates, an id needs the signer's pubkey
+	}
+	for i := range events {
+		if err := events[i].sign(secretKey); err != nil {
+			return nil, fmt.Errorf("failed to sign NIP-66 event: %v", err)
+		}
+	}
+	return events, nil
+}
+
+// discoveryTags returns the measured round trips and, with -nip11, the advertised
+// software, NIPs and requirements of a relay
+func discoveryTags(record *RelayRecord) [][]string {
+	var tags [][]string
+	if record.DialMs > 0 {
+		tags = append(tags, []string{"rtt-open", strconv.Itoa(int(record.DialMs))})
+	}
+	if record.EOSEMs > 0 {
+		tags = append(tags, []string{"rtt-read", strconv.Itoa(int(record.EOSEMs))})
+	}
+	if record.Software != "" {
+		tags = append(tags, []string{"s", record.Software})
+	}
+	for _, nip := range record.SupportedNIPs {
+		tags = append(tags, []string{"N", strconv.Itoa(nip)})
+	}
+	if record.documented {
+		limitation := record.Limitation
+		requirement := func(name string, required bool) []string {
+			if !required {
+				name = "!" + name
+			}
+			return []string{"R", name}
+		}
+		tags = append(tags,
+			requirement("auth", limitation != nil && limitation.AuthRequired),
+			requirement("payment", record.Paid),
+			requirement("writes", limitation != nil && limitation.RestrictedWrites))
+	}
+	return tags
+}
+
+// publishEvents sends events to a relay no faster than -nip66-rate per second and
+// counts the OK messages that come back
+func publishEvents(relayURL string, events []Event) (accepted, rejected int, err error) {
+	config, err := websocket.NewConfig(relayURL, "http://localhost/")
+	if err != nil {
+		return 0, 0, fmt.Errorf("config error: %v", err)
+	}
+	config.Dialer = &net.Dialer{Timeout: nip66DialTimeout}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return 0, 0, fmt.Errorf("dial error: %v", err)
+	}
+	defer ws.Close()
+
+	// Read OK messages until every event is answered or the connection closes
+	var mu sync.Mutex
+	answered := make(chan struct{})
+	go func() {
+		defer recoverAndLog("nip66 acks from " + relayURL)
+		for {
+			var msg []byte
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				return
+			}
+			var ok []interface{}
+			if json.Unmarshal(msg, &ok) != nil || len(ok) < 3 || ok[0] != "OK" {
+				continue
+			}
+			mu.Lock()
+			if ok[2] == true {
+				accepted++
+			} else {
+				rejected++
+			}
+			done := accepted+rejected == len(events)
+			mu.Unlock()
+			if done {
+				close(answered)
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.NIP66Rate))
+	defer ticker.Stop()
+	for _, event := range events {
+		data, err := json.Marshal([]interface{}{"EVENT", event})
+		if err != nil {
+			return 0, 0, err
+		}
+		if err := websocket.Message.Send(ws, string(data)); err != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			return accepted, rejected, fmt.Errorf("send error: %v", err)
+		}
+		<-ticker.C
+	}
+
+	select {
+	case <-answered:
+	case <-time.After(nip66AckWait):
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return accepted, rejected, nil
+}
+
+// writeEventLines writes events one JSON object per line
+func writeEventLines(path string, events []Event) error {
+	file, err := atomicfile.Create(path)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetEscapeHTML(false)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			file.Abort()
+			return err
+		}
+	}
+	return file.Commit()
+}
+
+// parseRelayURLs splits a comma separated list of relay URLs
+func parseRelayURLs(value string) []string {
+	var relays []string
+	for _, relay := range strings.Split(value, ",") {
+		if relay = strings.TrimSpace(relay); relay != "" {
+			relays = append(relays, relay)
+		}
+	}
+	return relays
+}
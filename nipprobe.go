@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// With -probe-nips, relays that reached EOSE get a few cheap requests on the same
+// connection to check what their NIP-11 supported_nips claim:
+//
+//	NIP-42  an AUTH challenge was sent during the crawl or the probes
+//	NIP-45  a COUNT request is answered with COUNT
+//	NIP-50  a search filter returns only events matching the search term
+//
+// A relay that never challenges may still support NIP-42, so it is only probed
+// positively. A search returning nothing proves nothing and leaves NIP-50 untested.
+
+// Capability probe tuning
+const (
+	probeTimeout    = 3 * time.Second // Per probe request
+	probeSearchTerm = "nostr"
+	probeSearchSize = 3
+)
+
+// NIPs checked by the capability probes
+var probedNIPs = []int{42, 45, 50}
+
+// Label of the NIP-45 answer, only the probes look for it
+const labelCount = "COUNT"
+
+// Results of comparing a probe with the NIP-11 document
+const (
+	probeVerified     = "verified"     // Advertised and observed
+	probeContradicted = "contradicted" // Advertised but not observed, or observed but not advertised
+	probeAbsent       = "absent"       // Neither advertised nor observed
+	probeNoNIP11      = "no_nip11"     // Observed, nothing to compare with
+)
+
+// NIPProbe is the outcome of probing one NIP on a relay
+type NIPProbe struct {
+	NIP        int    `json:"nip"`
+	Observed   bool   `json:"observed"`
+	Advertised bool   `json:"advertised"`
+	Result     string `json:"result"`
+}
+
+// NIPProbeStats aggregates the probes of one NIP across relays with a NIP-11 document
+type NIPProbeStats struct {
+	Verified     int     `json:"verified"`
+	Contradicted int     `json:"contradicted"`
+	Absent       int     `json:"absent"`
+	Agreement    float64 `json:"agreement_percent"` // Verified and absent among those compared
+}
+
+// NIPProbeSummary reports the probes for the run summary
+type NIPProbeSummary struct {
+	Probed  int                    `json:"probed"`
+	Skipped int64                  `json:"skipped_rate_limited"`
+	NIPs    map[int]*NIPProbeStats `json:"nips"`
+}
+
+var (
+	probeTokens  chan struct{} // Filled at -probe-nips-rate, see startNIPProbes
+	probeSkipped atomic.Int64
+)
+
+// startNIPProbes starts refilling the probe budget once a second, up to one second's worth
+func startNIPProbes() {
+	rate := max(1, cfg.ProbeNIPsRate)
+	probeTokens = make(chan struct{}, rate)
+	go func() {
+		defer recoverFatal("nip probes")
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		for range ticker.C {
+			select {
+			case probeTokens <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
+
+// probeNIPs probes a relay that just sent EOSE, at most once per run and only while the
+// rate limit allows, skipping it otherwise. challenged tells whether the crawl already
+// saw an AUTH challenge. Failures only mean a capability wasn't observed.
+func probeNIPs(ws *websocket.Conn, relayURL string, challenged bool) {
+	if probeTokens == nil {
+		return
+	}
+	var probed bool
+	locked(func() { probed = recordFor(relayURL).probes != nil })
+	if probed {
+		return
+	}
+	select {
+	case <-probeTokens:
+	default:
+		probeSkipped.Add(1)
+		return
+	}
+
+	observed := map[int]bool{45: false} // No COUNT answer before the timeout counts as none
+	probe := func(subscriptionID string, request []interface{}, answer func(label string, msg []json.RawMessage) (done bool)) {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return
+		}
+		ws.SetDeadline(time.Now().Add(probeTimeout))
+		if sendFrame(ws, data) != nil {
+			return
+		}
+		defer func() {
+			ws.SetWriteDeadline(time.Now().Add(probeTimeout))
+			sendFrame(ws, []byte(`["CLOSE","`+subscriptionID+`"]`))
+		}()
+
+		for {
+			frame, err := receiveFrame(ws)
+			if err != nil {
+				return
+			}
+			var msg []json.RawMessage
+			if json.Unmarshal(frame, &msg) != nil || len(msg) == 0 {
+				continue
+			}
+			var label, subscription string
+			json.Unmarshal(msg[0], &label)
+			if label == labelAuth {
+				challenged = true
+				continue
+			}
+			if len(msg) > 1 {
+				json.Unmarshal(msg[1], &subscription)
+			}
+			if subscription == subscriptionID && answer(label, msg) {
+				return
+			}
+		}
+	}
+
+	probe("crawlr-count", []interface{}{labelCount, "crawlr-count", map[string]interface{}{"kinds": []int{10002}}},
+		func(label string, msg []json.RawMessage) bool {
+			observed[45] = label == labelCount
+			return true
+		})
+
+	searched, matched := 0, 0
+	probe("crawlr-search", []interface{}{"REQ", "crawlr-search", map[string]interface{}{
+		"kinds": []int{1}, "search": probeSearchTerm, "limit": probeSearchSize,
+	}}, func(label string, msg []json.RawMessage) bool {
+		if label != labelEvent || len(msg) < 3 {
+			return true // EOSE, CLOSED or anything else ends the search
+		}
+		var event Event
+		if json.Unmarshal(msg[2], &event) == nil {
+			searched++
+			if strings.Contains(strings.ToLower(event.Content), probeSearchTerm) {
+				matched++
+			}
+		}
+		return searched >= probeSearchSize
+	})
+
+	locked(func() {
+		record := recordFor(relayURL)
+		record.probes = observed
+		if challenged {
+			record.probes[42] = true
+		}
+		if searched > 0 {
+			record.probes[50] = matched == searched // A relay ignoring the search field returns anything
+		}
+	})
+}
+
+// nipProbes compares the probes of a relay with its NIP-11 document, nil when it wasn't
+// probed. Caller must hold mu.
+func nipProbes(record *RelayRecord) []NIPProbe {
+	if record.probes == nil {
+		return nil
+	}
+	var results []NIPProbe
+	for _, nip := range probedNIPs {
+		observed, tested := record.probes[nip]
+		if !tested {
+			continue
+		}
+		result := NIPProbe{NIP: nip, Observed: observed}
+		for _, supported := range record.SupportedNIPs {
+			result.Advertised = result.Advertised || supported == nip
+		}
+		switch {
+		case !record.documented:
+			if !observed {
+				continue // Nothing claimed and nothing seen
+			}
+			result.Result = probeNoNIP11
+		case result.Advertised && observed:
+			result.Result = probeVerified
+		case result.Advertised != observed:
+			result.Result = probeContradicted
+		default:
+			result.Result = probeAbsent
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// summarizeNIPProbes aggregates the probes of the online relays, nil without
+// -probe-nips. Caller must hold mu.
+func summarizeNIPProbes() *NIPProbeSummary {
+	if !cfg.ProbeNIPs {
+		return nil
+	}
+	summary := &NIPProbeSummary{Skipped: probeSkipped.Load(), NIPs: make(map[int]*NIPProbeStats)}
+	for _, nip := range probedNIPs {
+		summary.NIPs[nip] = new(NIPProbeStats)
+	}
+	for relay := range clearOnline {
+		record, ok := relayRecords[relay]
+		if !ok || record.probes == nil {
+			continue
+		}
+		summary.Probed++
+		for _, probe := range nipProbes(record) {
+			stats := summary.NIPs[probe.NIP]
+			switch probe.Result {
+			case probeVerified:
+				stats.Verified++
+			case probeContradicted:
+				stats.Contradicted++
+			case probeAbsent:
+				stats.Absent++
+			}
+		}
+	}
+	for _, stats := range summary.NIPs {
+		if compared := stats.Verified + stats.Contradicted + stats.Absent; compared > 0 {
+			stats.Agreement = float64(stats.Verified+stats.Absent) * 100 / float64(compared)
+		}
+	}
+	return summary
+}
+
+// sortedNIPs returns the NIPs of a probe summary in order
+func (s *NIPProbeSummary) sortedNIPs() []int {
+	nips := make([]int, 0, len(s.NIPs))
+	for nip := range s.NIPs {
+		nips = append(nips, nip)
+	}
+	sort.Ints(nips)
+	return nips
+}
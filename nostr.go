@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// Labels of the relay to client messages of NIP-01 and NIP-42
+const (
+	labelEvent  = "EVENT"
+	labelEOSE   = "EOSE"
+	labelNotice = "NOTICE"
+	labelClosed = "CLOSED"
+	labelAuth   = "AUTH"
+)
+
+// eventMessage is a decoded ["EVENT", <subscription id>, <event>] message
+type eventMessage struct {
+	SubscriptionID string
+	Event          Event
+}
+
+// peekLabel returns the label of a relay message without decoding the rest of it.
+// Anything but a JSON array is an error, an array that doesn't start with a plain
+// string is an unknown message and gets an empty label.
+func peekLabel(msg []byte) (string, error) {
+	rest := bytes.TrimLeft(msg, " \t\r\n")
+	if len(rest) == 0 || rest[0] != '[' {
+		return "", fmt.Errorf("message is not a JSON array")
+	}
+	rest = bytes.TrimLeft(rest[1:], " \t\r\n")
+	if len(rest) == 0 || rest[0] != '"' {
+		return "", nil
+	}
+	end := bytes.IndexByte(rest[1:], '"')
+	if end < 0 {
+		return "", fmt.Errorf("unterminated message label")
+	}
+	label := rest[1 : end+1]
+	if bytes.IndexByte(label, '\\') >= 0 {
+		return "", nil // No known label needs escaping
+	}
+	return string(label), nil
+}
+
+// decodeEventMessage decodes an EVENT message straight into its typed fields, returning
+// nil when the message stops short of the event
+func decodeEventMessage(msg []byte) (*eventMessage, error) {
+	var label string
+	message := new(eventMessage)
+
+	// Unmarshal decodes into the pointers already in the slice and trims it to the
+	// number of elements present
+	elements := []interface{}{&label, &message.SubscriptionID, &message.Event}
+	if err := json.Unmarshal(msg, &elements); err != nil {
+		return nil, err
+	}
+	if len(elements) < 3 {
+		return nil, nil
+	}
+	return message, nil
+}
+
+// serialize returns the NIP-01 serialization the event id is computed over
+func (e *Event) serialize() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false) // NIP-01 forbids escaping <, > and &
+	if err := encoder.Encode([]interface{}{0, e.Pubkey, e.CreatedAt, e.Kind, e.Tags, e.Content}); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// computeID sets the event id from its serialized content
+func (e *Event) computeID() ([]byte, error) {
+	if e.Tags == nil {
+		e.Tags = [][]string{}
+	}
+	serialized, err := e.serialize()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(serialized)
+	e.ID = hex.EncodeToString(sum[:])
+	return sum[:], nil
+}
+
+// sign sets the pubkey, id and BIP-340 signature of the event
+func (e *Event) sign(secretKey []byte) error {
+	privateKey, publicKey := btcec.PrivKeyFromBytes(secretKey)
+	e.Pubkey = hex.EncodeToString(schnorr.SerializePubKey(publicKey))
+
+	id, err := e.computeID()
+	if err != nil {
+		return err
+	}
+	signature, err := schnorr.Sign(privateKey, id)
+	if err != nil {
+		return err
+	}
+	e.Sig = hex.EncodeToString(signature.Serialize())
+	return nil
+}
+
+// parseSecretKey accepts a secret key as 64 hex characters or a NIP-19 nsec
+func parseSecretKey(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "nsec1") {
+		hrp, data, err := decodeBech32(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nsec: %v", err)
+		}
+		if hrp != "nsec" || len(data) != 32 {
+			return nil, fmt.Errorf("invalid nsec")
+		}
+		return data, nil
+	}
+
+	key, err := hex.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("secret key must be 64 hex characters or an nsec")
+	}
+	return key, nil
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// decodeBech32 decodes a bech32 string into its human readable part and 8-bit data
+func decodeBech32(value string) (string, []byte, error) {
+	value = strings.ToLower(value)
+	separator := strings.LastIndexByte(value, '1')
+	if separator < 1 || separator+7 > len(value) {
+		return "", nil, fmt.Errorf("malformed bech32 string")
+	}
+	hrp := value[:separator]
+
+	values := make([]byte, 0, len(value)-separator-1)
+	for _, c := range value[separator+1:] {
+		index := strings.IndexRune(bech32Charset, c)
+		if index < 0 {
+			return "", nil, fmt.Errorf("invalid bech32 character %q", c)
+		}
+		values = append(values, byte(index))
+	}
+
+	if bech32Polymod(append(bech32ExpandHRP(hrp), values...)) != 1 {
+		return "", nil, fmt.Errorf("bad bech32 checksum")
+	}
+
+	// Drop the checksum and regroup 5-bit values into bytes
+	var data []byte
+	acc, bits := 0, 0
+	for _, v := range values[:len(values)-6] {
+		acc = acc<<5 | int(v)
+		bits += 5
+		for bits >= 8 {
+			bits -= 8
+			data = append(data, byte(acc>>bits))
+		}
+	}
+	return hrp, data, nil
+}
+
+func bech32ExpandHRP(hrp string) []byte {
+	expanded := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]&31)
+	}
+	return expanded
+}
+
+func bech32Polymod(values []byte) int {
+	generator := []int{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := 1
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ int(v)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
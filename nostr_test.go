@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// A relay list with one malformed tag still gives up the relays of its other tags
+func TestHandleMessageBadTags(t *testing.T) {
+	resetState(t)
+	frame := `["EVENT","crawlr",{"id":"` + strings.Repeat("a", 64) + `","pubkey":"` + strings.Repeat("b", 64) +
+		`","created_at":1700000000,"kind":10002,"tags":[["r","wss://a.example.com"],["r",42],` +
+		`["r","wss://b.example.com",{"marker":"write"}],"r",["expiration",1700000000],["r","wss://c.example.com"]],` +
+		`"content":"","sig":"` + strings.Repeat("c", 128) + `"}]`
+
+	if err := handleMessage([]byte(frame), "wss://seed.example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, relay := range []string{"wss://a.example.com", "wss://b.example.com", "wss://c.example.com"} {
+		if _, ok := clearOnline[relay]; !ok {
+			t.Errorf("%s missing", relay)
+		}
+	}
+	if len(clearOnline) != 3 || len(malformed) != 0 {
+		t.Errorf("classified online %v and malformed %v, want only the three relays", clearOnline, malformed)
+	}
+	if authors := relayRecords["wss://seed.example.com"].UniquePubkeys; authors != 1 {
+		t.Errorf("seed served lists of %d authors, want 1", authors)
+	}
+}
+
+// BenchmarkDecodeEventMessage decodes kind 10002 frames with only string tags, the
+// common case, and with one tag holding a number
+func BenchmarkDecodeEventMessage(b *testing.B) {
+	clean := relayListFrames(b, 1)[0]
+	bad := []byte(strings.Replace(string(clean), `["r","wss://relay0.example.com","write"]`,
+		`["r","wss://relay0.example.com",1]`, 1))
+	if string(bad) == string(clean) {
+		b.Fatal("no tag to break in the frame")
+	}
+
+	for _, bench := range []struct {
+		name  string
+		frame []byte
+	}{{"string-tags", clean}, {"number-tag", bad}} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				message, err := decodeEventMessage(bench.frame)
+				if err != nil || message == nil || len(message.Event.Tags) != 8 {
+					b.Fatalf("decoded %v, %v", message, err)
+				}
+			}
+		})
+	}
+}
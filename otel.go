@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// OTLP export tuning
+const (
+	otlpBatchSize     = 512
+	otlpFlushInterval = 5 * time.Second
+	otlpQueueSize     = 4096
+	otlpTimeout       = 10 * time.Second
+)
+
+// OTLP span kinds and status codes, see the OpenTelemetry protocol
+const (
+	otlpKindInternal = 1
+	otlpKindClient   = 3
+	otlpStatusOK     = 1
+	otlpStatusError  = 2
+)
+
+// Span exporter, nil unless -otlp-endpoint is set. Every span method accepts a nil
+// span, so crawls that aren't sampled only pay for a nil check.
+var spanExporter *otlpExporter
+
+// span is one timed operation of a sampled relay crawl. Children are collected on the
+// root and exported together when it ends.
+type span struct {
+	name     string
+	kind     int
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	start    time.Time
+	end      time.Time
+	attrs    map[string]any
+	err      error
+	root     *span
+
+	mu       sync.Mutex // Guards finished on the root
+	finished []*span
+}
+
+// startCrawlSpan starts the root span of a relay crawl, nil when it isn't sampled
+func startCrawlSpan(relayURL string) *span {
+	if spanExporter == nil || rand.Float64() >= cfg.OTLPSampleRate {
+		return nil
+	}
+	s := &span{name: "relay.crawl", kind: otlpKindClient, start: time.Now(), attrs: map[string]any{"relay.url": relayURL}}
+	binary.BigEndian.PutUint64(s.traceID[:8], rand.Uint64())
+	binary.BigEndian.PutUint64(s.traceID[8:], rand.Uint64())
+	binary.BigEndian.PutUint64(s.spanID[:], rand.Uint64())
+	s.root = s
+	return s
+}
+
+// child starts a span below s
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	c := &span{name: name, kind: otlpKindInternal, traceID: s.traceID, parentID: s.spanID, start: time.Now(), root: s.root}
+	binary.BigEndian.PutUint64(c.spanID[:], rand.Uint64())
+	return c
+}
+
+// set annotates the span with an attribute
+func (s *span) set(key string, value any) {
+	if s == nil {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = make(map[string]any)
+	}
+	s.attrs[key] = value
+}
+
+// finish ends the span, marking it failed when err is set. Ending the root hands the
+// whole crawl to the exporter.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+
+	s.root.mu.Lock()
+	s.root.finished = append(s.root.finished, s)
+	spans := s.root.finished
+	s.root.mu.Unlock()
+
+	if s == s.root {
+		spanExporter.enqueue(spans)
+	}
+}
+
+// dialWithSpans performs the same dial as websocket.DialConfig with a child span for
+// each phase: DNS lookup, TCP/TLS dial and websocket handshake
+func dialWithSpans(config *websocket.Config, parent *span) (*websocket.Conn, error) {
+	if host := config.Location.Hostname(); net.ParseIP(host) == nil {
+		dns := parent.child("dns")
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.CrawlTimeout)
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		cancel()
+		dns.set("dns.addresses", len(addrs))
+		dns.finish(err)
+		if err != nil {
+			return nil, &websocket.DialError{Config: config, Err: err}
+		}
+	}
+
+	dial := parent.child("dial")
+	conn, err := dialConn(config)
+	dial.finish(err)
+	if err != nil {
+		return nil, &websocket.DialError{Config: config, Err: err}
+	}
+
+	handshake := parent.child("handshake")
+	ws, err := websocket.NewClient(config, conn)
+	handshake.finish(err)
+	if err != nil {
+		conn.Close()
+		return nil, &websocket.DialError{Config: config, Err: err}
+	}
+	return ws, nil
+}
+
+// otlpExporter batches finished spans and posts them as OTLP/HTTP JSON
+type otlpExporter struct {
+	url    string
+	client *http.Client
+	queue  chan []*span
+	flush  chan chan struct{}
+}
+
+// openSpanExporter starts exporting spans when an OTLP endpoint is configured
+func openSpanExporter() {
+	if cfg.OTLPEndpoint == "" {
+		return
+	}
+	spanExporter = &otlpExporter{
+		url:    strings.TrimRight(cfg.OTLPEndpoint, "/") + "/v1/traces",
+		client: &http.Client{Timeout: otlpTimeout},
+		queue:  make(chan []*span, otlpQueueSize),
+		flush:  make(chan chan struct{}),
+	}
+	go spanExporter.run()
+}
+
+// enqueue hands a finished crawl to the exporter, dropping it when the queue is full
+func (e *otlpExporter) enqueue(spans []*span) {
+	select {
+	case e.queue <- spans:
+	default:
+		mainLog.Debug("span queue full, dropping trace")
+	}
+}
+
+// run posts a batch when it is full, every otlpFlushInterval and when asked to flush
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case spans := <-e.queue:
+			batch = append(batch, spans...)
+			if len(batch) >= otlpBatchSize {
+				e.post(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.post(batch)
+			batch = nil
+		case flushed := <-e.flush:
+			for queued := len(e.queue); queued > 0; queued-- {
+				batch = append(batch, <-e.queue...)
+			}
+			e.post(batch)
+			batch = nil
+			close(flushed)
+		}
+	}
+}
+
+// post sends one batch, failures are logged and the batch dropped
+func (e *otlpExporter) post(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(otlpRequest(batch))
+	if err != nil {
+		mainLog.Warn("failed to encode spans", "error", err)
+		return
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		mainLog.Warn("failed to export spans", "endpoint", e.url, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		mainLog.Warn("failed to export spans", "endpoint", e.url, "status", resp.Status)
+	}
+}
+
+// flushSpanExporter sends the spans queued so far, crawls still running at exit may
+// keep adding spans so the queue stays open
+func flushSpanExporter() {
+	if spanExporter == nil {
+		return
+	}
+	flushed := make(chan struct{})
+	spanExporter.flush <- flushed
+	<-flushed
+}
+
+// otlpRequest builds an ExportTraceServiceRequest in the OTLP JSON encoding
+func otlpRequest(batch []*span) map[string]any {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		encoded := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+			"status":            map[string]any{"code": otlpStatusOK},
+		}
+		if s.parentID != [8]byte{} {
+			encoded["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != nil {
+			encoded["status"] = map[string]any{"code": otlpStatusError, "message": s.err.Error()}
+		}
+		spans = append(spans, encoded)
+	}
+
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": otlpAttributes(map[string]any{
+				"service.name":    "crawlr",
+				"service.version": crawlerVersion,
+			})},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "crawlr"},
+				"spans": spans,
+			}},
+		}},
+	}
+}
+
+// otlpAttributes encodes attributes as OTLP key/value pairs
+func otlpAttributes(attrs map[string]any) []map[string]any {
+	encoded := make([]map[string]any, 0, len(attrs))
+	for key, value := range attrs {
+		var v map[string]any
+		switch value := value.(type) {
+		case string:
+			v = map[string]any{"stringValue": value}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+		case bool:
+			v = map[string]any{"boolValue": value}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(value)}
+		}
+		encoded = append(encoded, map[string]any{"key": key, "value": v})
+	}
+	return encoded
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// How long a fatal panic waits for the relay lists before exporting without the lock
+const fatalLockTimeout = 5 * time.Second
+
+// Set once the final export has started, so a panic during it doesn't export again
+var finalizing atomic.Bool
+
+// Hooks for tests: exitProcess ends the process after a fatal panic and crawlHook, when
+// set, runs as each relay's crawl starts so a test can make it panic
+var (
+	exitProcess = os.Exit
+	crawlHook   func(relayURL string)
+)
+
+// locked runs fn while holding mu, releasing it even if fn panics
+func locked(fn func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	fn()
+}
+
+// recoverRelay turns a panic while crawling a relay into a failure of that relay so
+// the rest of the run carries on. It must be deferred directly.
+func recoverRelay(relayURL string) {
+	value := recover()
+	if value == nil {
+		return
+	}
+
+	crawlLog.Error("recovered from panic while crawling relay", "relay", relayURL, "panic", value,
+		"stack", string(debug.Stack()), outcomeKey, outcomeFailure)
+
+	var record RelayRecord
+	locked(func() {
+		err := fmt.Errorf("panic: %v", value)
+		if _, offline := clearOffline[relayURL]; offline {
+			recordFailure(relayURL, err) // Already counted, only note the panic
+			recordFor(relayURL).crawled = true
+			record = relayRecordFor(relayURL, ClearOffline, clearOffline[relayURL])
+			return
+		}
+		record = markOffline(relayURL, err)
+	})
+	saveToStore(record)
+}
+
+// recoverAndLog logs a panic so the goroutine's caller carries on, e.g. with the next
+// crawl pass. It must be deferred directly.
+func recoverAndLog(what string) {
+	if value := recover(); value != nil {
+		mainLog.Error("recovered from panic", "in", what, "panic", value, "stack", string(debug.Stack()))
+	}
+}
+
+// recoverFatal handles a panic that leaves the crawler unable to continue: it logs the
+// stack, writes whatever was collected and exits non-zero. It must be deferred directly
+// at the top of a goroutine.
+func recoverFatal(where string) {
+	value := recover()
+	if value == nil {
+		return
+	}
+
+	mainLog.Error("fatal panic, writing collected results before exiting", "in", where, "panic", value,
+		"stack", string(debug.Stack()))
+	fmt.Fprintf(os.Stderr, "crawlr: fatal panic in %s: %v\n", where, value)
+
+	if !finalizing.Load() {
+		screen.Stop()
+		bestEffortFinalize()
+	}
+	exitProcess(1)
+}
+
+// bestEffortFinalize exports without waiting forever on a lock a dead goroutine may
+// still hold
+func bestEffortFinalize() {
+	deadline := time.Now().Add(fatalLockTimeout)
+	for !mu.TryLock() {
+		if time.Now().After(deadline) {
+			mainLog.Error("relay lists still locked, exporting without the lock")
+			finalizeLocked()
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	defer mu.Unlock()
+	finalizeLocked()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// injectPanic makes every relay crawl panic until the test ends
+func injectPanic(t *testing.T) {
+	t.Helper()
+	crawlHook = func(relayURL string) { panic(fmt.Sprintf("injected panic crawling %s", relayURL)) }
+	t.Cleanup(func() { crawlHook = nil })
+}
+
+// A panic while crawling one relay fails that relay and the crawl carries on
+func TestPanicFailsRelay(t *testing.T) {
+	resetState(t)
+	captureJSONLogs(t)
+	injectPanic(t)
+
+	relay := "wss://relay.example.com"
+	locked(func() { classifyRelay(listedRelay{url: relay, category: ClearOnline}, "wss://seed.example.com") })
+	crawlRelay(relay, fastLane) // Returns instead of panicking
+
+	mu.Lock()
+	defer mu.Unlock()
+	if _, offline := clearOffline[relay]; !offline {
+		t.Fatal("relay not marked offline after its crawl panicked")
+	}
+	if reason := relayRecords[relay].FailureReason; !strings.Contains(reason, "injected panic") {
+		t.Errorf("failure reason %q doesn't name the panic", reason)
+	}
+	if accounting := crawlAccounting(); accounting.Failed != 1 || accounting.Remaining != 0 {
+		t.Errorf("accounting = %+v, want the relay counted as failed", accounting)
+	}
+}
+
+// A fatal panic in a goroutine writes the CSVs of what was collected before exiting 1
+func TestFatalPanicWritesExports(t *testing.T) {
+	resetState(t)
+	cfg.Quiet = true
+	logs := captureJSONLogs(t)
+	injectPanic(t)
+	var exitCode int
+	exitProcess = func(code int) { exitCode = code }
+	t.Cleanup(func() {
+		exitProcess = os.Exit
+		finalizing.Store(false)
+	})
+
+	locked(func() {
+		for i := 0; i < 5; i++ {
+			classifyRelay(listedRelay{url: fmt.Sprintf("wss://relay%d.example.com", i), category: ClearOnline},
+				"wss://seed.example.com")
+		}
+		classifyRelay(listedRelay{url: "ws://relay.onion", category: Onion}, "wss://seed.example.com")
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer recoverFatal("crawl worker")
+		crawlHook("wss://relay0.example.com")
+	}()
+	<-done
+
+	if exitCode != 1 {
+		t.Errorf("exit code %d, want 1", exitCode)
+	}
+	if !strings.Contains(logs.String(), `"in":"crawl worker"`) {
+		t.Errorf("fatal panic not logged: %s", logs)
+	}
+	for category, rows := range map[RelayCategory]int{ClearOnline: 5, Onion: 1} {
+		file, err := os.Open(outputPath(category, "csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := csv.NewReader(file).ReadAll()
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != rows {
+			t.Errorf("%s CSV has %d rows, want %d", category, len(records), rows)
+		}
+	}
+	if _, err := os.Stat(runFilePath("summary.json")); err != nil {
+		t.Error(err)
+	}
+}
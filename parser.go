@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Frames read from relays are parsed off the read loop: receiveMessages only queues
+// each frame, and a few parser goroutines decode, classify and merge them. The queue is
+// bounded and a full queue blocks the reader rather than dropping the frame, so a burst
+// of large events makes the relay wait on a slower consumer instead of losing events.
+
+// parseJob is a frame waiting to be parsed and the session it was read in
+type parseJob struct {
+	msg     []byte
+	session *listSession
+}
+
+var (
+	parseQueue   chan parseJob // Nil until startParsers, frames are parsed inline then
+	parsePending atomic.Int64  // Frames queued or being parsed
+)
+
+// startParsers starts the parser goroutines and the queue feeding them
+func startParsers(workers, capacity int) {
+	parseQueue = make(chan parseJob, capacity)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer recoverFatal("frame parser")
+			parseFrames()
+		}()
+	}
+}
+
+// queueFrame hands a frame to the parsers, blocking while the queue is full. Before
+// the parsers start the frame is parsed on the spot.
+func queueFrame(msg []byte, session *listSession) {
+	if parseQueue == nil {
+		parseFrame(parseJob{msg: msg, session: session})
+		return
+	}
+	// The memory guard holds the queue to a fraction of its size
+	for memoryThrottled.Load() && len(parseQueue) >= cap(parseQueue)/parseQueueThrottledShare {
+		time.Sleep(parseDrainPoll)
+	}
+	parsePending.Add(1)
+	parseQueue <- parseJob{msg: msg, session: session}
+}
+
+// parseFrames parses queued frames for the rest of the run
+func parseFrames() {
+	for job := range parseQueue {
+		parseFrame(job)
+		parsePending.Add(-1)
+	}
+}
+
+// parseFrame handles one frame, logging what couldn't be parsed
+func parseFrame(job parseJob) {
+	if err := handleMessage(job.msg, job.session.relay, job.session); err != nil {
+		crawlLog.Debug("failed to handle message", "relay", job.session.relay, "error", err)
+	}
+}
+
+// drainParsers blocks until every frame queued so far has been parsed, so the relays
+// they list are known before the frontier is checked or the exports are written
+func drainParsers() {
+	for parsePending.Load() > 0 {
+		time.Sleep(parseDrainPoll)
+	}
+}
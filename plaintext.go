@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// With -plaintext-probe a wss:// relay whose dial failed in the TLS layer gets one more
+// attempt over ws:// on the same host and port. Some self-hosted relays have a broken
+// certificate or no TLS terminator at all. A relay that answers is online with
+// PlaintextOnly set, its URL stays as listed.
+
+// tlsError marks a dial that failed in the TLS layer, the message is unchanged
+type tlsError struct{ error }
+
+// isTLSFailure reports whether a dial error came from the TLS handshake or certificate
+// verification rather than DNS, TCP or the websocket handshake
+func isTLSFailure(err error) bool {
+	if dialErr, ok := err.(*websocket.DialError); ok {
+		err = dialErr.Err // DialError doesn't unwrap
+	}
+	var remote *net.OpError
+	if errors.As(err, &remote) && remote.Op == "remote error" {
+		return true // An alert the server sent during the handshake
+	}
+	var (
+		recordHeader tls.RecordHeaderError
+		verification *tls.CertificateVerificationError
+		alert        tls.AlertError
+		authority    x509.UnknownAuthorityError
+		hostname     x509.HostnameError
+		invalid      x509.CertificateInvalidError
+	)
+	return errors.As(err, &recordHeader) || errors.As(err, &verification) || errors.As(err, &alert) ||
+		errors.As(err, &authority) || errors.As(err, &hostname) || errors.As(err, &invalid)
+}
+
+// plaintextURL is the ws:// URL on the same host and port as a wss:// relay
+func plaintextURL(relayURL string) string {
+	parsed, err := url.Parse(relayURL)
+	if err != nil || parsed.Scheme != "wss" {
+		return relayURL
+	}
+	port := parsed.Port()
+	if port == "" {
+		port = "443"
+	}
+	parsed.Scheme = "ws"
+	parsed.Host = net.JoinHostPort(parsed.Hostname(), port)
+	return parsed.String()
+}
+
+// probePlaintext retries a wss:// relay over ws:// when its last attempt failed in the
+// TLS layer. Every other failure, and relays listed as ws:// already, are left alone.
+func probePlaintext(relayURL string, timeout time.Duration, err error) (crawlTiming, bool) {
+	var failure tlsError
+	if !errors.As(err, &failure) || plaintextURL(relayURL) == relayURL {
+		return crawlTiming{}, false
+	}
+
+	started := time.Now()
+	timing, probeErr := attemptCrawl(relayURL, timeout, true)
+	if probeErr == errIPBusy {
+		return crawlTiming{}, false
+	}
+	locked(func() { recordAttempt(relayURL, started, probeErr) })
+	if probeErr != nil {
+		crawlLog.Debug("plaintext probe failed", "relay", relayURL, "error", probeErr)
+		return crawlTiming{}, false
+	}
+	crawlLog.Info("relay only reachable over plaintext", "relay", relayURL)
+	return timing, true
+}
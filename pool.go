@@ -0,0 +1,195 @@
+package main
+
+import "time"
+
+// The crawl pool is a fixed set of workers fed from the frontier: every clear online
+// relay is queued the moment it is first seen, so it is dialed as soon as a worker is
+// free instead of waiting for the current pass to end. Each relay is queued at most
+// once per run, so the crawl never has to scan clearOnline for work.
+
+// crawlLane is a queue of relays with its own workers and crawl timeout. New relays go
+// to the fast lane; those that hit its deadline are retried in the slow lane, whose few
+// workers can wait on half-dead relays without holding up everyone else. Relays under
+// a domain that keeps producing dead relays skip both for the penalty lane, whose few
+// workers give each of them only a short timeout.
+type crawlLane struct {
+	name     string
+	timeout  time.Duration
+	limited  bool          // Workers count against the target concurrency
+	queue    []string      // Relays waiting for a worker, oldest first, guarded by mu
+	ready    chan struct{} // Wakes the dispatcher after push
+	frontier chan string   // Hands relays from the dispatcher to the workers, set by start
+}
+
+// The lanes of the crawl pool
+var (
+	fastLane    = &crawlLane{name: "fast", limited: true, ready: make(chan struct{}, 1)}
+	slowLane    = &crawlLane{name: "slow", timeout: slowLaneTimeout, ready: make(chan struct{}, 1)}
+	penaltyLane = &crawlLane{name: "penalty", timeout: penaltyLaneTimeout, ready: make(chan struct{}, 1)}
+)
+
+// push queues a relay on the lane, caller must hold mu
+func (l *crawlLane) push(relayURL string) {
+	l.queue = append(l.queue, relayURL)
+	frontierPending++
+
+	// Wake the dispatcher, a wakeup already pending covers this relay too
+	select {
+	case l.ready <- struct{}{}:
+	default:
+	}
+}
+
+// requeueLater puts a relay back on the lane after ipBusyRetry, counting it as pending
+// meanwhile so the frontier doesn't look idle
+func (l *crawlLane) requeueLater(relayURL string) {
+	locked(func() { frontierPending++ })
+	time.AfterFunc(ipBusyRetry, func() {
+		locked(func() {
+			frontierPending--
+			l.push(relayURL)
+		})
+	})
+}
+
+// enqueueRelay adds a relay to the frontier unless it was queued before, caller must hold mu.
+// Before the pool starts, e.g. during a replay, nothing is queued: startCrawlPool picks
+// up the relays known by then.
+func enqueueRelay(relayURL string) {
+	if workerSlots.Load() == 0 {
+		return
+	}
+	record := recordFor(relayURL)
+	if record.queued || record.crawled {
+		return
+	}
+	record.queued = true
+	if sampleRelay(relayURL) {
+		laneFor(relayURL).push(relayURL)
+	}
+}
+
+// recheckRelay queues an offline relay that was mentioned again for another crawl once
+// it has been offline for -dead-relay-ttl. Until then the offline list acts as a
+// negative cache and the relay is never redialed. Caller must hold mu.
+func recheckRelay(relayURL string, mentions int) {
+	record := recordFor(relayURL)
+	if workerSlots.Load() == 0 || !record.crawled || record.skippedStreak {
+		return // Not crawled by this run yet, its recheck is already queued or it is skipped for good
+	}
+	if cfg.DeadRelayTTL <= 0 || time.Since(record.offlineAt) < cfg.DeadRelayTTL {
+		deadRelayHits.Add(int64(mentions))
+		return
+	}
+	record.crawled = false
+	laneFor(relayURL).push(relayURL)
+}
+
+// startCrawlPool starts size fast lane workers, of which at most concurrency crawl at
+// once, plus the slow and penalty lanes', and queues the relays already known, such as those loaded
+// from the previous run
+func startCrawlPool(size, concurrency int) {
+	setTargetConcurrency(int64(concurrency))
+	fastLane.timeout = cfg.CrawlTimeout
+
+	mu.Lock()
+	workerSlots.Store(int64(size))
+	for relay := range clearOnline {
+		if _, offline := clearOffline[relay]; !offline {
+			enqueueRelay(relay)
+		}
+	}
+	mu.Unlock()
+
+	fastLane.start(size)
+	slowLane.start(max(1, concurrency/slowLaneShare))
+	penaltyLane.start(max(1, concurrency/slowLaneShare))
+}
+
+// start runs the lane's dispatcher and workers
+func (l *crawlLane) start(workers int) {
+	l.frontier = make(chan string)
+	l.addWorkers(workers)
+	go func() {
+		defer recoverFatal("frontier dispatcher")
+		l.dispatch(l.frontier)
+	}()
+}
+
+// addWorkers starts more workers on a running lane
+func (l *crawlLane) addWorkers(workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer recoverFatal("crawl worker")
+			l.work(l.frontier)
+		}()
+	}
+}
+
+// setConcurrency changes the target concurrency of a running crawl, growing the fast
+// lane when the pool is too small for it. Lowering it only holds back new crawls, those
+// in flight run to completion. With -adaptive-concurrency the value is kept within
+// -min-concurrency and -max-concurrency and retuned from there.
+func setConcurrency(concurrency int) int {
+	if cfg.Adaptive {
+		concurrency = max(cfg.MinConcurrency, min(cfg.MaxConcurrency, concurrency))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if slots := int(workerSlots.Load()); concurrency > slots {
+		fastLane.addWorkers(concurrency - slots)
+		workerSlots.Store(int64(concurrency))
+	}
+	setTargetConcurrency(int64(concurrency))
+	return concurrency
+}
+
+// dispatch hands queued relays to the lane's workers in discovery order
+func (l *crawlLane) dispatch(frontier chan<- string) {
+	for {
+		mu.Lock()
+		if len(l.queue) == 0 {
+			mu.Unlock()
+			<-l.ready
+			continue
+		}
+		relay := l.queue[0]
+		l.queue = l.queue[1:]
+		if len(l.queue) == 0 {
+			l.queue = nil // Let the drained backing array be collected
+		}
+		mu.Unlock()
+
+		waitWhilePaused()
+		if l.limited {
+			handOff(frontier, relay)
+		} else {
+			frontier <- relay
+		}
+	}
+}
+
+// work crawls relays from the lane until its frontier is closed
+func (l *crawlLane) work(frontier <-chan string) {
+	for relay := range frontier {
+		crawlRelay(relay, l)
+		if l.limited {
+			releaseSlot() // Counted busy by handOff
+		}
+		locked(func() { frontierPending-- })
+	}
+}
+
+// frontierIdle reports whether every queued relay has been crawled
+func frontierIdle() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return frontierPending == 0
+}
+
+// waitForIdleFrontier blocks until the frontier is empty and all workers are idle
+func waitForIdleFrontier() {
+	for !frontierIdle() {
+		time.Sleep(200 * time.Millisecond)
+	}
+}
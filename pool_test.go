@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/websocket"
+)
+
+// mockRelay is a local relay answering every REQ after delay with its events and an
+// EOSE, then holding the connection until the client hangs up. Each path, or each host
+// name with resolveToLoopback, is a relay of its own, so one server stands in for as
+// many relays as a test needs.
+type mockRelay struct {
+	*httptest.Server
+	delay  time.Duration
+	events []string
+
+	mu            sync.Mutex
+	connections   map[string]int // Connections made to each relay, by relayKey
+	active        map[string]int // Connections to each relay between accept and EOSE
+	concurrent    int            // Connections between accept and EOSE over all paths
+	maxConcurrent int
+	overlapped    []string // Relays that had two connections served at once
+}
+
+func newMockRelay(t *testing.T, delay time.Duration, events ...string) *mockRelay {
+	t.Helper()
+	relay := &mockRelay{
+		delay:       delay,
+		events:      events,
+		connections: make(map[string]int),
+		active:      make(map[string]int),
+	}
+	relay.Server = httptest.NewServer(websocket.Handler(relay.serve))
+	t.Cleanup(relay.Close)
+	return relay
+}
+
+// url returns the URL of the mock's i-th relay, told apart by its path
+func (m *mockRelay) url(i int) string {
+	return fmt.Sprintf("ws%s/relay%d", strings.TrimPrefix(m.URL, "http"), i)
+}
+
+// hostURL returns the URL of the mock's i-th relay under a clearnet host name of its
+// own, which only resolves to the mock with resolveToLoopback
+func (m *mockRelay) hostURL(i int) string {
+	return fmt.Sprintf("ws://relay%d.example.com:%s", i, m.URL[strings.LastIndexByte(m.URL, ':')+1:])
+}
+
+// relayKey tells the mock's relays apart by path, or by host name at the root
+func relayKey(u *url.URL) string {
+	if u.Path != "" && u.Path != "/" {
+		return u.Path
+	}
+	return u.Hostname()
+}
+
+// serve answers one connection, counting it against its relay
+func (m *mockRelay) serve(ws *websocket.Conn) {
+	request := ws.Request()
+	request.URL.Host = request.Host
+	path := relayKey(request.URL)
+	m.mu.Lock()
+	m.connections[path]++
+	m.active[path]++
+	if m.active[path] > 1 {
+		m.overlapped = append(m.overlapped, path)
+	}
+	m.concurrent++
+	m.maxConcurrent = max(m.maxConcurrent, m.concurrent)
+	m.mu.Unlock()
+
+	var req string
+	websocket.Message.Receive(ws, &req)
+	time.Sleep(m.delay)
+	for _, event := range m.events {
+		websocket.Message.Send(ws, event)
+	}
+
+	m.mu.Lock()
+	m.active[path]--
+	m.concurrent--
+	m.mu.Unlock()
+	websocket.Message.Send(ws, `["EOSE","crawlr"]`)
+	io.Copy(io.Discard, ws)
+}
+
+// peak returns the most connections served at once
+func (m *mockRelay) peak() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.maxConcurrent
+}
+
+// checkCrawledOnce fails the test unless each of the relays had exactly one connection,
+// no other relay had any and none was served twice at once
+func (m *mockRelay) checkCrawledOnce(t *testing.T, relays []string) {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, relay := range relays {
+		u, err := url.Parse(relay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count := m.connections[relayKey(u)]; count != 1 {
+			t.Errorf("%s was fetched %d times, want once", relay, count)
+		}
+	}
+	if len(m.connections) != len(relays) {
+		t.Errorf("%d relays were fetched, want %d", len(m.connections), len(relays))
+	}
+	if len(m.overlapped) > 0 {
+		t.Errorf("relays served two connections at once: %v", m.overlapped)
+	}
+}
+
+// resolveToLoopback answers every host name lookup with 127.0.0.1 until the test ends,
+// so relays under clearnet names, which categorize doesn't file as local, reach a mock
+func resolveToLoopback(t testing.TB) {
+	t.Helper()
+	saved := net.DefaultResolver
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe() // Not a PacketConn, so DNS over TCP framing
+			go answerLoopback(server)
+			return client, nil
+		},
+	}
+	t.Cleanup(func() { net.DefaultResolver = saved })
+}
+
+// answerLoopback answers one DNS query over conn, A queries with 127.0.0.1 and any
+// other type with no records
+func answerLoopback(conn net.Conn) {
+	defer conn.Close()
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return
+	}
+	query := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, query); err != nil {
+		return
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return
+	}
+	builder := dnsmessage.NewBuilder(make([]byte, 2, 512), dnsmessage.Header{ID: header.ID, Response: true,
+		Authoritative: true})
+	builder.StartQuestions()
+	builder.Question(question)
+	builder.StartAnswers()
+	if question.Type == dnsmessage.TypeA {
+		builder.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60},
+			dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+	}
+	response, err := builder.Finish()
+	if err != nil {
+		return
+	}
+	binary.BigEndian.PutUint16(response, uint16(len(response)-2))
+	conn.Write(response)
+}
+
+// startTestPool starts a crawl pool on lanes of its own, so pools left running by
+// earlier tests don't take its relays. Their workers stay blocked on their own lanes.
+func startTestPool(t *testing.T, size, concurrency int) {
+	t.Helper()
+	fast, slow, penalty := fastLane, slowLane, penaltyLane
+	fastLane = &crawlLane{name: "fast", limited: true, ready: make(chan struct{}, 1)}
+	slowLane = &crawlLane{name: "slow", timeout: slowLaneTimeout, ready: make(chan struct{}, 1)}
+	penaltyLane = &crawlLane{name: "penalty", timeout: penaltyLaneTimeout, ready: make(chan struct{}, 1)}
+	t.Cleanup(func() {
+		fastLane, slowLane, penaltyLane = fast, slow, penalty
+		workerSlots.Store(0)
+		targetConcurrency.Store(0)
+		busyWorkers.Store(0)
+	})
+	startCrawlPool(size, concurrency)
+}
+
+// waitForCrawl waits for the pool to drain its frontier, failing the test after timeout
+func waitForCrawl(t *testing.T, timeout time.Duration) {
+	t.Helper()
+	drained := make(chan struct{})
+	go func() {
+		waitForIdleFrontier()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		var pending int
+		locked(func() { pending = frontierPending })
+		t.Fatalf("frontier not drained after %v, %d relays pending", timeout, pending)
+	}
+}
+
+// Relays known before the pool starts and those discovered while it runs are all
+// crawled once, with no more connections at a time than the target concurrency
+func TestCrawlPool(t *testing.T) {
+	resetState(t)
+	cfg.MaxPerIP = 0
+	relay := newMockRelay(t, 5*time.Millisecond)
+	const known, discovered, concurrency = 50, 150, 10
+	urls := make([]string, known+discovered)
+	for i := range urls {
+		urls[i] = relay.url(i)
+	}
+
+	locked(func() {
+		for _, url := range urls[:known] {
+			classifyRelay(listedRelay{url: url, category: ClearOnline}, "wss://seed.example.com")
+		}
+	})
+	startTestPool(t, 2*concurrency, concurrency)
+
+	// Several seed sessions discover the rest at once
+	var wg sync.WaitGroup
+	for session := 0; session < 5; session++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := known + session; i < len(urls); i += 5 {
+				locked(func() {
+					classifyRelay(listedRelay{url: urls[i], category: ClearOnline}, "wss://seed.example.com")
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	waitForCrawl(t, 30*time.Second)
+
+	relay.checkCrawledOnce(t, urls)
+	if peak := relay.peak(); peak > concurrency {
+		t.Errorf("%d relays were fetched at once, want at most %d", peak, concurrency)
+	}
+	if accounting := crawlAccounting(); accounting.Succeeded != known+discovered || accounting.Remaining != 0 {
+		t.Errorf("accounting = %+v, want all %d relays succeeded", accounting, known+discovered)
+	}
+	if busy := busyWorkers.Load(); busy != 0 {
+		t.Errorf("%d workers still counted busy after the frontier drained", busy)
+	}
+}
+
+// A hand-off only counts as saturated when every allowed worker was busy, not when a
+// free worker is still finishing its last job, and it resumes as soon as a worker frees
+// up or the target concurrency is raised
+func TestHandOffSaturation(t *testing.T) {
+	resetState(t)
+	t.Cleanup(func() {
+		setTargetConcurrency(0)
+		busyWorkers.Store(0)
+		locked(func() { workers = workerStats{} })
+	})
+	locked(func() { workers = workerStats{} })
+	frontier := make(chan string)
+	receive := func(after time.Duration) {
+		go func() {
+			time.Sleep(after)
+			<-frontier
+		}()
+	}
+	saturated := func() int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return workers.saturated
+	}
+
+	// A free worker between two jobs
+	setTargetConcurrency(2)
+	receive(50 * time.Millisecond)
+	handOff(frontier, "wss://relay1.example.com")
+	if count := saturated(); count != 0 {
+		t.Errorf("%d saturated hand-offs with a worker free, want 0", count)
+	}
+
+	// Every worker busy until one finishes
+	busyWorkers.Store(2)
+	receive(0)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		releaseSlot()
+	}()
+	started := time.Now()
+	handOff(frontier, "wss://relay2.example.com")
+	if waited := time.Since(started); waited < 50*time.Millisecond || waited > time.Second {
+		t.Errorf("hand-off took %v, want until the worker finished", waited)
+	}
+
+	// Every worker busy until the target is raised
+	receive(0)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		setTargetConcurrency(3)
+	}()
+	handOff(frontier, "wss://relay3.example.com")
+
+	if count := saturated(); count != 2 {
+		t.Errorf("%d saturated hand-offs, want 2", count)
+	}
+	if busy := busyWorkers.Load(); busy != 3 {
+		t.Errorf("%d workers counted busy, want the 3 handed relays", busy)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if wait := workers.slotWait.summarize(); wait.Count != 3 {
+		t.Errorf("%d slot waits observed, want 3", wait.Count)
+	}
+}
+
+// Raising the concurrency of a running crawl grows the pool and the new ceiling holds
+func TestCrawlPoolSetConcurrency(t *testing.T) {
+	resetState(t)
+	cfg.MaxPerIP = 0
+	relay := newMockRelay(t, 20*time.Millisecond)
+	urls := make([]string, 200)
+	for i := range urls {
+		urls[i] = relay.url(i)
+	}
+
+	startTestPool(t, 4, 4)
+	locked(func() {
+		for _, url := range urls {
+			classifyRelay(listedRelay{url: url, category: ClearOnline}, "wss://seed.example.com")
+		}
+	})
+	time.Sleep(50 * time.Millisecond)
+	if got := setConcurrency(16); got != 16 {
+		t.Fatalf("setConcurrency(16) = %d", got)
+	}
+	waitForCrawl(t, 30*time.Second)
+
+	relay.checkCrawledOnce(t, urls)
+	if slots := workerSlots.Load(); slots != 16 {
+		t.Errorf("pool has %d worker slots, want 16", slots)
+	}
+	if peak := relay.peak(); peak <= 4 || peak > 16 {
+		t.Errorf("%d relays were fetched at once, want more than the old 4 and at most 16", peak)
+	}
+}
+
+// One event listing 500 relays is crawled through the pool, never with more dials at
+// once than -concurrency
+func TestRelayListDialLimit(t *testing.T) {
+	resetState(t)
+	resolveToLoopback(t)
+	cfg.MaxPerIP = 0 // Every relay resolves to 127.0.0.1, leave the limit to -concurrency
+	relay := newMockRelay(t, 10*time.Millisecond)
+	const relays, concurrency = 500, 16
+
+	urls := make([]string, relays)
+	tags := make([][]string, relays)
+	for i := range urls {
+		urls[i] = relay.hostURL(i)
+		tags[i] = []string{"r", urls[i]}
+	}
+	frame, err := json.Marshal([]any{"EVENT", "crawlr", Event{Kind: 10002, Pubkey: fmt.Sprintf("%064x", 1), Tags: tags}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTestPool(t, 4*concurrency, concurrency)
+	if err := handleMessage(frame, "wss://seed.example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitForCrawl(t, 60*time.Second)
+
+	relay.checkCrawledOnce(t, urls)
+	if peak := relay.peak(); peak > concurrency {
+		t.Errorf("%d relays were dialed at once, want at most %d", peak, concurrency)
+	}
+	if accounting := crawlAccounting(); accounting.Succeeded != relays {
+		t.Errorf("accounting = %+v, want all %d relays succeeded", accounting, relays)
+	}
+}
+
+// Many sessions listing the same relays in different orders while others hold claims
+// on them, as seed queries do, must still get each relay fetched once and never over
+// two connections at once
+func TestClaimQueueStress(t *testing.T) {
+	resetState(t)
+	cfg.MaxPerIP = 0
+	relay := newMockRelay(t, 30*time.Millisecond)
+	urls := make([]string, 300)
+	for i := range urls {
+		urls[i] = relay.url(i)
+	}
+	startTestPool(t, 32, 32)
+
+	var wg sync.WaitGroup
+	for session := 0; session < 24; session++ {
+		wg.Add(1)
+		source := fmt.Sprintf("wss://source%d.example.com", session)
+		go func() {
+			defer wg.Done()
+			for i := range urls {
+				url := urls[(i*7+session*13)%len(urls)] // A different order for each session
+				locked(func() {
+					classifyRelay(listedRelay{url: url, category: ClearOnline}, source)
+					enqueueRelay(url) // As startCrawlPool and -control seeds queue known relays
+				})
+			}
+		}()
+	}
+	for holder := 0; holder < 8; holder++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := holder; i < len(urls); i += 8 {
+				release := claimRelay(urls[i])
+				time.Sleep(time.Millisecond)
+				release()
+			}
+		}()
+	}
+	wg.Wait()
+	waitForCrawl(t, 60*time.Second)
+
+	// Relays mentioned or queued again after their crawl aren't crawled again
+	locked(func() {
+		for _, url := range urls {
+			classifyRelay(listedRelay{url: url, category: ClearOnline}, "wss://late.example.com")
+			enqueueRelay(url)
+		}
+	})
+	waitForCrawl(t, 10*time.Second)
+
+	relay.checkCrawledOnce(t, urls)
+	if accounting := crawlAccounting(); accounting.Succeeded != len(urls) || accounting.Remaining != 0 {
+		t.Errorf("accounting = %+v, want all %d relays succeeded", accounting, len(urls))
+	}
+}
+
+// BenchmarkCrawlPool parses relay lists from as many parsers as a full pool has
+// connections, classifying each list before taking mu as parseRelayList does, and with
+// the classification under mu for comparison
+func BenchmarkCrawlPool(b *testing.B) {
+	const parsers = 200
+	relays := testRelays(1000)
+	for i := range relays {
+		if i%2 == 0 {
+			relays[i] = strings.ToUpper(relays[i]) + "/" // Left for normalizeURL to clean up
+		}
+	}
+
+	for _, bench := range []struct {
+		name  string
+		parse func(event *Event)
+	}{
+		{"classify_outside_lock", func(event *Event) {
+			parseRelayList(nil, event, "wss://seed.example.com", nil)
+		}},
+		{"classify_under_lock", func(event *Event) {
+			locked(func() {
+				recordFor("wss://seed.example.com").addPubkey(event.Pubkey)
+				for _, tag := range event.Tags {
+					normalizedURL := normalizeURL(tag[1])
+					classifyRelay(listedRelay{url: normalizedURL, category: categorize(normalizedURL)},
+						"wss://seed.example.com")
+				}
+			})
+		}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			resetState(b)
+			b.ReportAllocs()
+			b.SetParallelism(max(1, parsers/runtime.GOMAXPROCS(0)))
+			var next atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					start := int(next.Add(1)) % (len(relays) - 20)
+					bench.parse(relayListEvent(fmt.Sprintf("%064x", start), relays[start:start+20]))
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "events/s")
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// With -probe the crawler checks a supplied relay list instead of discovering relays:
+// no seed is queried and nothing is bootstrapped, every listed relay is crawled once by
+// the usual pool and the run finalizes as soon as the frontier is empty. Crawls never
+// parse events, so the list can't grow.
+
+// Provenance recorded for relays read from the -probe list
+const probeSource = "probe"
+
+// loadProbeList classifies every URL of the -probe list, one per line with # comments,
+// "-" reading standard input. Caller must not hold mu.
+func loadProbeList(path string) (int, error) {
+	var input io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	listed := 0
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		normalizedURL := normalizeURL(line)
+		classifyRelay(listedRelay{url: normalizedURL, category: categorize(normalizedURL)}, probeSource)
+		listed++
+	}
+	if err := scanner.Err(); err != nil {
+		return listed, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return listed, nil
+}
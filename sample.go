@@ -0,0 +1,201 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// With -sample discovery runs as usual but only a uniform random share of the crawlable
+// relays is dialed, for a quick health estimate instead of a full crawl. Every relay
+// draws a number from a generator seeded with -sample-seed and its URL, so the same seed
+// picks the same relays from the same discoveries whatever order they arrive in. A
+// fraction dials the relays whose draw falls below it as they are found. A count holds
+// relays back until the first seed query is through, then dials those with the lowest
+// draws, and relays found later are left out. Relays left out are exported marked
+// not_probed so the sample frame can be audited, and the summary extrapolates from the
+// relays the sample crawled.
+
+// SampleSummary reports a -sample run and its estimate for every crawlable relay
+type SampleSummary struct {
+	Sample           string  `json:"sample"` // -sample as given: a fraction or a number of relays
+	Seed             uint64  `json:"seed"`
+	Frame            int     `json:"frame"` // Crawlable relays the sample was drawn from
+	Probed           int     `json:"probed"`
+	NotProbed        int     `json:"not_probed"`
+	Rate             float64 `json:"sampling_rate"` // Probed share of the frame
+	Online           int     `json:"online"`        // Crawled relays of the sample that answered
+	Offline          int     `json:"offline"`
+	OnlinePct        float64 `json:"online_percent"`
+	MarginPct        float64 `json:"margin_percent"` // 95% confidence, finite population corrected
+	EstimatedOnline  int     `json:"estimated_online"`
+	EstimatedOffline int     `json:"estimated_offline"`
+}
+
+// Sampling state, guarded by mu
+var sample struct {
+	drawn     bool     // With a count, the sample was drawn and later relays are left out
+	held      []string // With a count, relays waiting for drawSample
+	probed    int
+	notProbed int
+}
+
+// samplingEnabled reports whether -sample was given
+func samplingEnabled() bool {
+	return cfg.SampleRate > 0 || cfg.SampleSize > 0
+}
+
+// seedSampling picks a -sample-seed when none was given, before the configuration is
+// logged so the run can be repeated with it
+func seedSampling() {
+	if samplingEnabled() && cfg.SampleSeed == 0 {
+		cfg.SampleSeed = rand.Uint64()
+	}
+}
+
+// parseSample reads -sample: a fraction like 0.1, a percentage like 10% or a whole
+// number of relays
+func parseSample(value string) error {
+	value = strings.TrimSpace(value)
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		rate, err := strconv.ParseFloat(percent, 64)
+		if err != nil || rate <= 0 || rate > 100 {
+			return fmt.Errorf("must be a percentage above 0 and up to 100")
+		}
+		cfg.SampleRate, cfg.SampleSize = rate/100, 0
+		return nil
+	}
+	if size, err := strconv.Atoi(value); err == nil {
+		if size < 1 {
+			return fmt.Errorf("must be at least one relay")
+		}
+		cfg.SampleRate, cfg.SampleSize = 0, size
+		return nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate <= 0 || rate > 1 {
+		return fmt.Errorf("must be a fraction up to 1, a percentage or a number of relays")
+	}
+	cfg.SampleRate, cfg.SampleSize = rate, 0
+	return nil
+}
+
+// sampleDraw is a relay's uniform draw in [0, 1), fixed by -sample-seed and its URL
+func sampleDraw(relayURL string) float64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(relayURL))
+	return rand.New(rand.NewPCG(cfg.SampleSeed, hash.Sum64())).Float64()
+}
+
+// sampleRelay decides whether a relay about to be queued is dialed. Relays outside the
+// sample are marked not probed, with a count they are held back until drawSample.
+// Caller must hold mu.
+func sampleRelay(relayURL string) bool {
+	switch {
+	case !samplingEnabled():
+		return true
+	case cfg.SampleSize > 0 && !sample.drawn:
+		sample.held = append(sample.held, relayURL)
+		return false
+	case cfg.SampleRate > 0 && sampleDraw(relayURL) < cfg.SampleRate:
+		sample.probed++
+		return true
+	}
+	leaveOut(relayURL)
+	return false
+}
+
+// drawSample queues the -sample count of held relays with the lowest draws and leaves
+// the rest out. Called once the first seed query is through, later calls do nothing.
+// Caller must hold mu.
+func drawSample() {
+	if cfg.SampleSize <= 0 || sample.drawn {
+		return
+	}
+	sample.drawn = true
+
+	slices.SortFunc(sample.held, func(a, b string) int {
+		return cmp.Or(cmp.Compare(sampleDraw(a), sampleDraw(b)), strings.Compare(a, b))
+	})
+	for i, relayURL := range sample.held {
+		if i < cfg.SampleSize {
+			sample.probed++
+			laneFor(relayURL).push(relayURL)
+		} else {
+			leaveOut(relayURL)
+		}
+	}
+	mainLog.Info("sample drawn", "frame", len(sample.held), "probed", sample.probed)
+	sample.held = nil
+}
+
+// leaveOut marks a relay outside the sample as not probed, taking it off the frontier.
+// Caller must hold mu.
+func leaveOut(relayURL string) {
+	recordFor(relayURL).NotProbed = true
+	sample.notProbed++
+	remainingRelays.Add(-1)
+	notProbedRelays.Add(1)
+}
+
+// sampleColumns formats whether a relay was left out of the sample for csvRow, none
+// without -sample
+func sampleColumns(record RelayRecord) []string {
+	if !samplingEnabled() {
+		return nil
+	}
+	return []string{strconv.FormatBool(record.NotProbed)}
+}
+
+// summarizeSample extrapolates the crawled part of the sample to the whole frame, nil
+// without -sample. Caller must hold mu.
+func summarizeSample() *SampleSummary {
+	if !samplingEnabled() {
+		return nil
+	}
+	summary := &SampleSummary{
+		Sample:    strconv.FormatFloat(cfg.SampleRate, 'f', -1, 64),
+		Seed:      cfg.SampleSeed,
+		Frame:     sample.probed + sample.notProbed,
+		Probed:    sample.probed,
+		NotProbed: sample.notProbed,
+	}
+	if cfg.SampleSize > 0 {
+		summary.Sample = strconv.Itoa(cfg.SampleSize)
+	}
+	if summary.Frame > 0 {
+		summary.Rate = float64(summary.Probed) / float64(summary.Frame)
+	}
+
+	// Relays of the sample still queued at the end have no outcome and don't count
+	for relayURL, record := range relayRecords {
+		if record.NotProbed || !record.crawled {
+			continue
+		}
+		if _, offline := clearOffline[relayURL]; offline {
+			summary.Offline++
+		} else if _, online := clearOnline[relayURL]; online {
+			summary.Online++
+		}
+	}
+
+	crawled := summary.Online + summary.Offline
+	if crawled == 0 {
+		return summary
+	}
+	share := float64(summary.Online) / float64(crawled)
+	margin := 1.96 * math.Sqrt(share*(1-share)/float64(crawled))
+	if summary.Frame > 1 {
+		margin *= math.Sqrt(float64(max(summary.Frame-crawled, 0)) / float64(summary.Frame-1))
+	}
+	summary.OnlinePct = share * 100
+	summary.MarginPct = margin * 100
+	summary.EstimatedOnline = int(math.Round(share * float64(summary.Frame)))
+	summary.EstimatedOffline = summary.Frame - summary.EstimatedOnline
+	return summary
+}
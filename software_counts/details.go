@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"crawlr2/atomicfile"
+	"crawlr2/nip11"
+)
+
+// Outcome of a relay that served its document
+const OutcomeOK = "ok"
+
+// Joins the entries of list columns in relay_info.csv
+const listSeparator = ";"
+
+// RelayInfo is one relay of the detailed output
+type RelayInfo struct {
+	URL         string `json:"url"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Contact     string `json:"contact,omitempty"`
+	Pubkey      string `json:"pubkey,omitempty"`
+	Software    string `json:"software,omitempty"`
+	Version     string `json:"version,omitempty"`
+	Freshness   string `json:"freshness,omitempty"` // See freshness, empty without a document
+	Outcome     string `json:"outcome"`             // OutcomeOK, a nip11.Outcome or a Skipped reason
+
+	AuthRequired        bool   `json:"auth_required,omitempty"`
+	PaymentRequired     bool   `json:"payment_required,omitempty"` // Says so or lists fees
+	RestrictedWrites    bool   `json:"restricted_writes,omitempty"`
+	MaxMessageLength    int    `json:"max_message_length,omitempty"`
+	CreatedAtLowerLimit int64  `json:"created_at_lower_limit,omitempty"`
+	CreatedAtUpperLimit int64  `json:"created_at_upper_limit,omitempty"`
+	PaymentsURL         string `json:"payments_url,omitempty"`
+
+	Icon           string   `json:"icon,omitempty"`
+	Banner         string   `json:"banner,omitempty"`
+	RelayCountries []string `json:"relay_countries,omitempty"`
+	LanguageTags   []string `json:"language_tags,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+	PostingPolicy  string   `json:"posting_policy,omitempty"`
+
+	Timing *nip11.Timing `json:"timing,omitempty"` // Nil for failures and cache hits
+}
+
+// newRelayInfo builds a relay's row, cutting its description at maxDescription runes
+func newRelayInfo(relayURL string, doc *nip11.Document, err error, maxDescription int) RelayInfo {
+	if err != nil {
+		return RelayInfo{URL: relayURL, Outcome: nip11.Outcome(err)}
+	}
+	info := RelayInfo{
+		URL:              relayURL,
+		Name:             doc.Name,
+		Description:      truncate(doc.Description, maxDescription),
+		Contact:          doc.Contact,
+		Pubkey:           doc.Pubkey,
+		Software:         doc.Software,
+		Version:          doc.Version,
+		Outcome:          OutcomeOK,
+		AuthRequired:     doc.AuthRequired(),
+		PaymentRequired:  doc.Paid(),
+		RestrictedWrites: doc.RestrictedWrites(),
+		PaymentsURL:      doc.PaymentsURL,
+		Icon:             doc.Icon,
+		Banner:           doc.Banner,
+		RelayCountries:   doc.RelayCountries,
+		LanguageTags:     doc.LanguageTags,
+		Tags:             doc.Tags,
+		PostingPolicy:    doc.PostingPolicy,
+		Timing:           doc.Timing,
+	}
+	if limitation := doc.Limitation; limitation != nil {
+		info.MaxMessageLength = limitation.MaxMessageLength
+		info.CreatedAtLowerLimit = limitation.CreatedAtLowerLimit
+		info.CreatedAtUpperLimit = limitation.CreatedAtUpperLimit
+	}
+	return info
+}
+
+// truncate cuts s to at most limit runes, marking the cut with an ellipsis. A limit
+// of 0 keeps s whole.
+func truncate(s string, limit int) string {
+	if limit <= 0 || utf8.RuneCountInString(s) <= limit {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:limit]) + "…"
+}
+
+// writeRelayInfoCSV writes a row per relay. The csv writer quotes fields holding
+// commas, quotes or newlines, which descriptions often do.
+func writeRelayInfoCSV(path string, relays []RelayInfo) error {
+	file, err := atomicfile.Create(path)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"url", "name", "description", "contact", "pubkey", "software", "version", "freshness", "outcome",
+		"auth_required", "payment_required", "restricted_writes", "max_message_length",
+		"created_at_lower_limit", "created_at_upper_limit", "payments_url",
+		"icon", "banner", "relay_countries", "language_tags", "tags", "posting_policy",
+		"connect_ms", "first_byte_ms", "total_ms"})
+	for _, relay := range relays {
+		row := []string{relay.URL, relay.Name, relay.Description, relay.Contact, relay.Pubkey,
+			relay.Software, relay.Version, relay.Freshness, relay.Outcome,
+			strconv.FormatBool(relay.AuthRequired), strconv.FormatBool(relay.PaymentRequired),
+			strconv.FormatBool(relay.RestrictedWrites), optionalInt(int64(relay.MaxMessageLength)),
+			optionalInt(relay.CreatedAtLowerLimit), optionalInt(relay.CreatedAtUpperLimit), relay.PaymentsURL,
+			relay.Icon, relay.Banner, strings.Join(relay.RelayCountries, listSeparator),
+			strings.Join(relay.LanguageTags, listSeparator), strings.Join(relay.Tags, listSeparator), relay.PostingPolicy}
+		if timing := relay.Timing; timing != nil {
+			row = append(row, millis(timing.ConnectMs), millis(timing.FirstByteMs), millis(timing.TotalMs))
+		} else {
+			row = append(row, "", "", "")
+		}
+		writer.Write(row)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Commit()
+}
+
+// optionalInt formats a limit, leaving it empty when the relay gave none
+func optionalInt(value int64) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.FormatInt(value, 10)
+}
+
+// millis formats a timing column
+func millis(ms float64) string {
+	return strconv.FormatFloat(ms, 'f', 1, 64)
+}
+
+// writeRelayInfoJSON writes the relays as a JSON array
+func writeRelayInfoJSON(path string, relays []RelayInfo) error {
+	data, err := json.MarshalIndent(relays, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Latest known release per software, keyed by normalized software name. It is a
+// snapshot, update it when implementations release or pass -latest-versions.
+//
+//go:embed latest_versions.json
+var embeddedLatestVersions []byte
+
+// How a relay's version compares to the latest known release of its software
+const (
+	FreshnessCurrent  = "current"  // Same major and minor release, patch releases behind at most
+	FreshnessOutdated = "outdated" // An older major or minor release
+	FreshnessUnknown  = "unknown"  // No version, an unparseable one or software not in the table
+)
+
+// loadLatestVersions reads the embedded table, with the entries of path, if given,
+// added or replacing its own
+func loadLatestVersions(path string) (map[string]string, error) {
+	latest := make(map[string]string)
+	if err := mergeLatestVersions(latest, embeddedLatestVersions); err != nil {
+		return nil, fmt.Errorf("invalid embedded version table: %v", err)
+	}
+	if path == "" {
+		return latest, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read version table: %v", err)
+	}
+	if err := mergeLatestVersions(latest, data); err != nil {
+		return nil, fmt.Errorf("failed to parse version table %s: %v", path, err)
+	}
+	return latest, nil
+}
+
+// mergeLatestVersions adds a JSON object of software to version to latest
+func mergeLatestVersions(latest map[string]string, data []byte) error {
+	var table map[string]string
+	if err := json.Unmarshal(data, &table); err != nil {
+		return err
+	}
+	for software, version := range table {
+		latest[normalizeSoftware(software)] = version
+	}
+	return nil
+}
+
+// freshness compares a relay's version against the latest known release of its
+// software. Only major and minor releases count, a relay a patch behind is current.
+func freshness(latest map[string]string, software, version string) string {
+	newest, ok := latest[software]
+	if !ok {
+		return FreshnessUnknown
+	}
+	have, ok := parseVersion(version)
+	if !ok {
+		return FreshnessUnknown
+	}
+	want, ok := parseVersion(newest)
+	if !ok {
+		return FreshnessUnknown
+	}
+	if have[0] < want[0] || have[0] == want[0] && have[1] < want[1] {
+		return FreshnessOutdated
+	}
+	return FreshnessCurrent
+}
+
+// parseVersion reads major.minor.patch out of the version strings relays publish:
+// "v1.0.2", "1.0.2-14-gdeadbeef", "0.8", "1.0.0-rc1" and "strfry 1.0.4" all parse, a
+// missing minor or patch is 0. Whatever follows the numbers is ignored.
+func parseVersion(version string) ([3]int, bool) {
+	var parsed [3]int
+	version = normalizeVersion(version)
+	start := strings.IndexAny(version, "0123456789")
+	if start < 0 {
+		return parsed, false
+	}
+	if start > 0 && version[start-1] != ' ' && version[start-1] != 'v' && version[start-1] != 'V' {
+		return parsed, false // Digits inside a word, as in "nip11", are no version
+	}
+
+	rest := version[start:]
+	for i := range parsed {
+		end := 0
+		for end < len(rest) && rest[end] >= '0' && rest[end] <= '9' {
+			end++
+		}
+		if end == 0 {
+			break
+		}
+		parsed[i], _ = strconv.Atoi(rest[:end])
+		rest = rest[end:]
+		if !strings.HasPrefix(rest, ".") {
+			break
+		}
+		rest = rest[1:]
+	}
+	return parsed, true
+}
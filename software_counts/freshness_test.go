@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Version strings in the shapes relays publish them
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    [3]int
+		ok      bool
+	}{
+		{"1.0.2", [3]int{1, 0, 2}, true},
+		{"v1.0.2", [3]int{1, 0, 2}, true},
+		{"V0.9.0", [3]int{0, 9, 0}, true},
+		{" 1.0.2 ", [3]int{1, 0, 2}, true},
+		{"1.0.2-14-gdeadbeef", [3]int{1, 0, 2}, true},
+		{"1.0.2-dirty", [3]int{1, 0, 2}, true},
+		{"v1.0.2-3-g1a2b3c4-dirty", [3]int{1, 0, 2}, true},
+		{"1.0.0-rc1", [3]int{1, 0, 0}, true},
+		{"0.34.0-beta.2", [3]int{0, 34, 0}, true},
+		{"1.2.3+build.7", [3]int{1, 2, 3}, true},
+		{"0.8", [3]int{0, 8, 0}, true},
+		{"2", [3]int{2, 0, 0}, true},
+		{"1.0.", [3]int{1, 0, 0}, true},
+		{"1.2.3.4", [3]int{1, 2, 3}, true},
+		{"strfry 1.0.4", [3]int{1, 0, 4}, true},
+		{"nostr-rs-relay v0.9.0", [3]int{0, 9, 0}, true},
+		{"2024.05.01", [3]int{2024, 5, 1}, true},
+		{"", [3]int{}, false},
+		{"unknown", [3]int{}, false},
+		{"latest", [3]int{}, false},
+		{"nip11", [3]int{}, false},
+		{"abc123", [3]int{}, false},
+		{"deadbeef", [3]int{}, false},
+	}
+	for _, test := range tests {
+		got, ok := parseVersion(test.version)
+		if ok != test.ok || ok && got != test.want {
+			t.Errorf("parseVersion(%q) = %v, %v, want %v, %v", test.version, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	latest := map[string]string{
+		"https://github.com/hoytech/strfry": "1.0.4",
+		"nostr-rs-relay":                    "v0.9.0",
+		"broken":                            "latest",
+	}
+	tests := []struct {
+		software, version, want string
+	}{
+		{"https://github.com/hoytech/strfry", "1.0.4", FreshnessCurrent},
+		{"https://github.com/hoytech/strfry", "v1.0.1", FreshnessCurrent}, // Patches behind only
+		{"https://github.com/hoytech/strfry", "1.0.0-12-gabcdef0", FreshnessCurrent},
+		{"https://github.com/hoytech/strfry", "1.1.0", FreshnessCurrent}, // Ahead of the table
+		{"https://github.com/hoytech/strfry", "2.0", FreshnessCurrent},
+		{"https://github.com/hoytech/strfry", "0.9.6", FreshnessOutdated},
+		{"https://github.com/hoytech/strfry", "0.10.0", FreshnessOutdated},
+		{"https://github.com/hoytech/strfry", "strfry 0.9.7", FreshnessOutdated},
+		{"nostr-rs-relay", "0.8.13", FreshnessOutdated},
+		{"nostr-rs-relay", "0.9.0-rc1", FreshnessCurrent},
+		{"nostr-rs-relay", "0.10", FreshnessCurrent}, // Compared as numbers, not strings
+		{"https://github.com/hoytech/strfry", "", FreshnessUnknown},
+		{"https://github.com/hoytech/strfry", "unknown", FreshnessUnknown},
+		{"unlisted", "1.0.0", FreshnessUnknown},
+		{"broken", "1.0.0", FreshnessUnknown}, // The table's own version doesn't parse
+	}
+	for _, test := range tests {
+		if got := freshness(latest, test.software, test.version); got != test.want {
+			t.Errorf("freshness(%s, %q) = %s, want %s", test.software, test.version, got, test.want)
+		}
+	}
+}
+
+// -latest-versions adds to the embedded table and replaces its entries, keyed by the
+// normalized software name either way
+func TestLoadLatestVersions(t *testing.T) {
+	embedded, err := loadLatestVersions("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(embedded) == 0 {
+		t.Fatal("embedded version table is empty")
+	}
+
+	path := filepath.Join(t.TempDir(), "latest.json")
+	override := `{"git+https://github.com/hoytech/strfry.git": "9.9.9", "https://example.com/NewRelay/": "0.1.0"}`
+	if err := os.WriteFile(path, []byte(override), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	latest, err := loadLatestVersions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := latest["https://github.com/hoytech/strfry"]; got != "9.9.9" {
+		t.Errorf("strfry = %q, want the override 9.9.9", got)
+	}
+	if got := latest["https://example.com/newrelay"]; got != "0.1.0" {
+		t.Errorf("new software = %q, want 0.1.0", got)
+	}
+	if len(latest) < len(embedded) {
+		t.Errorf("%d entries after the override, want at least the %d embedded", len(latest), len(embedded))
+	}
+
+	if err := os.WriteFile(path, []byte(`["not", "an", "object"]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadLatestVersions(path); err == nil {
+		t.Error("a table that isn't an object was accepted")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// relayInput reads relay URLs from one column of a CSV, counting the rows it cannot
+// use instead of giving up on them. The crawler's own exports read as they are: no
+// header, the URL first and a varying number of columns after it.
+type relayInput struct {
+	reader    *csv.Reader
+	column    int
+	name      string // Column looked up in the header row, empty to use column
+	header    bool   // Skip the first row
+	started   bool
+	malformed int // Rows that failed to parse, or had no URL in the column
+}
+
+// openInput opens the input file, "-" reads stdin
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// newRelayInput reads the column given as a 0-based index or a header name. A name
+// implies a header row.
+func newRelayInput(r io.Reader, column string, header bool) *relayInput {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1 // Exports of offline relays have more columns than their header might say
+	reader.ReuseRecord = true
+	input := &relayInput{reader: reader, header: header}
+	if index, err := strconv.Atoi(column); err == nil {
+		input.column = index
+	} else {
+		input.name = column
+		input.header = true
+	}
+	return input
+}
+
+// next returns the next relay URL, io.EOF after the last
+func (in *relayInput) next() (string, error) {
+	for {
+		record, err := in.reader.Read()
+		if err == io.EOF {
+			return "", io.EOF
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			in.malformed++
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if !in.started {
+			in.started = true
+			if in.header {
+				if in.name != "" {
+					if in.column = columnIndex(record, in.name); in.column < 0 {
+						return "", fmt.Errorf("no %q column in the header", in.name)
+					}
+				}
+				continue
+			}
+			// A header that was not announced is recognised by its url column
+			if in.column < len(record) && strings.EqualFold(strings.TrimSpace(record[in.column]), "url") {
+				continue
+			}
+		}
+
+		if in.column >= len(record) || strings.TrimSpace(record[in.column]) == "" {
+			in.malformed++
+			continue
+		}
+		return strings.TrimSpace(record[in.column]), nil
+	}
+}
+
+// columnIndex finds a header name, ignoring case and surrounding space, -1 if missing
+func columnIndex(header []string, name string) int {
+	for i, column := range header {
+		if strings.EqualFold(strings.TrimSpace(column), name) {
+			return i
+		}
+	}
+	return -1
+}
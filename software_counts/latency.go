@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"crawlr2/atomicfile"
+)
+
+// LatencyStats summarizes how long one software's relays took to serve their document
+type LatencyStats struct {
+	Relays int     `json:"relays"` // Relays timed, cache hits and failures are not
+	P50Ms  float64 `json:"p50_ms"`
+	P90Ms  float64 `json:"p90_ms"`
+}
+
+// summarizeLatencies reduces each software's total fetch times to percentiles
+func summarizeLatencies(latencies map[string][]float64) map[string]LatencyStats {
+	stats := make(map[string]LatencyStats, len(latencies))
+	for software, totals := range latencies {
+		sort.Float64s(totals)
+		stats[software] = LatencyStats{
+			Relays: len(totals),
+			P50Ms:  percentile(totals, 0.5),
+			P90Ms:  percentile(totals, 0.9),
+		}
+	}
+	return stats
+}
+
+// percentile returns the nearest-rank percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(rank, 0)]
+}
+
+// writeLatencies writes software, relays, p50_ms, p90_ms rows, slowest median first
+func writeLatencies(path string, stats map[string]LatencyStats) error {
+	software := make([]string, 0, len(stats))
+	for name := range stats {
+		software = append(software, name)
+	}
+	sort.Slice(software, func(i, j int) bool {
+		if stats[software[i]].P50Ms != stats[software[j]].P50Ms {
+			return stats[software[i]].P50Ms > stats[software[j]].P50Ms
+		}
+		return software[i] < software[j]
+	})
+
+	file, err := atomicfile.Create(path)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"software", "relays", "p50_ms", "p90_ms"})
+	for _, name := range software {
+		writer.Write([]string{name, strconv.Itoa(stats[name].Relays),
+			fmt.Sprintf("%.1f", stats[name].P50Ms), fmt.Sprintf("%.1f", stats[name].P90Ms)})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Commit()
+}
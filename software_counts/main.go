@@ -3,132 +3,506 @@ package main
 import (
 	"encoding/csv"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
-)
 
-type RelayInfo struct {
-	Name          string   `json:"name"`
-	Description   string   `json:"description"`
-	Pubkey        string   `json:"pubkey"`
-	Contact       string   `json:"contact"`
-	SupportedNIPs []int    `json:"supported_nips"`
-	Software      string   `json:"software"`
-	Version       string   `json:"version"`
-}
+	"crawlr2/atomicfile"
+	"crawlr2/nip11"
+)
 
 const (
 	NoSoftwareListed = "No Software Listed"
-	Offline          = "Offline"
 	Other            = "Other"
+	UnknownVersion   = "unknown"
+
+	// Why a relay in the input was never requested
+	SkippedPlaintext    = "skipped_plaintext"     // ws:// with -no-plaintext
+	SkippedNotWebsocket = "skipped_not_websocket" // Neither wss:// nor ws://
+
+	// What relays that served a document restrict, see countAccess
+	AccessAuth       = "auth_required"
+	AccessPaid       = "payment_required"
+	AccessRestricted = "restricted_writes"
+	AccessOpen       = "open"
+
+	// Networks relays are counted on
+	Clearnet = "clearnet"
+	Onion    = "onion"
 )
 
+// git describe's "-<commits>-g<hash>" and a "-dirty" marker, stripped from versions
+var describeSuffix = regexp.MustCompile(`(-\d+-g[0-9a-f]{4,40})?(-dirty)?$`)
+
 func main() {
-	file, err := os.Open("relays.csv")
+	inputPath := flag.String("input", "relays.csv", "CSV of relays to probe, such as the crawler's clear_online export (- reads stdin)")
+	column := flag.String("column", "0", "column holding the relay URL, as a 0-based index or a header name")
+	header := flag.Bool("header", false, "skip the first row of the input (a header named url is skipped anyway)")
+	noCache := flag.Bool("no-cache", false, "fetch every NIP-11 document instead of using the cache")
+	cachePath := flag.String("cache", "nip11_cache.json", "file NIP-11 documents are cached in between runs")
+	cacheTTL := flag.Duration("cache-ttl", 24*time.Hour, "how long a cached NIP-11 document is used without asking the relay")
+	probeConcurrency := flag.Int("probe-concurrency", 50, "maximum NIP-11 requests in flight at once")
+	probeTimeout := flag.Duration("probe-timeout", 10*time.Second, "timeout of a single NIP-11 request")
+	socksProxy := flag.String("socks-proxy", "", "SOCKS5 proxy .onion relays are requested through, e.g. Tor at 127.0.0.1:9050 (onion relays are not requested by default)")
+	onionTimeout := flag.Duration("onion-timeout", 60*time.Second, "timeout of a single NIP-11 request to an onion relay")
+	threshold := flag.Int("threshold", 10, "software with fewer relays than this is grouped into Other (0 disables grouping)")
+	format := flag.String("format", "csv", "output format of the software counts: csv or json")
+	outputPath := flag.String("output", "", "file the software counts are written to (software_counts.<format> by default)")
+	details := flag.Bool("details", false, "also write relay_info.<format> with the name, description, contact, pubkey, software, version and outcome of every relay")
+	descriptionLength := flag.Int("description-length", 200, "descriptions in relay_info are cut to this many characters (0 keeps them whole)")
+	latestVersionsPath := flag.String("latest-versions", "", "JSON object of software to latest release, added to or replacing the built-in table")
+	quiet := flag.Bool("quiet", false, "do not print progress while probing")
+	progressInterval := flag.Duration("progress", 10*time.Second, "how often progress is printed while probing")
+	noPlaintext := flag.Bool("no-plaintext", false, "skip ws:// relays instead of fetching their documents over unencrypted http://")
+	flag.Parse()
+
+	if *format != "csv" && *format != "json" {
+		fmt.Println("Error: -format must be csv or json")
+		return
+	}
+	if *outputPath == "" {
+		*outputPath = "software_counts." + *format
+	}
+
+	latestVersions, err := loadLatestVersions(*latestVersionsPath)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	fetcher := &nip11.Fetcher{Client: &http.Client{Timeout: *probeTimeout}}
+	if *socksProxy != "" {
+		if fetcher.Onion, err = nip11.SOCKSClient(*socksProxy, *onionTimeout); err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+	}
+	if !*noCache {
+		if fetcher.Cache, err = nip11.LoadCache(*cachePath, *cacheTTL); err != nil {
+			fmt.Println("Starting with an empty cache:", err)
+		}
+	}
+
+	file, err := openInput(*inputPath)
 	if err != nil {
 		fmt.Println("Error opening CSV file:", err)
 		return
 	}
 	defer file.Close()
 
-	reader := csv.NewReader(file)
+	input := newRelayInput(file, *column, *header)
 	softwareCounts := make(map[string]int)
+	failureCounts := make(map[string]int) // Relays without a document, by nip11.Outcome
+	skipCounts := make(map[string]int)    // Relays never requested, by reason
+	schemeCounts := make(map[string]int)  // Relays requested, by the scheme of the request
+	accessCounts := make(map[string]int)  // Relays that served a document, by what they restrict
+	versionCounts := make(map[versionKey]int)
+	networkCounts := map[string]map[string]int{Clearnet: {}, Onion: {}} // Relays per software on each network
+	nips := newNIPCounts()
+	latencies := make(map[string][]float64) // Total fetch times per software, in ms
+	countryCounts := make(map[string]int)   // Relays per self-declared country
+	languageCounts := make(map[string]int)  // Relays per language tag
+	freshnessCounts := make(map[string]int) // Relays by how their version compares to the latest release
+	var relays []RelayInfo                  // Only filled with -details
 	var mu sync.Mutex
-	var wg sync.WaitGroup
+	probes := nip11.NewPool(*probeConcurrency, fetcher, func(relayURL string, doc *nip11.Document, err error) {
+		mu.Lock()
+		if *details {
+			info := newRelayInfo(relayURL, doc, err, *descriptionLength)
+			if err == nil {
+				info.Freshness = freshness(latestVersions, softwareName(doc), doc.Version)
+			}
+			relays = append(relays, info)
+		}
+		if err != nil {
+			failureCounts[nip11.Outcome(err)]++
+		} else {
+			software := softwareName(doc)
+			network := networkOf(relayURL)
+			softwareCounts[software]++
+			networkCounts[network][software]++
+			countAccess(accessCounts, doc)
+			freshnessCounts[freshness(latestVersions, software, doc.Version)]++
+			for _, country := range doc.RelayCountries {
+				countryCounts[country]++
+			}
+			for _, language := range doc.LanguageTags {
+				languageCounts[language]++
+			}
+			if doc.Timing != nil {
+				latencies[software] = append(latencies[software], doc.Timing.TotalMs)
+			}
+			nips.add(software, doc.SupportedNIPs)
+			if doc.Software != "" {
+				versionCounts[versionKey{software, normalizeVersion(doc.Version), network}]++
+			}
+		}
+		mu.Unlock()
+	})
+
+	started := time.Now()
+	inputDone, progressDone := make(chan struct{}), make(chan struct{})
+	if !*quiet {
+		go reportProgress(probes, *progressInterval, inputDone, progressDone)
+	}
+	defer close(progressDone)
 
 	for {
-		record, err := reader.Read()
+		relayURL, err := input.next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
+			probes.Close()
 			fmt.Println("Error reading CSV:", err)
 			return
 		}
 
-		if len(record) > 0 {
-			url := record[0]
-			wg.Add(1)
-			go func(url string) {
-				defer wg.Done()
-				software := getSoftwareInfo(url)
-				mu.Lock()
-				softwareCounts[software]++
-				mu.Unlock()
-			}(url)
+		httpURL, err := nip11.HTTPURL(relayURL)
+		skipped := ""
+		switch {
+		case err != nil:
+			skipped = SkippedNotWebsocket
+		case *noPlaintext && strings.HasPrefix(httpURL, "http://"):
+			skipped = SkippedPlaintext
+		}
+		if skipped != "" {
+			mu.Lock()
+			skipCounts[skipped]++
+			if *details {
+				relays = append(relays, RelayInfo{URL: relayURL, Outcome: skipped})
+			}
+			mu.Unlock()
+		} else {
+			schemeCounts[httpURL[:strings.Index(httpURL, ":")]]++
+			probes.Submit(relayURL)
 		}
 	}
 
-	wg.Wait()
+	close(inputDone)
+	probes.Close()
+	printSummary(probes.Stats(), skipCounts, input.malformed, time.Since(started))
+	fmt.Printf("Auth required: %d, payment required: %d, restricted writes: %d, open: %d\n",
+		accessCounts[AccessAuth], accessCounts[AccessPaid], accessCounts[AccessRestricted], accessCounts[AccessOpen])
+	fmt.Printf("Requested over https: %d, http: %d\n", schemeCounts["https"], schemeCounts["http"])
+	fmt.Printf("Versions current: %d, outdated: %d, unknown: %d\n",
+		freshnessCounts[FreshnessCurrent], freshnessCounts[FreshnessOutdated], freshnessCounts[FreshnessUnknown])
+
+	if fetcher.Cache != nil {
+		if err := fetcher.Cache.Save(); err != nil {
+			fmt.Println("Error saving cache:", err)
+		}
+		hits, revalidated, misses := fetcher.Cache.Stats()
+		fmt.Printf("NIP-11 cache: %d fetches served from the cache (%d fresh, %d not modified), %d downloaded\n",
+			hits+revalidated, hits, revalidated, misses)
+	}
 
-	// Process software counts to group less common software into "Other"
-	threshold := 10
-	groupedCounts := make(map[string]int)
+	grouped, folded := groupSoftware(softwareCounts, *threshold)
+	counts := SoftwareCounts{
+		Grouped:  grouped,
+		Software: softwareCounts,
+		Failures: failureCounts,
+		Skipped:  skipCounts,
+		Schemes:  schemeCounts,
+		Networks: networkCounts,
+		Access:   accessCounts,
+		Latency:  summarizeLatencies(latencies),
+
+		Countries: countryCounts,
+		Languages: languageCounts,
+		Freshness: freshnessCounts,
+
+		FoldedIntoOther: folded,
+		MalformedRows:   input.malformed,
+	}
+	write := writeCountsCSV
+	if *format == "json" {
+		write = writeCountsJSON
+	}
+	if err := write(*outputPath, counts); err != nil {
+		fmt.Println("Error writing software counts:", err)
+		return
+	}
+	fmt.Println("Software counts have been written to", *outputPath)
+
+	if *threshold > 0 {
+		// The long tail that grouping folds into Other
+		if err := writeCounts("software_counts_full.csv", []string{"Software", "Count"}, softwareCounts); err != nil {
+			fmt.Println("Error writing ungrouped software counts:", err)
+			return
+		}
+		fmt.Println("Ungrouped software counts have been written to software_counts_full.csv")
+	}
+
+	if *details {
+		sort.Slice(relays, func(i, j int) bool { return relays[i].URL < relays[j].URL })
+		writeDetails := writeRelayInfoCSV
+		if *format == "json" {
+			writeDetails = writeRelayInfoJSON
+		}
+		detailsPath := "relay_info." + *format
+		if err := writeDetails(detailsPath, relays); err != nil {
+			fmt.Println("Error writing relay details:", err)
+			return
+		}
+		fmt.Println("Relay details have been written to", detailsPath)
+	}
+
+	if err := writeVersions("software_versions.csv", versionCounts); err != nil {
+		fmt.Println("Error writing version CSV file:", err)
+		return
+	}
+	fmt.Println("Version counts have been written to software_versions.csv")
+
+	if err := writeLatencies("software_latency.csv", counts.Latency); err != nil {
+		fmt.Println("Error writing latency CSV file:", err)
+		return
+	}
+	fmt.Println("Fetch latency per software has been written to software_latency.csv")
+
+	for _, aggregate := range []struct {
+		path   string
+		header []string
+		counts map[string]int
+	}{
+		{"relays_by_country.csv", []string{"country", "relays"}, countryCounts},
+		{"relays_by_language.csv", []string{"language", "relays"}, languageCounts},
+	} {
+		if err := writeCounts(aggregate.path, aggregate.header, aggregate.counts); err != nil {
+			fmt.Println("Error writing", aggregate.path+":", err)
+			return
+		}
+	}
+	fmt.Println("Relays per country and language have been written to relays_by_country.csv and relays_by_language.csv")
+
+	if err := nips.write("nips_summary"); err != nil {
+		fmt.Println("Error writing NIP summary:", err)
+		return
+	}
+	fmt.Println("NIP support has been written to nips_summary.csv and nips_summary.json")
+}
+
+// SoftwareCounts is what software_counts reports: relays per software with the rare
+// ones grouped into Other, the same without grouping and split by network, the relays
+// that served no document by nip11.Outcome, the relays never requested and the
+// schemes requested over, and how many relays restrict access
+type SoftwareCounts struct {
+	Grouped  map[string]int            `json:"grouped"`
+	Software map[string]int            `json:"software"`
+	Failures map[string]int            `json:"failures"`
+	Skipped  map[string]int            `json:"skipped"`
+	Schemes  map[string]int            `json:"schemes"`
+	Networks map[string]map[string]int `json:"networks"` // Software counts split by Clearnet and Onion
+	Access   map[string]int            `json:"access"`   // See countAccess
+	Latency  map[string]LatencyStats   `json:"latency"`  // Document fetch times per software
+
+	Countries map[string]int `json:"countries"` // Relays per relay_countries entry
+	Languages map[string]int `json:"languages"` // Relays per language_tags entry
+	Freshness map[string]int `json:"freshness"` // Relays per Freshness value
+
+	FoldedIntoOther int `json:"folded_into_other"` // Distinct software grouped into Other
+	MalformedRows   int `json:"malformed_rows"`    // Input rows without a usable URL
+}
+
+// versionKey is one row of software_versions.csv
+type versionKey struct {
+	software, version, network string
+}
+
+// groupSoftware folds software with fewer than threshold relays into Other, returning
+// how many distinct software values were folded
+func groupSoftware(softwareCounts map[string]int, threshold int) (map[string]int, int) {
+	grouped := make(map[string]int)
+	folded := 0
 	for software, count := range softwareCounts {
 		if count < threshold {
-			groupedCounts[Other] += count
+			grouped[Other] += count
+			folded++
 		} else {
-			groupedCounts[software] = count
+			grouped[software] = count
 		}
 	}
+	return grouped, folded
+}
+
+// sortedCounts returns the keys of a count map, highest count first
+func sortedCounts(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
 
-	// Write results to a new CSV file
-	outputFile, err := os.Create("software_counts.csv")
+// writeCountsCSV writes the grouped counts, most relays first, followed by a row per
+// failure outcome and skip reason. Neither is ever folded into Other, each keeps its
+// own row. The Folded column says how many distinct software values Other stands for.
+func writeCountsCSV(path string, counts SoftwareCounts) error {
+	file, err := atomicfile.Create(path)
 	if err != nil {
-		fmt.Println("Error creating output CSV file:", err)
-		return
+		return err
 	}
-	defer outputFile.Close()
 
-	writer := csv.NewWriter(outputFile)
-	defer writer.Flush()
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"Software", "Count", "Folded"})
+	for _, software := range sortedCounts(counts.Grouped) {
+		folded := ""
+		if software == Other {
+			folded = strconv.Itoa(counts.FoldedIntoOther)
+		}
+		writer.Write([]string{software, strconv.Itoa(counts.Grouped[software]), folded})
+	}
+	for outcome, count := range counts.Failures {
+		writer.Write([]string{outcome, strconv.Itoa(count), ""})
+	}
+	for reason, count := range counts.Skipped {
+		writer.Write([]string{reason, strconv.Itoa(count), ""})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Commit()
+}
 
-	writer.Write([]string{"Software", "Count"})
-	for software, count := range groupedCounts {
-		writer.Write([]string{software, fmt.Sprintf("%d", count)})
+// writeCounts writes a count map under a name, count header, most relays first
+func writeCounts(path string, header []string, counts map[string]int) error {
+	file, err := atomicfile.Create(path)
+	if err != nil {
+		return err
 	}
 
-	fmt.Println("Software counts have been written to software_counts.csv")
+	writer := csv.NewWriter(file)
+	writer.Write(header)
+	for _, key := range sortedCounts(counts) {
+		writer.Write([]string{key, strconv.Itoa(counts[key])})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Commit()
 }
 
-func getSoftwareInfo(wsURL string) string {
-	httpURL := strings.Replace(wsURL, "wss://", "https://", 1)
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest("GET", httpURL, nil)
+// writeCountsJSON writes the grouped and ungrouped counts and the failures
+func writeCountsJSON(path string, counts SoftwareCounts) error {
+	data, err := json.MarshalIndent(counts, "", "  ")
 	if err != nil {
-		return Offline
+		return err
 	}
+	return atomicfile.WriteFile(path, data)
+}
 
-	req.Header.Set("Accept", "application/nostr+json")
+// writeVersions writes software, version, network, count rows, each software's
+// versions together with clearnet first and the most common first on each network
+func writeVersions(path string, versionCounts map[versionKey]int) error {
+	rows := make([]versionKey, 0, len(versionCounts))
+	for key := range versionCounts {
+		rows = append(rows, key)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].software != rows[j].software {
+			return rows[i].software < rows[j].software
+		}
+		if rows[i].network != rows[j].network {
+			return rows[i].network < rows[j].network
+		}
+		if versionCounts[rows[i]] != versionCounts[rows[j]] {
+			return versionCounts[rows[i]] > versionCounts[rows[j]]
+		}
+		return rows[i].version < rows[j].version
+	})
 
-	resp, err := client.Do(req)
+	file, err := atomicfile.Create(path)
 	if err != nil {
-		return Offline
+		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return Offline
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"software", "version", "network", "count"})
+	for _, row := range rows {
+		writer.Write([]string{row.software, row.version, row.network, strconv.Itoa(versionCounts[row])})
 	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Commit()
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return Offline
+// normalizeVersion folds the spellings of one release together: "v1.0.2",
+// "1.0.2-14-gdeadbeef" and "1.0.2" are all "1.0.2". Empty is UnknownVersion.
+func normalizeVersion(version string) string {
+	version = strings.TrimSpace(version)
+	if len(version) > 1 && (version[0] == 'v' || version[0] == 'V') && version[1] >= '0' && version[1] <= '9' {
+		version = version[1:]
+	}
+	version = describeSuffix.ReplaceAllString(version, "")
+	if version == "" {
+		return UnknownVersion
+	}
+	return version
+}
+
+// countAccess counts a relay under each restriction it advertises, or as open when it
+// advertises none. A relay that lists fees counts as payment required.
+func countAccess(accessCounts map[string]int, doc *nip11.Document) {
+	open := true
+	for access, restricted := range map[string]bool{
+		AccessAuth:       doc.AuthRequired(),
+		AccessPaid:       doc.Paid(),
+		AccessRestricted: doc.RestrictedWrites(),
+	} {
+		if restricted {
+			accessCounts[access]++
+			open = false
+		}
+	}
+	if open {
+		accessCounts[AccessOpen]++
 	}
+}
 
-	var relayInfo RelayInfo
-	if err := json.Unmarshal(body, &relayInfo); err != nil {
-		return Offline
+// networkOf returns the network a relay is reached on
+func networkOf(relayURL string) string {
+	if parsed, err := url.Parse(relayURL); err == nil && nip11.IsOnion(parsed.Host) {
+		return Onion
 	}
+	return Clearnet
+}
 
-	if relayInfo.Software == "" {
+// softwareName is the row a relay that served its document is counted in
+func softwareName(doc *nip11.Document) string {
+	software := normalizeSoftware(doc.Software)
+	if software == "" {
 		return NoSoftwareListed
 	}
+	return software
+}
 
-	return strings.TrimSpace(relayInfo.Software)
+// normalizeSoftware folds the spellings of one software together. Most relays name
+// their repository, some as "git+https://github.com/hoytech/strfry.git", others
+// without the prefix, the .git or with a trailing slash, in any case.
+func normalizeSoftware(software string) string {
+	software = strings.ToLower(strings.TrimSpace(software))
+	software = strings.TrimPrefix(software, "git+")
+	software = strings.TrimSuffix(software, "/")
+	return strings.TrimSuffix(software, ".git")
 }
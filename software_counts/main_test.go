@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runMain runs software_counts with args in dir, its output discarded
+func runMain(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Chdir(wd)
+		os.Stdout = stdout
+		devNull.Close()
+	}()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = devNull
+	os.Args = append([]string{"software_counts"}, args...)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	main()
+}
+
+// A large input is fetched with no more requests in flight than -probe-concurrency,
+// and every relay is still counted
+func TestProbeConcurrencyCap(t *testing.T) {
+	const rows, concurrency = 5000, 16
+
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+
+		time.Sleep(2 * time.Millisecond)
+		relay, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/relay"))
+		software := "git+https://github.com/hoytech/strfry.git"
+		if relay%2 == 1 {
+			software = "https://github.com/scsibug/nostr-rs-relay"
+		}
+		w.Header().Set("Content-Type", "application/nostr+json")
+		fmt.Fprintf(w, `{"name":"relay %d","software":%q,"version":"1.0.0","supported_nips":[1,11]}`, relay, software)
+	}))
+	defer server.Close()
+
+	// Rows shaped like the crawler's clear_online export, the URL and then its counts
+	dir := t.TempDir()
+	var input strings.Builder
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&input, "ws%s/relay%d,%d,41.5,,120.25\n", strings.TrimPrefix(server.URL, "http"), i, i%7)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "relays.csv"), []byte(input.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	runMain(t, dir, "-no-cache", "-quiet", "-format", "json", "-threshold", "0",
+		"-probe-concurrency", strconv.Itoa(concurrency))
+
+	if peak > concurrency {
+		t.Errorf("%d requests were in flight at once, want at most %d", peak, concurrency)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "software_counts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counts SoftwareCounts
+	if err := json.Unmarshal(data, &counts); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"https://github.com/hoytech/strfry": rows / 2, "https://github.com/scsibug/nostr-rs-relay": rows / 2}
+	for software, count := range want {
+		if counts.Software[software] != count {
+			t.Errorf("%s counted %d times, want %d", software, counts.Software[software], count)
+		}
+	}
+	if len(counts.Software) != len(want) || len(counts.Failures) != 0 || counts.MalformedRows != 0 {
+		t.Errorf("counts = %+v, want only the two software", counts)
+	}
+}
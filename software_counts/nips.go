@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"crawlr2/atomicfile"
+)
+
+// Software name the rows covering every relay are written under
+const AllSoftware = "all"
+
+// NIPSupport counts how many relays of one group advertise each NIP
+type NIPSupport struct {
+	Relays int               `json:"relays"` // Relays in the group that served a document
+	NIPs   map[int]NIPRelays `json:"nips"`
+}
+
+// NIPRelays is how many relays of a group advertise a NIP, and what share they are
+type NIPRelays struct {
+	Relays  int     `json:"relays"`
+	Percent float64 `json:"percent"`
+}
+
+// nipCounts aggregates supported_nips over every relay and per software
+type nipCounts struct {
+	all      map[int]int
+	software map[string]map[int]int
+	relays   map[string]int // Relays per software, AllSoftware for the total
+}
+
+func newNIPCounts() *nipCounts {
+	return &nipCounts{
+		all:      make(map[int]int),
+		software: make(map[string]map[int]int),
+		relays:   make(map[string]int),
+	}
+}
+
+// add counts one relay's document, each NIP once however often it is listed
+func (c *nipCounts) add(software string, nips []int) {
+	c.relays[AllSoftware]++
+	c.relays[software]++
+	if c.software[software] == nil {
+		c.software[software] = make(map[int]int)
+	}
+	seen := make(map[int]bool, len(nips))
+	for _, nip := range nips {
+		if seen[nip] {
+			continue
+		}
+		seen[nip] = true
+		c.all[nip]++
+		c.software[software][nip]++
+	}
+}
+
+// support returns one group's counts with their share of the group's relays
+func (c *nipCounts) support(group string, counts map[int]int) NIPSupport {
+	support := NIPSupport{Relays: c.relays[group], NIPs: make(map[int]NIPRelays, len(counts))}
+	for nip, relays := range counts {
+		support.NIPs[nip] = NIPRelays{Relays: relays, Percent: 100 * float64(relays) / float64(support.Relays)}
+	}
+	return support
+}
+
+// write saves the aggregation as <base>.json, keyed by software with AllSoftware for
+// the total, and <base>.csv with software, nip, relays, percent rows
+func (c *nipCounts) write(base string) error {
+	summary := map[string]NIPSupport{AllSoftware: c.support(AllSoftware, c.all)}
+	for software, counts := range c.software {
+		summary[software] = c.support(software, counts)
+	}
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(base+".json", data); err != nil {
+		return err
+	}
+
+	file, err := atomicfile.Create(base + ".csv")
+	if err != nil {
+		return err
+	}
+
+	groups := make([]string, 0, len(summary))
+	for group := range summary {
+		if group != AllSoftware {
+			groups = append(groups, group)
+		}
+	}
+	sort.Strings(groups)
+	groups = append([]string{AllSoftware}, groups...)
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"software", "nip", "relays", "percent"})
+	for _, group := range groups {
+		support := summary[group]
+		nips := make([]int, 0, len(support.NIPs))
+		for nip := range support.NIPs {
+			nips = append(nips, nip)
+		}
+		sort.Ints(nips)
+		for _, nip := range nips {
+			writer.Write([]string{group, strconv.Itoa(nip), strconv.Itoa(support.NIPs[nip].Relays),
+				fmt.Sprintf("%.1f", support.NIPs[nip].Percent)})
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Commit()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"crawlr2/nip11"
+)
+
+// reportProgress prints the pool's progress every interval until done is closed. The
+// total grows while the input is still being read, marked with a "+".
+func reportProgress(probes *nip11.Pool, interval time.Duration, inputDone <-chan struct{}, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	reading := true
+	for {
+		select {
+		case <-done:
+			return
+		case <-inputDone:
+			reading = false
+			inputDone = nil
+			continue
+		case <-ticker.C:
+		}
+
+		stats := probes.Stats()
+		total := fmt.Sprint(stats.Submitted)
+		if reading {
+			total += "+"
+		}
+		fmt.Printf("Progress: %d/%s processed, %s, %.1f/s\n",
+			stats.Fetched, total, formatOutcomes(stats), stats.PerSecond)
+	}
+}
+
+// formatOutcomes lists successes followed by each failure outcome, largest first
+func formatOutcomes(stats nip11.PoolStats) string {
+	parts := []string{fmt.Sprintf("%s %d", OutcomeOK, stats.Fetched-stats.Failed)}
+	for _, outcome := range sortedOutcomes(stats.Outcomes) {
+		parts = append(parts, fmt.Sprintf("%s %d", outcome, stats.Outcomes[outcome]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// sortedOutcomes returns the outcomes of a count map, highest count first
+func sortedOutcomes(outcomes map[string]int64) []string {
+	keys := make([]string, 0, len(outcomes))
+	for outcome := range outcomes {
+		keys = append(keys, outcome)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if outcomes[keys[i]] != outcomes[keys[j]] {
+			return outcomes[keys[i]] > outcomes[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// printSummary prints the totals of a run per outcome, including the relays that were
+// skipped or unreadable, and how long it took
+func printSummary(stats nip11.PoolStats, skipCounts map[string]int, malformed int, elapsed time.Duration) {
+	fmt.Printf("Processed %d relays in %s (%.1f/s), peak backlog %d of %d\n",
+		stats.Fetched, elapsed.Round(time.Millisecond), stats.PerSecond, stats.PeakBacklog, stats.QueueCapacity)
+	fmt.Printf("  %-24s %d\n", OutcomeOK, stats.Fetched-stats.Failed)
+	for _, outcome := range sortedOutcomes(stats.Outcomes) {
+		fmt.Printf("  %-24s %d\n", outcome, stats.Outcomes[outcome])
+	}
+	for _, reason := range []string{SkippedPlaintext, SkippedNotWebsocket} {
+		if skipCounts[reason] > 0 {
+			fmt.Printf("  %-24s %d\n", reason, skipCounts[reason])
+		}
+	}
+	if malformed > 0 {
+		fmt.Printf("  %-24s %d\n", "malformed_rows", malformed)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// CrawlAccounting counts the crawlable relays. Every clearnet relay is in exactly one
+// of succeeded, failed, remaining or not probed, so crawled never exceeds discovered:
+//
+//	failed     = in clearOffline
+//	succeeded  = in clearOnline, crawled and not in clearOffline
+//	not probed = in clearOnline and left out of the -sample
+//	remaining  = in clearOnline, not crawled, not in clearOffline and not left out (the frontier)
+//	crawled    = succeeded + failed
+//	discovered = crawled + remaining + not probed
+type CrawlAccounting struct {
+	Discovered int     `json:"discovered"`
+	Crawled    int     `json:"crawled"`
+	Succeeded  int     `json:"succeeded"`
+	Failed     int     `json:"failed"`
+	Remaining  int     `json:"remaining"`
+	NotProbed  int     `json:"not_probed,omitempty"`
+	Progress   float64 `json:"progress_percent"` // Of the relays to crawl, not probed ones left out
+}
+
+// Relay counters behind the status, updated by countRelay, countSuccess, countRecovered and countOffline
+// wherever the relay lists change so reading them never takes mu. They are the only
+// source the TUI, progress lines, /status, metrics and summary read from.
+var (
+	relayCounts     = make(map[RelayCategory]*atomic.Int64, len(allCategories)) // Size of each list
+	succeededRelays atomic.Int64
+	remainingRelays atomic.Int64
+	notProbedRelays atomic.Int64
+)
+
+func init() {
+	for _, category := range allCategories {
+		relayCounts[category] = new(atomic.Int64)
+	}
+}
+
+// countRelay counts a relay newly added to a category's list, caller must hold mu
+func countRelay(category RelayCategory, relayURL string) {
+	relayCounts[category].Add(1)
+	if category != ClearOnline {
+		return
+	}
+	if _, offline := clearOffline[relayURL]; !offline && !isCrawled(relayURL) {
+		remainingRelays.Add(1)
+	}
+}
+
+// countSuccess moves a relay from remaining to succeeded, caller must hold mu
+func countSuccess() {
+	remainingRelays.Add(-1)
+	succeededRelays.Add(1)
+}
+
+// countRecovered moves a rechecked relay from failed to succeeded, caller must hold mu
+func countRecovered() {
+	relayCounts[ClearOffline].Add(-1)
+	relayCounts[ClearOnline].Add(1)
+	succeededRelays.Add(1)
+}
+
+// countOffline moves a relay that is about to be marked offline out of the online list
+// and the frontier, or out of succeeded when it had answered, caller must hold mu
+func countOffline(relayURL string) {
+	if _, online := clearOnline[relayURL]; online {
+		relayCounts[ClearOnline].Add(-1)
+		if isCrawled(relayURL) {
+			succeededRelays.Add(-1) // Panicked after its success was counted
+		} else {
+			remainingRelays.Add(-1)
+		}
+	}
+	if _, offline := clearOffline[relayURL]; !offline {
+		relayCounts[ClearOffline].Add(1)
+	}
+}
+
+// crawlAccounting reads the accounting from the relay counters
+func crawlAccounting() CrawlAccounting {
+	accounting := CrawlAccounting{
+		Failed:    int(relayCounts[ClearOffline].Load()),
+		Succeeded: int(succeededRelays.Load()),
+		Remaining: int(remainingRelays.Load()),
+		NotProbed: int(notProbedRelays.Load()),
+	}
+
+	accounting.Crawled = accounting.Succeeded + accounting.Failed
+	accounting.Discovered = accounting.Crawled + accounting.Remaining + accounting.NotProbed
+	if toCrawl := accounting.Crawled + accounting.Remaining; toCrawl > 0 {
+		accounting.Progress = float64(accounting.Crawled) / float64(toCrawl) * 100
+	}
+	return accounting
+}
+
+// CrawlStatus is a point-in-time view of the crawl shared by the TUI, the progress
+// lines, the /status endpoint and the summary, so they always show the same numbers
+type CrawlStatus struct {
+	StartedAt     time.Time             `json:"started_at"`
+	UptimeSeconds float64               `json:"uptime_seconds"`
+	Pass          int64                 `json:"pass"`
+	Paused        bool                  `json:"paused"`
+	IdleSeconds   float64               `json:"idle_seconds"` // 0 while there is work
+	Categories    map[RelayCategory]int `json:"categories"`
+	CrawlAccounting
+	ActiveConnections int64   `json:"active_connections"`
+	BusyWorkers       int64   `json:"busy_workers"`
+	WorkerSlots       int     `json:"worker_slots"`
+	TargetConcurrency int     `json:"target_concurrency"`
+	EventsProcessed   int64   `json:"events_processed"`
+	BytesTransferred  int64   `json:"bytes_transferred"`
+	EventsPerSecond   float64 `json:"events_per_second"`
+	CrawledPerMinute  float64 `json:"crawled_per_minute"`
+}
+
+// workerUtilization returns the percentage of the target concurrency currently busy
+func (s CrawlStatus) workerUtilization() float64 {
+	if s.TargetConcurrency == 0 {
+		return 0
+	}
+	return float64(s.BusyWorkers) * 100 / float64(s.TargetConcurrency)
+}
+
+// snapshotStatus reads the crawl status from the counters without taking mu, so
+// polling it never slows the crawl down
+func snapshotStatus() CrawlStatus {
+	status := CrawlStatus{
+		StartedAt:  runStart.UTC(),
+		Categories: make(map[RelayCategory]int, len(allCategories)),
+	}
+
+	for _, category := range allCategories {
+		status.Categories[category] = int(relayCounts[category].Load())
+	}
+	status.CrawlAccounting = crawlAccounting()
+
+	status.Pass = passNumber.Load()
+	status.Paused = discoveryPaused.Load()
+	if since := idleSince.Load(); since != 0 {
+		status.IdleSeconds = time.Since(time.Unix(0, since)).Seconds()
+	}
+	status.ActiveConnections = metricActiveConnections.Load()
+	status.BusyWorkers = busyWorkers.Load()
+	status.WorkerSlots = int(workerSlots.Load())
+	status.TargetConcurrency = int(targetConcurrency.Load())
+	status.EventsProcessed = eventsProcessed.Load()
+	status.BytesTransferred = bytesTransferred.Load()
+
+	uptime := time.Since(runStart)
+	status.UptimeSeconds = uptime.Seconds()
+	if uptime > 0 {
+		status.EventsPerSecond = float64(status.EventsProcessed) / uptime.Seconds()
+		status.CrawledPerMinute = float64(status.Crawled) / uptime.Minutes()
+	}
+	return status
+}
+
+// handleStatus serves the current crawl status as JSON
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := snapshotStatus()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(status)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// countedAccounting derives the accounting from the relay lists as CrawlAccounting
+// defines it, for checking the counters against. Caller must hold mu.
+func countedAccounting() CrawlAccounting {
+	var accounting CrawlAccounting
+	accounting.Failed = len(clearOffline)
+	for relay := range clearOnline {
+		if _, offline := clearOffline[relay]; offline {
+			continue
+		}
+		switch {
+		case relayRecords[relay].NotProbed:
+			accounting.NotProbed++
+		case isCrawled(relay):
+			accounting.Succeeded++
+		default:
+			accounting.Remaining++
+		}
+	}
+	accounting.Crawled = accounting.Succeeded + accounting.Failed
+	accounting.Discovered = accounting.Crawled + accounting.Remaining + accounting.NotProbed
+	if toCrawl := accounting.Crawled + accounting.Remaining; toCrawl > 0 {
+		accounting.Progress = float64(accounting.Crawled) / float64(toCrawl) * 100
+	}
+	return accounting
+}
+
+// succeed marks a relay crawled the way crawlRelay does when it answers, caller must hold mu
+func succeed(relay string) {
+	if _, offline := clearOffline[relay]; offline {
+		markRecovered(relay)
+	} else {
+		countSuccess()
+	}
+	recordFor(relay).crawled = true
+}
+
+// Walk relays through every transition the crawl makes and check the counters agree
+// with the lists, and with the expected numbers, after each one
+func TestCrawlAccounting(t *testing.T) {
+	resetState(t)
+	relay := func(i int) string { return fmt.Sprintf("wss://relay%d.example.com", i) }
+	timeout := errors.New("timeout")
+
+	steps := []struct {
+		name string
+		step func()
+		want CrawlAccounting
+	}{
+		{"discover", func() {
+			for i := 0; i < 10; i++ {
+				classifyRelay(listedRelay{url: relay(i), category: ClearOnline}, "wss://seed.example.com")
+			}
+			classifyRelay(listedRelay{url: "ws://relay.onion", category: Onion}, "wss://seed.example.com")
+		}, CrawlAccounting{Discovered: 10, Remaining: 10}},
+		{"mentioned again", func() {
+			classifyRelay(listedRelay{url: relay(0), category: ClearOnline}, "wss://other.example.com")
+		}, CrawlAccounting{Discovered: 10, Remaining: 10}},
+		{"succeed", func() {
+			for i := 0; i < 4; i++ {
+				succeed(relay(i))
+			}
+		}, CrawlAccounting{Discovered: 10, Crawled: 4, Succeeded: 4, Remaining: 6, Progress: 40}},
+		{"fail", func() {
+			for i := 4; i < 7; i++ {
+				markOffline(relay(i), timeout)
+			}
+		}, CrawlAccounting{Discovered: 10, Crawled: 7, Succeeded: 4, Failed: 3, Remaining: 3, Progress: 70}},
+		{"online relay panics after its success", func() {
+			markOffline(relay(0), errors.New("panic: boom")) // As recoverRelay does
+		}, CrawlAccounting{Discovered: 10, Crawled: 7, Succeeded: 3, Failed: 4, Remaining: 3, Progress: 70}},
+		{"offline relay fails its recheck", func() {
+			recordFor(relay(4)).crawled = false // Requeued by recheckRelay
+			markOffline(relay(4), timeout)
+		}, CrawlAccounting{Discovered: 10, Crawled: 7, Succeeded: 3, Failed: 4, Remaining: 3, Progress: 70}},
+		{"offline relay recovers", func() {
+			recordFor(relay(5)).crawled = false
+			succeed(relay(5))
+		}, CrawlAccounting{Discovered: 10, Crawled: 7, Succeeded: 4, Failed: 3, Remaining: 3, Progress: 70}},
+		{"offline relay rediscovered", func() {
+			classifyRelay(listedRelay{url: relay(6), category: ClearOnline}, "wss://other.example.com")
+		}, CrawlAccounting{Discovered: 10, Crawled: 7, Succeeded: 4, Failed: 3, Remaining: 3, Progress: 70}},
+		{"left out of the sample", func() {
+			leaveOut(relay(9))
+		}, CrawlAccounting{Discovered: 10, Crawled: 7, Succeeded: 4, Failed: 3, Remaining: 2, NotProbed: 1,
+			Progress: float64(7) / 9 * 100}},
+		{"frontier drained", func() {
+			succeed(relay(7))
+			markOffline(relay(8), timeout)
+		}, CrawlAccounting{Discovered: 10, Crawled: 9, Succeeded: 5, Failed: 4, NotProbed: 1, Progress: 100}},
+	}
+
+	for _, step := range steps {
+		var counted CrawlAccounting
+		locked(func() {
+			step.step()
+			counted = countedAccounting()
+		})
+		got := crawlAccounting()
+		if got != step.want {
+			t.Errorf("%s: accounting = %+v, want %+v", step.name, got, step.want)
+		}
+		if got != counted {
+			t.Errorf("%s: counters = %+v, lists = %+v", step.name, got, counted)
+		}
+	}
+
+	status := snapshotStatus()
+	if status.CrawlAccounting != crawlAccounting() {
+		t.Errorf("status accounting = %+v, want %+v", status.CrawlAccounting, crawlAccounting())
+	}
+	if status.Categories[ClearOnline] != len(clearOnline) || status.Categories[ClearOffline] != len(clearOffline) ||
+		status.Categories[Onion] != 1 {
+		t.Errorf("status categories = %v", status.Categories)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// With -stdin relay URLs piped in while the crawler runs, one per line, join the
+// frontier as they arrive next to the relays discovery finds, until standard input is
+// closed. Each URL is keyed by its normalized form, like the relays discovery finds, so
+// a relay named twice, or already known, is only crawled once. Lines that aren't relay
+// URLs are counted and skipped.
+
+// Provenance recorded for relays read from standard input
+const stdinSource = "stdin"
+
+// StdinSummary reports the lines read from standard input with -stdin
+type StdinSummary struct {
+	Lines      int  `json:"lines"`
+	Added      int  `json:"added"`
+	Duplicates int  `json:"duplicates"`
+	Malformed  int  `json:"malformed"`
+	Closed     bool `json:"closed"` // Whether standard input reached EOF before the run ended
+}
+
+var (
+	stdinStats  StdinSummary          // Guarded by mu
+	stdinClosed = make(chan struct{}) // Closed at EOF of standard input, right away without -stdin
+)
+
+// startStdinSeeds starts reading relay URLs from standard input with -stdin
+func startStdinSeeds() {
+	if !cfg.Stdin {
+		close(stdinClosed)
+		return
+	}
+	go func() {
+		defer recoverFatal("stdin")
+		defer close(stdinClosed)
+		readStdinSeeds()
+	}()
+}
+
+// readStdinSeeds feeds every line of standard input to the frontier until EOF
+func readStdinSeeds() {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		locked(func() { addStdinSeed(scanner.Text()) })
+	}
+	if err := scanner.Err(); err != nil {
+		mainLog.Warn("stopped reading relays from standard input", "error", err)
+	}
+
+	mu.Lock()
+	stdinStats.Closed = true
+	stats := stdinStats
+	mu.Unlock()
+	mainLog.Info("standard input closed", "lines", stats.Lines, "added", stats.Added,
+		"duplicates", stats.Duplicates, "malformed", stats.Malformed)
+}
+
+// addStdinSeed classifies one line of standard input. Caller must hold mu.
+func addStdinSeed(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	stdinStats.Lines++
+
+	relayURL := normalizeURL(line)
+	category := categorize(relayURL)
+	if category == Malformed {
+		stdinStats.Malformed++
+		mainLog.Debug("skipped malformed relay URL from standard input", "line", line)
+		return
+	}
+	if _, known := relayRecords[relayURL]; known {
+		stdinStats.Duplicates++
+		return
+	}
+
+	classifyRelay(listedRelay{url: relayURL, category: category}, stdinSource)
+	stdinStats.Added++
+}
+
+// summarizeStdin reports what -stdin read, nil without it. Caller must hold mu.
+func summarizeStdin() *StdinSummary {
+	if !cfg.Stdin {
+		return nil
+	}
+	stats := stdinStats
+	return &stats
+}
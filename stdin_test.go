@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+// Relays read from standard input are keyed like discovered ones, so a relay named on
+// both, however it's spelled, has one entry crawled once
+func TestAddStdinSeed(t *testing.T) {
+	resetState(t)
+	saved := stdinStats
+	t.Cleanup(func() { stdinStats = saved })
+	stdinStats = StdinSummary{}
+
+	listed := relayListEvent("", []string{"wss://relay.listed.com", "wss://relay.port.com:443"})
+	if err := parseRelayList(nil, listed, "wss://seed.example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	locked(func() {
+		for _, line := range []string{
+			"wss://Relay.Stdin.com/",
+			"  wss://relay.stdin.com  ", // The same relay
+			"wss://RELAY.LISTED.COM/",   // Discovered already
+			"wss://relay.port.com:443",  // Discovered already, under its port
+			"wss://relay.stdin.com:443", // A relay of its own, like discovery keys it
+			"not a relay",
+			"",
+		} {
+			addStdinSeed(line)
+		}
+	})
+	listed = relayListEvent("", []string{"wss://relay.stdin.com", "wss://relay.stdin.com:443"})
+	if err := parseRelayList(nil, listed, "wss://other.example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := StdinSummary{Lines: 6, Added: 2, Duplicates: 3, Malformed: 1}
+	if stdinStats != want {
+		t.Errorf("stdin summary = %+v, want %+v", stdinStats, want)
+	}
+	wantListed := map[string]int{"wss://relay.listed.com": 1, "wss://relay.port.com:443": 1,
+		"wss://relay.stdin.com": 1, "wss://relay.stdin.com:443": 1}
+	if len(clearOnline) != len(wantListed) {
+		t.Errorf("clear online relays = %v, want %v", clearOnline, wantListed)
+	}
+	for relay, mentions := range wantListed {
+		if clearOnline[relay] != mentions {
+			t.Errorf("%s has %d mentions, want %d", relay, clearOnline[relay], mentions)
+		}
+	}
+	for _, relay := range []string{"wss://relay.stdin.com", "wss://relay.stdin.com:443"} {
+		if by := relayRecords[relay].DiscoveredBy; by != stdinSource {
+			t.Errorf("%s discovered by %q, want %q", relay, by, stdinSource)
+		}
+	}
+}
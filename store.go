@@ -0,0 +1,27 @@
+package main
+
+// RelayStore persists crawl results somewhere other than the run directory
+type RelayStore interface {
+	// BeginRun registers the run before any relays are saved
+	BeginRun(run RunMetadata) error
+	// SaveRelay queues the current state of a relay, writes may be batched
+	SaveRelay(record RelayRecord)
+	// FinishRun flushes queued relays and marks the run as finished
+	FinishRun(run RunMetadata) error
+	Close() error
+}
+
+// openStore returns the configured store, or nil when results only go to files
+func openStore() (RelayStore, error) {
+	if cfg.PostgresDSN == "" {
+		return nil, nil
+	}
+	return openPostgresStore(cfg.PostgresDSN)
+}
+
+// saveToStore queues a relay record if a store is configured
+func saveToStore(record RelayRecord) {
+	if store != nil {
+		store.SaveRelay(record)
+	}
+}
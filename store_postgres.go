@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+// Batching limits for the PostgreSQL writer
+const (
+	postgresBatchSize     = 500
+	postgresFlushInterval = 2 * time.Second
+	postgresMaxConns      = 4
+
+	// Serializes migrations between crawlers starting against the same database
+	postgresMigrationLock = 0x63726177 // "craw"
+)
+
+// postgresStore writes relay records to PostgreSQL from a single batching goroutine,
+// so crawl workers never hold database connections themselves
+type postgresStore struct {
+	db      *sql.DB
+	runID   string
+	queue   chan RelayRecord
+	flushed chan chan error
+	done    sync.WaitGroup
+
+	closeMu sync.RWMutex // Held for reading while sending on queue, for writing to close it
+	closed  bool         // Set by Close, later saves are dropped
+}
+
+// openPostgresStore connects to the database and applies pending migrations
+func openPostgresStore(dsn string) (*postgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("postgres open error: %v", err)
+	}
+	db.SetMaxOpenConns(postgresMaxConns)
+	db.SetMaxIdleConns(postgresMaxConns)
+	db.SetConnMaxIdleTime(5 * time.Minute)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("postgres connect error: %v", err)
+	}
+	if err := migratePostgres(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("postgres migration error: %v", err)
+	}
+
+	return &postgresStore{
+		db:      db,
+		queue:   make(chan RelayRecord, postgresBatchSize*2),
+		flushed: make(chan chan error),
+	}, nil
+}
+
+// migratePostgres applies embedded migrations that haven't run yet, in file name order.
+// They run in one transaction under an advisory lock, so crawlers on several machines
+// starting at once apply each migration exactly once instead of racing on
+// schema_migrations.
+func migratePostgres(db *sql.DB) error {
+	names, err := fs.Glob(postgresMigrations, "migrations/postgres/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing once committed
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, postgresMigrationLock); err != nil {
+		return fmt.Errorf("migration lock: %v", err)
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		base := name[strings.LastIndex(name, "/")+1:]
+		version, err := strconv.Atoi(strings.SplitN(base, "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("bad migration name %s", base)
+		}
+
+		var applied bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, version).Scan(&applied); err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+
+		script, err := postgresMigrations.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(string(script)); err != nil {
+			return fmt.Errorf("%s: %v", base, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// BeginRun inserts the run row and starts the batching writer
+func (s *postgresStore) BeginRun(run RunMetadata) error {
+	s.runID = run.RunID
+	_, err := s.db.Exec(`
+		INSERT INTO runs (id, started_at, crawler_version, crawler_commit, seed)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO NOTHING`,
+		run.RunID, run.StartedAt, run.CrawlerVersion, run.CrawlerCommit, pq.Array(run.Seed))
+	if err != nil {
+		return fmt.Errorf("postgres run insert error: %v", err)
+	}
+
+	s.done.Add(1)
+	go s.writer()
+	return nil
+}
+
+// SaveRelay queues a record for the next batch. Records saved after Close, e.g. by a
+// worker still finishing during shutdown, are dropped.
+func (s *postgresStore) SaveRelay(record RelayRecord) {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		storeLog.Debug("dropped relay saved after the store closed", "relay", record.URL)
+		return
+	}
+	s.queue <- record
+}
+
+// writer collects queued records and writes them in batches
+func (s *postgresStore) writer() {
+	defer s.done.Done()
+
+	ticker := time.NewTicker(postgresFlushInterval)
+	defer ticker.Stop()
+
+	// Records are keyed by URL so repeated updates within a batch collapse into one write
+	batch := make(map[string]RelayRecord)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := s.writeBatch(batch)
+		batch = make(map[string]RelayRecord)
+		return err
+	}
+
+	for {
+		select {
+		case record, ok := <-s.queue:
+			if !ok {
+				if err := flush(); err != nil {
+					storeLog.Error("failed to write relays to postgres", "error", err)
+				}
+				return
+			}
+			batch[record.URL] = record
+			if len(batch) >= postgresBatchSize {
+				if err := flush(); err != nil {
+					storeLog.Error("failed to write relays to postgres", "error", err)
+				}
+			}
+		case reply := <-s.flushed:
+			// Drain what is already queued before answering
+			for drained := false; !drained; {
+				select {
+				case record := <-s.queue:
+					batch[record.URL] = record
+				default:
+					drained = true
+				}
+			}
+			reply <- flush()
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				storeLog.Error("failed to write relays to postgres", "error", err)
+			}
+		}
+	}
+}
+
+// writeBatch upserts a batch of relays and their observations in one transaction
+func (s *postgresStore) writeBatch(batch map[string]RelayRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	relayStmt, err := tx.Prepare(`
+		INSERT INTO relays (url, category, discovered_by, first_seen, last_seen, last_online)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6)
+		ON CONFLICT (url) DO UPDATE SET
+			category = EXCLUDED.category,
+			discovered_by = COALESCE(relays.discovered_by, EXCLUDED.discovered_by),
+			first_seen = LEAST(relays.first_seen, EXCLUDED.first_seen),
+			last_seen = EXCLUDED.last_seen,
+			last_online = GREATEST(relays.last_online, EXCLUDED.last_online)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer relayStmt.Close()
+
+	observationStmt, err := tx.Prepare(`
+		INSERT INTO relay_observations
+			(run_id, url, observed_at, category, count, failure_reason, failure_class, unique_pubkeys)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), $8)
+		ON CONFLICT (run_id, url) DO UPDATE SET
+			observed_at = EXCLUDED.observed_at,
+			category = EXCLUDED.category,
+			count = EXCLUDED.count,
+			failure_reason = EXCLUDED.failure_reason,
+			failure_class = EXCLUDED.failure_class,
+			unique_pubkeys = EXCLUDED.unique_pubkeys`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer observationStmt.Close()
+
+	now := time.Now().UTC()
+	for _, record := range batch {
+		firstSeen := now
+		if record.FirstSeen != nil {
+			firstSeen = *record.FirstSeen
+		}
+		if _, err := relayStmt.Exec(record.URL, string(record.Category), record.DiscoveredBy, firstSeen, now,
+			record.LastSeen); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("relay %s: %v", record.URL, err)
+		}
+		if _, err := observationStmt.Exec(s.runID, record.URL, now, string(record.Category), record.Count,
+			record.FailureReason, record.FailureClass, record.UniquePubkeys); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("observation %s: %v", record.URL, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// FinishRun flushes pending relays and records the finish time
+func (s *postgresStore) FinishRun(run RunMetadata) error {
+	reply := make(chan error)
+	s.flushed <- reply
+	if err := <-reply; err != nil {
+		return fmt.Errorf("postgres flush error: %v", err)
+	}
+
+	_, err := s.db.Exec(`UPDATE runs SET finished_at = $2 WHERE id = $1`, run.RunID, run.FinishedAt)
+	if err != nil {
+		return fmt.Errorf("postgres run update error: %v", err)
+	}
+	return nil
+}
+
+// Close stops the writer after flushing and closes the connection pool
+func (s *postgresStore) Close() error {
+	s.closeMu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.closeMu.Unlock()
+	s.done.Wait()
+	return s.db.Close()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// openTestPostgres connects to the database named by CRAWLR_TEST_POSTGRES_DSN, skipping
+// the test without one. The database should be a scratch one, tests write to it.
+func openTestPostgres(t *testing.T) *postgresStore {
+	t.Helper()
+	dsn := os.Getenv("CRAWLR_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("CRAWLR_TEST_POSTGRES_DSN not set")
+	}
+	store, err := openPostgresStore(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// Crawlers on several machines starting together must all get through the migrations
+func TestPostgresConcurrentMigrations(t *testing.T) {
+	first := openTestPostgres(t)
+	defer first.Close()
+
+	dsn := os.Getenv("CRAWLR_TEST_POSTGRES_DSN")
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store, err := openPostgresStore(dsn)
+			if err != nil {
+				errs <- err
+				return
+			}
+			store.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestPostgresStoreRoundTrip(t *testing.T) {
+	store := openTestPostgres(t)
+	defer store.Close()
+
+	run := RunMetadata{
+		RunID:          fmt.Sprintf("test-%d", time.Now().UnixNano()),
+		Seed:           []string{"wss://seed.example.com"},
+		StartedAt:      time.Now().UTC(),
+		CrawlerVersion: "test",
+	}
+	urls := []string{"wss://" + run.RunID + ".example.com", "wss://" + run.RunID + ".example.net"}
+	defer func() {
+		store.db.Exec(`DELETE FROM runs WHERE id = $1`, run.RunID)
+		store.db.Exec(`DELETE FROM relays WHERE url = ANY($1)`, pq.Array(urls))
+	}()
+
+	if err := store.BeginRun(run); err != nil {
+		t.Fatal(err)
+	}
+	store.SaveRelay(RelayRecord{URL: urls[0], Category: ClearOnline, Count: 3})
+	store.SaveRelay(RelayRecord{URL: urls[0], Category: ClearOnline, Count: 4}) // Collapses into one write
+	store.SaveRelay(RelayRecord{URL: urls[1], Category: ClearOffline, Count: 1, FailureReason: "timeout"})
+	run.FinishedAt = time.Now().UTC()
+	if err := store.FinishRun(run); err != nil {
+		t.Fatal(err)
+	}
+
+	var observations, count int
+	if err := store.db.QueryRow(`SELECT COUNT(*) FROM relay_observations WHERE run_id = $1`, run.RunID).
+		Scan(&observations); err != nil {
+		t.Fatal(err)
+	}
+	if observations != 2 {
+		t.Errorf("got %d observations, want 2", observations)
+	}
+	if err := store.db.QueryRow(`SELECT count FROM relay_observations WHERE run_id = $1 AND url = $2`,
+		run.RunID, urls[0]).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("got count %d, want the latest save's 4", count)
+	}
+
+	var finished bool
+	if err := store.db.QueryRow(`SELECT finished_at IS NOT NULL FROM runs WHERE id = $1`, run.RunID).
+		Scan(&finished); err != nil {
+		t.Fatal(err)
+	}
+	if !finished {
+		t.Error("run not marked finished")
+	}
+}
+
+// A worker saving after finalize closed the store must not panic
+func TestPostgresSaveAfterClose(t *testing.T) {
+	db, err := sql.Open("postgres", "host=localhost dbname=unused") // Connects lazily, never here
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &postgresStore{db: db, queue: make(chan RelayRecord, 1), flushed: make(chan chan error)}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store.SaveRelay(RelayRecord{URL: "wss://late.example.com"})
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
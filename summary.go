@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"crawlr2/atomicfile"
+)
+
+// Number of relays listed in the top relays table
+const summaryTopRelays = 20
+
+// Summary holds the headline numbers of a run
+type Summary struct {
+	Run              RunMetadata                      `json:"run"`
+	DurationSeconds  float64                          `json:"duration_seconds"`
+	Totals           map[RelayCategory]int            `json:"totals"`
+	Crawl            CrawlAccounting                  `json:"crawl"`
+	EventsProcessed  int64                            `json:"events_processed"`
+	BytesTransferred int64                            `json:"bytes_transferred"`
+	OfflineReasons   map[string]int                   `json:"offline_reasons"`
+	Latency          map[RelayCategory]LatencySummary `json:"latency,omitempty"`
+	Workers          WorkerSummary                    `json:"workers"`
+	SlowLaneRelays   int                              `json:"slow_lane_relays"`
+	PenalizedDomains []DomainStats                    `json:"penalized_domains,omitempty"`
+	MemoryGuard      *MemoryGuardSummary              `json:"memory_guard,omitempty"`
+	NIP11            *NIP11Summary                    `json:"nip11,omitempty"`
+	Webhooks         *WebhookSummary                  `json:"webhooks,omitempty"`
+	DroppedLogLines  int64                            `json:"dropped_log_lines,omitempty"`
+	TopRelays        []TopRelay                       `json:"top_relays_by_pubkeys"`
+	TopDiscoverers   []TopDiscoverer                  `json:"top_discoverers"`
+	TopCountries     []CountryStats                   `json:"top_countries,omitempty"`
+	ASNConcentration *ASNConcentration                `json:"asn_concentration,omitempty"`
+	NIPProbes        *NIPProbeSummary                 `json:"nip_probes,omitempty"`
+	Availability     *AvailabilitySummary             `json:"availability,omitempty"`
+	Coverage         *CoverageSummary                 `json:"coverage,omitempty"`
+	TimeLimit        *TimeLimitSummary                `json:"time_limited,omitempty"`
+	Stdin            *StdinSummary                    `json:"stdin,omitempty"`
+	Sample           *SampleSummary                   `json:"sample,omitempty"`
+	ExportFilters    *ExportFilterSummary             `json:"export_filters,omitempty"`
+}
+
+// TopRelay is one entry of the top relays table
+type TopRelay struct {
+	URL           string `json:"url"`
+	UniquePubkeys int    `json:"unique_pubkeys"`
+}
+
+// TopDiscoverer is one entry of the top contributors table
+type TopDiscoverer struct {
+	URL        string `json:"url"`
+	Discovered int    `json:"discovered_count"`
+}
+
+// buildSummary collects the summary from the same state the exports use, caller must hold mu
+func buildSummary(run RunMetadata) Summary {
+	state := liveState()
+	summary := Summary{
+		Run:              run,
+		DurationSeconds:  run.FinishedAt.Sub(run.StartedAt).Seconds(),
+		Totals:           make(map[RelayCategory]int),
+		EventsProcessed:  eventsProcessed.Load(),
+		BytesTransferred: bytesTransferred.Load(),
+		OfflineReasons:   make(map[string]int),
+		Crawl:            crawlAccounting(),
+		DroppedLogLines:  droppedLogLines.Load(),
+		Workers:          workers.summarize(),
+		PenalizedDomains: penalizedDomains(),
+		MemoryGuard:      summarizeMemoryGuard(),
+		NIP11:            summarizeEnrichment(),
+		Webhooks:         summarizeWebhooks(),
+		ASNConcentration: state.buildASNConcentration(),
+		NIPProbes:        summarizeNIPProbes(),
+		Availability:     summarizeAvailability(),
+		TimeLimit:        summarizeTimeLimit(),
+		Stdin:            summarizeStdin(),
+		Sample:           summarizeSample(),
+		ExportFilters:    summarizeExportFilters(),
+	}
+	if report := state.buildCoverageReport(); report != nil {
+		summary.Coverage = &report.Summary
+	}
+
+	for _, category := range allCategories {
+		summary.Totals[category] = categoryTotal(category)
+	}
+
+	for relay := range clearOffline {
+		reason := "unknown"
+		if record, ok := relayRecords[relay]; ok && record.FailureClass != "" {
+			reason = record.FailureClass
+		}
+		summary.OfflineReasons[reason]++
+	}
+
+	if len(latencies) > 0 {
+		summary.Latency = make(map[RelayCategory]LatencySummary, len(latencies))
+		for category, histograms := range latencies {
+			summary.Latency[category] = LatencySummary{Dial: histograms.dial.summarize(), EOSE: histograms.eose.summarize()}
+		}
+	}
+
+	for _, record := range relayRecords {
+		if record.UniquePubkeys > 0 {
+			summary.TopRelays = append(summary.TopRelays, TopRelay{URL: record.URL, UniquePubkeys: record.UniquePubkeys})
+		}
+		if record.Lane == slowLane.name {
+			summary.SlowLaneRelays++
+		}
+		if record.Discovered > 0 {
+			summary.TopDiscoverers = append(summary.TopDiscoverers, TopDiscoverer{URL: record.URL, Discovered: record.Discovered})
+		}
+	}
+	sort.Slice(summary.TopRelays, func(i, j int) bool {
+		a, b := summary.TopRelays[i], summary.TopRelays[j]
+		if a.UniquePubkeys != b.UniquePubkeys {
+			return a.UniquePubkeys > b.UniquePubkeys
+		}
+		return a.URL < b.URL
+	})
+	if len(summary.TopRelays) > summaryTopRelays {
+		summary.TopRelays = summary.TopRelays[:summaryTopRelays]
+	}
+
+	sort.Slice(summary.TopDiscoverers, func(i, j int) bool {
+		a, b := summary.TopDiscoverers[i], summary.TopDiscoverers[j]
+		if a.Discovered != b.Discovered {
+			return a.Discovered > b.Discovered
+		}
+		return a.URL < b.URL
+	})
+	if len(summary.TopDiscoverers) > summaryTopRelays {
+		summary.TopDiscoverers = summary.TopDiscoverers[:summaryTopRelays]
+	}
+
+	if countries := state.buildCountryReport(); countries != nil {
+		summary.TopCountries = countries.Countries[:min(len(countries.Countries), summaryTopCountries)]
+	}
+
+	return summary
+}
+
+// sortedKeys returns the keys of a count map, highest count first
+func sortedKeys(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// totalsLine renders the relay totals on one line, for quiet mode
+func (s Summary) totalsLine() string {
+	totals := make([]string, 0, len(allCategories))
+	for _, category := range allCategories {
+		totals = append(totals, fmt.Sprintf("%s=%d", category, s.Totals[category]))
+	}
+	duration := time.Duration(s.DurationSeconds * float64(time.Second)).Round(time.Second)
+	return fmt.Sprintf("crawlr: %s events=%d duration=%s", strings.Join(totals, " "), s.EventsProcessed, duration)
+}
+
+// writeText renders the summary in human readable form
+func (s Summary) writeText(w io.Writer) {
+	duration := time.Duration(s.DurationSeconds * float64(time.Second)).Round(time.Second)
+
+	fmt.Fprintf(w, "crawlr run summary (%s)\n", s.Run.CrawlerVersion)
+	fmt.Fprintf(w, "Started:  %s\n", s.Run.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Finished: %s\n", s.Run.FinishedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Duration: %s\n", duration)
+	fmt.Fprintf(w, "Seed:     %s\n\n", strings.Join(s.Run.Seed, ", "))
+
+	fmt.Fprintln(w, "Relays per category:")
+	for _, category := range allCategories {
+		fmt.Fprintf(w, "  %-14s %d\n", category, s.Totals[category])
+	}
+
+	fmt.Fprintf(w, "\nCrawled %d of %d discovered relays (%.2f%%): %d online, %d offline, %d remaining\n",
+		s.Crawl.Crawled, s.Crawl.Discovered, s.Crawl.Progress, s.Crawl.Succeeded, s.Crawl.Failed, s.Crawl.Remaining)
+	if p := s.Sample; p != nil {
+		fmt.Fprintf(w, "Sample: probed %d of %d crawlable relays (%.1f%%, -sample %s, -sample-seed %d), %d not probed\n",
+			p.Probed, p.Frame, p.Rate*100, p.Sample, p.Seed, p.NotProbed)
+		if p.Online+p.Offline > 0 {
+			fmt.Fprintf(w, "Estimated from %d sampled relays crawled: %.1f%% ±%.1f%% online, %d online and %d offline "+
+				"of all %d\n", p.Online+p.Offline, p.OnlinePct, p.MarginPct, p.EstimatedOnline, p.EstimatedOffline, p.Frame)
+		}
+	}
+	if f := s.ExportFilters; f != nil {
+		var suppressed []string
+		for _, category := range allCategories {
+			if n := f.Suppressed[category]; n > 0 {
+				suppressed = append(suppressed, fmt.Sprintf("%d %s", n, category))
+			}
+		}
+		if len(suppressed) > 0 {
+			fmt.Fprintf(w, "Export filters left out %s relays\n", strings.Join(suppressed, ", "))
+		} else {
+			fmt.Fprintln(w, "Export filters are set but left out no relays")
+		}
+	}
+	if t := s.TimeLimit; t != nil {
+		fmt.Fprintf(w, "Time-limited: stopped after -max-runtime %s with %d frontier relays unvisited\n",
+			t.MaxRuntime, t.Unvisited)
+	}
+	if in := s.Stdin; in != nil {
+		state := "closed"
+		if !in.Closed {
+			state = "still open at exit"
+		}
+		fmt.Fprintf(w, "Standard input: %d lines, %d relays added, %d duplicates, %d malformed, %s\n",
+			in.Lines, in.Added, in.Duplicates, in.Malformed, state)
+	}
+
+	if a := s.Availability; a != nil {
+		fmt.Fprintf(w, "Across runs: %d new relays, %d returning, %d skipped after %d offline runs in a row\n",
+			a.New, a.Returning, a.SkippedStreak, cfg.MaxOfflineStreak)
+	}
+	if c := s.Coverage; c != nil {
+		fmt.Fprintf(w, "Reference coverage: %.1f%% of %d reference relays found online, %.1f%% discovered "+
+			"(%d online, %d offline, %d other, %d not discovered), %d found relays unlisted\n",
+			c.OnlinePct, c.Reference, c.DiscoveredPct, c.Online, c.Offline, c.Other, c.NotDiscovered, c.Unlisted)
+	}
+
+	fmt.Fprintf(w, "\nEvents processed:  %d\n", s.EventsProcessed)
+	fmt.Fprintf(w, "Bytes transferred: %d\n", s.BytesTransferred)
+	if s.DroppedLogLines > 0 {
+		fmt.Fprintf(w, "Log lines dropped: %d\n", s.DroppedLogLines)
+	}
+
+	if len(s.OfflineReasons) > 0 {
+		fmt.Fprintln(w, "\nOffline relays by failure reason:")
+		for _, reason := range sortedKeys(s.OfflineReasons) {
+			fmt.Fprintf(w, "  %-14s %d\n", reason, s.OfflineReasons[reason])
+		}
+	}
+
+	if len(s.Latency) > 0 {
+		fmt.Fprintln(w, "\nLatency of successful crawls (ms):")
+		fmt.Fprintf(w, "  %-14s %-6s %7s %9s %9s %9s\n", "category", "phase", "count", "p50", "p90", "p99")
+		for _, category := range allCategories {
+			latency, ok := s.Latency[category]
+			if !ok {
+				continue
+			}
+			for _, phase := range []struct {
+				name      string
+				quantiles LatencyQuantiles
+			}{{"dial", latency.Dial}, {"eose", latency.EOSE}} {
+				q := phase.quantiles
+				fmt.Fprintf(w, "  %-14s %-6s %7d %9.1f %9.1f %9.1f\n", category, phase.name, q.Count, q.P50, q.P90, q.P99)
+			}
+		}
+	}
+
+	pool := s.Workers
+	if pool.Slots > 0 {
+		fmt.Fprintf(w, "\nWorkers: %d slots, %.1f%% average utilization (p50 %d%%, p90 %d%%)\n",
+			pool.Slots, pool.AverageUtilization, pool.UtilizationP50, pool.UtilizationP90)
+		fmt.Fprintf(w, "Slot wait (ms): p50 %.1f, p90 %.1f, p99 %.1f; %d of %d relays found every worker busy\n",
+			pool.SlotWait.P50, pool.SlotWait.P90, pool.SlotWait.P99, pool.Saturated, pool.SlotWait.Count)
+		fmt.Fprintf(w, "Slow lane: %d relays retried with a %s timeout\n", s.SlowLaneRelays, slowLaneTimeout)
+	}
+
+	if guard := s.MemoryGuard; guard != nil {
+		fmt.Fprintf(w, "\nMemory guard: limit %d MB, peak %d MB, held back discovery %d times for %s\n",
+			guard.LimitMB, guard.PeakMB, guard.Activations,
+			time.Duration(guard.ThrottledSeconds*float64(time.Second)).Round(time.Second))
+	}
+
+	if nip := s.NIP11; nip != nil {
+		fmt.Fprintf(w, "\nNIP-11: %d documents fetched (%.1f/s), %d failed, peak backlog %d of %d, %d still pending\n",
+			nip.Fetched, nip.PerSecond, nip.Failed, nip.PeakBacklog, nip.QueueCapacity, nip.Pending)
+		fmt.Fprintf(w, "  open %d, auth required %d, paid %d, restricted writes %d\n",
+			nip.Open, nip.AuthRequired, nip.Paid, nip.RestrictedWrites)
+		if cfg.NIP11Cache != "" {
+			fmt.Fprintf(w, "  cache: %d fresh hits, %d not modified, %d downloaded\n",
+				nip.CacheHits, nip.CacheRevalidated, nip.CacheMisses)
+		}
+		keys := sortedKeys(nip.Software)
+		if len(keys) > summaryTopRelays {
+			keys = keys[:summaryTopRelays]
+		}
+		for _, software := range keys {
+			fmt.Fprintf(w, "  %-50s %d\n", software, nip.Software[software])
+		}
+		for _, outcome := range sortedKeys(nip.Failures) {
+			fmt.Fprintf(w, "  %-50s %d\n", "("+outcome+")", nip.Failures[outcome])
+		}
+	}
+
+	if probes := s.NIPProbes; probes != nil {
+		fmt.Fprintf(w, "\nNIP probes: %d online relays probed, %d skipped by the rate limit\n", probes.Probed, probes.Skipped)
+		fmt.Fprintf(w, "  %-6s %9s %13s %7s %10s\n", "nip", "verified", "contradicted", "absent", "agreement")
+		for _, nip := range probes.sortedNIPs() {
+			stats := probes.NIPs[nip]
+			fmt.Fprintf(w, "  %-6d %9d %13d %7d %9.1f%%\n", nip, stats.Verified, stats.Contradicted, stats.Absent, stats.Agreement)
+		}
+	}
+
+	if hooks := s.Webhooks; hooks != nil {
+		fmt.Fprintf(w, "\nWebhooks: %d delivered, %d failed, %d dropped, %d still queued\n",
+			hooks.Delivered, hooks.Failed, hooks.Dropped, hooks.Pending)
+	}
+
+	if len(s.PenalizedDomains) > 0 {
+		fmt.Fprintf(w, "\nDomains penalized for dead relays (%s timeout):\n", penaltyLaneTimeout)
+		fmt.Fprintf(w, "  %-40s %9s %7s %5s\n", "domain", "penalized", "crawled", "dead")
+		for _, domain := range s.PenalizedDomains {
+			fmt.Fprintf(w, "  %-40s %9d %7d %5d\n", domain.Domain, domain.Penalized, domain.Crawled, domain.Dead)
+		}
+	}
+
+	if len(s.TopRelays) > 0 {
+		fmt.Fprintf(w, "\nTop %d relays by unique pubkeys:\n", len(s.TopRelays))
+		for i, relay := range s.TopRelays {
+			fmt.Fprintf(w, "  %2d. %-50s %d\n", i+1, relay.URL, relay.UniquePubkeys)
+		}
+	}
+
+	if len(s.TopDiscoverers) > 0 {
+		fmt.Fprintf(w, "\nTop %d relays by newly discovered relays:\n", len(s.TopDiscoverers))
+		for i, relay := range s.TopDiscoverers {
+			fmt.Fprintf(w, "  %2d. %-50s %d\n", i+1, relay.URL, relay.Discovered)
+		}
+	}
+
+	if asn := s.ASNConcentration; asn != nil {
+		fmt.Fprintf(w, "\nHosting concentration: %d online relays in %d autonomous systems, %d with unknown AS\n",
+			asn.Relays, asn.ASNs, asn.Unknown)
+		fmt.Fprintf(w, "  top 1 AS %.1f%%, top 5 %.1f%%, top 10 %.1f%% of relays with a known AS, HHI %.0f\n",
+			asn.Top1, asn.Top5, asn.Top10, asn.HHI)
+	}
+
+	if len(s.TopCountries) > 0 {
+		fmt.Fprintf(w, "\nTop %d countries of online relays (declared split across multi-country declarations):\n",
+			len(s.TopCountries))
+		fmt.Fprintf(w, "  %-8s %7s %9s %11s\n", "country", "geoip", "declared", "mismatched")
+		for _, country := range s.TopCountries {
+			fmt.Fprintf(w, "  %-8s %7d %9.2f %11d\n", country.Country, country.GeoIP, country.Declared, country.Mismatched)
+		}
+	}
+}
+
+// writeSummary writes summary.txt and summary.json to the run directory and prints
+// the summary, just its totals line in quiet mode. Caller must hold mu.
+func writeSummary(run RunMetadata) error {
+	summary := buildSummary(run)
+
+	textPath := runFilePath("summary.txt")
+	text, err := atomicfile.Create(textPath)
+	if err != nil {
+		return err
+	}
+	summary.writeText(text)
+	if err := text.Commit(); err != nil {
+		return err
+	}
+	recordOutput(textPath, 0)
+
+	if err := writeJSONFile(runFilePath("summary.json"), summary, 0); err != nil {
+		return err
+	}
+
+	switch {
+	case cfg.LogFormat == "json":
+		// Plain text would corrupt the log stream, log the headline numbers instead
+		args := []any{"duration_seconds", summary.DurationSeconds,
+			"events", summary.EventsProcessed, "bytes", summary.BytesTransferred}
+		for _, category := range allCategories {
+			args = append(args, string(category), summary.Totals[category])
+		}
+		exportLog.Info("run summary", args...)
+	case cfg.Quiet:
+		consolePrint(summary.totalsLine() + "\n")
+	default:
+		var text strings.Builder
+		text.WriteString("\n")
+		summary.writeText(&text)
+		consolePrint(text.String())
+	}
+	return nil
+}
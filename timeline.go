@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/csv"
+	"strconv"
+	"time"
+
+	"crawlr2/atomicfile"
+)
+
+// timelineSample holds the cumulative counters at the end of one minute of the run
+type timelineSample struct {
+	discovered int
+	crawled    int
+	offline    int
+	events     int64
+}
+
+// sampleTimeline reads the timeline counters from the status the progress display uses
+func sampleTimeline(status CrawlStatus) timelineSample {
+	return timelineSample{
+		discovered: status.Discovered,
+		crawled:    status.Crawled,
+		offline:    status.Categories[ClearOffline],
+		events:     status.EventsProcessed,
+	}
+}
+
+// logHeartbeat logs a line every heartbeatInterval while passes find nothing to crawl,
+// so waiting as designed can be told apart from a wedged crawler
+func logHeartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	heartbeat(ticker.C)
+}
+
+// heartbeat logs the idle line for every tick while idle, taking the time from the tick
+func heartbeat(ticks <-chan time.Time) {
+	for now := range ticks {
+		since := idleSince.Load()
+		if since == 0 {
+			continue
+		}
+		status := snapshotStatus()
+		mainLog.Info("idle, waiting for new relays",
+			"idle_for", now.Sub(time.Unix(0, since)).Round(time.Second),
+			"next_pass_in", time.Unix(0, nextPassAt.Load()).Sub(now).Round(time.Second),
+			"pass", status.Pass, "discovered", status.Discovered, "crawled", status.Crawled,
+			"online", status.Succeeded, "offline", status.Failed)
+	}
+}
+
+// recordTimeline closes a timeline bucket every minute of the run
+func recordTimeline() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		mu.Lock()
+		timeline = append(timeline, sampleTimeline(snapshotStatus()))
+		mu.Unlock()
+	}
+}
+
+// exportTimeline writes timeline.csv with one row per minute of the run: minute,
+// discovered, crawled, offline, events, each counting what happened in that minute.
+// The current partial minute is the last row.
+func exportTimeline(state relayState) error {
+	path := runFilePath("timeline.csv")
+	file, err := atomicfile.Create(path)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"minute", "discovered", "crawled", "offline", "events"})
+
+	samples := append(state.timeline[:len(state.timeline):len(state.timeline)], sampleTimeline(snapshotStatus()))
+	var previous timelineSample
+	for i, sample := range samples {
+		writer.Write([]string{
+			strconv.Itoa(i + 1),
+			strconv.Itoa(sample.discovered - previous.discovered),
+			strconv.Itoa(sample.crawled - previous.crawled),
+			strconv.Itoa(sample.offline - previous.offline),
+			strconv.FormatInt(sample.events-previous.events, 10),
+		})
+		previous = sample
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Abort()
+		return err
+	}
+	if err := file.Commit(); err != nil {
+		return err
+	}
+	recordOutput(path, len(samples))
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Drive the heartbeat with a fake clock: it stays silent while the crawl is busy and
+// reports how long it has idled and the wait for the next pass once it isn't
+func TestHeartbeat(t *testing.T) {
+	resetState(t)
+	logs := captureJSONLogs(t)
+	t.Cleanup(func() {
+		idleSince.Store(0)
+		nextPassAt.Store(0)
+	})
+
+	// Each tick is handled in full before the state changes for the next
+	beat := func(now time.Time) {
+		ticks := make(chan time.Time, 1)
+		ticks <- now
+		close(ticks)
+		heartbeat(ticks)
+	}
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	idleSince.Store(0)
+	beat(start.Add(heartbeatInterval)) // Busy, no line
+
+	idleSince.Store(start.Add(time.Minute).UnixNano())
+	nextPassAt.Store(start.Add(10 * time.Minute).UnixNano())
+	beat(start.Add(2 * time.Minute))
+	beat(start.Add(2*time.Minute + heartbeatInterval))
+
+	idleSince.Store(0) // A pass found work again
+	beat(start.Add(3 * time.Minute))
+
+	want := []struct{ idleFor, nextPassIn time.Duration }{
+		{time.Minute, 8 * time.Minute},
+		{time.Minute + heartbeatInterval, 8*time.Minute - heartbeatInterval},
+	}
+	var lines []map[string]any
+	scanner := bufio.NewScanner(logs)
+	for scanner.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d heartbeat lines, want %d: %v", len(lines), len(want), lines)
+	}
+	for i, line := range lines {
+		if line["message"] != "idle, waiting for new relays" {
+			t.Errorf("line %d: message %v", i, line["message"])
+		}
+		if line["idle_for"] != float64(want[i].idleFor) {
+			t.Errorf("line %d: idle_for %v, want %v", i, line["idle_for"], want[i].idleFor)
+		}
+		if line["next_pass_in"] != float64(want[i].nextPassIn) {
+			t.Errorf("line %d: next_pass_in %v, want %v", i, line["next_pass_in"], want[i].nextPassIn)
+		}
+	}
+}
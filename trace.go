@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// relayTracer records everything exchanged with one relay to a trace file
+type relayTracer struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Tracers for relays selected with -trace-relay, keyed by normalized URL. The map is
+// built before crawling starts and only read afterwards.
+var tracers = make(map[string]*relayTracer)
+
+// openTracers creates a trace file in the run directory for every traced relay
+func openTracers() error {
+	for _, relay := range cfg.TraceRelays {
+		relay = normalizeURL(relay)
+		if _, ok := tracers[relay]; ok {
+			continue
+		}
+
+		path := runFilePath("trace_" + traceFileName(relay) + ".log")
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open trace file for %s: %v", relay, err)
+		}
+		tracers[relay] = &relayTracer{file: file}
+	}
+	return nil
+}
+
+// closeTracers closes all trace files
+func closeTracers() {
+	for _, tracer := range tracers {
+		tracer.mu.Lock()
+		tracer.file.Close()
+		tracer.mu.Unlock()
+	}
+}
+
+// traceFileName turns a relay URL into a safe file name
+func traceFileName(relayURL string) string {
+	name := strings.TrimPrefix(strings.TrimPrefix(relayURL, "wss://"), "ws://")
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// tracerFor returns the tracer of a relay, or nil when it isn't traced
+func tracerFor(relayURL string) *relayTracer {
+	if len(tracers) == 0 {
+		return nil
+	}
+	return tracers[normalizeURL(relayURL)]
+}
+
+// traceFrame records a frame if the connection's relay is traced
+func traceFrame(ws *websocket.Conn, direction string, data []byte) {
+	if len(tracers) == 0 {
+		return // Nothing is traced, skip the lookup
+	}
+	tracerFor(ws.Config().Location.String()).record(direction, data)
+}
+
+// record writes one timestamped entry, direction is ">" for outbound and "<" for inbound
+func (t *relayTracer) record(direction string, data []byte) {
+	if t == nil {
+		return
+	}
+	line := fmt.Sprintf("%s %s %s\n", time.Now().UTC().Format(time.RFC3339Nano), direction, redactSecrets(string(data)))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.file.WriteString(line)
+}
+
+// redactSecrets removes the configured secret key from traced data
+func redactSecrets(data string) string {
+	if cfg.SecretKey == "" {
+		return data
+	}
+	data = strings.ReplaceAll(data, cfg.SecretKey, "[REDACTED]")
+	if key, err := parseSecretKey(cfg.SecretKey); err == nil {
+		data = strings.ReplaceAll(data, hex.EncodeToString(key), "[REDACTED]")
+	}
+	return data
+}
+
+// recordingConn keeps a copy of the bytes exchanged during the websocket handshake
+type recordingConn struct {
+	net.Conn
+	done    bool // Set once the handshake is over, frames are traced as messages
+	written bytes.Buffer
+	read    bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.done {
+		c.read.Write(p[:n])
+	}
+	return n, err
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	if !c.done {
+		c.written.Write(p)
+	}
+	return c.Conn.Write(p)
+}
+
+// dialTraced performs the same dial as websocket.DialConfig but records the handshake
+// request and response headers to the relay's trace
+func dialTraced(config *websocket.Config, tracer *relayTracer) (*websocket.Conn, error) {
+	conn, err := dialConn(config)
+	if err != nil {
+		tracer.record("!", []byte("dial failed: "+err.Error()))
+		return nil, &websocket.DialError{Config: config, Err: err}
+	}
+
+	recorder := &recordingConn{Conn: conn}
+	ws, err := websocket.NewClient(config, recorder)
+	recorder.done = true
+
+	crlf, lf := []byte("\r\n"), []byte("\n")
+	tracer.record(">", bytes.ReplaceAll(bytes.TrimSpace(recorder.written.Bytes()), crlf, lf))
+	tracer.record("<", bytes.ReplaceAll(handshakeHeaders(recorder.read.Bytes()), crlf, lf))
+	recorder.written.Reset()
+	recorder.read.Reset()
+
+	if err != nil {
+		conn.Close()
+		tracer.record("!", []byte("handshake failed: "+err.Error()))
+		return nil, &websocket.DialError{Config: config, Err: err}
+	}
+	return ws, nil
+}
+
+// dialConn opens the TCP connection for a websocket config, with TLS for wss, the way
+// websocket.DialConfig does before its handshake
+func dialConn(config *websocket.Config) (net.Conn, error) {
+	host := config.Location.Host
+	if config.Location.Port() == "" {
+		if config.Location.Scheme == "wss" {
+			host = net.JoinHostPort(host, "443")
+		} else {
+			host = net.JoinHostPort(host, "80")
+		}
+	}
+
+	dialer := config.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+
+	if config.Location.Scheme == "wss" {
+		tlsConfig := config.TlsConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{ServerName: config.Location.Hostname()}
+		}
+		return tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+	}
+	return dialer.Dial("tcp", host)
+}
+
+// handshakeHeaders cuts the HTTP response headers out of the bytes read during the
+// handshake, which may already contain the start of the first frame
+func handshakeHeaders(data []byte) []byte {
+	reader := bufio.NewReader(bytes.NewReader(data))
+	var headers bytes.Buffer
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.TrimSpace(line) == "" || err != nil {
+			headers.WriteString(strings.TrimRight(line, "\r\n"))
+			break
+		}
+		headers.WriteString(line)
+	}
+	return bytes.TrimSpace(headers.Bytes())
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+// TUI tuning
+const (
+	tuiRedrawInterval = 250 * time.Millisecond
+	tuiLogLines       = 500 // Log lines kept for the scrolling pane
+)
+
+// tui is the full-screen view of a crawl: totals per category, the connections in
+// flight and a log pane, drawn with tcell. It is driven by the console goroutine, which
+// owns the terminal.
+type tui struct {
+	screen   tcell.Screen
+	events   chan tcell.Event // Key presses and resizes, see enter
+	logLines []string         // Newest last
+	rates    progressRates
+	quit     chan<- os.Signal
+}
+
+// startTUI takes over the terminal, the console goroutine draws on it once logging
+// starts. Pressing q or Ctrl+C sends os.Interrupt to quit.
+func startTUI(quit chan<- os.Signal) (*tui, error) {
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return nil, err
+	}
+	if err := screen.Init(); err != nil {
+		return nil, err
+	}
+	return &tui{screen: screen, events: make(chan tcell.Event, 16), quit: quit}, nil
+}
+
+// Stop has the console give the terminal back and print further log lines plainly,
+// safe on nil
+func (t *tui) Stop() {
+	if t == nil {
+		return
+	}
+	if !consoleRunning.Load() {
+		t.leave() // The console is gone, restore the terminal directly
+		return
+	}
+	left := make(chan struct{})
+	consoleLeave <- left
+	<-left
+}
+
+// enter starts delivering terminal events and draws the first frame
+func (t *tui) enter() {
+	go t.screen.ChannelEvents(t.events, nil) // Ends once leave finalizes the screen
+	t.sample()
+	t.draw()
+}
+
+// leave restores the terminal
+func (t *tui) leave() {
+	t.screen.Fini()
+}
+
+// addLog appends text to the log pane a line at a time, keeping the newest tuiLogLines
+func (t *tui) addLog(text string) {
+	t.logLines = append(t.logLines, strings.Split(strings.TrimRight(text, "\n"), "\n")...)
+	if len(t.logLines) > tuiLogLines {
+		t.logLines = t.logLines[len(t.logLines)-tuiLogLines:]
+	}
+}
+
+// handleEvent applies the key bindings shown in the header and follows resizes
+func (t *tui) handleEvent(event tcell.Event) {
+	switch event := event.(type) {
+	case *tcell.EventResize:
+		t.screen.Sync()
+	case *tcell.EventKey:
+		key := event.Rune()
+		if event.Key() == tcell.KeyCtrlC {
+			key = 'q' // The terminal is raw, Ctrl+C arrives as a key
+		} else if event.Key() != tcell.KeyRune {
+			return
+		}
+		switch key {
+		case 'q':
+			select {
+			case t.quit <- os.Interrupt:
+			default:
+			}
+		case 'p':
+			setPaused(!discoveryPaused.Load())
+		case 'c':
+			go func() {
+				defer recoverAndLog("checkpoint")
+				checkpoint()
+			}()
+		}
+	}
+}
+
+// sample feeds the rolling rates once a second
+func (t *tui) sample() {
+	status := snapshotStatus()
+	t.rates.add(sampleProgress(status))
+	observeUtilization()
+}
+
+// draw renders one frame at the current terminal size
+func (t *tui) draw() {
+	width, height := t.screen.Size()
+
+	status := snapshotStatus()
+	crawlRate, discoveryRate := t.rates.perMinute()
+	eta := estimateRemaining(status.Remaining, crawlRate, discoveryRate)
+	connections := inFlightConnections()
+
+	var lines []string
+	state := "running"
+	if status.Paused {
+		state = "PAUSED"
+	} else if status.IdleSeconds > 0 {
+		state = fmt.Sprintf("idle %s, waiting for new relays", time.Duration(status.IdleSeconds*float64(time.Second)).Round(time.Second))
+	}
+	lines = append(lines,
+		fmt.Sprintf("crawlr  pass %d  up %s  %s    [p] pause  [c] checkpoint  [q] quit",
+			status.Pass, time.Duration(status.UptimeSeconds*float64(time.Second)).Round(time.Second), state),
+		fmt.Sprintf("Discovered: %d (%.0f/min) | Crawled: %d (%.0f/min) | Remaining: %d | ETA %s (est.) | [%s] %.2f%%",
+			status.Discovered, discoveryRate, status.Crawled, crawlRate, status.Remaining, eta,
+			generateProgressBar(int(status.Progress), defaultBarWidth), status.Progress),
+		fmt.Sprintf("Events: %d (%.1f/s) | Connections: %d | Workers: %d/%d (%.0f%%)", status.EventsProcessed,
+			t.rates.eventsPerSecond(), status.ActiveConnections, status.BusyWorkers, status.TargetConcurrency, status.workerUtilization()),
+	)
+
+	var categories []string
+	for _, category := range allCategories {
+		categories = append(categories, fmt.Sprintf("%s: %d", category, status.Categories[category]))
+	}
+	lines = append(lines, strings.Join(categories, "  "), "")
+
+	// Split the remaining rows between the connection table and the log pane
+	rows := height - len(lines) - 2
+	tableRows := max(0, min(len(connections), rows/2))
+	lines = append(lines, fmt.Sprintf("In flight (%d)", len(connections)))
+	for _, conn := range connections[:tableRows] {
+		lines = append(lines, fmt.Sprintf("  %8s  %s", time.Since(conn.started).Round(100*time.Millisecond), conn.url))
+	}
+
+	lines = append(lines, "Log")
+	logRows := height - len(lines)
+	if logRows > 0 {
+		lines = append(lines, t.logLines[max(0, len(t.logLines)-logRows):]...)
+	}
+
+	t.screen.Clear()
+	for row, line := range lines[:min(len(lines), height)] {
+		t.drawLine(row, line, width)
+	}
+	t.screen.Show()
+}
+
+// drawLine puts a line on a row, cut at the screen width so it never wraps. The color
+// escapes of log lines become styles.
+func (t *tui) drawLine(row int, line string, width int) {
+	style := tcell.StyleDefault
+	for i, x := 0, 0; i < len(line) && x < width; {
+		if line[i] == '\033' {
+			end := strings.IndexByte(line[i:], 'm')
+			if end < 0 {
+				return
+			}
+			style = logStyle(line[i : i+end+1])
+			i += end + 1
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(line[i:])
+		i += size
+		if r < ' ' {
+			continue // Control characters would move the cursor
+		}
+		t.screen.SetContent(x, row, r, nil, style)
+		x += max(1, runewidth.RuneWidth(r))
+	}
+}
+
+// logStyle returns the style of a log color, see colorFor
+func logStyle(color string) tcell.Style {
+	switch color {
+	case colorRed:
+		return tcell.StyleDefault.Foreground(tcell.ColorMaroon)
+	case colorGreen:
+		return tcell.StyleDefault.Foreground(tcell.ColorGreen)
+	case colorYellow:
+		return tcell.StyleDefault.Foreground(tcell.ColorOlive)
+	case colorCyan:
+		return tcell.StyleDefault.Foreground(tcell.ColorTeal)
+	}
+	return tcell.StyleDefault
+}
+
+// inFlightConnection is a relay currently being crawled
+type inFlightConnection struct {
+	url     string
+	started time.Time
+}
+
+// inFlightConnections lists the relays being crawled, longest running first
+func inFlightConnections() []inFlightConnection {
+	inFlightMu.Lock()
+	connections := make([]inFlightConnection, 0, len(inFlight))
+	for url, flight := range inFlight {
+		connections = append(connections, inFlightConnection{url: url, started: flight.started})
+	}
+	inFlightMu.Unlock()
+
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].started.Before(connections[j].started)
+	})
+	return connections
+}
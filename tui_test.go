@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// newTestTUI returns a TUI drawing on a simulated terminal of the given size
+func newTestTUI(t *testing.T, width, height int) (*tui, tcell.SimulationScreen, chan os.Signal) {
+	t.Helper()
+	screen := tcell.NewSimulationScreen("UTF-8")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(screen.Fini)
+	screen.SetSize(width, height)
+	quit := make(chan os.Signal, 1)
+	return &tui{screen: screen, events: make(chan tcell.Event, 16), quit: quit}, screen, quit
+}
+
+// screenRow returns the text on a row of the simulated screen and the style of its
+// first cell
+func screenRow(screen tcell.SimulationScreen, row int) (string, tcell.Style) {
+	cells, width, _ := screen.GetContents()
+	var text strings.Builder
+	for _, cell := range cells[row*width : (row+1)*width] {
+		if len(cell.Runes) > 0 {
+			text.WriteRune(cell.Runes[0])
+		}
+	}
+	return strings.TrimRight(text.String(), " "), cells[row*width].Style
+}
+
+// A frame shows the totals, the connections in flight and the newest log lines in
+// their colors, every row cut at the screen width
+func TestTUIDraw(t *testing.T) {
+	resetState(t)
+	locked(func() {
+		classifyRelay(listedRelay{url: "wss://a.example.com", category: ClearOnline}, "wss://seed.example.com")
+		classifyRelay(listedRelay{url: "ws://relay.onion", category: Onion}, "wss://seed.example.com")
+	})
+	ui, screen, _ := newTestTUI(t, 60, 12)
+	for i := 0; i < tuiLogLines+10; i++ {
+		ui.addLog("old line\n")
+	}
+	ui.addLog("first\nsecond\n")
+	ui.addLog(colorRed + "failed " + strings.Repeat("x", 100) + colorReset + "\n")
+	if len(ui.logLines) != tuiLogLines {
+		t.Errorf("%d log lines kept, want %d", len(ui.logLines), tuiLogLines)
+	}
+	ui.draw()
+
+	if header, _ := screenRow(screen, 0); !strings.HasPrefix(header, "crawlr  pass") {
+		t.Errorf("header %q", header)
+	}
+	if totals, _ := screenRow(screen, 3); !strings.Contains(totals, "clear_online: 1") || !strings.Contains(totals, "onion: 1") {
+		t.Errorf("category totals %q", totals)
+	}
+	for row, want := range map[int]string{9: "first", 10: "second"} {
+		if line, _ := screenRow(screen, row); line != want {
+			t.Errorf("row %d = %q, want %q", row, line, want)
+		}
+	}
+	line, style := screenRow(screen, 11)
+	if want := "failed " + strings.Repeat("x", 53); line != want {
+		t.Errorf("last row = %q, want %q", line, want)
+	}
+	if foreground, _, _ := style.Decompose(); foreground != tcell.ColorMaroon {
+		t.Errorf("error line drawn in %v, want red", foreground)
+	}
+}
+
+// The key bindings pause discovery and quit, Ctrl+C included since the terminal is raw
+func TestTUIKeys(t *testing.T) {
+	resetState(t)
+	t.Cleanup(func() { setPaused(false) })
+	ui, _, quit := newTestTUI(t, 80, 24)
+
+	ui.handleEvent(tcell.NewEventKey(tcell.KeyRune, 'p', tcell.ModNone))
+	if !discoveryPaused.Load() {
+		t.Error("p didn't pause discovery")
+	}
+	ui.handleEvent(tcell.NewEventKey(tcell.KeyRune, 'p', tcell.ModNone))
+	if discoveryPaused.Load() {
+		t.Error("p didn't resume discovery")
+	}
+
+	for _, key := range []*tcell.EventKey{
+		tcell.NewEventKey(tcell.KeyRune, 'q', tcell.ModNone),
+		tcell.NewEventKey(tcell.KeyCtrlC, 0, tcell.ModCtrl),
+	} {
+		ui.handleEvent(key)
+		select {
+		case signal := <-quit:
+			if signal != os.Interrupt {
+				t.Errorf("%s sent %v", key.Name(), signal)
+			}
+		default:
+			t.Errorf("%s didn't quit", key.Name())
+		}
+	}
+}
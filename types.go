@@ -1,4 +1,297 @@
 package main
 
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"crawlr2/nip11"
+)
+
 // Relay categories
 type RelayCategory string
+
+// RelayRecord holds per-relay metadata collected during the crawl
+type RelayRecord struct {
+	URL           string         `json:"url"`
+	Category      RelayCategory  `json:"category"`
+	Count         int            `json:"count"`
+	DiscoveredBy  string         `json:"discovered_by,omitempty"`
+	Referrers     []string       `json:"referrers,omitempty"`      // The first -max-referrers relays that listed this one
+	ReferrerCount int            `json:"referrer_count,omitempty"` // Distinct relays that listed this one, estimated past referrerSetCap
+	FailureReason string         `json:"failure_reason,omitempty"`
+	FailureClass  string         `json:"failure_class,omitempty"`
+	UniquePubkeys int            `json:"unique_pubkeys,omitempty"`   // Estimated once past -max-pubkeys
+	Discovered    int            `json:"discovered_count,omitempty"` // Relays first seen in this relay's lists
+	LastAttempt   *time.Time     `json:"last_attempt,omitempty"`
+	FirstSeen     *time.Time     `json:"first_seen,omitempty"` // First listed or crawled, in any run with -availability
+	LastSeen      *time.Time     `json:"last_seen,omitempty"`  // Last crawled successfully, in any run with -availability
+	Attempts      []CrawlAttempt `json:"attempts,omitempty"`   // The latest -max-attempt-history
+	AttemptCount  int            `json:"attempt_count,omitempty"`
+	Truncated     bool           `json:"truncated,omitempty"` // Attempts or pubkeys hit their cap
+
+	// Timings of the successful crawl in milliseconds, absent when the phase never happened
+	DialMs       float64 `json:"dial_ms,omitempty"`        // Websocket handshake
+	FirstEventMs float64 `json:"first_event_ms,omitempty"` // REQ to the first EVENT
+	EOSEMs       float64 `json:"eose_ms,omitempty"`        // REQ to EOSE
+	Lane         string  `json:"lane,omitempty"`           // Crawl pool lane the final attempt ran in
+
+	// What the relay's NIP-11 document advertises, with -nip11
+	Software       string            `json:"software,omitempty"`
+	Version        string            `json:"version,omitempty"`
+	SupportedNIPs  []int             `json:"supported_nips,omitempty"`
+	Limitation     *nip11.Limitation `json:"limitation,omitempty"`
+	NIP11URL       string            `json:"nip11_url,omitempty"` // Where redirects led the document request, if away
+	Paid           bool              `json:"paid,omitempty"`      // Requires payment or lists fees
+	PaymentsURL    string            `json:"payments_url,omitempty"`
+	RelayCountries []string          `json:"relay_countries,omitempty"`
+
+	IP      string `json:"ip,omitempty"`      // Address of the last successful dial
+	Country string `json:"country,omitempty"` // Where -geoip locates IP
+	ASN     int    `json:"asn,omitempty"`     // Autonomous system announcing IP, with -asn-db
+	ASOrg   string `json:"as_org,omitempty"`
+
+	// TLS leaf certificate of the last successful wss dial, see watchCertificate
+	CertSPKI  string   `json:"cert_spki,omitempty"` // SHA-256 of the public key, hex
+	CertSANs  []string `json:"cert_sans,omitempty"`
+	ClusterID string   `json:"cluster_id,omitempty"` // Set at export, see buildClusters
+
+	DNS *DNSRecords `json:"dns,omitempty"` // With -dns, see resolveRelay
+
+	PlaintextOnly bool `json:"plaintext_only,omitempty"` // Answered over ws:// after wss:// failed TLS, see probePlaintext
+
+	NotProbed bool `json:"not_probed,omitempty"` // Left out of the -sample, never dialed, see sampleRelay
+
+	pubkeys map[string]struct{} // Authors of the relay lists this relay served, up to -max-pubkeys
+	sketch  *pubkeySketch       // Replaces pubkeys once the cap is reached
+
+	referrers      map[string]struct{} // Relays that listed this one, up to referrerSetCap
+	referrerSketch *pubkeySketch       // Replaces referrers once the cap is reached
+
+	// Crawl state, kept on the record every relay already has instead of in URL-keyed
+	// sets that would hold a second map entry per relay for the whole run
+	queued    bool      // Handed to the crawl pool
+	crawled   bool      // Crawl finished, online or offline
+	offlineAt time.Time // When the relay was last marked offline, see recheckRelay
+
+	documented bool // Served a NIP-11 document, see attachDocument
+
+	probes map[int]bool // Capabilities tested by -probe-nips, see probeNIPs
+
+	// Availability across runs with -availability, including this run, see applyAvailability
+	RunsObserved  int        `json:"runs_observed,omitempty"`
+	RunsOnline    int        `json:"runs_online,omitempty"`
+	OfflineStreak int        `json:"offline_streak,omitempty"`
+	Uptime        *float64   `json:"uptime_percent,omitempty"`
+	skippedStreak bool       // Not dialed for its offline streak, see skipForStreak
+	NIPProbes     []NIPProbe `json:"nip_probes,omitempty"` // Set by relayRecordFor from probes
+}
+
+// addPubkey records an author seen on this relay. Past cfg.MaxPubkeys the exact set is
+// folded into a fixed-size sketch and the count becomes an estimate.
+func (r *RelayRecord) addPubkey(pubkey string) {
+	if r.sketch != nil {
+		r.sketch.add(pubkey)
+		r.UniquePubkeys = r.sketch.estimate()
+		return
+	}
+
+	if r.pubkeys == nil {
+		r.pubkeys = make(map[string]struct{})
+	}
+	r.pubkeys[pubkey] = struct{}{}
+	r.UniquePubkeys = len(r.pubkeys)
+
+	if len(r.pubkeys) > cfg.MaxPubkeys {
+		r.sketch = new(pubkeySketch)
+		for seen := range r.pubkeys {
+			r.sketch.add(seen)
+		}
+		r.pubkeys = nil
+		r.Truncated = true
+		r.UniquePubkeys = r.sketch.estimate()
+	}
+}
+
+// Distinct referrers tracked exactly per relay before they are folded into a sketch
+const referrerSetCap = 1024
+
+// addReferrer records a relay whose list mentioned this one. The distinct count stays
+// exact up to referrerSetCap and is estimated with the same sketch as pubkeys past it.
+func (r *RelayRecord) addReferrer(referrer string) {
+	if r.referrerSketch != nil {
+		r.referrerSketch.add(referrer)
+		r.ReferrerCount = r.referrerSketch.estimate()
+		return
+	}
+
+	if _, seen := r.referrers[referrer]; seen {
+		return
+	}
+	if r.referrers == nil {
+		r.referrers = make(map[string]struct{})
+	}
+	r.referrers[referrer] = struct{}{}
+	r.ReferrerCount = len(r.referrers)
+	if len(r.Referrers) < cfg.MaxReferrers {
+		r.Referrers = append(r.Referrers, referrer)
+	}
+
+	if len(r.referrers) > referrerSetCap {
+		r.referrerSketch = new(pubkeySketch)
+		for seen := range r.referrers {
+			r.referrerSketch.add(seen)
+		}
+		r.referrers = nil
+		r.ReferrerCount = r.referrerSketch.estimate()
+	}
+}
+
+// Bits in a pubkey sketch, 8 KiB per relay that outgrows the exact set
+const pubkeySketchBits = 1 << 16
+
+// pubkeySketch estimates the number of distinct pubkeys with linear counting: each
+// pubkey sets one hashed bit and the share of bits still clear gives the estimate.
+// Referrer URLs are counted with it as well.
+type pubkeySketch [pubkeySketchBits / 64]uint64
+
+// add sets the pubkey's bit
+func (s *pubkeySketch) add(pubkey string) {
+	h := fnv.New64a()
+	h.Write([]byte(pubkey))
+	sum := h.Sum64()
+	bit := (sum ^ sum>>32) % pubkeySketchBits // FNV's low bits alone are poorly mixed
+	s[bit/64] |= 1 << (bit % 64)
+}
+
+// estimate returns the approximate number of distinct pubkeys added
+func (s *pubkeySketch) estimate() int {
+	clear := 0
+	for _, word := range s {
+		clear += 64 - bits.OnesCount64(word)
+	}
+	if clear == 0 {
+		clear = 1 // Saturated, report the upper bound of what the sketch can tell
+	}
+	return int(math.Round(-pubkeySketchBits * math.Log(float64(clear)/pubkeySketchBits)))
+}
+
+// isCrawled reports whether a relay's crawl has finished, caller must hold mu
+func isCrawled(relayURL string) bool {
+	record, ok := relayRecords[relayURL]
+	return ok && record.crawled
+}
+
+// CrawlAttempt is one connection attempt made against a relay
+type CrawlAttempt struct {
+	StartedAt time.Time `json:"started_at"`
+	Duration  string    `json:"duration"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// crawlTiming holds how long each phase of a crawl attempt took, zero when it never happened
+type crawlTiming struct {
+	dial       time.Duration
+	firstEvent time.Duration
+	eose       time.Duration
+	timedOut   bool // Answered, but the deadline hit before EOSE
+}
+
+// countedMutex is a mutex that counts how often it's taken, so benchmarks can tell how
+// much work a change moved out from under mu
+type countedMutex struct {
+	sync.Mutex
+	acquired atomic.Int64
+}
+
+// Lock takes the mutex and counts it
+func (m *countedMutex) Lock() {
+	m.Mutex.Lock()
+	m.acquired.Add(1)
+}
+
+// TryLock takes the mutex if it's free, counting it when it was
+func (m *countedMutex) TryLock() bool {
+	if !m.Mutex.TryLock() {
+		return false
+	}
+	m.acquired.Add(1)
+	return true
+}
+
+// crawlFlight is a connection held open to a relay by claimRelay
+type crawlFlight struct {
+	started time.Time
+	done    chan struct{} // Closed when the claim is released
+}
+
+// RunMetadata describes a single crawler run in exported documents
+type RunMetadata struct {
+	RunID          string    `json:"run_id"`
+	Seed           []string  `json:"seed"`
+	StartedAt      time.Time `json:"started_at"`
+	FinishedAt     time.Time `json:"finished_at"`
+	CrawlerVersion string    `json:"crawler_version"`
+	CrawlerCommit  string    `json:"crawler_commit,omitempty"`
+}
+
+// Event is a nostr event as defined by NIP-01
+type Event struct {
+	ID        string `json:"id,omitempty"` // Empty, like Pubkey and Sig, on an unsigned template
+	Pubkey    string `json:"pubkey,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+	Kind      int    `json:"kind"`
+	Tags      Tags   `json:"tags"`
+	Content   string `json:"content"`
+	Sig       string `json:"sig,omitempty"`
+}
+
+// Tags are the tags of an event. Relays do send tags holding numbers or objects, so
+// decoding skips a tag that isn't an array and ends one at its first element that
+// isn't a string, like the []interface{} walk this replaced, instead of failing the
+// whole event.
+type Tags [][]string
+
+func (t *Tags) UnmarshalJSON(data []byte) error {
+	// Nearly every event has only string tags, those decode in one go
+	var tags [][]string
+	if err := json.Unmarshal(data, &tags); err == nil {
+		*t = tags
+		return nil
+	}
+
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	tags = make([][]string, 0, len(raw))
+	for _, element := range raw {
+		if tag := decodeTag(element); len(tag) > 0 {
+			tags = append(tags, tag)
+		}
+	}
+	*t = tags
+	return nil
+}
+
+// decodeTag decodes the elements of a tag up to the first that isn't a string, nil
+// when the tag isn't an array
+func decodeTag(data json.RawMessage) []string {
+	var elements []json.RawMessage
+	if err := json.Unmarshal(data, &elements); err != nil {
+		return nil
+	}
+	tag := make([]string, 0, len(elements))
+	for _, element := range elements {
+		var value string
+		if err := json.Unmarshal(element, &value); err != nil {
+			break
+		}
+		tag = append(tag, value)
+	}
+	return tag
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestTagsUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want Tags
+	}{
+		{"string tags", `[["r","wss://a.example.com"],["r","wss://b.example.com","write"]]`,
+			Tags{{"r", "wss://a.example.com"}, {"r", "wss://b.example.com", "write"}}},
+		{"number element ends its tag", `[["r","wss://a.example.com"],["t",5,"nostr"],["r","wss://b.example.com"]]`,
+			Tags{{"r", "wss://a.example.com"}, {"t"}, {"r", "wss://b.example.com"}}},
+		{"object after the URL", `[["r","wss://a.example.com",{"read":true}]]`,
+			Tags{{"r", "wss://a.example.com"}}},
+		{"tags that aren't arrays", `["r",7,null,{"r":"wss://x.example.com"},["r","wss://a.example.com"]]`,
+			Tags{{"r", "wss://a.example.com"}}},
+		{"nothing left", `[[1,"wss://a.example.com"],[]]`, Tags{}},
+		{"empty", `[]`, Tags{}},
+		{"null", `null`, nil},
+	}
+	for _, test := range tests {
+		var tags Tags
+		if err := json.Unmarshal([]byte(test.json), &tags); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(tags, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, tags, test.want)
+		}
+	}
+
+	var tags Tags
+	if err := json.Unmarshal([]byte(`{"r":"wss://a.example.com"}`), &tags); err == nil {
+		t.Error("tags that aren't an array decoded without an error")
+	}
+}
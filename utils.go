@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
-	"os"
-	"regexp"
+	"strconv"
 	"strings"
+	"time"
+
+	"crawlr2/atomicfile"
 )
 
 // normalizeURL strips trailing slashes and converts the URL to lowercase for comparison
@@ -16,6 +20,21 @@ func normalizeURL(url string) string {
 	return strings.ToLower(url)
 }
 
+// hasTLD reports whether a host ends in a TLD of at least two alphabetic characters.
+// Every listed relay URL is checked, so this is a plain scan instead of a regexp.
+func hasTLD(host string) bool {
+	dot := strings.LastIndexByte(host, '.')
+	if dot < 0 || len(host)-dot-1 < 2 {
+		return false
+	}
+	for i := dot + 1; i < len(host); i++ {
+		if c := host[i] | 0x20; c < 'a' || c > 'z' { // ASCII letters only, either case
+			return false
+		}
+	}
+	return true
+}
+
 // isMalformedRelay checks if the URL is malformed
 func isMalformedRelay(urlStr string) bool {
 	// Check if the URL starts with a quote or doesn't start with "ws://" or "wss://"
@@ -33,12 +52,7 @@ func isMalformedRelay(urlStr string) bool {
 	host := parsedURL.Hostname()
 
 	// Ensure the host has a valid TLD (e.g., ".com", ".net")
-	// Use a regular expression to check that the TLD has at least two alphabetic characters
-	tldPattern := `\.[a-zA-Z]{2,}$`
-	match, _ := regexp.MatchString(tldPattern, host)
-
-	// Simplified return statement
-	return !match // If no valid TLD, return true (malformed), else return false
+	return !hasTLD(host) // If no valid TLD, return true (malformed), else return false
 }
 
 // isLocalRelay checks if the URL contains a private/local IP or ends with .local
@@ -127,38 +141,271 @@ func isReservedIP(ip net.IP) bool {
 	return false
 }
 
-// Export discovered relays to CSV
-func exportToCSV(category RelayCategory, relayList map[string]int) {
-	// Ensure logs directory exists
-	if err := os.MkdirAll("logs", os.ModePerm); err != nil {
-		//fmt.Printf("Failed to create logs directory: %v\n", err)
-		return
+// csvRow builds the CSV columns for a relay: url, count. Online relays add their
+// timings, finds, NIP-11 software and referrers: dial_ms, first_event_ms, eose_ms,
+// discovered_count, software, version, referrer_count. Offline relays add their failure
+// details and referrers: failure_reason, attempt_count, last_attempt, discovered_by,
+// referrer_count. Both then add first_seen and last_seen, online relays their
+// cluster_id, with -dns first_address and has_cname and with -sample not_probed, and
+// both their availability with -availability: runs_observed, runs_online,
+// offline_streak, uptime_percent
+func csvRow(state relayState, category RelayCategory, relay string, count int) []string {
+	row := []string{relay, strconv.Itoa(count)}
+	switch category {
+	case ClearOnline:
+		record := state.recordFor(relay, category, count)
+		row = append(row, csvMillis(record.DialMs), csvMillis(record.FirstEventMs), csvMillis(record.EOSEMs),
+			strconv.Itoa(record.Discovered), record.Software, record.Version, strconv.Itoa(record.ReferrerCount))
+		row = append(append(row, seenColumns(record)...), record.ClusterID)
+		row = append(append(row, dnsColumns(record)...), sampleColumns(record)...)
+		return append(row, availabilityColumns(record)...)
+	case ClearOffline:
+		record := state.recordFor(relay, category, count)
+		lastAttempt := ""
+		if record.LastAttempt != nil {
+			lastAttempt = record.LastAttempt.Format(time.RFC3339)
+		}
+		row = append(row, record.FailureReason, strconv.Itoa(record.AttemptCount), lastAttempt, record.DiscoveredBy,
+			strconv.Itoa(record.ReferrerCount))
+		return append(append(row, seenColumns(record)...), availabilityColumns(record)...)
+	}
+	return row
+}
+
+// seenColumns formats the first and last sighting of a relay for csvRow
+func seenColumns(record RelayRecord) []string {
+	columns := make([]string, 2)
+	for i, seen := range []*time.Time{record.FirstSeen, record.LastSeen} {
+		if seen != nil {
+			columns[i] = seen.Format(time.RFC3339)
+		}
+	}
+	return columns
+}
+
+// availabilityColumns formats the availability of a relay for csvRow, none without
+// -availability
+func availabilityColumns(record RelayRecord) []string {
+	if availability == nil {
+		return nil
+	}
+	uptime := ""
+	if record.Uptime != nil {
+		uptime = strconv.FormatFloat(*record.Uptime, 'f', 1, 64)
+	}
+	return []string{strconv.Itoa(record.RunsObserved), strconv.Itoa(record.RunsOnline),
+		strconv.Itoa(record.OfflineStreak), uptime}
+}
+
+// csvMillis formats a timing column, empty when the phase never happened
+func csvMillis(ms float64) string {
+	if ms == 0 {
+		return ""
 	}
+	return strconv.FormatFloat(ms, 'f', 3, 64)
+}
 
-	file, err := os.Create(fmt.Sprintf("logs/%s_relays.csv", category))
+// Export discovered relays to CSV, as far as the export filters let them through
+// The file is written through a large buffer and checked for errors every
+// exportChunkRows rows, so a full disk aborts the export early instead of being
+// noticed only at the end.
+func exportToCSV(state relayState, category RelayCategory) error {
+	path := outputPath(category, "csv")
+	file, err := atomicfile.Create(path)
 	if err != nil {
-		//fmt.Printf("Failed to create CSV file for %s: %v\n", category, err)
-		return
+		return fmt.Errorf("failed to create %s: %v", path, err)
 	}
-	defer file.Close()
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	writer := csv.NewWriter(bufio.NewWriterSize(file, exportBufferSize))
+	rows := 0
+	relayList := state.lists[category]
+	for _, relay := range state.exportedRelays(category) {
+		if err := writer.Write(selectColumns(category, csvRow(state, category, relay, relayList[relay]))); err != nil {
+			file.Abort()
+			return fmt.Errorf("failed to write %s: %v", path, err)
+		}
+		rows++
 
-	for relay, count := range relayList {
-		err := writer.Write([]string{relay, fmt.Sprintf("%d", count)})
-		if err != nil {
-			fmt.Printf("Failed to write relay %s to CSV: %v\n", relay, err)
+		if rows%exportChunkRows == 0 {
+			writer.Flush()
+			if err := writer.Error(); err != nil {
+				file.Abort()
+				return fmt.Errorf("failed to write %s after %d rows: %v", path, rows, err)
+			}
 		}
 	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Abort()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := file.Commit(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	recordOutput(path, rows)
+	return nil
 }
 
 // On program exit, write CSVs and print results for debugging
 func finalize() {
-	exportToCSV(ClearOnline, clearOnline)
-	exportToCSV(ClearOffline, clearOffline)
-	exportToCSV(ClearAPI, clearAPI)
-	exportToCSV(Onion, onion)
-	exportToCSV(Local, local)
-	exportToCSV(Malformed, malformed)
+	mu.Lock()
+	defer mu.Unlock()
+	finalizeLocked()
+}
+
+// finalizeLocked writes every output and closes the optional components, caller must hold mu
+func finalizeLocked() {
+	finalizing.Store(true)
+	exportMu.Lock()
+	defer exportMu.Unlock()
+
+	run := runMetadata()
+	if err := writeExports(liveState(), run); err != nil {
+		exportLog.Error("failed to prepare output directory", "error", err)
+		return
+	}
+
+	if err := writeSummary(run); err != nil {
+		exportLog.Error("failed to write summary", "error", err)
+	}
+
+	if store != nil {
+		saveAllToStore(run)
+	}
+	saveEnrichmentCache()
+	saveAvailability()
+	saveHistory(run)
+	if err := archive.Close(); err != nil {
+		exportLog.Error("failed to close event archive", "error", err)
+	}
+
+	// The manifest covers every file above, so it has to be written last
+	if err := writeManifest(run); err != nil {
+		exportLog.Error("failed to write manifest", "error", err)
+	}
+
+	closeTracers()
+	flushSpanExporter()
+	if logFile != nil {
+		logFile.Close()
+	}
+}
+
+// checkpoint writes the exports for the crawl so far without stopping it. Only the copy
+// of the relay state is taken under mu, the exports are built and written from it while
+// the crawl goes on. The summary and manifest are left to finalize since the archive is
+// still being written.
+func checkpoint() {
+	mu.Lock()
+	state := snapshotState()
+	run := runMetadata()
+	mu.Unlock()
+
+	exportMu.Lock()
+	defer exportMu.Unlock()
+	if err := writeExports(state, run); err != nil {
+		exportLog.Error("failed to prepare output directory", "error", err)
+		return
+	}
+	exportLog.Info("checkpoint written", "dir", runDir())
+}
+
+// writeExports writes every enabled export format from the relay state, which must be
+// a snapshot or the live state under mu. Only a missing output directory is returned,
+// failed exports are logged and skipped.
+func writeExports(state relayState, run RunMetadata) error {
+	// Recreate the output directory in case it was removed during the run
+	if err := prepareOutputDir(); err != nil {
+		return err
+	}
+	// Clusters first, the relay exports carry each relay's cluster id
+	clusters := state.buildClusters()
+
+	if outputEnabled("csv") {
+		for _, category := range allCategories {
+			if !exportCategory(category) {
+				continue
+			}
+			if err := exportToCSV(state, category); err != nil {
+				exportLog.Error("failed to export CSV", "category", category, "error", err)
+			}
+		}
+	}
+
+	if outputEnabled("json") {
+		if err := exportToJSON(state, runFilePath("relays.json"), run); err != nil {
+			exportLog.Error("failed to export relays.json", "error", err)
+		}
+	}
+	if outputEnabled("nostrwatch") {
+		if err := exportNostrWatch(state); err != nil {
+			exportLog.Error("failed to export nostr.watch lists", "error", err)
+		}
+	}
+	if outputEnabled("nip51") {
+		if err := exportRelaySet(state, run); err != nil {
+			exportLog.Error("failed to export NIP-51 relay set", "error", err)
+		}
+	}
+	if err := exportTimeline(state); err != nil {
+		exportLog.Error("failed to export timeline", "error", err)
+	}
+	if err := exportCountries(state); err != nil {
+		exportLog.Error("failed to export country report", "error", err)
+	}
+	if err := exportASNSummary(state.buildASNConcentration()); err != nil {
+		exportLog.Error("failed to export AS summary", "error", err)
+	}
+	if err := exportClusters(clusters); err != nil {
+		exportLog.Error("failed to export relay clusters", "error", err)
+	}
+	if err := exportCoverage(state); err != nil {
+		exportLog.Error("failed to export coverage report", "error", err)
+	}
+	return nil
+}
+
+// classifyFailure maps a crawl error onto a short failure class for reporting
+func classifyFailure(err error) string {
+	if errors.Is(err, errOfflineStreak) {
+		return "offline_streak"
+	}
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "no such host") || strings.Contains(msg, "lookup "):
+		return "dns"
+	case strings.Contains(msg, "timeout") || strings.Contains(msg, "deadline exceeded"):
+		return "timeout"
+	case strings.Contains(msg, "connection refused"):
+		return "refused"
+	case strings.Contains(msg, "x509") || strings.Contains(msg, "tls"):
+		return "tls"
+	case strings.Contains(msg, "bad status") || strings.Contains(msg, "handshake"):
+		return "handshake"
+	case strings.Contains(msg, "connection reset") || strings.Contains(msg, "broken pipe"):
+		return "reset"
+	case strings.Contains(msg, "eof"):
+		return "closed"
+	case strings.HasPrefix(msg, "panic:"):
+		return "panic"
+	}
+	return "other"
+}
+
+// saveAllToStore writes the final state of every relay to the store and closes it,
+// caller must hold mu
+func saveAllToStore(run RunMetadata) {
+	for _, category := range allCategories {
+		for relay, count := range categoryMap(category) {
+			store.SaveRelay(relayRecordFor(relay, category, count))
+		}
+	}
+	if err := store.FinishRun(run); err != nil {
+		storeLog.Error("failed to store results", "error", err)
+	}
+	if err := store.Close(); err != nil {
+		storeLog.Error("failed to close store", "error", err)
+	}
+	store = nil
 }
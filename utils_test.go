@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// loadRelayURLs reads testdata/relay_urls.txt, relay URLs in the shapes relay lists
+// carry them: well-formed, unnormalized, onion, local, with paths and plain junk
+func loadRelayURLs(tb testing.TB) []string {
+	tb.Helper()
+	data, err := os.ReadFile("testdata/relay_urls.txt")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// The TLD check isMalformedRelay used before hasTLD, which must agree with it
+var tldPattern = regexp.MustCompile(`\.[a-zA-Z]{2,}$`)
+
+func TestHasTLD(t *testing.T) {
+	hosts := []string{"", ".", "com", ".com", "relay.io", "relay.c", "relay.co.", "relay.c0m", "relay.123",
+		"relay.ab_", "relay.a@", "relay.a[", "relay.a`", "relay.a{", "relay.XN", "relay.xn--p1ai", "relay.ñé"}
+	for _, relay := range loadRelayURLs(t) {
+		hosts = append(hosts, extractHost(normalizeURL(relay)))
+	}
+	for _, host := range hosts {
+		if got, want := hasTLD(host), tldPattern.MatchString(host); got != want {
+			t.Errorf("hasTLD(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+// BenchmarkNormalizeURL normalizes one corpus URL per op
+func BenchmarkNormalizeURL(b *testing.B) {
+	relays := loadRelayURLs(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		normalizeURL(relays[i%len(relays)])
+	}
+}
+
+// BenchmarkIsMalformedRelay checks one normalized corpus URL per op
+func BenchmarkIsMalformedRelay(b *testing.B) {
+	relays := loadRelayURLs(b)
+	for i, relay := range relays {
+		relays[i] = normalizeURL(relay)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		isMalformedRelay(relays[i%len(relays)])
+	}
+}
+
+// BenchmarkHasTLD checks the host of one corpus URL per op
+func BenchmarkHasTLD(b *testing.B) {
+	relays := loadRelayURLs(b)
+	hosts := make([]string, len(relays))
+	for i, relay := range relays {
+		hosts[i] = extractHost(normalizeURL(relay))
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		hasTLD(hosts[i%len(hosts)])
+	}
+}
+
+// BenchmarkCategorize runs one corpus URL per op through the pipeline parseRelayList
+// runs every r tag through
+func BenchmarkCategorize(b *testing.B) {
+	relays := loadRelayURLs(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		categorize(normalizeURL(relays[i%len(relays)]))
+	}
+}
+
+// BenchmarkIsReservedIP checks one address per op, the corpus IPs and public ones
+func BenchmarkIsReservedIP(b *testing.B) {
+	var ips []net.IP
+	for _, relay := range loadRelayURLs(b) {
+		if ip := net.ParseIP(extractHost(normalizeURL(relay))); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	ips = append(ips, net.ParseIP("1.1.1.1"), net.ParseIP("8.8.8.8"), net.ParseIP("2606:4700::1111"))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		isReservedIP(ips[i%len(ips)])
+	}
+}
+
+// exportBenchRows is the size of the synthetic categories the export benchmarks write
+const exportBenchRows = 1_000_000
+
+// syntheticExportState returns a relay state with rows crawled clear online relays,
+// with records like a crawl leaves, and as many malformed URLs without
+func syntheticExportState(rows int) relayState {
+	state := relayState{lists: make(map[RelayCategory]map[string]int, len(allCategories)),
+		records: make(map[string]*RelayRecord, rows)}
+	for _, category := range allCategories {
+		state.lists[category] = make(map[string]int)
+	}
+	seen := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < rows; i++ {
+		relay := fmt.Sprintf("wss://relay%d.example.com", i)
+		state.lists[ClearOnline][relay] = i % 50
+		state.records[relay] = &RelayRecord{URL: relay, FirstSeen: &seen, LastSeen: &seen,
+			DiscoveredBy: "wss://seed.example.com", DialMs: 41.5, EOSEMs: 120.25, AttemptCount: 1}
+		state.lists[Malformed][fmt.Sprintf("wss://junk-relay-%d", i)] = 1
+	}
+	return state
+}
+
+// BenchmarkExportToCSV writes a million row CSV of crawled relays and one of malformed
+// URLs, reporting rows written per second
+func BenchmarkExportToCSV(b *testing.B) {
+	resetState(b)
+	state := syntheticExportState(exportBenchRows)
+	if err := prepareOutputDir(); err != nil {
+		b.Fatal(err)
+	}
+	exportMu.Lock()
+	defer exportMu.Unlock()
+
+	for _, category := range []RelayCategory{ClearOnline, Malformed} {
+		b.Run(string(category), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := exportToCSV(state, category); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(exportBenchRows*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+// A checkpoint builds its exports from a copy, so the crawl keeps changing the relay
+// state while it writes. Run with -race.
+func TestCheckpointWhileCrawling(t *testing.T) {
+	resetState(t)
+
+	mu.Lock()
+	for i := 0; i < 2000; i++ {
+		relay := fmt.Sprintf("wss://relay%d.example.com", i)
+		classifyRelay(listedRelay{url: relay, category: ClearOnline}, "wss://seed.example.com")
+		recordAttempt(relay, time.Now(), nil)
+	}
+	mu.Unlock()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20000; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			locked(func() {
+				classifyRelay(listedRelay{url: fmt.Sprintf("wss://new%d.example.com", i), category: ClearOnline},
+					"wss://seed.example.com")
+				relay := fmt.Sprintf("wss://relay%d.example.com", i%2000)
+				recordAttempt(relay, time.Now(), errors.New("timeout"))
+				recordFor(relay).addReferrer(fmt.Sprintf("wss://referrer%d.example.com", i))
+			})
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		checkpoint()
+	}
+	close(stop)
+	wg.Wait()
+
+	for _, path := range []string{outputPath(ClearOnline, "csv"), runFilePath("relays.json"),
+		runFilePath("timeline.csv")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Error(err)
+		}
+	}
+}
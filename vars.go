@@ -1,16 +1,68 @@
 package main
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // Relay lists with mutex protection
 var (
-	mu            sync.Mutex
-	clearOnline   = make(map[string]int)
-	clearOffline  = make(map[string]int)
-	clearAPI      = make(map[string]int)
-	onion         = make(map[string]int)
-	local         = make(map[string]int)
-	malformed     = make(map[string]int)
-	crawledRelays = make(map[string]bool)
-	logChannel    = make(chan string, 100)
-)
\ No newline at end of file
+	mu                countedMutex
+	clearOnline       = make(map[string]int)
+	clearOffline      = make(map[string]int)
+	clearAPI          = make(map[string]int)
+	onion             = make(map[string]int)
+	local             = make(map[string]int)
+	malformed         = make(map[string]int)
+	relayRecords      = make(map[string]*RelayRecord)
+	offlineReasons    = make(map[string]int)                    // Offline relays per failure class
+	domainStats       = make(map[string]*DomainStats)           // Crawl outcomes per registrable domain
+	recentDiscoveries []Discovery                               // Newest last, see rememberDiscovery
+	latencies         = make(map[RelayCategory]*phaseLatencies) // Timings of successful crawls
+	workers           workerStats                               // Worker slot usage
+	frontierPending   int                                       // Relays queued or being crawled
+	timeline          []timelineSample                          // Counters at the end of each minute
+	logChannel        = make(chan string, 100)
+)
+
+// Relays being crawled by their normalized URL, see claimRelay. Every connection
+// touches it twice, so it has its own lock instead of contending on mu.
+var (
+	inFlightMu sync.Mutex
+	inFlight   = make(map[string]*crawlFlight)
+)
+
+// Run metadata
+var (
+	// crawlerVersion can be set at build time with -ldflags "-X main.crawlerVersion=..."
+	crawlerVersion = "dev"
+	runStart       time.Time
+	runEnd         time.Time // Fixed end time for replays, zero during live runs
+	runID          string
+	seedRelays     []string
+	outputRows     = make(map[string]int) // Output files written this run and their row counts, guarded by exportMu
+	exportMu       sync.Mutex             // Held while exports are written, so checkpoints and finalize take turns
+	store          RelayStore             // Optional external store, nil when unused
+	archive        *eventArchive          // Optional event archive, nil when unused
+	logFile        *rotatingLog           // Optional log file, nil when unused
+	screen         *tui                   // Full-screen view, nil without a terminal
+)
+
+// Traffic counters, updated without holding mu
+var (
+	eventsProcessed   atomic.Int64 // EVENT messages received from any relay
+	bytesTransferred  atomic.Int64
+	passNumber        atomic.Int64 // Seed queries made, starting at 1
+	discoveryPaused   atomic.Bool  // Set from the TUI or the control API, holds back new crawls
+	droppedLogLines   atomic.Int64 // Log lines dropped because a log queue was full
+	deadRelayHits     atomic.Int64 // Mentions of offline relays that weren't redialed
+	busyWorkers       atomic.Int64 // Workers currently crawling a relay
+	workerSlots       atomic.Int64 // Size of the crawl pool, 0 until it starts
+	targetConcurrency atomic.Int64 // Workers allowed to crawl at once, see adjustConcurrency
+	idleSince         atomic.Int64 // Unix nanoseconds since the frontier ran dry, 0 when busy
+	nextPassAt        atomic.Int64 // Unix nanoseconds of the next seed query
+)
+
+// All relay categories in export order
+var allCategories = []RelayCategory{ClearOnline, ClearOffline, ClearAPI, Onion, Local, Malformed}
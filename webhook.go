@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Webhook event types, selected with -webhook-events
+const (
+	WebhookDiscovered = "relay_discovered" // A relay seen for the first time this run
+	WebhookOffline    = "relay_offline"    // A relay crawled successfully before failed
+	WebhookPass       = "pass_completed"   // A crawl pass that crawled at least one relay
+)
+
+// Supported values for -webhook-events
+var knownWebhookEvents = map[string]bool{
+	WebhookDiscovered: true,
+	WebhookOffline:    true,
+	WebhookPass:       true,
+}
+
+// Webhook delivery tuning
+const (
+	webhookQueueSize       = 1024
+	webhookAttempts        = 3
+	webhookBackoff         = time.Second // Doubled after every failed attempt
+	webhookSignatureHeader = "X-Crawlr-Signature"
+)
+
+// WebhookEvent is the JSON payload POSTed to every webhook
+type WebhookEvent struct {
+	Type      string        `json:"type"`
+	Relay     string        `json:"relay,omitempty"`
+	Category  RelayCategory `json:"category,omitempty"`
+	Pass      int64         `json:"pass,omitempty"`
+	Timestamp time.Time     `json:"timestamp"`
+	RunID     string        `json:"run_id"`
+}
+
+// WebhookSummary counts webhook deliveries for the run summary
+type WebhookSummary struct {
+	Delivered int64 `json:"delivered"`
+	Failed    int64 `json:"failed"`  // Still failing after webhookAttempts
+	Dropped   int64 `json:"dropped"` // Queue full, never sent
+	Pending   int   `json:"pending"` // Queued when the run ended
+}
+
+var (
+	webhookQueue     = make(chan WebhookEvent, webhookQueueSize)
+	webhookDelivered atomic.Int64
+	webhookFailed    atomic.Int64
+	webhookDropped   atomic.Int64
+)
+
+// webhookEnabled reports whether an event type is sent to the webhooks
+func webhookEnabled(eventType string) bool {
+	if len(cfg.Webhooks) == 0 {
+		return false
+	}
+	for _, enabled := range cfg.WebhookEvents {
+		if enabled == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyWebhooks queues an event for the sender without ever blocking the caller, an
+// event that finds the queue full is dropped and counted
+func notifyWebhooks(event WebhookEvent) {
+	if !webhookEnabled(event.Type) {
+		return
+	}
+	event.Timestamp = time.Now().UTC()
+	event.RunID = runID
+	select {
+	case webhookQueue <- event:
+	default:
+		webhookDropped.Add(1)
+	}
+}
+
+// runWebhookSender delivers queued events to every webhook for the rest of the run
+func runWebhookSender() {
+	client := &http.Client{Timeout: cfg.WebhookTimeout}
+	for event := range webhookQueue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			mainLog.Error("failed to encode webhook event", "type", event.Type, "error", err)
+			continue
+		}
+		for _, url := range cfg.Webhooks {
+			if err := deliverWebhook(client, url, body); err != nil {
+				webhookFailed.Add(1)
+				mainLog.Warn("webhook delivery failed", "type", event.Type, "relay", event.Relay,
+					"attempts", webhookAttempts, "error", err)
+				continue
+			}
+			webhookDelivered.Add(1)
+		}
+	}
+}
+
+// deliverWebhook POSTs a payload, retrying network errors, 429 and 5xx responses.
+// The webhook URL is left out of errors as it often embeds a token.
+func deliverWebhook(client *http.Client, url string, body []byte) error {
+	var err error
+	backoff := webhookBackoff
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var retry bool
+		if retry, err = postWebhook(client, url, body); err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// postWebhook makes a single delivery attempt, reporting whether a failure is worth retrying
+func postWebhook(client *http.Client, url string, body []byte) (retry bool, err error) {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("invalid webhook URL")
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "crawlr/"+crawlerVersion)
+	if cfg.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(cfg.WebhookSecret))
+		mac.Write(body)
+		request.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return true, fmt.Errorf("request failed: %v", errors.Unwrap(err))
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return false, nil
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return true, fmt.Errorf("status %d", response.StatusCode)
+	}
+	return false, fmt.Errorf("status %d", response.StatusCode)
+}
+
+// summarizeWebhooks reports webhook deliveries, nil without webhooks
+func summarizeWebhooks() *WebhookSummary {
+	if len(cfg.Webhooks) == 0 {
+		return nil
+	}
+	return &WebhookSummary{
+		Delivered: webhookDelivered.Load(),
+		Failed:    webhookFailed.Load(),
+		Dropped:   webhookDropped.Load(),
+		Pending:   len(webhookQueue),
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Broadcast whenever busyWorkers drops or targetConcurrency changes, so handOff waits
+// for a slot instead of polling. Both only change while holding slotMu.
+var (
+	slotMu    sync.Mutex
+	slotFreed = sync.NewCond(&slotMu)
+)
+
+// workerStats tracks how the crawl worker slots are used, for tuning the concurrency.
+// Guarded by mu.
+type workerStats struct {
+	utilization [101]int64 // Once-a-second samples of the percentage of busy slots
+	samples     int64
+	busySum     float64
+	slotWait    latencyHistogram // Milliseconds relays waited for a free slot
+	saturated   int64            // Relays that had to wait for a busy worker to finish
+}
+
+// WorkerSummary reports worker slot usage over the run
+type WorkerSummary struct {
+	Slots              int              `json:"slots"`
+	AverageUtilization float64          `json:"average_utilization_percent"`
+	UtilizationP50     int              `json:"utilization_p50_percent"`
+	UtilizationP90     int              `json:"utilization_p90_percent"`
+	SlotWait           LatencyQuantiles `json:"slot_wait"`
+	Saturated          int64            `json:"saturated_acquires"`
+}
+
+// handOff blocks until a worker below the target concurrency takes the relay and
+// records how long it waited for one. The worker is counted busy from the hand-off on,
+// so the next call already sees it. Only a relay that found every allowed worker busy
+// counts as saturated, one that waits for a free worker to finish its last job doesn't.
+func handOff(frontier chan<- string, relay string) {
+	started := time.Now()
+	saturated := false
+	slotMu.Lock()
+	for busyWorkers.Load() >= targetConcurrency.Load() {
+		saturated = true
+		slotFreed.Wait()
+	}
+	busyWorkers.Add(1)
+	slotMu.Unlock()
+
+	frontier <- relay
+	waited := durationMillis(time.Since(started))
+	locked(func() {
+		if saturated {
+			workers.saturated++
+		}
+		workers.slotWait.observe(waited)
+	})
+}
+
+// releaseSlot counts a worker counted busy by handOff as free again
+func releaseSlot() {
+	slotMu.Lock()
+	busyWorkers.Add(-1)
+	slotMu.Unlock()
+	slotFreed.Broadcast()
+}
+
+// setTargetConcurrency changes the workers allowed to crawl at once
+func setTargetConcurrency(concurrency int64) {
+	slotMu.Lock()
+	targetConcurrency.Store(concurrency)
+	slotMu.Unlock()
+	slotFreed.Broadcast()
+}
+
+// observeUtilization samples the share of the target concurrency in use, called once a second by
+// whichever progress display is running
+func observeUtilization() {
+	locked(func() {
+		slots := targetConcurrency.Load()
+		if slots == 0 {
+			return
+		}
+		percent := min(100, int(math.Round(float64(busyWorkers.Load())*100/float64(slots))))
+		workers.utilization[percent]++
+		workers.samples++
+		workers.busySum += float64(percent)
+	})
+}
+
+// utilizationQuantile returns the q-th utilization sample in percent, caller must hold mu
+func (w *workerStats) utilizationQuantile(q float64) int {
+	rank := int64(math.Ceil(q * float64(w.samples)))
+	var seen int64
+	for percent, count := range w.utilization {
+		seen += count
+		if seen >= rank && seen > 0 {
+			return percent
+		}
+	}
+	return 0
+}
+
+// summarize reports the worker usage, caller must hold mu
+func (w *workerStats) summarize() WorkerSummary {
+	summary := WorkerSummary{
+		Slots:          int(workerSlots.Load()),
+		UtilizationP50: w.utilizationQuantile(0.50),
+		UtilizationP90: w.utilizationQuantile(0.90),
+		SlotWait:       w.slotWait.summarize(),
+		Saturated:      w.saturated,
+	}
+	if w.samples > 0 {
+		summary.AverageUtilization = math.Round(w.busySum/float64(w.samples)*10) / 10
+	}
+	return summary
+}